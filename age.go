@@ -0,0 +1,761 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// age.go implements encrypted exports in the age file format, version 1
+// (https://age-encryption.org/v1), so that a subset of a store can be handed
+// to tools that cannot link Go code, such as the age command line tool.
+// ExportAge writes the entries of an export, see export.go, as the payload of
+// an age file, and ImportAge reads them back. An age file is
+//   age-encryption.org/v1
+//   -> [recipient type] [arguments]...
+//   [wrapped file key, base64, in lines of 64 columns]
+//   --- [header MAC, base64]
+//   [16-byte nonce][payload]
+// A random file key is wrapped for every recipient, either to an X25519 public
+// key or with a key derived from a passphrase with scrypt. The payload is
+// sealed in 64 KiB chunks with the STREAM construction, as streams are in
+// stream.go, with an 11-byte chunk counter and a final flag as nonce.
+//
+// The format fixes its primitives, so only the AEAD is shared with crypto.go:
+// age seals with ChaCha20-Poly1305, the 12-byte nonce sibling of the
+// XChaCha20-Poly1305 the rest of the store uses, and derives keys with
+// HKDF-SHA256 where the store uses BLAKE2b.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	ageIntro        = "age-encryption.org/v1\n"
+	ageStanzaPrefix = "-> "
+	ageMACPrefix    = "---"
+
+	// ageColumns is the length of the lines of the body of a stanza. The
+	// last line is always shorter, and so empty if the body fills the others.
+	ageColumns = 64
+
+	ageFileKeySize = 16
+	ageNonceSize   = 16
+	ageChunkSize   = 64 * 1024
+
+	ageX25519Type  = "X25519"
+	ageX25519Label = "age-encryption.org/v1/X25519"
+	ageScryptType  = "scrypt"
+	ageScryptLabel = "age-encryption.org/v1/scrypt"
+
+	ageScryptSaltSize = 16
+
+	// AgeDefaultWorkFactor is the scrypt work factor, the base 2 logarithm of
+	// its cost, that age uses by default, and AgeMaxWorkFactor the largest
+	// accepted when decrypting.
+	AgeDefaultWorkFactor = 18
+	AgeMaxWorkFactor     = 22
+
+	ageRecipientHRP = "age"
+	ageIdentityHRP  = "AGE-SECRET-KEY-"
+
+	errAge             = "invalid age archive: %s"
+	errAgeNoIdentity   = "no identity matches the recipients of the archive"
+	errAgeRecipient    = "invalid age recipient: %s"
+	errAgeIdentity     = "invalid age identity: %s"
+	errAgeWorkFactor   = "invalid scrypt work factor %d"
+	errAgeScryptAlone  = "a passphrase must be the only recipient"
+	errAgeNoRecipients = "no recipients"
+)
+
+// AgeRecipient is a recipient to encrypt an age archive to. It is implemented
+// by AgeX25519Recipient and AgeScryptRecipient.
+type AgeRecipient interface {
+	// wrap returns the stanza of the header holding the file key encrypted
+	// to the recipient.
+	wrap(fileKey []byte, csprng io.Reader) (*ageStanza, error)
+}
+
+// AgeIdentity decrypts age archives encrypted to its recipient. It is
+// implemented by AgeX25519Identity and AgeScryptIdentity.
+type AgeIdentity interface {
+	// unwrap returns the file key in the stanza, or nil if the stanza is not
+	// for the identity.
+	unwrap(s *ageStanza) ([]byte, error)
+}
+
+// ExportAge writes the given keys, and their values, to w as an age archive
+// encrypted to the recipients. Decrypted with ImportAge, or with any
+// implementation of age, the archive holds the entries Export writes in the
+// given format. A nil keys exports every key, as Export does. Otherwise,
+// returns an error for which Exists is false if one of keys has no value.
+//
+// A passphrase, given as an AgeScryptRecipient, must be the only recipient.
+func (f *Filestore) ExportAge(w io.Writer, keys []string, format ExportFormat,
+	recipients ...AgeRecipient) error {
+	if len(recipients) == 0 {
+		return errors.Errorf(errAgeRecipient, errAgeNoRecipients)
+	}
+	for _, r := range recipients {
+		if _, ok := r.(*AgeScryptRecipient); ok && len(recipients) > 1 {
+			return errors.Errorf(errAgeRecipient, errAgeScryptAlone)
+		}
+	}
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	fileKey := make([]byte, ageFileKeySize)
+	if _, err = io.ReadFull(f.csprng, fileKey); err != nil {
+		return errors.Wrap(err, "Could not generate file key")
+	}
+	stanzas := make([]*ageStanza, len(recipients))
+	for i, r := range recipients {
+		if stanzas[i], err = r.wrap(fileKey, f.csprng); err != nil {
+			return err
+		}
+	}
+	aw, err := newAgeWriter(w, fileKey, stanzas, f.csprng)
+	if err != nil {
+		return err
+	}
+	encode, err := newExportEncoder(aw, format)
+	if err != nil {
+		return err
+	}
+	jww.TRACE.Printf("%s,EXPORT_AGE,%d", kvDebugHeader, len(keys))
+	if err = f.exportEntries(encode, keys); err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+// ImportAge reads an age archive written by ExportAge, decrypting it with the
+// first of the identities that matches one of its recipients, and writes its
+// entries, in the given format, into the store as Import does: either every
+// entry or none. A truncated or tampered archive is refused with ErrCorrupt or
+// ErrTampered, and a wrong passphrase with ErrWrongPassword.
+func (f *Filestore) ImportAge(r io.Reader, format ExportFormat,
+	identities ...AgeIdentity) error {
+	ar, err := newAgeReader(r, identities)
+	if err != nil {
+		return err
+	}
+	entries, err := readExportEntries(ar, format)
+	if err != nil {
+		return err
+	}
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	jww.TRACE.Printf("%s,IMPORT_AGE,%d", kvDebugHeader, len(entries))
+	return f.importEntries(entries)
+}
+
+// AgeX25519Recipient is an X25519 public key to encrypt age archives to,
+// encoded as a string starting with "age1".
+type AgeX25519Recipient struct {
+	publicKey []byte
+}
+
+// ParseAgeX25519Recipient parses a recipient encoded as by
+// AgeX25519Recipient.String, such as those printed by age-keygen.
+func ParseAgeX25519Recipient(s string) (*AgeX25519Recipient, error) {
+	hrp, key, err := bech32Decode(s)
+	if err != nil {
+		return nil, errors.Errorf(errAgeRecipient, err.Error())
+	}
+	if hrp != ageRecipientHRP || len(key) != curve25519.PointSize {
+		return nil, errors.Errorf(errAgeRecipient, "not an X25519 recipient")
+	}
+	return &AgeX25519Recipient{publicKey: key}, nil
+}
+
+// String returns the encoding of the recipient.
+func (r *AgeX25519Recipient) String() string {
+	s, err := bech32Encode(ageRecipientHRP, r.publicKey)
+	if err != nil {
+		jww.FATAL.Panicf("Failed to encode recipient: %+v", err)
+	}
+	return s
+}
+
+// wrap implements AgeRecipient. The file key is encrypted with a key derived
+// from an ephemeral key agreement with the recipient.
+func (r *AgeX25519Recipient) wrap(fileKey []byte, csprng io.Reader) (
+	*ageStanza, error) {
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(csprng, ephemeral); err != nil {
+		return nil, errors.Wrap(err, "Could not generate ephemeral key")
+	}
+	defer wipe(ephemeral)
+	share, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	shared, err := curve25519.X25519(ephemeral, r.publicKey)
+	if err != nil {
+		return nil, errors.Errorf(errAgeRecipient, err.Error())
+	}
+	defer wipe(shared)
+
+	key := ageHKDF(shared, append(share[:len(share):len(share)],
+		r.publicKey...), ageX25519Label)
+	defer wipe(key)
+	body, err := ageWrapKey(key, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return &ageStanza{kind: ageX25519Type,
+		args: []string{base64.RawStdEncoding.EncodeToString(share)},
+		body: body}, nil
+}
+
+// AgeX25519Identity is an X25519 private key to decrypt age archives with,
+// encoded as a string starting with "AGE-SECRET-KEY-1".
+type AgeX25519Identity struct {
+	secretKey, publicKey []byte
+}
+
+// GenerateAgeX25519Identity returns a new identity with a private key read
+// from csprng.
+func GenerateAgeX25519Identity(csprng io.Reader) (*AgeX25519Identity,
+	error) {
+	secretKey := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(csprng, secretKey); err != nil {
+		return nil, errors.Wrap(err, "Could not generate private key")
+	}
+	return newAgeX25519Identity(secretKey)
+}
+
+// ParseAgeX25519Identity parses an identity encoded as by
+// AgeX25519Identity.String, such as those written by age-keygen.
+func ParseAgeX25519Identity(s string) (*AgeX25519Identity, error) {
+	hrp, key, err := bech32Decode(s)
+	if err != nil {
+		return nil, errors.Errorf(errAgeIdentity, err.Error())
+	}
+	if hrp != strings.ToLower(ageIdentityHRP) ||
+		len(key) != curve25519.ScalarSize {
+		return nil, errors.Errorf(errAgeIdentity, "not an X25519 identity")
+	}
+	return newAgeX25519Identity(key)
+}
+
+// newAgeX25519Identity returns the identity with the private key.
+func newAgeX25519Identity(secretKey []byte) (*AgeX25519Identity, error) {
+	publicKey, err := curve25519.X25519(secretKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, errors.Errorf(errAgeIdentity, err.Error())
+	}
+	return &AgeX25519Identity{secretKey: secretKey, publicKey: publicKey},
+		nil
+}
+
+// Recipient returns the recipient of archives the identity decrypts.
+func (i *AgeX25519Identity) Recipient() *AgeX25519Recipient {
+	return &AgeX25519Recipient{publicKey: i.publicKey}
+}
+
+// String returns the encoding of the identity. It holds the private key.
+func (i *AgeX25519Identity) String() string {
+	s, err := bech32Encode(strings.ToLower(ageIdentityHRP), i.secretKey)
+	if err != nil {
+		jww.FATAL.Panicf("Failed to encode identity: %+v", err)
+	}
+	return strings.ToUpper(s)
+}
+
+// unwrap implements AgeIdentity.
+func (i *AgeX25519Identity) unwrap(s *ageStanza) ([]byte, error) {
+	if s.kind != ageX25519Type {
+		return nil, nil
+	}
+	if len(s.args) != 1 {
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(errAge,
+			"invalid X25519 stanza")})
+	}
+	share, err := base64.RawStdEncoding.Strict().DecodeString(s.args[0])
+	if err != nil || len(share) != curve25519.PointSize {
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(errAge,
+			"invalid X25519 share")})
+	}
+	shared, err := curve25519.X25519(i.secretKey, share)
+	if err != nil {
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(errAge,
+			"invalid X25519 share")})
+	}
+	defer wipe(shared)
+
+	key := ageHKDF(shared, append(share, i.publicKey...), ageX25519Label)
+	defer wipe(key)
+	fileKey, err := ageUnwrapKey(key, s.body)
+	if err != nil {
+		// Wrapped for another recipient
+		return nil, nil
+	}
+	return fileKey, nil
+}
+
+// AgeScryptRecipient is a passphrase to encrypt an age archive with.
+type AgeScryptRecipient struct {
+	passphrase []byte
+	workFactor int
+}
+
+// NewAgeScryptRecipient returns the recipient for the passphrase. workFactor
+// is the base 2 logarithm of the cost of scrypt, up to AgeMaxWorkFactor, or 0
+// for AgeDefaultWorkFactor.
+func NewAgeScryptRecipient(passphrase string, workFactor int) (
+	*AgeScryptRecipient, error) {
+	if workFactor == 0 {
+		workFactor = AgeDefaultWorkFactor
+	}
+	if workFactor < 1 || workFactor > AgeMaxWorkFactor {
+		return nil, errors.Errorf(errAgeWorkFactor, workFactor)
+	}
+	return &AgeScryptRecipient{passphrase: []byte(passphrase),
+		workFactor: workFactor}, nil
+}
+
+// wrap implements AgeRecipient. The file key is encrypted with a key derived
+// from the passphrase and a random salt with scrypt.
+func (r *AgeScryptRecipient) wrap(fileKey []byte, csprng io.Reader) (
+	*ageStanza, error) {
+	salt := make([]byte, ageScryptSaltSize)
+	if _, err := io.ReadFull(csprng, salt); err != nil {
+		return nil, errors.Wrap(err, "Could not generate salt")
+	}
+	key, err := ageScryptKey(r.passphrase, salt, r.workFactor)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key)
+	body, err := ageWrapKey(key, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return &ageStanza{kind: ageScryptType, args: []string{
+		base64.RawStdEncoding.EncodeToString(salt),
+		strconv.Itoa(r.workFactor)}, body: body}, nil
+}
+
+// AgeScryptIdentity is a passphrase to decrypt an age archive with.
+type AgeScryptIdentity struct {
+	passphrase []byte
+}
+
+// NewAgeScryptIdentity returns the identity for the passphrase. It accepts
+// work factors up to AgeMaxWorkFactor.
+func NewAgeScryptIdentity(passphrase string) *AgeScryptIdentity {
+	return &AgeScryptIdentity{passphrase: []byte(passphrase)}
+}
+
+// unwrap implements AgeIdentity. Returns ErrWrongPassword if the file key
+// cannot be decrypted with the passphrase.
+func (i *AgeScryptIdentity) unwrap(s *ageStanza) ([]byte, error) {
+	if s.kind != ageScryptType {
+		return nil, nil
+	}
+	if len(s.args) != 2 {
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(errAge,
+			"invalid scrypt stanza")})
+	}
+	salt, err := base64.RawStdEncoding.Strict().DecodeString(s.args[0])
+	if err != nil || len(salt) != ageScryptSaltSize {
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(errAge,
+			"invalid scrypt salt")})
+	}
+	workFactor, err := strconv.Atoi(s.args[1])
+	if err != nil || strconv.Itoa(workFactor) != s.args[1] {
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(errAge,
+			"invalid scrypt work factor")})
+	}
+	if workFactor < 1 || workFactor > AgeMaxWorkFactor {
+		return nil, errors.Errorf(errAgeWorkFactor, workFactor)
+	}
+
+	key, err := ageScryptKey(i.passphrase, salt, workFactor)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key)
+	fileKey, err := ageUnwrapKey(key, s.body)
+	if err != nil {
+		return nil, errors.WithStack(ErrWrongPassword)
+	}
+	return fileKey, nil
+}
+
+// ageScryptKey derives the key wrapping the file key from the passphrase.
+func ageScryptKey(passphrase, salt []byte, workFactor int) ([]byte, error) {
+	labeled := append([]byte(ageScryptLabel), salt...)
+	key, err := scrypt.Key(passphrase, labeled, 1<<workFactor, 8, 1,
+		chacha20poly1305.KeySize)
+	return key, errors.WithStack(err)
+}
+
+// ageHKDF returns the 32-byte key derived with HKDF-SHA256.
+func ageHKDF(secret, salt []byte, info string) []byte {
+	key := make([]byte, chacha20poly1305.KeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)),
+		key)
+	if err != nil {
+		jww.FATAL.Panicf("Failed to derive key: %+v", err)
+	}
+	return key
+}
+
+// ageWrapKey encrypts the file key with key. Every key is used once, so the
+// nonce is zero.
+func ageWrapKey(key, fileKey []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return aead.Seal(nil, make([]byte, aead.NonceSize()), fileKey, nil), nil
+}
+
+// ageUnwrapKey decrypts the file key encrypted with ageWrapKey.
+func ageUnwrapKey(key, wrapped []byte) ([]byte, error) {
+	if len(wrapped) != ageFileKeySize+chacha20poly1305.Overhead {
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(errAge,
+			"invalid wrapped file key")})
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	fileKey, err := aead.Open(nil, make([]byte, aead.NonceSize()), wrapped,
+		nil)
+	return fileKey, errors.WithStack(err)
+}
+
+// ageStanza is a recipient stanza of the header of an age file.
+type ageStanza struct {
+	kind string
+	args []string
+	body []byte
+}
+
+// marshal encodes the stanza as in the header.
+func (s *ageStanza) marshal() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(ageStanzaPrefix + s.kind)
+	for _, arg := range s.args {
+		buf.WriteString(" " + arg)
+	}
+	buf.WriteByte('\n')
+	body := base64.RawStdEncoding.EncodeToString(s.body)
+	for {
+		line := body[:min(len(body), ageColumns)]
+		body = body[len(line):]
+		buf.WriteString(line + "\n")
+		if len(line) < ageColumns {
+			return buf.Bytes()
+		}
+	}
+}
+
+// ageHeaderMAC returns the MAC of the header, up to and including the MAC
+// prefix, keyed by the file key.
+func ageHeaderMAC(fileKey, header []byte) []byte {
+	key := ageHKDF(fileKey, nil, "header")
+	defer wipe(key)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(header)
+	return mac.Sum(nil)
+}
+
+// agePayloadAEAD returns the AEAD sealing the payload with the nonce.
+func agePayloadAEAD(fileKey, nonce []byte) (cipher.AEAD, error) {
+	key := ageHKDF(fileKey, nonce, "payload")
+	defer wipe(key)
+	aead, err := chacha20poly1305.New(key)
+	return aead, errors.WithStack(err)
+}
+
+// ageChunkNonce returns the nonce of chunk n of the payload, marked if it is
+// the final chunk.
+func ageChunkNonce(n uint64, final bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[3:11], n)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// ageWriter encrypts what is written to it into the payload of an age file.
+// Close must be called to write the final chunk.
+type ageWriter struct {
+	w    io.Writer
+	aead cipher.AEAD
+	buf  []byte
+	n    uint64
+}
+
+// newAgeWriter writes the header of an age file with the stanzas and the
+// payload nonce to w, and returns the writer of its payload.
+func newAgeWriter(w io.Writer, fileKey []byte, stanzas []*ageStanza,
+	csprng io.Reader) (*ageWriter, error) {
+	header := []byte(ageIntro)
+	for _, s := range stanzas {
+		header = append(header, s.marshal()...)
+	}
+	header = append(header, ageMACPrefix...)
+	mac := ageHeaderMAC(fileKey, header)
+	header = append(header, " "+base64.RawStdEncoding.EncodeToString(mac)+
+		"\n"...)
+
+	nonce := make([]byte, ageNonceSize)
+	if _, err := io.ReadFull(csprng, nonce); err != nil {
+		return nil, errors.Wrap(err, "Could not generate nonce")
+	}
+	if _, err := w.Write(append(header, nonce...)); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	aead, err := agePayloadAEAD(fileKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &ageWriter{w: w, aead: aead,
+		buf: make([]byte, 0, ageChunkSize)}, nil
+}
+
+// Write buffers p, sealing every chunk that fills up once more follows it.
+func (aw *ageWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(aw.buf) == ageChunkSize {
+			if err := aw.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(aw.buf[len(aw.buf):ageChunkSize], p)
+		aw.buf = aw.buf[:len(aw.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals what is buffered as the final chunk.
+func (aw *ageWriter) Close() error {
+	return aw.seal(true)
+}
+
+// seal encrypts the buffer as the next chunk and writes it.
+func (aw *ageWriter) seal(final bool) error {
+	sealed := aw.aead.Seal(nil, ageChunkNonce(aw.n, final), aw.buf, nil)
+	if _, err := aw.w.Write(sealed); err != nil {
+		return errors.WithStack(err)
+	}
+	aw.n++
+	aw.buf = aw.buf[:0]
+	return nil
+}
+
+// ageReader decrypts the payload of an age file. It returns io.EOF only
+// after the final chunk, and an error if the payload is cut short.
+type ageReader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	buf   []byte
+	n     uint64
+	final bool
+}
+
+// newAgeReader reads the header of an age file from r, unwraps the file key
+// with the first identity matching a stanza and checks the header MAC.
+func newAgeReader(r io.Reader, identities []AgeIdentity) (*ageReader, error) {
+	br := bufio.NewReader(r)
+	stanzas, header, mac, err := readAgeHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range stanzas {
+		if s.kind == ageScryptType && len(stanzas) > 1 {
+			return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+				errAge, errAgeScryptAlone)})
+		}
+	}
+
+	var fileKey []byte
+	for _, id := range identities {
+		for _, s := range stanzas {
+			if fileKey, err = id.unwrap(s); err != nil {
+				return nil, err
+			} else if fileKey != nil {
+				break
+			}
+		}
+		if fileKey != nil {
+			break
+		}
+	}
+	if fileKey == nil {
+		return nil, errors.New(errAgeNoIdentity)
+	}
+	defer wipe(fileKey)
+	if !hmac.Equal(mac, ageHeaderMAC(fileKey, header)) {
+		return nil, errors.Wrap(ErrTampered, "age header")
+	}
+
+	nonce := make([]byte, ageNonceSize)
+	if _, err = io.ReadFull(br, nonce); err != nil {
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(errAge,
+			"missing payload")})
+	}
+	aead, err := agePayloadAEAD(fileKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &ageReader{r: br, aead: aead}, nil
+}
+
+// readAgeHeader reads the header of an age file. Returns its stanzas, the
+// header up to and including the MAC prefix, and the MAC.
+func readAgeHeader(br *bufio.Reader) (stanzas []*ageStanza, header,
+	mac []byte, err error) {
+	corrupt := func(reason string) error {
+		return errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(errAge,
+			reason)})
+	}
+	readLine := func() (string, error) {
+		line, err := br.ReadSlice('\n')
+		if err != nil {
+			return "", corrupt("header is truncated or malformed")
+		}
+		header = append(header, line...)
+		return string(line[:len(line)-1]), nil
+	}
+
+	if line, err := readLine(); err != nil {
+		return nil, nil, nil, err
+	} else if line+"\n" != ageIntro {
+		return nil, nil, nil, corrupt("not an age file")
+	}
+	for {
+		line, err := readLine()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if encodedMAC, ok := strings.CutPrefix(line, ageMACPrefix+" "); ok {
+			header = header[:len(header)-len(line)-1+len(ageMACPrefix)]
+			mac, err = base64.RawStdEncoding.Strict().DecodeString(
+				encodedMAC)
+			if err != nil || len(mac) != sha256.Size {
+				return nil, nil, nil, corrupt("invalid header MAC")
+			}
+			if len(stanzas) == 0 {
+				return nil, nil, nil, corrupt(errAgeNoRecipients)
+			}
+			return stanzas, header, mac, nil
+		}
+
+		args, ok := strings.CutPrefix(line, ageStanzaPrefix)
+		if !ok {
+			return nil, nil, nil, corrupt("invalid stanza")
+		}
+		s := &ageStanza{}
+		for i, arg := range strings.Split(args, " ") {
+			if arg == "" {
+				return nil, nil, nil, corrupt("invalid stanza argument")
+			}
+			if i == 0 {
+				s.kind = arg
+			} else {
+				s.args = append(s.args, arg)
+			}
+		}
+		var body string
+		for {
+			line, err = readLine()
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if len(line) > ageColumns {
+				return nil, nil, nil, corrupt("invalid stanza body")
+			}
+			body += line
+			if len(line) < ageColumns {
+				break
+			}
+		}
+		s.body, err = base64.RawStdEncoding.Strict().DecodeString(body)
+		if err != nil {
+			return nil, nil, nil, corrupt("invalid stanza body")
+		}
+		stanzas = append(stanzas, s)
+	}
+}
+
+// Read returns the decrypted payload.
+func (ar *ageReader) Read(p []byte) (int, error) {
+	for len(ar.buf) == 0 {
+		if ar.final {
+			return 0, io.EOF
+		}
+		if err := ar.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, ar.buf)
+	ar.buf = ar.buf[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk. It is the final chunk if nothing
+// follows it.
+func (ar *ageReader) open() error {
+	sealed := make([]byte, ageChunkSize+chacha20poly1305.Overhead)
+	n, err := io.ReadFull(ar.r, sealed)
+	if err == io.ErrUnexpectedEOF {
+		ar.final = true
+	} else if err == nil {
+		_, err = ar.r.Peek(1)
+		ar.final = err == io.EOF
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return errors.WithStack(err)
+	}
+	if n < chacha20poly1305.Overhead {
+		return errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(errAge,
+			errBackupTruncated)})
+	}
+
+	ar.buf, err = ar.aead.Open(sealed[:0], ageChunkNonce(ar.n, ar.final),
+		sealed[:n], nil)
+	if err != nil {
+		return errors.Wrapf(ErrTampered, "age payload chunk %d", ar.n)
+	}
+	if ar.final && len(ar.buf) == 0 && ar.n > 0 {
+		return errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(errAge,
+			"empty final chunk")})
+	}
+	ar.n++
+	return nil
+}
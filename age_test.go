@@ -0,0 +1,317 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portableOS"
+)
+
+// Tests that selected keys exported to an age archive, for X25519 recipients
+// or a passphrase, are imported into another store by the matching identities
+// only.
+func TestFilestore_ExportImportAge(t *testing.T) {
+	srcDir := ".ekv_testdir_age_src"
+	defer func() {
+		if err := portableOS.RemoveAll(srcDir); err != nil {
+			t.Error(err)
+		}
+	}()
+	src, err := NewFilestore(srcDir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	large := bytes.Repeat([]byte("0123456789"), ageChunkSize/5)
+	for key, value := range map[string][]byte{"a": []byte("a"),
+		"large": large, "secret": []byte("not exported")} {
+		if err = src.SetBytes(key, value); err != nil {
+			t.Fatalf("SetBytes failed: %+v", err)
+		}
+	}
+
+	alice, err := GenerateAgeX25519Identity(rand.Reader)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	bob, err := GenerateAgeX25519Identity(rand.Reader)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	eve, err := GenerateAgeX25519Identity(rand.Reader)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	passphrase, err := NewAgeScryptRecipient("correct horse", 10)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	keys := []string{"a", "large"}
+	var x25519, scrypt bytes.Buffer
+	err = src.ExportAge(&x25519, keys, ExportJSONLines, alice.Recipient(),
+		bob.Recipient())
+	if err != nil {
+		t.Fatalf("ExportAge failed: %+v", err)
+	}
+	if !strings.HasPrefix(x25519.String(), ageIntro+"-> X25519 ") {
+		t.Errorf("Unexpected header: %q", x25519.String()[:40])
+	}
+	if err = src.ExportAge(&scrypt, keys, ExportCBOR, passphrase); err != nil {
+		t.Fatalf("ExportAge failed: %+v", err)
+	}
+	if err = src.ExportAge(&bytes.Buffer{}, keys, ExportCBOR, passphrase,
+		alice.Recipient()); err == nil {
+		t.Errorf("Exported to a passphrase along with other recipients")
+	}
+	if err = src.ExportAge(&bytes.Buffer{}, []string{"missing"},
+		ExportCBOR, alice.Recipient()); Exists(err) {
+		t.Errorf("Exported a missing key: %+v", err)
+	}
+
+	for name, test := range map[string]struct {
+		archive  []byte
+		format   ExportFormat
+		identity AgeIdentity
+	}{
+		"alice": {x25519.Bytes(), ExportJSONLines, alice},
+		"bob":   {x25519.Bytes(), ExportJSONLines, bob},
+		"passphrase": {scrypt.Bytes(), ExportCBOR,
+			NewAgeScryptIdentity("correct horse")},
+	} {
+		dir := ".ekv_testdir_age_" + name
+		defer os.RemoveAll(dir)
+		dst, err := NewFilestore(dir, "Goodbye, World!")
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		err = dst.ImportAge(bytes.NewReader(test.archive), test.format,
+			eve, test.identity)
+		if err != nil {
+			t.Fatalf("ImportAge as %s failed: %+v", name, err)
+		}
+		if value, err := dst.GetBytes("large"); err != nil ||
+			!bytes.Equal(value, large) {
+			t.Errorf("Unexpected value imported as %s: %+v", name, err)
+		}
+		if _, err = dst.GetBytes("secret"); Exists(err) {
+			t.Errorf("Key not selected imported as %s: %+v", name, err)
+		}
+	}
+
+	dir := ".ekv_testdir_age_refused"
+	defer os.RemoveAll(dir)
+	dst, err := NewFilestore(dir, "Goodbye, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	err = dst.ImportAge(bytes.NewReader(x25519.Bytes()), ExportJSONLines, eve)
+	if err == nil {
+		t.Errorf("Imported an archive without a matching identity")
+	}
+	err = dst.ImportAge(bytes.NewReader(scrypt.Bytes()), ExportCBOR,
+		NewAgeScryptIdentity("wrong"))
+	if !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("Expected ErrWrongPassword, got %+v", err)
+	}
+
+	archive := x25519.Bytes()
+	tampered := append([]byte{}, archive...)
+	tampered[len(tampered)-100] ^= 1
+	header := append([]byte{}, archive...)
+	header[len(ageIntro)+12] ^= 1
+	for name, data := range map[string][]byte{
+		"tampered payload": tampered,
+		"tampered header":  header,
+		"truncated":        archive[:len(archive)-ageChunkSize/2],
+		"no final chunk":   archive[:len(archive)-len(large)/3],
+		"trailing data":    append(append([]byte{}, archive...), 0),
+		"not age":          []byte("age-encryption.org/v2\n"),
+	} {
+		err = dst.ImportAge(bytes.NewReader(data), ExportJSONLines, alice)
+		if err == nil {
+			t.Errorf("Imported %s archive", name)
+		}
+		if _, err = dst.GetBytes("a"); Exists(err) {
+			t.Errorf("Store changed importing %s archive: %+v", name, err)
+		}
+	}
+}
+
+// Known-answer vectors made with filippo.io/age v1.0.0: an X25519 identity
+// and its recipient, and the same JSON Lines export encrypted to that
+// recipient and to a passphrase with work factor 10.
+const (
+	ageTestIdentity   = "AGE-SECRET-KEY-176V5CQ0NTZR72R70EC98UNZNLJHC4HMNJT6NCFXPE8MKJZ5THKMQSGG5WJ"
+	ageTestRecipient  = "age1085q396h3vhaj5xjcg7rnneu5wsgtkjh2md9evhdz3e8za6k5ewq6tf66m"
+	ageTestPassphrase = "correct horse battery staple"
+	ageTestPlaintext  = `{"key":"greeting","value":"aGVsbG8gZnJvbSBhZ2U="}` + "\n"
+
+	ageTestX25519File = "YWdlLWVuY3J5cHRpb24ub3JnL3YxCi0+IFgyNTUxOSA4UnN6" +
+		"alpZMkJoV0NGZWJna0h4cU0yOE1DZ2Q5SHkwelZpRER2djljOXo4ClIwcnpG" +
+		"L0dOaDV5dFFvK2ZBOFVib1U3d29TSkxoc3JQaU05bmxsOFU4LzgKLS0tIDNt" +
+		"Q0dyU2FCY3VpM09FR1lYKzRyRUFSMEdZZFlDRmVla3c3ZHBYK3lCZ0UKPwtl" +
+		"lQUbsO2E1O3n1p185rHxOuUloA8PMRb8hOpIgXLpR4KXrc5LANvU8URFLzYR" +
+		"52qDCGTtWN/IMIcB60LV+wuDWmeMDH3YpFAHP1msoOBe3g=="
+	ageTestScryptFile = "YWdlLWVuY3J5cHRpb24ub3JnL3YxCi0+IHNjcnlwdCBaSGpJ" +
+		"N0dtUndla2p3TFVKRVpKZ2xBIDEwCk5BdVlDaDhWRFdaaFdkOHF1OTBMT21X" +
+		"QkRVbUlrTmd5M1o1bFlIbWJoT0UKLS0tIFlJSmdZSzlzNS8rR0R4TFJ0NUNZ" +
+		"OXRCNS9UTDdRM2M5VFBxZEdvTXZ1ZGsKnyGdsjIjKaNYRoTIGWQzdKJOCJip" +
+		"7NnSRDyqmkiefx2MZ0h5taGXAIzCt5vRAbQYW6LomhVW3UqRlllQrjJMjIqw" +
+		"HcmqU2DgP7Qia4sG/UdyTw=="
+)
+
+// Tests that archives encrypted by the reference implementation of age, to an
+// X25519 recipient and to a passphrase, are decrypted and imported.
+func TestFilestore_ImportAgeVectors(t *testing.T) {
+	dir := ".ekv_testdir_age_vectors"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	id, err := ParseAgeX25519Identity(ageTestIdentity)
+	if err != nil {
+		t.Fatalf("ParseAgeX25519Identity failed: %+v", err)
+	}
+	if id.Recipient().String() != ageTestRecipient {
+		t.Errorf("Unexpected recipient: %s", id.Recipient())
+	}
+	other, err := GenerateAgeX25519Identity(rand.Reader)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	for _, v := range []struct {
+		name     string
+		file     string
+		identity AgeIdentity
+		wrong    AgeIdentity
+	}{
+		{"X25519", ageTestX25519File, id, other},
+		{"scrypt", ageTestScryptFile, NewAgeScryptIdentity(ageTestPassphrase),
+			NewAgeScryptIdentity("wrong")},
+	} {
+		file, err := base64.StdEncoding.DecodeString(v.file)
+		if err != nil {
+			t.Fatalf("%s: %+v", v.name, err)
+		}
+		ar, err := newAgeReader(bytes.NewReader(file),
+			[]AgeIdentity{v.identity})
+		if err != nil {
+			t.Fatalf("%s: newAgeReader failed: %+v", v.name, err)
+		}
+		plaintext, err := io.ReadAll(ar)
+		if err != nil || string(plaintext) != ageTestPlaintext {
+			t.Errorf("%s: unexpected plaintext %q: %+v", v.name, plaintext,
+				err)
+		}
+
+		err = f.ImportAge(bytes.NewReader(file), ExportJSONLines, v.wrong)
+		if err == nil {
+			t.Errorf("%s: imported with the wrong identity", v.name)
+		}
+		err = f.ImportAge(bytes.NewReader(file), ExportJSONLines, v.identity)
+		if err != nil {
+			t.Fatalf("%s: ImportAge failed: %+v", v.name, err)
+		}
+		value, err := f.GetBytes("greeting")
+		if err != nil || string(value) != "hello from age" {
+			t.Errorf("%s: unexpected value %q: %+v", v.name, value, err)
+		}
+		if err = f.Delete("greeting"); err != nil {
+			t.Fatalf("%s: Delete failed: %+v", v.name, err)
+		}
+
+		// Flipping a bit of the payload is detected
+		tampered := append([]byte(nil), file...)
+		tampered[len(tampered)-1] ^= 1
+		err = f.ImportAge(bytes.NewReader(tampered), ExportJSONLines,
+			v.identity)
+		if !errors.Is(err, ErrTampered) {
+			t.Errorf("%s: tampered archive not refused: %+v", v.name, err)
+		}
+
+		// And so is a payload cut short of a whole chunk, after the nonce
+		// that follows the header
+		mac := bytes.Index(file, []byte("\n--- ")) + 1
+		payload := mac + bytes.IndexByte(file[mac:], '\n') + 1 + ageNonceSize
+		err = f.ImportAge(bytes.NewReader(file[:payload+8]), ExportJSONLines,
+			v.identity)
+		var corrupt *ErrCorrupt
+		if !errors.As(err, &corrupt) {
+			t.Errorf("%s: truncated archive not refused: %+v", v.name, err)
+		}
+		if _, err = f.GetBytes("greeting"); Exists(err) {
+			t.Errorf("%s: refused archive was imported: %+v", v.name, err)
+		}
+	}
+}
+
+// Tests that age identities and recipients are encoded as age-keygen does and
+// parsed back.
+func TestAgeX25519Identity_String(t *testing.T) {
+	id, err := GenerateAgeX25519Identity(rand.Reader)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !strings.HasPrefix(id.String(), "AGE-SECRET-KEY-1") ||
+		!strings.HasPrefix(id.Recipient().String(), "age1") {
+		t.Errorf("Unexpected encoding: %s, %s", id, id.Recipient())
+	}
+	parsed, err := ParseAgeX25519Identity(id.String())
+	if err != nil || parsed.Recipient().String() != id.Recipient().String() {
+		t.Errorf("Failed to parse identity: %+v", err)
+	}
+	recipient, err := ParseAgeX25519Recipient(id.Recipient().String())
+	if err != nil || recipient.String() != id.Recipient().String() {
+		t.Errorf("Failed to parse recipient: %+v", err)
+	}
+	if _, err = ParseAgeX25519Recipient(id.String()); err == nil {
+		t.Errorf("Parsed an identity as a recipient")
+	}
+	mangled := []byte(id.Recipient().String())
+	mangled[10] ^= 1
+	if _, err = ParseAgeX25519Recipient(string(mangled)); err == nil {
+		t.Errorf("Parsed a recipient with an invalid checksum")
+	}
+}
+
+// Tests bech32Decode against the test vectors of BIP 173.
+func Test_bech32Decode(t *testing.T) {
+	for _, s := range []string{
+		"A12UEL5L",
+		"a12uel5l",
+		"abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw",
+		"split1checkupstagehandshakeupstreamerranterredcaperred2y9e3w",
+	} {
+		if _, _, err := bech32Decode(s); err != nil {
+			t.Errorf("Failed to decode valid %s: %+v", s, err)
+		}
+	}
+	for _, s := range []string{
+		"pzry9x0s0muk", "1pzry9x0s0muk", "x1b4n0q5v", "li1dgmt3",
+		"A1G7SGD8", "10a06t8", "1qzzfhee", "a12UEL5L",
+	} {
+		if _, _, err := bech32Decode(s); err == nil {
+			t.Errorf("Decoded invalid %s", s)
+		}
+	}
+}
@@ -0,0 +1,586 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// append.go implements record logs: append-only sequences of records kept
+// for a key alongside its value. In a Filestore, every append is written as a
+// new encrypted segment holding only the new records, and a small encrypted
+// manifest lists the segments in order. Appending therefore never rewrites or
+// re-encrypts the existing records.
+//
+// To keep the number of files in check, once enough small segments build up
+// at the end of the log they are consolidated into one. Segments that reach
+// appendSegmentSize are full and are never rewritten again.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+const (
+	// appendKeyPrefix is prepended to a key to derive the key of its record
+	// log manifest, and appendSegmentKeyPrefix to derive its segments.
+	appendKeyPrefix        = "\x00ekv:append:"
+	appendSegmentKeyPrefix = "\x00ekv:append-segment:"
+
+	// appendSegmentSize is the size at which a segment is full and is no
+	// longer consolidated with the segments after it.
+	appendSegmentSize = 256 * 1024
+
+	// defaultAppendConsolidationThreshold is the number of segments smaller
+	// than appendSegmentSize at the end of a record log that triggers their
+	// consolidation into one.
+	defaultAppendConsolidationThreshold = 32
+
+	// appendManifestVersion is the version of the manifests written.
+	// Manifests of version 1 do not record their key.
+	appendManifestVersion = 2
+
+	errAppendManifest = "invalid record log manifest: %s"
+	errAppendSegment  = "invalid record log segment: %s"
+)
+
+// RecordIterator iterates over the records appended to a key. Records are
+// loaded as they are reached. Like bufio.Scanner, Next advances to the next
+// record and returns false once there are none left or an error occurred,
+// which Err then returns:
+//
+//	it, err := kv.Records("key")
+//	...
+//	defer it.Close()
+//	for it.Next() {
+//		record := it.Record()
+//	}
+//	err = it.Err()
+//
+// The record log of the key cannot be appended to while the iterator is
+// open. The iterator is released once Next returns false or it is closed.
+type RecordIterator struct {
+	// load returns the next batch of records, or nil once there are none.
+	load    func() ([][]byte, error)
+	release func()
+
+	batch  [][]byte
+	record []byte
+	err    error
+	done   bool
+}
+
+// Next advances the iterator to the next record, which is then available
+// through Record. It returns false when there are no more records or an
+// error occurred.
+func (it *RecordIterator) Next() bool {
+	if it.done {
+		return false
+	}
+	for len(it.batch) == 0 {
+		batch, err := it.load()
+		if err != nil || batch == nil {
+			it.err = err
+			it.record = nil
+			it.Close()
+			return false
+		}
+		it.batch = batch
+	}
+	it.record, it.batch = it.batch[0], it.batch[1:]
+	return true
+}
+
+// Record returns the current record. It is only valid after Next returned
+// true and must not be modified.
+func (it *RecordIterator) Record() []byte {
+	return it.record
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *RecordIterator) Err() error {
+	return it.err
+}
+
+// Close releases the iterator. Closing it again does nothing.
+func (it *RecordIterator) Close() error {
+	if it.done {
+		return nil
+	}
+	it.done = true
+	it.batch = nil
+	if it.release != nil {
+		it.release()
+	}
+	return nil
+}
+
+// appendSegment describes a single segment of a record log.
+type appendSegment struct {
+	id      uint64
+	records uint64
+	// size is the size of the marshalled, unencrypted records.
+	size uint64
+}
+
+// appendManifest lists the segments of a record log in order.
+type appendManifest struct {
+	// key is the key of the record log, so that the keys of the merge logs
+	// of a Filestore can be listed from its files, see keyIndex.go.
+	key      string
+	nextID   uint64
+	segments []appendSegment
+}
+
+// marshal encodes the manifest as
+// [version][uvarint key size][key][uvarint next ID][uvarint count]
+// followed by [uvarint ID][uvarint records][uvarint size] for every segment.
+func (m *appendManifest) marshal() []byte {
+	buf := make([]byte, 0, 1+len(m.key)+
+		binary.MaxVarintLen64*(3+3*len(m.segments)))
+	buf = append(buf, appendManifestVersion)
+	buf = binary.AppendUvarint(buf, uint64(len(m.key)))
+	buf = append(buf, m.key...)
+	buf = binary.AppendUvarint(buf, m.nextID)
+	buf = binary.AppendUvarint(buf, uint64(len(m.segments)))
+	for _, s := range m.segments {
+		buf = binary.AppendUvarint(buf, s.id)
+		buf = binary.AppendUvarint(buf, s.records)
+		buf = binary.AppendUvarint(buf, s.size)
+	}
+	return buf
+}
+
+// unmarshalAppendManifest is the inverse of appendManifest.marshal.
+func unmarshalAppendManifest(data []byte) (*appendManifest, error) {
+	if len(data) == 0 || data[0] == 0 || data[0] > appendManifestVersion {
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+			errAppendManifest, "unknown version")})
+	}
+	version := data[0]
+	data = data[1:]
+
+	var key string
+	if version > 1 {
+		size, n := binary.Uvarint(data)
+		if n <= 0 || size > uint64(len(data)-n) {
+			return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+				errAppendManifest, "truncated key")})
+		}
+		key = string(data[n : n+int(size)])
+		data = data[n+int(size):]
+	}
+
+	fields := make([]uint64, 0, 2)
+	next := func() bool {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return false
+		}
+		fields = append(fields, v)
+		data = data[n:]
+		return true
+	}
+	if !next() || !next() {
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+			errAppendManifest, "truncated header")})
+	}
+	m := &appendManifest{key: key, nextID: fields[0]}
+	count := fields[1]
+
+	// Every segment takes at least 3 bytes, so a larger count is corrupt
+	if count > uint64(len(data))/3 {
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+			errAppendManifest, "segment count exceeds size")})
+	}
+	m.segments = make([]appendSegment, count)
+	for i := range m.segments {
+		fields = fields[:0]
+		if !next() || !next() || !next() {
+			return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+				errAppendManifest, "truncated segment")})
+		}
+		m.segments[i] = appendSegment{
+			id: fields[0], records: fields[1], size: fields[2]}
+	}
+	if len(data) != 0 {
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+			errAppendManifest, "trailing data")})
+	}
+	return m, nil
+}
+
+// marshalRecords encodes records as a [uvarint length][record] sequence.
+func marshalRecords(records [][]byte) []byte {
+	size := 0
+	for _, r := range records {
+		size += binary.MaxVarintLen64 + len(r)
+	}
+	buf := make([]byte, 0, size)
+	for _, r := range records {
+		buf = binary.AppendUvarint(buf, uint64(len(r)))
+		buf = append(buf, r...)
+	}
+	return buf
+}
+
+// unmarshalRecords is the inverse of marshalRecords. It checks that the data
+// holds exactly count records.
+func unmarshalRecords(data []byte, count uint64) ([][]byte, error) {
+	if count > uint64(len(data)) {
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+			errAppendSegment, "record count exceeds size")})
+	}
+	records := make([][]byte, 0, count)
+	for len(data) > 0 {
+		size, n := binary.Uvarint(data)
+		if n <= 0 || size > uint64(len(data)-n) {
+			return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+				errAppendSegment, "truncated record")})
+		}
+		records = append(records, data[n:n+int(size)])
+		data = data[n+int(size):]
+	}
+	if uint64(len(records)) != count {
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+			errAppendSegment, "wrong record count")})
+	}
+	return records, nil
+}
+
+// AppendBytes appends data as a new record to the record log of key. Only the
+// new record is encrypted and written; the existing records are left as they
+// are. The records are read back in order with Records.
+//
+// Record logs are kept apart from the values set with SetBytes. Delete
+// removes both.
+func (f *Filestore) AppendBytes(key string, data []byte) error {
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	appendKey := f.getAppendKey(key)
+	jww.TRACE.Printf(
+		"%s,APPEND,%s,%s,%s", kvDebugHeader, key, appendKey, data)
+	unlock := f.takeLocks(true, appendKey)
+	defer unlock()
+	return f.appendRecords(key, appendKey, [][]byte{data})
+}
+
+// Records returns an iterator over the records appended to key. Returns an
+// error for which Exists is false if nothing was ever appended to it.
+func (f *Filestore) Records(key string) (*RecordIterator, error) {
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return nil, err
+	}
+
+	appendKey := f.getAppendKey(key)
+	unlock := f.takeLocks(false, appendKey)
+	m, err := f.readAppendManifest(appendKey)
+	if err != nil {
+		unlock()
+		done()
+		return nil, errors.WithStack(err)
+	}
+
+	segments := m.segments
+	return &RecordIterator{
+		load: func() ([][]byte, error) {
+			if len(segments) == 0 {
+				return nil, nil
+			}
+			s := segments[0]
+			segments = segments[1:]
+			return f.readSegment(key, s)
+		},
+		release: func() {
+			unlock()
+			done()
+		},
+	}, nil
+}
+
+// ConsolidateRecords merges every segment smaller than appendSegmentSize at
+// the end of the record log of key into one. This happens automatically as
+// records are appended, so it is rarely needed. It does nothing if there is
+// no record log.
+func (f *Filestore) ConsolidateRecords(key string) error {
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	appendKey := f.getAppendKey(key)
+	unlock := f.takeLocks(true, appendKey)
+	defer unlock()
+
+	m, err := f.readAppendManifest(appendKey)
+	if err != nil {
+		if !Exists(err) {
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+	return f.consolidateRecords(key, appendKey, m, 2)
+}
+
+// appendRecords writes records as a new segment at the end of the record log
+// of key and consolidates the log if enough small segments have built up. The
+// caller must hold the lock of appendKey.
+func (f *Filestore) appendRecords(key, appendKey string, records [][]byte) error {
+	m, err := f.readAppendManifest(appendKey)
+	if err != nil {
+		if Exists(err) {
+			return errors.WithStack(err)
+		}
+		m = &appendManifest{}
+	}
+	m.key = key
+
+	s, err := f.writeSegment(key, m.nextID, records)
+	if err != nil {
+		return err
+	}
+	m.nextID++
+	m.segments = append(m.segments, s)
+
+	// The manifest is the commit point. A segment written without it is
+	// overwritten by the next append, as it reuses the ID.
+	err = f.writeAppendManifest(appendKey, m)
+	if err != nil {
+		return err
+	}
+
+	return f.consolidateRecords(
+		key, appendKey, m, f.appendConsolidationThreshold)
+}
+
+// consolidateRecords merges the segments smaller than appendSegmentSize at
+// the end of the record log into one if there are at least threshold of them.
+// The caller must hold the lock of appendKey.
+func (f *Filestore) consolidateRecords(key, appendKey string,
+	m *appendManifest, threshold int) error {
+	start := len(m.segments)
+	for start > 0 && m.segments[start-1].size < appendSegmentSize {
+		start--
+	}
+	run := m.segments[start:]
+	if len(run) < max(threshold, 2) {
+		return nil
+	}
+
+	var records [][]byte
+	for _, s := range run {
+		segmentRecords, err := f.readSegment(key, s)
+		if err != nil {
+			return err
+		}
+		records = append(records, segmentRecords...)
+	}
+
+	consolidated, err := f.writeSegment(key, m.nextID, records)
+	if err != nil {
+		return err
+	}
+	old := append([]appendSegment(nil), run...)
+	m.nextID++
+	m.segments = append(m.segments[:start], consolidated)
+	err = f.writeAppendManifest(appendKey, m)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range old {
+		err = deleteFiles(f.getSegmentKey(key, s.id), f.csprng)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropSegments removes the first n segments from the record log and
+// securely deletes them. The caller must hold the lock of appendKey.
+func (f *Filestore) dropSegments(key, appendKey string, m *appendManifest,
+	n int) error {
+	old := append([]appendSegment(nil), m.segments[:n]...)
+	m.segments = m.segments[n:]
+
+	// The manifest goes first so that a failure cannot leave it listing
+	// deleted segments
+	err := f.writeAppendManifest(appendKey, m)
+	if err != nil {
+		return err
+	}
+	for _, s := range old {
+		err = deleteFiles(f.getSegmentKey(key, s.id), f.csprng)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readAppendManifest returns the manifest of the record log at appendKey. The
+// caller must hold its lock.
+func (f *Filestore) readAppendManifest(appendKey string) (
+	*appendManifest, error) {
+	encrypted, err := read(appendKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := decrypt(encrypted, f.key)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalAppendManifest(data)
+}
+
+// writeAppendManifest replaces the manifest at appendKey with m. The caller
+// must hold its lock.
+func (f *Filestore) writeAppendManifest(appendKey string,
+	m *appendManifest) error {
+	encrypted, err := encrypt(m.marshal(), f.key, f.csprng)
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(write(appendKey, encrypted, f.csprng))
+}
+
+// readSegment reads and decrypts the records of segment s of the record log
+// of key.
+func (f *Filestore) readSegment(key string, s appendSegment) ([][]byte, error) {
+	segmentKey := f.getSegmentKey(key, s.id)
+	encrypted, err := read(segmentKey)
+	if err != nil {
+		if !Exists(err) {
+			return nil, errors.WithStack(&ErrCorrupt{Path: segmentKey,
+				Reason: fmt.Sprintf(errAppendSegment, "missing")})
+		}
+		return nil, err
+	}
+	data, err := decrypt(encrypted, f.key)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalRecords(data, s.records)
+}
+
+// writeSegment encrypts and writes records as segment id of the record log of
+// key and returns its description.
+func (f *Filestore) writeSegment(key string, id uint64, records [][]byte) (
+	appendSegment, error) {
+	data := marshalRecords(records)
+	encrypted, err := encrypt(data, f.key, f.csprng)
+	if err != nil {
+		return appendSegment{}, err
+	}
+	err = write(f.getSegmentKey(key, id), encrypted, f.csprng)
+	if err != nil {
+		return appendSegment{}, errors.WithStack(err)
+	}
+	return appendSegment{
+		id:      id,
+		records: uint64(len(records)),
+		size:    uint64(len(data)),
+	}, nil
+}
+
+// deleteRecords securely deletes every segment and the manifest of the
+// record log of key, if there is one. The caller must hold the lock of
+// appendKey.
+func (f *Filestore) deleteRecords(key, appendKey string) error {
+	m, err := f.readAppendManifest(appendKey)
+	if err != nil {
+		if !Exists(err) {
+			return nil
+		}
+		return err
+	}
+
+	// The manifest goes first so that a failure cannot leave it listing
+	// deleted segments
+	err = deleteFiles(appendKey, f.csprng)
+	if err != nil {
+		return err
+	}
+	for _, s := range m.segments {
+		err = deleteFiles(f.getSegmentKey(key, s.id), f.csprng)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getAppendKey returns the path of the record log manifest of key.
+func (f *Filestore) getAppendKey(key string) string {
+	return f.getKey(appendKeyPrefix + key)
+}
+
+// getSegmentKey returns the path of segment id of the record log of key.
+func (f *Filestore) getSegmentKey(key string, id uint64) string {
+	return f.getKey(
+		appendSegmentKeyPrefix + strconv.FormatUint(id, 10) + ":" + key)
+}
+
+// AppendBytes appends data as a new record to the record log of key. The
+// records are read back in order with Records.
+//
+// Record logs are kept apart from the values set with SetBytes. Delete
+// removes both.
+func (m *Memstore) AppendBytes(key string, data []byte) error {
+	done, err := m.lifecycle.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.appendRecords(key, [][]byte{data})
+	return nil
+}
+
+// Records returns an iterator over the records appended to key. Returns an
+// error for which Exists is false if nothing was ever appended to it.
+func (m *Memstore) Records(key string) (*RecordIterator, error) {
+	done, err := m.lifecycle.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	m.mux.RLock()
+	records, ok := m.records[key]
+	m.mux.RUnlock()
+	if !ok {
+		return nil, errors.WithStack(ErrNotFound)
+	}
+
+	// Records are never modified once appended, so the slice can be shared
+	return &RecordIterator{
+		load: func() ([][]byte, error) {
+			batch := records
+			records = nil
+			return batch, nil
+		},
+	}, nil
+}
+
+// appendRecords appends copies of records to the record log of key. The
+// caller must hold the write lock.
+func (m *Memstore) appendRecords(key string, records [][]byte) {
+	for _, r := range records {
+		m.records[key] = append(m.records[key], append([]byte{}, r...))
+	}
+}
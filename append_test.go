@@ -0,0 +1,303 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"gitlab.com/elixxir/ekv/portableOS"
+)
+
+// appendStore is the subset of the store methods exercised by these tests.
+type appendStore interface {
+	KeyValue
+	AppendBytes(key string, data []byte) error
+	Records(key string) (*RecordIterator, error)
+}
+
+// readRecords returns every record appended to key.
+func readRecords(t *testing.T, s appendStore, key string) [][]byte {
+	it, err := s.Records(key)
+	if err != nil {
+		t.Fatalf("Records failed: %+v", err)
+	}
+	defer it.Close()
+
+	var records [][]byte
+	for it.Next() {
+		records = append(records, it.Record())
+	}
+	if err = it.Err(); err != nil {
+		t.Fatalf("Iteration failed: %+v", err)
+	}
+	return records
+}
+
+// checkRecords checks that the records of key are "0", "1", ... up to n.
+func checkRecords(t *testing.T, s appendStore, key string, n int) {
+	records := readRecords(t, s, key)
+	if len(records) != n {
+		t.Fatalf("Expected %d records, got %d", n, len(records))
+	}
+	for i, r := range records {
+		if string(r) != strconv.Itoa(i) {
+			t.Errorf("Record %d is %q", i, r)
+		}
+	}
+}
+
+// testAppend appends records directly and inside a transaction and checks
+// they are read back in order and are independent of the value of the key.
+func testAppend(t *testing.T, s appendStore) {
+	if _, err := s.Records("key"); Exists(err) {
+		t.Errorf("Records of an empty log did not return not found: %+v", err)
+	}
+
+	if err := s.SetBytes("key", []byte("value")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := s.AppendBytes("key", []byte(strconv.Itoa(i))); err != nil {
+			t.Fatalf("AppendBytes failed: %+v", err)
+		}
+	}
+	checkRecords(t, s, "key", 10)
+
+	err := s.Transaction(func(files map[string]Operable, _ Extender) error {
+		files["key"].Append([]byte("10"))
+		files["key"].Append([]byte("11"))
+		return nil
+	}, "key")
+	if err != nil {
+		t.Fatalf("Transaction failed: %+v", err)
+	}
+	checkRecords(t, s, "key", 12)
+
+	data, err := s.GetBytes("key")
+	if err != nil || !bytes.Equal(data, []byte("value")) {
+		t.Errorf("Appending changed the value: %q, %+v", data, err)
+	}
+
+	if err = s.Delete("key"); err != nil {
+		t.Fatalf("Delete failed: %+v", err)
+	}
+	if _, err = s.Records("key"); Exists(err) {
+		t.Errorf("Records exist after delete: %+v", err)
+	}
+
+	// As does deleting in a transaction, even without a value, but records
+	// appended after the delete are kept
+	if err = s.AppendBytes("key", []byte("deleted")); err != nil {
+		t.Fatalf("AppendBytes failed: %+v", err)
+	}
+	err = s.Transaction(func(files map[string]Operable, _ Extender) error {
+		files["key"].Delete()
+		return nil
+	}, "key")
+	if err != nil {
+		t.Fatalf("Transaction failed: %+v", err)
+	}
+	if _, err = s.Records("key"); Exists(err) {
+		t.Errorf("Records exist after delete in a transaction: %+v", err)
+	}
+	err = s.Transaction(func(files map[string]Operable, _ Extender) error {
+		files["key"].Delete()
+		files["key"].Append([]byte("0"))
+		return nil
+	}, "key")
+	if err != nil {
+		t.Fatalf("Transaction failed: %+v", err)
+	}
+	checkRecords(t, s, "key", 1)
+}
+
+// Tests that records appended to a Memstore are read back in order.
+func TestMemstore_Append(t *testing.T) {
+	testAppend(t, MakeMemstore())
+}
+
+// Tests that records appended to a Filestore are read back in order and that
+// the log survives reopening the store.
+func TestFilestore_Append(t *testing.T) {
+	dir := ".ekv_testdir_append"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	testAppend(t, f)
+
+	for i := 0; i < 3; i++ {
+		if err = f.AppendBytes("persisted", []byte(strconv.Itoa(i))); err != nil {
+			t.Fatalf("AppendBytes failed: %+v", err)
+		}
+	}
+	f, err = NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkRecords(t, f, "persisted", 3)
+}
+
+// Tests that deleting a key in a transaction removes every file of the key,
+// as Delete does: its value, records, stream and history.
+func TestFilestore_TransactionDelete(t *testing.T) {
+	dir := ".ekv_testdir_transaction_delete"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	f.SetRetention(RetentionPolicy{Versions: 2})
+	for _, data := range []string{"first", "second"} {
+		if err = f.SetBytes("key", []byte(data)); err != nil {
+			t.Fatalf("SetBytes failed: %+v", err)
+		}
+	}
+	if err = f.AppendBytes("key", []byte("0")); err != nil {
+		t.Fatalf("AppendBytes failed: %+v", err)
+	}
+	writeStream(t, f, "key", []byte("stream"))
+
+	err = f.Transaction(func(files map[string]Operable, _ Extender) error {
+		files["key"].Delete()
+		return nil
+	}, "key")
+	if err != nil {
+		t.Fatalf("Transaction failed: %+v", err)
+	}
+
+	if _, err = f.GetBytes("key"); Exists(err) {
+		t.Errorf("Value exists after delete: %+v", err)
+	}
+	if _, err = f.Records("key"); Exists(err) {
+		t.Errorf("Records exist after delete: %+v", err)
+	}
+	if r, err := f.OpenReader("key"); Exists(err) {
+		if err == nil {
+			_ = r.Close()
+		}
+		t.Errorf("Stream exists after delete: %+v", err)
+	}
+	if versions, err := f.ListVersions("key"); err != nil ||
+		len(versions) != 0 {
+		t.Errorf("Versions exist after delete: %+v, %+v", versions, err)
+	}
+}
+
+// Tests that small segments are consolidated once the threshold is reached
+// and that the old segments are deleted.
+func TestFilestore_AppendConsolidation(t *testing.T) {
+	dir := ".ekv_testdir_append_consolidation"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	f.appendConsolidationThreshold = 4
+
+	// A full segment is never consolidated
+	full := make([]byte, appendSegmentSize)
+	if err = f.AppendBytes("key", full); err != nil {
+		t.Fatalf("AppendBytes failed: %+v", err)
+	}
+	for i := 1; i < 4; i++ {
+		if err = f.AppendBytes("key", []byte(strconv.Itoa(i))); err != nil {
+			t.Fatalf("AppendBytes failed: %+v", err)
+		}
+	}
+
+	m, err := f.readAppendManifest(f.getAppendKey("key"))
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %+v", err)
+	}
+	if len(m.segments) != 4 {
+		t.Errorf("Consolidated early: %d segments", len(m.segments))
+	}
+
+	if err = f.AppendBytes("key", []byte("4")); err != nil {
+		t.Fatalf("AppendBytes failed: %+v", err)
+	}
+	m, err = f.readAppendManifest(f.getAppendKey("key"))
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %+v", err)
+	}
+	if len(m.segments) != 2 || m.segments[1].records != 4 {
+		t.Errorf("Unexpected segments after consolidation: %+v", m.segments)
+	}
+	for id := uint64(1); id <= 4; id++ {
+		if _, err = read(f.getSegmentKey("key", id)); Exists(err) {
+			t.Errorf("Segment %d was not deleted: %+v", id, err)
+		}
+	}
+
+	records := readRecords(t, f, "key")
+	if len(records) != 5 || !bytes.Equal(records[0], full) {
+		t.Fatalf("Unexpected records after consolidation: %d", len(records))
+	}
+	for i := 1; i < 5; i++ {
+		if string(records[i]) != strconv.Itoa(i) {
+			t.Errorf("Record %d is %q", i, records[i])
+		}
+	}
+}
+
+// Tests that a manifest and records survive a marshal and unmarshal round
+// trip, that manifests written without their key are still read and that
+// truncated data is rejected.
+func Test_unmarshalAppendManifest(t *testing.T) {
+	m := &appendManifest{key: "log", nextID: 300, segments: []appendSegment{
+		{id: 1, records: 2, size: 3}, {id: 299, records: 1, size: 1 << 20}}}
+	data := m.marshal()
+	decoded, err := unmarshalAppendManifest(data)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal: %+v", err)
+	}
+	if decoded.key != m.key || decoded.nextID != m.nextID ||
+		len(decoded.segments) != 2 || decoded.segments[1] != m.segments[1] {
+		t.Errorf("Manifest mismatch: %+v != %+v", decoded, m)
+	}
+	decoded, err = unmarshalAppendManifest([]byte{1, 5, 0})
+	if err != nil || decoded.key != "" || decoded.nextID != 5 {
+		t.Errorf("Unexpected manifest of version 1: %+v, %+v", decoded, err)
+	}
+	if _, err = unmarshalAppendManifest(data[:len(data)-1]); err == nil {
+		t.Errorf("Unmarshalled a truncated manifest")
+	}
+
+	records := [][]byte{[]byte("a"), {}, bytes.Repeat([]byte("b"), 200)}
+	decodedRecords, err := unmarshalRecords(marshalRecords(records), 3)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal records: %+v", err)
+	}
+	for i := range records {
+		if !bytes.Equal(decodedRecords[i], records[i]) {
+			t.Errorf("Record %d mismatch", i)
+		}
+	}
+	if _, err = unmarshalRecords(marshalRecords(records), 2); err == nil {
+		t.Errorf("Unmarshalled records with the wrong count")
+	}
+}
@@ -0,0 +1,570 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// backup.go implements backing up a Filestore to a single archive, to move it
+// to a new device, and restoring it from one. The archive is
+//   [header][frame]...[final frame]
+// where the header is
+//   [magic][version][32-byte salt][32-byte key check]
+// and every frame is
+//   [4-byte big endian size][XChaCha20-Poly1305 ciphertext]
+// The frames are encrypted with a key derived from the key of the store and
+// the salt, with the header as associated data. The nonce of a frame is its
+// number, and that of the final frame is marked, so frames cannot be
+// reordered, dropped or added without failing authentication, and an archive
+// cut short lacks its final frame.
+//
+// The plaintext of the frames is a list of entries, each either a file of the
+// store
+//   [0][uvarint name size][name][uvarint size][contents]
+// or a file deleted since the backup an incremental backup follows
+//   [1][uvarint name size][name]
+// and ends with a trailer describing the backup, see incremental.go
+//   [2][backup info]
+// The files are copied as they are, still encrypted with the key of the store,
+// so the archive can only be restored to a store with the same password.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/ekv/portableOS"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	backupMagic = "EKVB"
+
+	// backupVersion is the version of the archives written and read.
+	backupVersion = 2
+
+	backupSaltSize   = 32
+	backupHeaderSize = len(backupMagic) + 1 + backupSaltSize + blake2b.Size256
+
+	// backupFrameSize is the size of the plaintext of every frame but the
+	// last.
+	backupFrameSize = 64 * 1024
+
+	// Types of the entries of an archive.
+	backupEntryFile    = 0
+	backupEntryDeleted = 1
+	backupEntryTrailer = 2
+
+	// backupDirName and restoreDirName are the directories, among the
+	// snapshots, where a backup is captured and a restore is staged.
+	backupDirName  = "..backup"
+	restoreDirName = "..restore"
+
+	errBackup          = "invalid backup: %s"
+	errBackupTruncated = "archive is truncated"
+	errBackupEntry     = "invalid file name %q"
+)
+
+// Backup writes a consistent copy of the store to w as a single encrypted,
+// authenticated archive, which Restore reads back into a store with the same
+// password. Snapshots are not included. Returns the token of the backup, from
+// which BackupSince can write an incremental backup.
+//
+// The store is copied like for Snapshot, in a temporary directory, and then
+// streamed to w. Operations are only held back while the copy is completed.
+func (f *Filestore) Backup(w io.Writer) (BackupToken, error) {
+	return f.backup(w, "")
+}
+
+// backup writes an archive of the store to w: a full backup if since is
+// empty, and otherwise an incremental backup of the files changed since the
+// backup with that token. Returns the token of the new backup.
+func (f *Filestore) backup(w io.Writer, since BackupToken) (BackupToken,
+	error) {
+	f.snapshots.Lock()
+	defer f.snapshots.Unlock()
+
+	// The backup state is only changed by backups, which hold the snapshots
+	// lock
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return "", err
+	}
+	dir := getSnapshotPath(f.basedir, backupDirName)
+	stateDir := getSnapshotPath(f.basedir, backupStateDirName)
+	state, err := f.readBackupState(stateDir)
+	var parent *backupManifest
+	if err == nil && since != "" {
+		parent, err = f.readParentManifest(stateDir, state, since)
+	}
+	done()
+	if err != nil {
+		return "", err
+	}
+
+	// Files the parent backup has with the same stamp are neither copied nor
+	// read again
+	var unchanged func(name string, info portableOS.FileInfo) bool
+	if parent != nil {
+		unchanged = func(name string, info portableOS.FileInfo) bool {
+			prev, existed := parent.file(name)
+			return existed && prev.unchanged(info, parent.started)
+		}
+	}
+	infos, started, err := f.capture(dir, unchanged)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := f.deleteSnapshot(dir); err != nil {
+			jww.WARN.Printf("Failed to delete backup copy %s: %+v", dir, err)
+		}
+	}()
+
+	done, err = f.lifecycle.begin()
+	if err != nil {
+		return "", err
+	}
+	defer done()
+	jww.TRACE.Printf("%s,BACKUP,%d", kvDebugHeader, state.next)
+
+	bw, err := f.newBackupWriter(w)
+	if err != nil {
+		return "", err
+	}
+	names := make([]string, 0, len(infos))
+	for name := range infos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	m := &backupManifest{seq: state.next, started: started,
+		files: make(map[string]backupFile, len(infos))}
+	for _, name := range names {
+		info := infos[name]
+		prev, existed := parent.file(name)
+		if existed && prev.unchanged(info, parent.started) {
+			m.files[name] = prev
+			continue
+		}
+		data, err := readFile(dir + string(os.PathSeparator) + name)
+		if err != nil {
+			return "", err
+		}
+		file := backupFile{size: info.Size(), modified: info.ModTime(),
+			hash: blake2b.Sum256(data)}
+		m.files[name] = file
+		if existed && prev.hash == file.hash {
+			continue
+		}
+		if err = writeBackupFile(bw, name, data); err != nil {
+			return "", err
+		}
+	}
+	for _, name := range parent.names() {
+		if _, exists := m.files[name]; !exists {
+			if err = writeBackupDeleted(bw, name); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	info := m.info(state.store, parent)
+	trailer := append([]byte{backupEntryTrailer}, info.marshal()...)
+	if _, err = bw.Write(trailer); err != nil {
+		return "", err
+	}
+	if err = bw.Close(); err != nil {
+		return "", err
+	}
+	if err = f.saveBackupManifest(stateDir, state, m); err != nil {
+		return "", err
+	}
+	return info.token(), nil
+}
+
+// newBackupWriter writes the header of a new archive to w and returns the
+// writer of its frames.
+func (f *Filestore) newBackupWriter(w io.Writer) (*backupWriter, error) {
+	salt := make([]byte, backupSaltSize)
+	if _, err := io.ReadFull(f.csprng, salt); err != nil {
+		return nil, errors.Wrap(err, "Could not generate salt")
+	}
+	header := make([]byte, 0, backupHeaderSize)
+	header = append(append(header, backupMagic...), backupVersion)
+	header = append(append(header, salt...), backupKeyCheck(f.key, salt)...)
+	if _, err := w.Write(header); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	aead, err := initChaCha20Poly1305(deriveBackupKey(f.key, salt))
+	if err != nil {
+		return nil, err
+	}
+	return &backupWriter{w: w, aead: aead, header: header}, nil
+}
+
+// Restore replaces the contents of the store with those of a full backup
+// written by Backup. The whole archive is read and authenticated before the
+// store is changed, so a truncated or tampered archive is refused with
+// ErrCorrupt or ErrTampered and leaves the store as it was. Returns
+// ErrWrongPassword if the archive was made by a store with another password.
+// Snapshots are kept.
+//
+// Operations are held back only while the files read from the archive replace
+// those of the store. Like RestoreSnapshot, that step is not atomic.
+func (f *Filestore) Restore(r io.Reader) error {
+	return f.RestoreChain(r)
+}
+
+// RestoreChain is Restore for a full backup followed by a chain of
+// incremental backups, each written by BackupSince with the token of the
+// backup before it. The chain is checked as the archives are read: every
+// incremental backup must follow the one before it, and the files restored
+// must be those of the last backup. The store is only changed once the whole
+// chain is found to be consistent.
+func (f *Filestore) RestoreChain(full io.Reader,
+	incrementals ...io.Reader) error {
+	f.snapshots.Lock()
+	defer f.snapshots.Unlock()
+
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return err
+	}
+	dir := getSnapshotPath(f.basedir, restoreDirName)
+	err = f.stageChain(dir, append([]io.Reader{full}, incrementals...))
+	done()
+	if err != nil {
+		return f.discardSnapshot(dir, err)
+	}
+	defer func() {
+		if err := f.deleteSnapshot(dir); err != nil {
+			jww.WARN.Printf("Failed to delete restored copy %s: %+v", dir, err)
+		}
+	}()
+
+	resume, err := f.lifecycle.pause()
+	if err != nil {
+		return err
+	}
+	defer resume()
+	jww.TRACE.Printf("%s,RESTORE_BACKUP,%d", kvDebugHeader,
+		len(incrementals))
+	return f.restoreFrom(dir)
+}
+
+// stageArchive reads the archive from r and applies its entries to the files
+// of the directory dir. Returns the trailer of the archive. The caller must be
+// in flight.
+func (f *Filestore) stageArchive(r io.Reader, dir string) (*backupInfo,
+	error) {
+	header := make([]byte, backupHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.WithStack(&ErrCorrupt{
+			Reason: fmt.Sprintf(errBackup, "header is truncated")})
+	}
+	version := header[len(backupMagic)]
+	if string(header[:len(backupMagic)]) != backupMagic {
+		return nil, errors.WithStack(&ErrCorrupt{
+			Reason: fmt.Sprintf(errBackup, "not a backup")})
+	} else if version != backupVersion {
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+			errBackup, fmt.Sprintf("unknown version %d", version))})
+	}
+	salt := header[len(backupMagic)+1 : len(backupMagic)+1+backupSaltSize]
+	check := header[len(backupMagic)+1+backupSaltSize:]
+	if !hmac.Equal(check, backupKeyCheck(f.key, salt)) {
+		return nil, errors.WithStack(ErrWrongPassword)
+	}
+	aead, err := initChaCha20Poly1305(deriveBackupKey(f.key, salt))
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(&backupReader{r: r, aead: aead, header: header})
+	for {
+		entryType, err := br.ReadByte()
+		if err != nil {
+			return nil, backupReadError(err)
+		}
+
+		switch entryType {
+		case backupEntryFile:
+			name, err := readBackupEntryName(br)
+			if err != nil {
+				return nil, backupReadError(err)
+			}
+			err = readBackupEntry(br, dir+string(os.PathSeparator)+name)
+			if err != nil {
+				return nil, err
+			}
+		case backupEntryDeleted:
+			name, err := readBackupEntryName(br)
+			if err != nil {
+				return nil, backupReadError(err)
+			}
+			err = deleteFile(dir+string(os.PathSeparator)+name, f.csprng)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+		case backupEntryTrailer:
+			info, err := readBackupInfo(br)
+			if err != nil {
+				return nil, err
+			}
+			if _, err = br.ReadByte(); err != io.EOF {
+				return nil, errors.WithStack(&ErrCorrupt{
+					Reason: fmt.Sprintf(errBackup, "data after the trailer")})
+			}
+			return info, nil
+		default:
+			return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+				errBackup, fmt.Sprintf("unknown entry type %d", entryType))})
+		}
+	}
+}
+
+// writeBackupFile writes the contents of the file called name to bw.
+func writeBackupFile(bw *backupWriter, name string, data []byte) error {
+	entry := []byte{backupEntryFile}
+	entry = binary.AppendUvarint(entry, uint64(len(name)))
+	entry = append(entry, name...)
+	entry = binary.AppendUvarint(entry, uint64(len(data)))
+	if _, err := bw.Write(entry); err != nil {
+		return err
+	}
+	_, err := bw.Write(data)
+	return err
+}
+
+// writeBackupDeleted writes to bw that the file called name was deleted.
+func writeBackupDeleted(bw *backupWriter, name string) error {
+	entry := []byte{backupEntryDeleted}
+	entry = binary.AppendUvarint(entry, uint64(len(name)))
+	_, err := bw.Write(append(entry, name...))
+	return err
+}
+
+// readBackupEntryName reads the name of the next file from br. Returns io.EOF
+// if the archive ends before it.
+func readBackupEntryName(br *bufio.Reader) (string, error) {
+	size, err := binary.ReadUvarint(br)
+	if err == io.EOF {
+		return "", io.EOF
+	} else if err != nil {
+		return "", backupReadError(err)
+	}
+	if size == 0 || size > 255 {
+		return "", errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(errBackup,
+			"invalid file name size")})
+	}
+	name := make([]byte, size)
+	if _, err = io.ReadFull(br, name); err != nil {
+		return "", backupReadError(err)
+	}
+	if string(name) == "." || string(name) == ".." ||
+		strings.ContainsAny(string(name), "/\\\x00") ||
+		bytes.IndexRune(name, os.PathSeparator) >= 0 {
+		return "", errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(errBackup,
+			fmt.Sprintf(errBackupEntry, name))})
+	}
+	return string(name), nil
+}
+
+// readBackupEntry reads the contents of the next file from br and writes them
+// to path.
+func readBackupEntry(br *bufio.Reader, path string) error {
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		return backupReadError(err)
+	}
+	out, err := portableOS.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = io.CopyN(out, br, int64(size))
+	if err != nil {
+		out.Close()
+		return backupReadError(err)
+	}
+	out.Sync()
+	return errors.WithStack(out.Close())
+}
+
+// readFile returns the contents of the file at path.
+func readFile(path string) ([]byte, error) {
+	in, err := portableOS.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer in.Close()
+	data, err := io.ReadAll(in)
+	return data, errors.WithStack(err)
+}
+
+// backupReadError returns the error to report for err, returned while reading
+// the plaintext of an archive. An archive that ends part way through a file is
+// corrupt.
+func backupReadError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(errBackup,
+			errBackupTruncated)})
+	}
+	return err
+}
+
+// deriveBackupKey returns the key that encrypts the frames of an archive with
+// the given salt.
+func deriveBackupKey(key, salt []byte) []byte {
+	return backupMAC(key, "ekv:backup-key:", salt)
+}
+
+// backupKeyCheck returns the value stored in the header of an archive with the
+// given salt to check the password of the store restoring it.
+func backupKeyCheck(key, salt []byte) []byte {
+	return backupMAC(key, "ekv:backup-check:", salt)
+}
+
+// backupMAC returns the keyed hash of the label followed by the salt.
+func backupMAC(key []byte, label string, salt []byte) []byte {
+	h, err := blake2b.New256(key)
+	if err != nil {
+		jww.FATAL.Panicf("Failed to initialize keyed hash: %+v", err)
+	}
+	h.Write([]byte(label))
+	h.Write(salt)
+	return h.Sum(nil)
+}
+
+// backupNonce returns the nonce of frame n, marked if it is the final frame.
+func backupNonce(aead cipher.AEAD, n uint64, final bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], n)
+	if final {
+		nonce[0] = 1
+	}
+	return nonce
+}
+
+// backupWriter encrypts what is written to it into the frames of an archive.
+// Close must be called to write the final frame.
+type backupWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	buf    []byte
+	n      uint64
+}
+
+// Write buffers p, writing every frame that fills up. A full frame is only
+// written once more data follows, so that the final frame is never empty
+// unless the archive is.
+func (bw *backupWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		if len(bw.buf) == backupFrameSize {
+			if err := bw.seal(false); err != nil {
+				return written - len(p), err
+			}
+		}
+		n := min(len(p), backupFrameSize-len(bw.buf))
+		bw.buf = append(bw.buf, p[:n]...)
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close writes the final frame.
+func (bw *backupWriter) Close() error {
+	return bw.seal(true)
+}
+
+// seal encrypts the buffered data and writes it as the next frame.
+func (bw *backupWriter) seal(final bool) error {
+	frame := make([]byte, 4, 4+len(bw.buf)+bw.aead.Overhead())
+	frame = bw.aead.Seal(frame, backupNonce(bw.aead, bw.n, final), bw.buf,
+		bw.header)
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+	if _, err := bw.w.Write(frame); err != nil {
+		return errors.WithStack(err)
+	}
+	bw.buf = bw.buf[:0]
+	bw.n++
+	return nil
+}
+
+// backupReader reads and authenticates the frames of an archive and returns
+// their plaintext. It returns io.EOF only after the final frame, and
+// ErrCorrupt if the archive ends before it or continues after it.
+type backupReader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	header []byte
+	buf    []byte
+	n      uint64
+	final  bool
+}
+
+// Read reads the plaintext of the archive into p.
+func (br *backupReader) Read(p []byte) (int, error) {
+	for len(br.buf) == 0 {
+		if br.final {
+			return 0, io.EOF
+		}
+		if err := br.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, br.buf)
+	br.buf = br.buf[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next frame.
+func (br *backupReader) open() error {
+	var size [4]byte
+	if _, err := io.ReadFull(br.r, size[:]); err != nil {
+		return backupReadError(err)
+	}
+	frameSize := binary.BigEndian.Uint32(size[:])
+	if frameSize < uint32(br.aead.Overhead()) ||
+		frameSize > uint32(backupFrameSize+br.aead.Overhead()) {
+		return errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(errBackup,
+			fmt.Sprintf("invalid frame size %d", frameSize))})
+	}
+	frame := make([]byte, frameSize)
+	if _, err := io.ReadFull(br.r, frame); err != nil {
+		return backupReadError(err)
+	}
+
+	// The final frame is the one that authenticates as final
+	for _, final := range []bool{false, true} {
+		plaintext, err := br.aead.Open(nil,
+			backupNonce(br.aead, br.n, final), frame, br.header)
+		if err != nil {
+			continue
+		}
+		br.buf, br.final = plaintext, final
+		br.n++
+		if final {
+			var extra [1]byte
+			if n, _ := io.ReadFull(br.r, extra[:]); n > 0 {
+				return errors.WithStack(&ErrCorrupt{
+					Reason: fmt.Sprintf(errBackup, "data after the end")})
+			}
+		}
+		return nil
+	}
+	return errors.Wrapf(ErrTampered, "Frame %d of the backup", br.n)
+}
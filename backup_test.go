@@ -0,0 +1,167 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portableOS"
+)
+
+// Tests that a Filestore backed up to an archive is restored, as a whole, to
+// a store with the same password in another directory.
+func TestFilestore_BackupRestore(t *testing.T) {
+	srcDir, dstDir := ".ekv_testdir_backup_src", ".ekv_testdir_backup_dst"
+	defer func() {
+		for _, dir := range []string{srcDir, dstDir} {
+			if err := portableOS.RemoveAll(dir); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	src, err := NewFilestore(srcDir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	values := map[string][]byte{
+		"large": bytes.Repeat([]byte("0123456789"), backupFrameSize/4),
+	}
+	for i := 0; i < 20; i++ {
+		values["key"+strconv.Itoa(i)] = []byte("value " + strconv.Itoa(i))
+	}
+	for key, value := range values {
+		if err = src.SetBytes(key, value); err != nil {
+			t.Fatalf("SetBytes failed: %+v", err)
+		}
+	}
+	if err = src.Snapshot("kept"); err != nil {
+		t.Fatalf("Snapshot failed: %+v", err)
+	}
+
+	var archive bytes.Buffer
+	if _, err = src.Backup(&archive); err != nil {
+		t.Fatalf("Backup failed: %+v", err)
+	}
+	if names, err := src.ListSnapshots(); err != nil || len(names) != 1 {
+		t.Errorf("Backup left snapshots behind: %v, %+v", names, err)
+	}
+
+	dst, err := NewFilestore(dstDir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = dst.SetBytes("replaced", []byte("value")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	if err = dst.Restore(bytes.NewReader(archive.Bytes())); err != nil {
+		t.Fatalf("Restore failed: %+v", err)
+	}
+	for key, expected := range values {
+		if value, err := dst.GetBytes(key); err != nil ||
+			!bytes.Equal(value, expected) {
+			t.Errorf("Unexpected value of %s after restore: %+v", key, err)
+		}
+	}
+	if _, err = dst.GetBytes("replaced"); Exists(err) {
+		t.Errorf("Key not in the backup survived the restore: %+v", err)
+	}
+	if names, err := dst.ListSnapshots(); err != nil || len(names) != 0 {
+		t.Errorf("Snapshots were restored: %v, %+v", names, err)
+	}
+
+	// A store with another password refuses the archive
+	other, err := NewFilestore(dstDir+"_other", "Goodbye, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer portableOS.RemoveAll(dstDir + "_other")
+	err = other.Restore(bytes.NewReader(archive.Bytes()))
+	if !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("Expected ErrWrongPassword, got %+v", err)
+	}
+}
+
+// Tests that truncated, tampered and extended archives are refused and leave
+// the store as it was.
+func TestFilestore_RestoreInvalid(t *testing.T) {
+	dir := ".ekv_testdir_restore_invalid"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	large := bytes.Repeat([]byte("x"), 3*backupFrameSize)
+	if err = f.SetBytes("large", large); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	var buf bytes.Buffer
+	if _, err = f.Backup(&buf); err != nil {
+		t.Fatalf("Backup failed: %+v", err)
+	}
+	archive := buf.Bytes()
+	if err = f.SetBytes("large", []byte("current")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+
+	// The size of the final frame is right after the full frames
+	frameSize := 4 + backupFrameSize + 16
+	final := backupHeaderSize + (len(archive)-backupHeaderSize)/frameSize*
+		frameSize
+	tampered := append([]byte{}, archive...)
+	tampered[backupHeaderSize+100] ^= 1
+	header := append([]byte{}, archive...)
+	header[10] ^= 1
+	frames := archive[backupHeaderSize:]
+	reordered := append([]byte{}, archive[:backupHeaderSize]...)
+	reordered = append(reordered, frames[frameSize:2*frameSize]...)
+	reordered = append(reordered, frames[:frameSize]...)
+	reordered = append(reordered, frames[2*frameSize:]...)
+
+	for name, data := range map[string][]byte{
+		"empty":             nil,
+		"truncated header":  archive[:backupHeaderSize-1],
+		"no frames":         archive[:backupHeaderSize],
+		"truncated frame":   archive[:backupHeaderSize+100],
+		"no final frame":    archive[:final],
+		"truncated final":   archive[:len(archive)-1],
+		"trailing data":     append(append([]byte{}, archive...), 0),
+		"tampered frame":    tampered,
+		"tampered header":   header,
+		"reordered frames":  reordered,
+		"not a backup file": bytes.Repeat([]byte("a"), len(archive)),
+	} {
+		err = f.Restore(bytes.NewReader(data))
+		var corrupt *ErrCorrupt
+		if !errors.As(err, &corrupt) && !errors.Is(err, ErrTampered) &&
+			!errors.Is(err, ErrWrongPassword) {
+			t.Errorf("Unexpected error restoring %s: %+v", name, err)
+		}
+		if value, err := f.GetBytes("large"); err != nil ||
+			string(value) != "current" {
+			t.Errorf("Store changed restoring %s: %+v", name, err)
+		}
+	}
+	if names, err := f.ListSnapshots(); err != nil || len(names) != 0 {
+		t.Errorf("Failed restores left snapshots behind: %v, %+v", names, err)
+	}
+
+	if err = f.Restore(bytes.NewReader(archive)); err != nil {
+		t.Fatalf("Restore failed: %+v", err)
+	}
+	if value, err := f.GetBytes("large"); err != nil ||
+		!bytes.Equal(value, large) {
+		t.Errorf("Unexpected value after restore: %+v", err)
+	}
+}
@@ -0,0 +1,144 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// Bucket gives typed access to the values of a KeyValue that share a key
+// prefix, encoding and decoding them with the codec of the store. Any
+// KeyValue works, including Memstore and Filestore.
+//
+//	users := ekv.NewBucket[User](kv, "users/")
+//	err := users.Set("alice", User{Name: "Alice"})
+//	alice, err := users.Get("alice")
+//
+// The prefix only namespaces the keys; the values are still accessible on the
+// underlying KeyValue under the prefixed key.
+type Bucket[T any] struct {
+	kv     KeyValue
+	prefix string
+}
+
+// NewBucket returns a Bucket of values of type T stored in kv under keys
+// starting with prefix. The prefix may be empty.
+func NewBucket[T any](kv KeyValue, prefix string) *Bucket[T] {
+	return &Bucket[T]{kv: kv, prefix: prefix}
+}
+
+// Get returns the value of key. Returns an error for which Exists is false if
+// it does not exist.
+func (b *Bucket[T]) Get(key string) (T, error) {
+	value, target := newDecodeTarget[T]()
+	err := b.kv.GetInterface(b.prefix+key, target)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return *value, nil
+}
+
+// Set stores value under key.
+func (b *Bucket[T]) Set(key string, value T) error {
+	return b.kv.SetInterface(b.prefix+key, value)
+}
+
+// Delete destroys key.
+func (b *Bucket[T]) Delete(key string) error {
+	return b.kv.Delete(b.prefix + key)
+}
+
+// Update atomically modifies the value of key with update. If the key does
+// not exist, update receives the zero value of T. The value is only written if
+// update returns nil.
+func (b *Bucket[T]) Update(key string, update func(value *T) error) error {
+	return b.Transaction(func(values map[string]*TypedOperable[T]) error {
+		value, err := values[key].Get()
+		if err != nil && Exists(err) {
+			return err
+		}
+		if err = update(&value); err != nil {
+			return err
+		}
+		return values[key].Set(value)
+	}, key)
+}
+
+// Transaction runs op on the values of keys per [KeyValue.Transaction]. The
+// map passed to op is keyed by the keys without the bucket prefix.
+func (b *Bucket[T]) Transaction(
+	op func(values map[string]*TypedOperable[T]) error, keys ...string) error {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = b.prefix + key
+	}
+
+	return b.kv.Transaction(func(
+		files map[string]Operable, _ Extender) error {
+		values := make(map[string]*TypedOperable[T], len(keys))
+		for i, key := range keys {
+			values[key] = &TypedOperable[T]{op: files[prefixed[i]]}
+		}
+		return op(values)
+	}, prefixed...)
+}
+
+// TypedOperable is an Operable whose value is of type T. It is only valid
+// during the transaction that created it.
+type TypedOperable[T any] struct {
+	op Operable
+}
+
+// Key returns the key the operable operates on, including the bucket prefix.
+func (o *TypedOperable[T]) Key() string {
+	return o.op.Key()
+}
+
+// Exists returns whether the value exists.
+func (o *TypedOperable[T]) Exists() bool {
+	return o.op.Exists()
+}
+
+// Get returns the value. Returns an error for which Exists is false if it does
+// not exist.
+func (o *TypedOperable[T]) Get() (T, error) {
+	value, target := newDecodeTarget[T]()
+	if err := o.op.GetInterface(target); err != nil {
+		var zero T
+		return zero, err
+	}
+	return *value, nil
+}
+
+// Set sets the value.
+func (o *TypedOperable[T]) Set(value T) error {
+	return errors.WithStack(o.op.SetInterface(value))
+}
+
+// Delete deletes the value.
+func (o *TypedOperable[T]) Delete() {
+	o.op.Delete()
+}
+
+// newDecodeTarget returns a new T and the object a codec should decode into
+// to fill it. If T is a pointer, it points to a newly allocated value and is
+// itself the target, so that codecs that require a specific type, such as
+// protobuf, receive it. Otherwise the target is a pointer to the T.
+func newDecodeTarget[T any]() (*T, interface{}) {
+	value := new(T)
+	t := reflect.TypeOf(value).Elem()
+	if t.Kind() != reflect.Pointer {
+		return value, value
+	}
+	elem := reflect.New(t.Elem())
+	reflect.ValueOf(value).Elem().Set(elem)
+	return value, elem.Interface()
+}
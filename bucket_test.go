@@ -0,0 +1,158 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portableOS"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// bucketUser is a value stored in the test buckets.
+type bucketUser struct {
+	Name   string
+	Visits int
+}
+
+// testBucket exercises a Bucket over kv.
+func testBucket(t *testing.T, kv KeyValue) {
+	users := NewBucket[bucketUser](kv, "users/")
+
+	if _, err := users.Get("alice"); Exists(err) {
+		t.Errorf("Get of a missing key did not return not found: %+v", err)
+	}
+	if err := users.Set("alice", bucketUser{Name: "Alice"}); err != nil {
+		t.Fatalf("Set failed: %+v", err)
+	}
+	alice, err := users.Get("alice")
+	if err != nil {
+		t.Fatalf("Get failed: %+v", err)
+	}
+	if alice.Name != "Alice" {
+		t.Errorf("Unexpected value: %+v", alice)
+	}
+
+	// The prefix namespaces the key on the underlying store
+	if _, err = kv.GetBytes("alice"); Exists(err) {
+		t.Errorf("Bucket key was stored without its prefix")
+	}
+	if _, err = kv.GetBytes("users/alice"); err != nil {
+		t.Errorf("Bucket key was not stored with its prefix: %+v", err)
+	}
+
+	// Concurrent updates, including of a key that does not exist yet
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, key := range []string{"alice", "bob"} {
+				err := users.Update(key, func(u *bucketUser) error {
+					u.Visits++
+					return nil
+				})
+				if err != nil {
+					t.Errorf("Update failed: %+v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for _, key := range []string{"alice", "bob"} {
+		u, err := users.Get(key)
+		if err != nil {
+			t.Fatalf("Get failed: %+v", err)
+		}
+		if u.Visits != 10 {
+			t.Errorf("%s has %d visits, expected 10", key, u.Visits)
+		}
+	}
+
+	// A failed update is not written
+	errStop := errors.New("stop")
+	err = users.Update("alice", func(u *bucketUser) error {
+		u.Name = "Mallory"
+		return errStop
+	})
+	if !errors.Is(err, errStop) {
+		t.Errorf("Update did not return the error: %+v", err)
+	}
+	if alice, _ = users.Get("alice"); alice.Name != "Alice" {
+		t.Errorf("Failed update was written: %+v", alice)
+	}
+
+	// Typed transactions
+	err = users.Transaction(func(values map[string]*TypedOperable[bucketUser]) error {
+		a, err := values["alice"].Get()
+		if err != nil {
+			return err
+		}
+		b, err := values["bob"].Get()
+		if err != nil {
+			return err
+		}
+		a.Visits, b.Visits = b.Visits+1, a.Visits-1
+		if err = values["alice"].Set(a); err != nil {
+			return err
+		}
+		if values["carol"].Exists() {
+			t.Errorf("Missing key exists")
+		}
+		values["bob"].Delete()
+		return values["carol"].Set(b)
+	}, "alice", "bob", "carol")
+	if err != nil {
+		t.Fatalf("Transaction failed: %+v", err)
+	}
+	if u, _ := users.Get("alice"); u.Visits != 11 {
+		t.Errorf("Unexpected alice after transaction: %+v", u)
+	}
+	if u, _ := users.Get("carol"); u.Visits != 9 {
+		t.Errorf("Unexpected carol after transaction: %+v", u)
+	}
+	if _, err = users.Get("bob"); Exists(err) {
+		t.Errorf("Bob exists after transaction: %+v", err)
+	}
+
+	// Pointer types are allocated, so codecs needing a concrete type work
+	messages := NewBucket[*wrapperspb.StringValue](kv, "messages/")
+	if err = messages.Set("m", wrapperspb.String("hi")); err != nil {
+		t.Fatalf("Set failed: %+v", err)
+	}
+	m, err := messages.Get("m")
+	if err != nil || m.GetValue() != "hi" {
+		t.Errorf("Pointer value did not round trip: %v, %+v", m, err)
+	}
+}
+
+// Tests Bucket over a Memstore.
+func TestBucket_Memstore(t *testing.T) {
+	testBucket(t, MakeMemstore())
+}
+
+// Tests Bucket over a Filestore with a non default codec.
+func TestBucket_Filestore(t *testing.T) {
+	dir := ".ekv_testdir_bucket"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.SetCodec(CBORCodec); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	testBucket(t, f)
+}
@@ -0,0 +1,290 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// chain.go splits values too large to comfortably hold in a single file across
+// several chunk files. Each chunk is stored with the same two-file scheme as
+// any other record, at the path of the value followed by "-1", "-2" and so on.
+// The files of the value itself hold a chain record describing the size of the
+// value and the checksum of every chunk.
+//
+// The chunks are written before the chain record, which is the commit point.
+// A chunk is always written over the file that does not hold the chunk the
+// committed chain refers to, so a crash before the chain record is written
+// leaves the previous value readable. Chunks are only deleted once neither
+// file of the value refers to them, as the older file is read if the newer
+// one is lost.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portableOS"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// blobChunkSize is the largest value stored in a single file. Larger
+	// values are split into chunks of this size.
+	blobChunkSize = 8 * 1024 * 1024
+
+	chainVersion    = 1
+	chainHeaderSize = 1 + 4 + 8
+
+	errChainDescriptor = "invalid chain descriptor: %s"
+	errChainLink       = "no chunk file matches the chain checksum"
+	errChainSize       = "chained value is %d bytes, expected %d"
+)
+
+// chain describes a value split across chunk files.
+type chain struct {
+	chunkSize uint32
+	size      uint64
+	hashes    [][blake2b.Size256]byte
+}
+
+// marshal encodes the chain as
+// [version][4-byte chunk size][8-byte size][checksum of each chunk].
+func (c *chain) marshal() []byte {
+	buf := make([]byte, 0, chainHeaderSize+len(c.hashes)*blake2b.Size256)
+	buf = append(buf, chainVersion)
+	buf = binary.LittleEndian.AppendUint32(buf, c.chunkSize)
+	buf = binary.LittleEndian.AppendUint64(buf, c.size)
+	for i := range c.hashes {
+		buf = append(buf, c.hashes[i][:]...)
+	}
+	return buf
+}
+
+// unmarshalChain is the inverse of chain.marshal.
+func unmarshalChain(data []byte) (*chain, error) {
+	if len(data) < chainHeaderSize {
+		return nil, errors.Errorf(errChainDescriptor, "too short")
+	}
+	if data[0] != chainVersion {
+		return nil, errors.Errorf(errChainDescriptor,
+			fmt.Sprintf("unknown version %d", data[0]))
+	}
+
+	c := &chain{
+		chunkSize: binary.LittleEndian.Uint32(data[1:]),
+		size:      binary.LittleEndian.Uint64(data[5:]),
+	}
+	if c.chunkSize == 0 || c.size == 0 {
+		return nil, errors.Errorf(errChainDescriptor, "empty chunks")
+	}
+
+	numChunks := c.size / uint64(c.chunkSize)
+	if c.size%uint64(c.chunkSize) != 0 {
+		numChunks++
+	}
+	hashes := data[chainHeaderSize:]
+	if uint64(len(hashes))%blake2b.Size256 != 0 ||
+		uint64(len(hashes))/blake2b.Size256 != numChunks {
+		return nil, errors.Errorf(errChainDescriptor,
+			"checksum count does not match size")
+	}
+
+	c.hashes = make([][blake2b.Size256]byte, numChunks)
+	for i := range c.hashes {
+		copy(c.hashes[i][:], hashes[i*blake2b.Size256:])
+	}
+	return c, nil
+}
+
+// getChunkPath returns the path of the nth chunk of the value at path,
+// counting from 1.
+func getChunkPath(path string, n int) string {
+	return path + "-" + strconv.Itoa(n)
+}
+
+// writeChain splits data into chunks, writes them and then commits them by
+// writing the chain record to path. Chunks that neither file of path refers
+// to afterwards are deleted.
+func writeChain(path string, data []byte, csprng io.Reader) error {
+	// Find the chunks referenced by the committed chain, which must survive
+	// until the new one is committed
+	var committed [][blake2b.Size256]byte
+	if rec, err := readRecord(path); err == nil && rec.kind == recordKindChain {
+		if c, err := unmarshalChain(rec.data); err == nil {
+			committed = c.hashes
+		}
+	}
+
+	c := &chain{chunkSize: blobChunkSize, size: uint64(len(data))}
+	for n := 1; len(data) > 0; n++ {
+		chunk := data[:min(len(data), blobChunkSize)]
+		data = data[len(chunk):]
+
+		var keep *[blake2b.Size256]byte
+		if n <= len(committed) {
+			keep = &committed[n-1]
+		}
+		err := writeRecord(getChunkPath(path, n), recordKindInline, chunk, keep)
+		if err != nil {
+			return err
+		}
+		c.hashes = append(c.hashes, blake2b.Sum256(chunk))
+	}
+
+	err := writeRecord(path, recordKindChain, c.marshal(), nil)
+	if err != nil {
+		return err
+	}
+
+	return deleteChunks(path, csprng)
+}
+
+// readChain returns the value described by the chain record data of the
+// value at path.
+func readChain(path string, data []byte) ([]byte, error) {
+	c, err := unmarshalChain(data)
+	if err != nil {
+		return nil, errors.WithStack(&ErrCorrupt{Path: path,
+			Reason: err.Error()})
+	}
+
+	value := make([]byte, 0, c.size)
+	for i := range c.hashes {
+		chunk, err := readChunk(getChunkPath(path, i+1), c.hashes[i])
+		if err != nil {
+			return nil, err
+		}
+		value = append(value, chunk...)
+	}
+
+	if uint64(len(value)) != c.size {
+		return nil, errors.WithStack(&ErrCorrupt{Path: path,
+			Reason: fmt.Sprintf(errChainSize, len(value), c.size)})
+	}
+	return value, nil
+}
+
+// readChunk returns the data of whichever of the two files of the chunk at
+// path matches the checksum in the chain. It may not be the newest, as a
+// newer chunk may have been written for a chain that was never committed.
+func readChunk(path string, hash [blake2b.Size256]byte) ([]byte, error) {
+	path1, path2 := getPaths(path)
+	for _, p := range []string{path1, path2} {
+		f, err := portableOS.Open(p)
+		if err != nil {
+			continue
+		}
+		rec, err := readContents(f)
+		f.Close()
+		if err != nil || rec.kind != recordKindInline {
+			continue
+		}
+		if blake2b.Sum256(rec.data) == hash {
+			return rec.data, nil
+		}
+	}
+
+	return nil, errors.WithStack(&ErrCorrupt{Path: path,
+		Reason: errChainLink})
+}
+
+// referencedChunks returns the checksums of the chunks that the chain records
+// in either file of path refer to, indexed by chunk number less one. The older
+// file holds the previous value, which is read if the newer one is lost, so
+// its chunks are as much in use as those of the newer one.
+func referencedChunks(path string) []map[[blake2b.Size256]byte]struct{} {
+	var refs []map[[blake2b.Size256]byte]struct{}
+	path1, path2 := getPaths(path)
+	for _, p := range []string{path1, path2} {
+		f, err := portableOS.Open(p)
+		if err != nil {
+			continue
+		}
+		rec, err := readContents(f)
+		f.Close()
+		if err != nil || rec.kind != recordKindChain {
+			continue
+		}
+		c, err := unmarshalChain(rec.data)
+		if err != nil {
+			continue
+		}
+		for i := range c.hashes {
+			if i == len(refs) {
+				refs = append(refs, make(map[[blake2b.Size256]byte]struct{}))
+			}
+			refs[i][c.hashes[i]] = struct{}{}
+		}
+	}
+	return refs
+}
+
+// deleteChunks deletes every chunk file of the value at path that neither
+// file of path refers to, stopping at the first unreferenced chunk with
+// neither file present.
+func deleteChunks(path string, csprng io.Reader) error {
+	path1, path2 := getPaths(getChunkPath(path, 1))
+	_, err1 := portableOS.Stat(path1)
+	_, err2 := portableOS.Stat(path2)
+	if !Exists(err1) && !Exists(err2) {
+		// Values that were never chained do not need their records read
+		return nil
+	}
+
+	refs := referencedChunks(path)
+	deleted := false
+	for n := 1; ; n++ {
+		path1, path2 = getPaths(getChunkPath(path, n))
+		_, err1 = portableOS.Stat(path1)
+		_, err2 = portableOS.Stat(path2)
+		if n > len(refs) && !Exists(err1) && !Exists(err2) {
+			break
+		}
+
+		for _, p := range []string{path1, path2} {
+			if n <= len(refs) && chunkReferenced(p, refs[n-1]) {
+				continue
+			}
+			if _, err := portableOS.Stat(p); !Exists(err) {
+				continue
+			}
+			if err := deleteFile(p, csprng); err != nil {
+				return err
+			}
+			deleted = true
+		}
+	}
+	if !deleted {
+		return nil
+	}
+
+	// Open directory and flush it
+	d, err := portableOS.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	d.Sync()
+	return d.Close()
+}
+
+// chunkReferenced returns true if the chunk file at p holds a chunk with one
+// of the given checksums.
+func chunkReferenced(p string,
+	hashes map[[blake2b.Size256]byte]struct{}) bool {
+	f, err := portableOS.Open(p)
+	if err != nil {
+		return false
+	}
+	rec, err := readContents(f)
+	f.Close()
+	if err != nil || rec.kind != recordKindInline {
+		return false
+	}
+	_, ok := hashes[blake2b.Sum256(rec.data)]
+	return ok
+}
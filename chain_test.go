@@ -0,0 +1,241 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portableOS"
+	"golang.org/x/crypto/blake2b"
+)
+
+// countChunks returns the number of chunks with files present for the value
+// at path.
+func countChunks(path string) int {
+	n := 0
+	for ; ; n++ {
+		path1, path2 := getPaths(getChunkPath(path, n+1))
+		_, err1 := os.Stat(path1)
+		_, err2 := os.Stat(path2)
+		if err1 != nil && err2 != nil {
+			return n
+		}
+	}
+}
+
+// Tests that values larger than 16 MiB survive a round trip and that chunks
+// are removed once no file refers to them or the value is deleted.
+func TestFilestore_LargeValue(t *testing.T) {
+	dir := ".ekv_testdir_large"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	path := f.getKey("key")
+
+	for _, test := range []struct {
+		size, chunks int
+	}{
+		{2*blobChunkSize + 1, 3},
+		{16*1024*1024 + 1, 3},
+		// The chunks of the previous value are kept for the older file
+		{blobChunkSize + 1, 3},
+		{100, 2},
+		{100, 0},
+	} {
+		data := make([]byte, test.size)
+		if _, err = rand.Read(data); err != nil {
+			t.Fatal(err)
+		}
+		if err = f.SetBytes("key", data); err != nil {
+			t.Fatalf("SetBytes of %d bytes failed: %+v", test.size, err)
+		}
+		got, err := f.GetBytes("key")
+		if err != nil {
+			t.Fatalf("GetBytes of %d bytes failed: %+v", test.size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("Value of %d bytes did not read back", test.size)
+		}
+		if n := countChunks(path); n != test.chunks {
+			t.Errorf("Value of %d bytes has %d chunks, expected %d",
+				test.size, n, test.chunks)
+		}
+	}
+
+	if err = f.SetBytes("key", make([]byte, blobChunkSize+1)); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	if err = f.Delete("key"); err != nil {
+		t.Fatalf("Delete failed: %+v", err)
+	}
+	if n := countChunks(path); n != 0 {
+		t.Errorf("%d chunks remain after delete", n)
+	}
+}
+
+// Tests that chunks written for a chain that is never committed do not
+// affect the committed value, and that a missing chunk is reported as
+// corruption.
+func TestChain_Uncommitted(t *testing.T) {
+	dir := ".ekv_testdir_chain"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	path := dir + "/chain"
+
+	data := bytes.Repeat([]byte{1}, blobChunkSize+10)
+	if err := write(path, data, rand.Reader); err != nil {
+		t.Fatalf("Write failed: %+v", err)
+	}
+
+	// Simulate crashing twice while writeChain was replacing the first chunk
+	committed := blake2b.Sum256(data[:blobChunkSize])
+	for i := 0; i < 2; i++ {
+		err := writeRecord(getChunkPath(path, 1), recordKindInline,
+			[]byte{2}, &committed)
+		if err != nil {
+			t.Fatalf("writeRecord failed: %+v", err)
+		}
+	}
+	got, err := read(path)
+	if err != nil {
+		t.Fatalf("Read failed: %+v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Uncommitted chunk replaced the committed value")
+	}
+
+	// Writing with the chain intact preserves the referenced chunk
+	if err = write(path, append(data, 3), rand.Reader); err != nil {
+		t.Fatalf("Write failed: %+v", err)
+	}
+	if got, err = read(path); err != nil || !bytes.Equal(got, append(data, 3)) {
+		t.Errorf("Failed to read rewritten value: %+v", err)
+	}
+
+	if err = deleteFiles(getChunkPath(path, 2), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	_, err = read(path)
+	var corrupt *ErrCorrupt
+	if !errors.As(err, &corrupt) {
+		t.Errorf("Expected ErrCorrupt for a missing chunk, got %+v", err)
+	}
+}
+
+// Tests that the chunks of a chained value are kept while the older file still
+// holds it, so that it can be read if the newer value is lost, and deleted
+// once neither file refers to them.
+func TestChain_Fallback(t *testing.T) {
+	dir := ".ekv_testdir_chain_fallback"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	path := dir + "/chain"
+
+	data := bytes.Repeat([]byte{1}, 2*blobChunkSize+10)
+	for _, value := range [][]byte{data, []byte("inline")} {
+		if err := write(path, value, rand.Reader); err != nil {
+			t.Fatalf("Write failed: %+v", err)
+		}
+	}
+	if n := countChunks(path); n != 3 {
+		t.Errorf("%d chunks remain while the older file refers to 3", n)
+	}
+
+	// Lose the newer value
+	newest, older, err := getFileOrder(getPaths(path))
+	if err != nil {
+		t.Fatalf("getFileOrder failed: %+v", err)
+	}
+	newestPath := newest.Name()
+	newest.Close()
+	older.Close()
+	contents, err := os.ReadFile(newestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents[len(contents)-1] ^= 0xFF
+	if err = os.WriteFile(newestPath, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := read(path)
+	if err != nil {
+		t.Fatalf("Read failed: %+v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Failed to fall back to the chained value")
+	}
+
+	// A shorter chain keeps the chunks of the longer one the older file holds
+	short := bytes.Repeat([]byte{2}, blobChunkSize+10)
+	if err = write(path, short, rand.Reader); err != nil {
+		t.Fatalf("Write failed: %+v", err)
+	}
+	if n := countChunks(path); n != 3 {
+		t.Errorf("%d chunks remain while the older file refers to 3", n)
+	}
+	if got, err = read(path); err != nil || !bytes.Equal(got, short) {
+		t.Errorf("Failed to read the shorter chain: %+v", err)
+	}
+
+	for _, value := range [][]byte{[]byte("inline"), []byte("again")} {
+		if err = write(path, value, rand.Reader); err != nil {
+			t.Fatalf("Write failed: %+v", err)
+		}
+	}
+	if n := countChunks(path); n != 0 {
+		t.Errorf("%d chunks remain after both files were overwritten", n)
+	}
+}
+
+// Tests that a chain descriptor survives a marshal and unmarshal round trip
+// and that inconsistent descriptors are rejected.
+func Test_unmarshalChain(t *testing.T) {
+	c := &chain{chunkSize: 10, size: 25}
+	c.hashes = make([][32]byte, 3)
+	c.hashes[2][0] = 7
+
+	decoded, err := unmarshalChain(c.marshal())
+	if err != nil {
+		t.Fatalf("Failed to unmarshal: %+v", err)
+	}
+	if decoded.chunkSize != c.chunkSize || decoded.size != c.size ||
+		len(decoded.hashes) != 3 || decoded.hashes[2] != c.hashes[2] {
+		t.Errorf("Chain mismatch: %+v != %+v", decoded, c)
+	}
+
+	c.size = 31
+	if _, err = unmarshalChain(c.marshal()); err == nil {
+		t.Errorf("Unmarshalled a chain with too few checksums")
+	}
+	if _, err = unmarshalChain([]byte{chainVersion, 1}); err == nil {
+		t.Errorf("Unmarshalled a truncated chain")
+	}
+}
@@ -0,0 +1,915 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// changes.go implements the change feed: a log of every change committed to
+// the values of a store, numbered in the order they were committed, that
+// consumers such as indexers and replicators read from the last change they
+// processed. The feed is off until enabled with EnableChanges. It records
+// which key changed and how, but not values, which consumers read from the
+// store, so deleting a key leaves nothing of its value in the feed.
+//
+// In a Filestore, the feed is kept in the record log of an internal key, see
+// append.go, so it is encrypted and survives restarts. It is enabled for as
+// long as that record log exists, so it stays on when the store is opened
+// again. Changes are numbered
+// consecutively, so the sequence number of any change follows from that of
+// the last one and the number of records before it. The log is truncated
+// by dropping whole segments from its start, never the last one, so that the
+// next sequence number can always be found again.
+//
+// Changes are recorded before they are committed, and only published once
+// they are, so a crash cannot lose a change that was committed. A change that
+// fails, or is cut short by a crash, is followed in the feed by the value its
+// key was left with. The store records that it is open, so that a crash is
+// found when it is next opened.
+//
+// Committed changes are published to watchers, see watch.go, whether or not
+// the feed is enabled. Only published changes hold values.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+const (
+	// changeLogKey is the key whose record log holds the change feed.
+	changeLogKey = "\x00ekv:changes"
+
+	// changeOpenKey is the key whose value marks a store as open, with the
+	// first change recorded since it was opened.
+	changeOpenKey = "\x00ekv:changes-open"
+
+	// DefaultChangeRetention is the number of changes the change feed keeps
+	// unless changed with SetChangeRetention.
+	DefaultChangeRetention = 10000
+
+	errChangeRecord = "invalid change record: %s"
+)
+
+// ChangeOp is the kind of a change.
+type ChangeOp byte
+
+const (
+	// ChangeSet is a value written by SetBytes, a transaction or any other
+	// write. Value holds the new value in events.
+	ChangeSet ChangeOp = iota + 1
+	// ChangeDelete is a deleted value, or an expired one that was purged.
+	ChangeDelete
+	// ChangeMerge is a merge operand recorded with Merge. Operator is the
+	// name of its merge operator and Value holds the operand in events.
+	ChangeMerge
+	// ChangeReset means that the values were replaced wholesale, by
+	// restoring a snapshot or a backup. The earlier changes were discarded
+	// and the store has to be read again.
+	ChangeReset
+)
+
+// String returns the name of the operation.
+func (op ChangeOp) String() string {
+	switch op {
+	case ChangeSet:
+		return "set"
+	case ChangeDelete:
+		return "delete"
+	case ChangeMerge:
+		return "merge"
+	case ChangeReset:
+		return "reset"
+	}
+	return fmt.Sprintf("ChangeOp(%d)", byte(op))
+}
+
+// Change is a change committed to a store.
+type Change struct {
+	// Seq is the sequence number of the change. The changes of a store are
+	// numbered from 1 without gaps, in the order they were committed. It is
+	// 0 for events of changes committed while the feed is not enabled.
+	Seq  uint64
+	Op   ChangeOp
+	Key  string
+	Time time.Time
+
+	// Value is only set in the events delivered to watchers. The feed does
+	// not record values, so readers of the feed get them with Get.
+	Value    []byte
+	Operator string
+}
+
+// marshal encodes the change, without its value, as
+// [uvarint seq][op][varint time][key][operator]
+// where strings are prefixed with their uvarint size.
+func (c *Change) marshal() []byte {
+	buf := binary.AppendUvarint(nil, c.Seq)
+	buf = append(buf, byte(c.Op))
+	buf = binary.AppendVarint(buf, c.Time.UnixNano())
+	buf = appendMetaString(buf, c.Key)
+	return appendMetaString(buf, c.Operator)
+}
+
+// unmarshalChange is the inverse of Change.marshal.
+func unmarshalChange(data []byte) (Change, error) {
+	d := metaDecoder{data: data}
+	c := Change{Seq: d.uvarint()}
+	if op := d.fixed(1); len(op) == 1 {
+		c.Op = ChangeOp(op[0])
+	}
+	c.Time = time.Unix(0, d.varint())
+	c.Key = d.string()
+	c.Operator = d.string()
+	if d.err == nil && len(d.data) != 0 {
+		d.err = errors.New("trailing data")
+	}
+	if d.err != nil {
+		return Change{}, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+			errChangeRecord, d.err.Error())})
+	}
+	return c, nil
+}
+
+// ChangeIterator iterates over the changes of a store, in order. Like
+// RecordIterator, Next advances to the next change and returns false once
+// there are none left or an error occurred, which Err then returns:
+//
+//	it, err := kv.Changes(lastSeq + 1)
+//	...
+//	defer it.Close()
+//	for it.Next() {
+//		change := it.Change()
+//	}
+//	err = it.Err()
+//
+// Changes committed while iterating are included. Unlike a RecordIterator,
+// an open ChangeIterator does not block writes.
+type ChangeIterator struct {
+	// load returns the next batch of changes, or nil once there are none.
+	load    func() ([]Change, error)
+	release func()
+
+	batch  []Change
+	change Change
+	err    error
+	done   bool
+}
+
+// Next advances the iterator to the next change, which is then available
+// through Change. It returns false when there are no more changes or an
+// error occurred.
+func (it *ChangeIterator) Next() bool {
+	if it.done {
+		return false
+	}
+	for len(it.batch) == 0 {
+		batch, err := it.load()
+		if err != nil || batch == nil {
+			it.err = err
+			it.change = Change{}
+			it.Close()
+			return false
+		}
+		it.batch = batch
+	}
+	it.change, it.batch = it.batch[0], it.batch[1:]
+	return true
+}
+
+// Change returns the current change. It is only valid after Next returned
+// true and its value must not be modified.
+func (it *ChangeIterator) Change() Change {
+	return it.change
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *ChangeIterator) Err() error {
+	return it.err
+}
+
+// Close releases the iterator. Closing it again does nothing.
+func (it *ChangeIterator) Close() error {
+	if it.done {
+		return nil
+	}
+	it.done = true
+	it.batch = nil
+	if it.release != nil {
+		it.release()
+	}
+	return nil
+}
+
+// changeFeed holds whether the change feed of a store is enabled, its
+// retention and, for a Filestore, the next sequence number once read. Its
+// lock serializes appending to the feed. It is taken while holding per-key
+// locks, so it must never be held while taking them.
+type changeFeed struct {
+	mux       sync.Mutex
+	retention uint64
+	// noRetention is set when retention was set to 0, so that a zero
+	// changeFeed keeps DefaultChangeRetention.
+	noRetention bool
+	enabled     bool
+	next        uint64
+	loaded      bool
+}
+
+// setRetention sets the number of changes kept, where 0 keeps every change.
+// The caller must hold the lock.
+func (c *changeFeed) setRetention(maxChanges uint64) {
+	c.retention, c.noRetention = maxChanges, maxChanges == 0
+}
+
+// keep returns the number of changes kept, or 0 if every change is. The
+// caller must hold the lock.
+func (c *changeFeed) keep() uint64 {
+	if c.retention == 0 && !c.noRetention {
+		return DefaultChangeRetention
+	}
+	return c.retention
+}
+
+// EnableChanges turns the change feed of the store on, from the next change.
+// The feed is off by default, so that writes do not pay for it. Once enabled,
+// it stays on, also when the store is opened again.
+func (f *Filestore) EnableChanges() error {
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	if f.readOnly {
+		return errors.WithStack(ErrReadOnly)
+	}
+
+	f.changes.mux.Lock()
+	defer f.changes.mux.Unlock()
+	appendKey := f.getAppendKey(changeLogKey)
+	next, err := f.nextChangeSeq(appendKey)
+	if err != nil || f.changes.enabled {
+		return err
+	}
+	// The store is marked open first, so that a crash once the feed exists
+	// is always found
+	if err = f.writeChangesOpen(next); err != nil {
+		return err
+	}
+	if err = f.writeAppendManifest(appendKey, &appendManifest{}); err != nil {
+		return err
+	}
+	f.changes.enabled = true
+	return nil
+}
+
+// SetChangeRetention sets how many of the latest changes the change feed
+// keeps at least. Older changes are discarded as new ones are committed. A
+// limit of 0 keeps every change. The feed keeps DefaultChangeRetention
+// changes by default.
+//
+// A Filestore discards changes in blocks, so it may keep more than the
+// limit. The limit is not persisted and applies from the next change.
+func (f *Filestore) SetChangeRetention(maxChanges uint64) {
+	f.changes.mux.Lock()
+	defer f.changes.mux.Unlock()
+	f.changes.setRetention(maxChanges)
+}
+
+// Changes returns an iterator over the changes committed to the store from
+// the change numbered fromSeq onwards, or from the oldest one kept if fromSeq
+// is 0. A consumer resumes from the sequence number after the last change it
+// processed.
+//
+// Returns an error for which errors.Is(err, ErrTruncated) is true if changes
+// from fromSeq were discarded, so that the consumer has to read the store
+// again. The iterator also fails with it if they are discarded while it is
+// open. Returns ErrChangesDisabled if the feed was never enabled.
+//
+// Every committed SetBytes, Delete, Merge and transaction is recorded, along
+// with the writes and deletions of Import, Sync, Revert and expiry. Records
+// appended with AppendBytes and streams are not.
+func (f *Filestore) Changes(fromSeq uint64) (*ChangeIterator, error) {
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return nil, err
+	}
+	f.changes.mux.Lock()
+	_, err = f.nextChangeSeq(f.getAppendKey(changeLogKey))
+	enabled := f.changes.enabled
+	f.changes.mux.Unlock()
+	if err == nil && !enabled {
+		err = errors.WithStack(ErrChangesDisabled)
+	}
+	if err != nil {
+		done()
+		return nil, err
+	}
+
+	next := fromSeq
+	load := func() ([]Change, error) {
+		f.changes.mux.Lock()
+		defer f.changes.mux.Unlock()
+		changes, err := f.readChanges(next)
+		if len(changes) > 0 {
+			next = changes[len(changes)-1].Seq + 1
+		}
+		return changes, err
+	}
+	// The first batch is loaded to report discarded changes right away
+	batch, err := load()
+	if err != nil {
+		done()
+		return nil, err
+	}
+	return &ChangeIterator{load: load, batch: batch, release: done}, nil
+}
+
+// TruncateChanges discards the changes numbered before seq, such as once
+// every consumer has processed them. A Filestore discards changes in blocks
+// and keeps the last block, so it may keep some of them.
+func (f *Filestore) TruncateChanges(seq uint64) error {
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	if f.readOnly {
+		return errors.WithStack(ErrReadOnly)
+	}
+
+	f.changes.mux.Lock()
+	defer f.changes.mux.Unlock()
+	return f.truncateChanges(seq)
+}
+
+// recordChanges numbers changes and appends them to the change feed, ahead of
+// committing them, and returns them numbered. Once they are committed, or
+// failed to be, the caller passes them to commitChanges. A crash in between
+// leaves them in the feed, to be checked against the values when the store
+// is next opened, see openChanges. If the feed is not enabled, the changes
+// are only timed, to be published. It does nothing on a read-only store. The
+// caller must be in flight and hold the locks of the changed keys, so that
+// the changes of a key are recorded in the order they are committed.
+func (f *Filestore) recordChanges(changes ...Change) ([]Change, error) {
+	if len(changes) == 0 || f.readOnly {
+		return nil, nil
+	}
+	f.changes.mux.Lock()
+	defer f.changes.mux.Unlock()
+
+	appendKey := f.getAppendKey(changeLogKey)
+	next, err := f.nextChangeSeq(appendKey)
+	if err != nil {
+		return nil, err
+	}
+	now := f.clock.Now()
+	if !f.changes.enabled {
+		for i := range changes {
+			changes[i].Time = now
+		}
+		return changes, nil
+	}
+	records := make([][]byte, len(changes))
+	for i := range changes {
+		changes[i].Seq, changes[i].Time = next+uint64(i), now
+		records[i] = changes[i].marshal()
+		jww.TRACE.Printf("%s,CHANGE,%d,%s,%s", kvDebugHeader,
+			changes[i].Seq, changes[i].Op, changes[i].Key)
+	}
+	err = f.appendRecords(changeLogKey, appendKey, records)
+	if err != nil {
+		return nil, err
+	}
+	f.changes.next = next + uint64(len(changes))
+
+	if keep := f.changes.keep(); keep > 0 && f.changes.next > keep {
+		return changes, f.truncateChanges(f.changes.next - keep)
+	}
+	return changes, nil
+}
+
+// commitChanges publishes the changes recorded by recordChanges once they are
+// committed, if err is nil. Otherwise, some of them may not have been, so the
+// values they left are recorded after them, see reconcileChanges. Returns
+// err. The caller must be in flight and hold the locks of the changed keys.
+func (f *Filestore) commitChanges(changes []Change, err error) error {
+	if err == nil {
+		f.publishChanges(changes)
+		return nil
+	}
+	if reconcileErr := f.reconcileChanges(changes); reconcileErr != nil {
+		jww.ERROR.Printf("Failed to record the values left by failed "+
+			"changes: %+v", reconcileErr)
+	}
+	return err
+}
+
+// publishChanges sends committed changes to the watchers of their keys.
+func (f *Filestore) publishChanges(changes []Change) {
+	if len(changes) == 0 {
+		return
+	}
+	f.changes.mux.Lock()
+	defer f.changes.mux.Unlock()
+	f.watchers.publish(changes)
+	f.observeExternal(changes...)
+}
+
+// reconcileChanges records, after changes that may not all have been
+// committed, the state each of their keys is in, unless it is the one the
+// last change of the key leaves. It is recorded as a ChangeSet of the stored
+// value, or a ChangeDelete if there is none, followed by a ChangeMerge for
+// every operand pending in the merge log of the key, so that watchers need no
+// merge operator. Keys whose value cannot be read are left out, and the error
+// is returned. The caller must be in flight and hold the locks of the keys.
+func (f *Filestore) reconcileChanges(changes []Change) error {
+	last := make(map[string]Change, len(changes))
+	keys := make([]string, 0, len(changes))
+	for _, c := range changes {
+		if c.Op == ChangeReset {
+			continue
+		}
+		if _, exists := last[c.Key]; !exists {
+			keys = append(keys, c.Key)
+		}
+		last[c.Key] = c
+	}
+
+	var corrections []Change
+	var stateErr error
+	for _, key := range keys {
+		state, err := f.keyState(key)
+		if err != nil {
+			// The other keys are still reconciled
+			stateErr = errors.WithMessagef(err, "key %q", key)
+			continue
+		}
+		if !last[key].leaves(state) {
+			corrections = append(corrections, state...)
+		}
+	}
+	corrections, err := f.recordChanges(corrections...)
+	if err != nil {
+		return err
+	}
+	f.publishChanges(corrections)
+	return stateErr
+}
+
+// keyState returns the changes that give key the value it has: a ChangeSet of
+// its stored value, or a ChangeDelete if it has none, followed by a
+// ChangeMerge for every operand pending in its merge log.
+func (f *Filestore) keyState(key string) ([]Change, error) {
+	operands, err := f.readMergeLog(key, f.getMergeLogKey(key))
+	if err != nil {
+		return nil, err
+	}
+	state := []Change{{Op: ChangeDelete, Key: key}}
+	encryptedContents, err := read(f.getKey(key))
+	if err != nil && Exists(err) {
+		return nil, err
+	} else if err == nil {
+		value, err := f.decryptValue(encryptedContents)
+		if err != nil {
+			return nil, err
+		}
+		if !value.meta.expired(f.clock.Now()) {
+			state[0] = Change{Op: ChangeSet, Key: key, Value: value.data}
+		}
+	}
+	for _, o := range operands {
+		state = append(state, Change{Op: ChangeMerge, Key: key,
+			Value: o.operand, Operator: o.name})
+	}
+	return state, nil
+}
+
+// leaves returns true if the change, as the last one of its key, leaves it in
+// the state given by keyState. Values are not compared, as the feed does not
+// record them: its readers get them from the store.
+func (c Change) leaves(state []Change) bool {
+	if c.Op == ChangeMerge {
+		return len(state) > 1 && state[len(state)-1].Operator == c.Operator
+	}
+	return len(state) == 1 && state[0].Op == c.Op
+}
+
+// openChanges reconciles the change feed with the values if the store was
+// not closed since it was last opened, as changes recorded since may not
+// have been committed. It then records that the store is open from the next
+// change on. It must be called before the store is in use.
+func (f *Filestore) openChanges() error {
+	encryptedKey := f.getKey(changeOpenKey)
+	encrypted, err := read(encryptedKey)
+	if err != nil && Exists(err) {
+		return err
+	} else if err == nil {
+		data, err := decrypt(encrypted, f.key)
+		if err != nil {
+			return err
+		}
+		from, n := binary.Uvarint(data)
+		if n <= 0 || n != len(data) {
+			return errors.WithStack(&ErrCorrupt{Path: encryptedKey,
+				Reason: fmt.Sprintf(errChangeRecord, "invalid open marker")})
+		}
+		jww.WARN.Printf("Store was not closed, reconciling the changes "+
+			"from %d", from)
+		if err = f.reconcileChangesFrom(from); err != nil {
+			return err
+		}
+	}
+	return f.markChangesOpen()
+}
+
+// reconcileChangesFrom reconciles the changes from seq on, or from the oldest
+// one kept if those were discarded. No other operation may be in flight.
+func (f *Filestore) reconcileChangesFrom(seq uint64) error {
+	var changes []Change
+	for {
+		f.changes.mux.Lock()
+		batch, err := f.readChanges(seq)
+		f.changes.mux.Unlock()
+		if errors.Is(err, ErrTruncated) {
+			seq = 0
+			continue
+		} else if err != nil {
+			return err
+		} else if len(batch) == 0 {
+			break
+		}
+		changes = append(changes, batch...)
+		seq = batch[len(batch)-1].Seq + 1
+	}
+	return f.reconcileChanges(changes)
+}
+
+// markChangesOpen records that the store is open from the next change on, if
+// its change feed is enabled. The caller must be in flight.
+func (f *Filestore) markChangesOpen() error {
+	f.changes.mux.Lock()
+	defer f.changes.mux.Unlock()
+	next, err := f.nextChangeSeq(f.getAppendKey(changeLogKey))
+	if err != nil || !f.changes.enabled {
+		return err
+	}
+	return f.writeChangesOpen(next)
+}
+
+// writeChangesOpen records that the store is open from the change numbered
+// next on. The caller must hold the lock of the feed.
+func (f *Filestore) writeChangesOpen(next uint64) error {
+	encrypted, err := encrypt(binary.AppendUvarint(nil, next), f.key,
+		f.csprng)
+	if err != nil {
+		return err
+	}
+	return write(f.getKey(changeOpenKey), encrypted, f.csprng)
+}
+
+// closeChanges records that the store was closed, so that its changes need
+// not be reconciled when it is next opened. No operation may be in flight.
+func (f *Filestore) closeChanges() error {
+	if f.readOnly || f.key == nil {
+		return nil
+	}
+	return deleteFiles(f.getKey(changeOpenKey), f.csprng)
+}
+
+// changedKeys returns the keys changed from the change numbered seq on and
+// the sequence number of the next change, or 0 if the feed is not enabled.
+// The keys are nil if they are unknown: seq is 0, the changes were discarded
+// or the feed was reset. The caller must be in flight.
+func (f *Filestore) changedKeys(seq uint64) (uint64, []string, error) {
+	f.changes.mux.Lock()
+	next, err := f.nextChangeSeq(f.getAppendKey(changeLogKey))
+	if !f.changes.enabled {
+		next = 0
+	}
+	f.changes.mux.Unlock()
+	if err != nil || seq == 0 || next == 0 {
+		return next, nil, err
+	}
+
+	// An empty list, unlike nil, means that no key changed
+	changed := make(map[string]struct{})
+	keys := make([]string, 0)
+	for seq < next {
+		f.changes.mux.Lock()
+		batch, err := f.readChanges(seq)
+		f.changes.mux.Unlock()
+		if errors.Is(err, ErrTruncated) {
+			return next, nil, nil
+		} else if err != nil {
+			return 0, nil, err
+		} else if len(batch) == 0 {
+			break
+		}
+		for _, c := range batch {
+			if c.Seq >= next {
+				break
+			} else if c.Op == ChangeReset {
+				return next, nil, nil
+			} else if _, exists := changed[c.Key]; !exists {
+				changed[c.Key] = struct{}{}
+				keys = append(keys, c.Key)
+			}
+		}
+		seq = batch[len(batch)-1].Seq + 1
+	}
+	return next, keys, nil
+}
+
+// readChanges returns the changes in the change feed from seq on, up to the
+// end of the segment holding seq, or nil if there are none. The caller must
+// hold the lock of the feed.
+func (f *Filestore) readChanges(seq uint64) ([]Change, error) {
+	appendKey := f.getAppendKey(changeLogKey)
+	next, err := f.nextChangeSeq(appendKey)
+	if err != nil || seq >= next {
+		return nil, err
+	}
+	m, err := f.readAppendManifest(appendKey)
+	if err != nil {
+		return nil, err
+	}
+
+	first := next
+	for _, s := range m.segments {
+		first -= s.records
+	}
+	if seq < first {
+		if seq == 0 {
+			seq = first
+		} else {
+			return nil, errors.Wrapf(ErrTruncated,
+				"changes from %d are gone, the oldest kept is %d", seq, first)
+		}
+	}
+
+	for _, s := range m.segments {
+		if seq >= first+s.records {
+			first += s.records
+			continue
+		}
+		records, err := f.readSegment(changeLogKey, s)
+		if err != nil {
+			return nil, err
+		}
+		changes := make([]Change, 0, uint64(len(records))-(seq-first))
+		for _, r := range records[seq-first:] {
+			c, err := unmarshalChange(r)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, c)
+		}
+		return changes, nil
+	}
+	return nil, nil
+}
+
+// truncateChanges discards the segments of the change feed that only hold
+// changes numbered before seq, except the last one. The caller must hold the
+// lock of the feed.
+func (f *Filestore) truncateChanges(seq uint64) error {
+	appendKey := f.getAppendKey(changeLogKey)
+	next, err := f.nextChangeSeq(appendKey)
+	if err != nil {
+		return err
+	}
+	m, err := f.readAppendManifest(appendKey)
+	if err != nil {
+		if !Exists(err) {
+			return nil
+		}
+		return err
+	}
+
+	first := next
+	for _, s := range m.segments {
+		first -= s.records
+	}
+	n := 0
+	for n < len(m.segments)-1 && first+m.segments[n].records <= seq {
+		first += m.segments[n].records
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	jww.TRACE.Printf("%s,TRUNCATE_CHANGES,%d", kvDebugHeader, first)
+	return f.dropSegments(changeLogKey, appendKey, m, n)
+}
+
+// nextChangeSeq returns the sequence number of the next change, reading it
+// from the last change in the feed the first time, along with whether the
+// feed is enabled. The caller must hold the lock of the feed.
+func (f *Filestore) nextChangeSeq(appendKey string) (uint64, error) {
+	if f.changes.loaded {
+		return f.changes.next, nil
+	}
+	next := uint64(1)
+	m, err := f.readAppendManifest(appendKey)
+	if err != nil && Exists(err) {
+		return 0, err
+	}
+	f.changes.enabled = err == nil
+	if err == nil && len(m.segments) > 0 {
+		records, err := f.readSegment(
+			changeLogKey, m.segments[len(m.segments)-1])
+		if err != nil {
+			return 0, err
+		}
+		if len(records) > 0 {
+			last, err := unmarshalChange(records[len(records)-1])
+			if err != nil {
+				return 0, err
+			}
+			next = last.Seq + 1
+		}
+	}
+	f.changes.next, f.changes.loaded = next, true
+	return next, nil
+}
+
+// resetChanges replaces the change feed restored with the files of the store
+// by a single ChangeReset, numbered after every change of the feed it
+// replaced, so that consumers neither miss the restore nor see sequence
+// numbers reused. next is the next sequence number before the restore. The
+// caller must have paused the store.
+func (f *Filestore) resetChanges(next uint64) error {
+	f.changes.mux.Lock()
+	defer f.changes.mux.Unlock()
+
+	appendKey := f.getAppendKey(changeLogKey)
+	f.changes.loaded = false
+	restored, err := f.nextChangeSeq(appendKey)
+	if err != nil {
+		return err
+	}
+	if restored == 1 && next == 1 {
+		// There were changes neither before nor after
+		return nil
+	}
+	if err = f.deleteRecords(changeLogKey, appendKey); err != nil {
+		return err
+	}
+	reset := Change{Seq: max(next, restored), Op: ChangeReset,
+		Time: f.clock.Now()}
+	jww.TRACE.Printf("%s,CHANGE,%d,%s", kvDebugHeader, reset.Seq, reset.Op)
+	err = f.appendRecords(changeLogKey, appendKey,
+		[][]byte{reset.marshal()})
+	if err != nil {
+		return err
+	}
+	f.changes.next = reset.Seq + 1
+	f.watchers.publish([]Change{reset})
+	return nil
+}
+
+// changeNext returns the sequence number of the next change. The caller must
+// have paused the store.
+func (f *Filestore) changeNext() (uint64, error) {
+	f.changes.mux.Lock()
+	defer f.changes.mux.Unlock()
+	return f.nextChangeSeq(f.getAppendKey(changeLogKey))
+}
+
+// memChangeFeed is the change feed of a Memstore, guarded by its lock.
+type memChangeFeed struct {
+	changeFeed
+	changes []Change
+}
+
+// EnableChanges turns the change feed of the Memstore on, from the next
+// change. The feed is off by default.
+func (m *Memstore) EnableChanges() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.changes.enabled = true
+	return nil
+}
+
+// SetChangeRetention sets how many of the latest changes the change feed
+// keeps. Older changes are discarded as new ones are committed. A limit of 0
+// keeps every change. The feed keeps DefaultChangeRetention changes by
+// default.
+func (m *Memstore) SetChangeRetention(maxChanges uint64) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.changes.setRetention(maxChanges)
+}
+
+// Changes returns an iterator over the changes committed to the Memstore from
+// the change numbered fromSeq onwards, or from the oldest one kept if fromSeq
+// is 0. Returns an error for which errors.Is(err, ErrTruncated) is true if
+// changes from fromSeq were discarded, and ErrChangesDisabled if the feed was
+// never enabled.
+func (m *Memstore) Changes(fromSeq uint64) (*ChangeIterator, error) {
+	done, err := m.lifecycle.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	m.mux.RLock()
+	enabled := m.changes.enabled
+	m.mux.RUnlock()
+	if !enabled {
+		return nil, errors.WithStack(ErrChangesDisabled)
+	}
+
+	next := fromSeq
+	load := func() ([]Change, error) {
+		m.mux.RLock()
+		defer m.mux.RUnlock()
+		if m.changes.changes == nil {
+			return nil, nil
+		}
+		first := m.changes.changes[0].Seq
+		if next < first {
+			if next != 0 {
+				return nil, errors.Wrapf(ErrTruncated, "changes from %d are "+
+					"gone, the oldest kept is %d", next, first)
+			}
+			next = first
+		}
+		if next-first >= uint64(len(m.changes.changes)) {
+			return nil, nil
+		}
+		// Changes are never modified once recorded, so the slice can be
+		// shared
+		batch := m.changes.changes[next-first:]
+		next = batch[len(batch)-1].Seq + 1
+		return batch, nil
+	}
+	batch, err := load()
+	if err != nil {
+		return nil, err
+	}
+	return &ChangeIterator{load: load, batch: batch}, nil
+}
+
+// TruncateChanges discards the changes numbered before seq, such as once
+// every consumer has processed them.
+func (m *Memstore) TruncateChanges(seq uint64) error {
+	done, err := m.lifecycle.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.truncateChanges(seq)
+	return nil
+}
+
+// recordChanges numbers changes and appends them, without their values, to
+// the change feed if it is enabled, and publishes them. The caller must hold
+// the write lock.
+func (m *Memstore) recordChanges(changes ...Change) {
+	if m.changes.next == 0 {
+		m.changes.next = 1
+	}
+	now := m.clock.Now()
+	published := make([]Change, len(changes))
+	for i, c := range changes {
+		c.Time = now
+		if m.changes.enabled {
+			c.Seq = m.changes.next
+			m.changes.next++
+			recorded := c
+			recorded.Value = nil
+			m.changes.changes = append(m.changes.changes, recorded)
+		}
+		c.Value = append([]byte(nil), c.Value...)
+		if len(c.Value) == 0 {
+			c.Value = nil
+		}
+		published[i] = c
+	}
+	m.watchers.publish(published)
+	if keep := m.changes.keep(); keep > 0 && m.changes.next > keep {
+		m.truncateChanges(m.changes.next - keep)
+	}
+}
+
+// truncateChanges discards the changes numbered before seq. The caller must
+// hold the write lock.
+func (m *Memstore) truncateChanges(seq uint64) {
+	n := 0
+	for n < len(m.changes.changes) && m.changes.changes[n].Seq < seq {
+		n++
+	}
+	// Iterators holding the old slice are unaffected, as appending never
+	// writes within it
+	m.changes.changes = m.changes.changes[n:]
+}
@@ -0,0 +1,317 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portableOS"
+)
+
+// changeStore is implemented by both stores.
+type changeStore interface {
+	KeyValue
+	RegisterMergeOperator(name string, op MergeOperator) error
+	Merge(key, name string, operand []byte) error
+	EnableChanges() error
+	Changes(fromSeq uint64) (*ChangeIterator, error)
+	TruncateChanges(seq uint64) error
+	SetChangeRetention(maxChanges uint64)
+}
+
+// readChanges returns every change from fromSeq on.
+func readChanges(t *testing.T, kv changeStore, fromSeq uint64) []Change {
+	t.Helper()
+	it, err := kv.Changes(fromSeq)
+	if err != nil {
+		t.Fatalf("Changes(%d) failed: %+v", fromSeq, err)
+	}
+	defer it.Close()
+	var changes []Change
+	for it.Next() {
+		changes = append(changes, it.Change())
+	}
+	if err = it.Err(); err != nil {
+		t.Fatalf("Iteration failed: %+v", err)
+	}
+	return changes
+}
+
+// testChanges tests that the feed is off until enabled, that every kind of
+// write is then recorded in order, without its value, and that reading can
+// resume from any change.
+func testChanges(t *testing.T, kv changeStore) {
+	err := kv.RegisterMergeOperator("counter", CounterMergeOperator)
+	if err != nil {
+		t.Fatalf("RegisterMergeOperator failed: %+v", err)
+	}
+	if err = kv.SetBytes("before", []byte("unrecorded")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	if _, err = kv.Changes(0); !errors.Is(err, ErrChangesDisabled) {
+		t.Errorf("Read the changes of a disabled feed: %+v", err)
+	}
+	if err = kv.EnableChanges(); err != nil {
+		t.Fatalf("EnableChanges failed: %+v", err)
+	}
+	if err = kv.SetBytes("a", counterOperand(1)); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	if err = kv.Merge("a", "counter", counterOperand(2)); err != nil {
+		t.Fatalf("Merge failed: %+v", err)
+	}
+	err = kv.Transaction(func(files map[string]Operable, _ Extender) error {
+		files["a"].Delete()
+		files["b"].Set([]byte("3"))
+		return nil
+	}, "a", "b")
+	if err != nil {
+		t.Fatalf("Transaction failed: %+v", err)
+	}
+	if err = kv.Delete("b"); err != nil {
+		t.Fatalf("Delete failed: %+v", err)
+	}
+
+	expected := []Change{
+		{Seq: 1, Op: ChangeSet, Key: "a"},
+		{Seq: 2, Op: ChangeMerge, Key: "a", Operator: "counter"},
+		{Seq: 3, Op: ChangeDelete, Key: "a"},
+		{Seq: 4, Op: ChangeSet, Key: "b"},
+		{Seq: 5, Op: ChangeDelete, Key: "b"},
+	}
+	changes := readChanges(t, kv, 0)
+	if len(changes) != len(expected) {
+		t.Fatalf("Read %d changes, expected %d: %+v", len(changes),
+			len(expected), changes)
+	}
+	// The changes of a transaction are recorded in no particular order
+	if changes[2].Key == "b" {
+		changes[2], changes[3] = changes[3], changes[2]
+		changes[2].Seq, changes[3].Seq = 3, 4
+	}
+	for i, c := range changes {
+		e := expected[i]
+		if c.Seq != e.Seq || c.Op != e.Op || c.Key != e.Key ||
+			c.Value != nil || c.Operator != e.Operator {
+			t.Errorf("Change %d is %+v, expected %+v", i, c, e)
+		}
+		if c.Time.IsZero() {
+			t.Errorf("Change %d has no time", i)
+		}
+	}
+
+	if resumed := readChanges(t, kv, 4); len(resumed) != 2 ||
+		resumed[0].Seq != 4 {
+		t.Errorf("Resumed at the wrong change: %+v", resumed)
+	}
+	if after := readChanges(t, kv, 6); len(after) != 0 {
+		t.Errorf("Read changes after the last one: %+v", after)
+	}
+}
+
+// Tests that the changes of a Memstore are recorded and discarded.
+func TestMemstore_Changes(t *testing.T) {
+	m := MakeMemstore()
+	testChanges(t, m)
+
+	m.SetChangeRetention(3)
+	if err := m.SetBytes("c", []byte("4")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	if changes := readChanges(t, m, 0); len(changes) != 3 ||
+		changes[0].Seq != 4 {
+		t.Errorf("Retention kept the wrong changes: %+v", changes)
+	}
+	if _, err := m.Changes(2); !errors.Is(err, ErrTruncated) {
+		t.Errorf("Reading discarded changes did not fail: %+v", err)
+	}
+	if err := m.TruncateChanges(6); err != nil {
+		t.Fatalf("TruncateChanges failed: %+v", err)
+	}
+	if changes := readChanges(t, m, 6); len(changes) != 1 {
+		t.Errorf("Truncated the wrong changes: %+v", changes)
+	}
+}
+
+// Tests that the changes of a Filestore are kept across restarts and that
+// discarding them keeps the sequence numbers.
+func TestFilestore_Changes(t *testing.T) {
+	dir := ".ekv_testdir_changes"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	testChanges(t, f)
+
+	f, err = NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	f.SetChangeRetention(0)
+	value := make([]byte, appendSegmentSize/4)
+	for i := 0; i < 8; i++ {
+		if err = f.SetBytes(strconv.Itoa(i), value); err != nil {
+			t.Fatalf("SetBytes failed: %+v", err)
+		}
+	}
+	changes := readChanges(t, f, 0)
+	if len(changes) != 13 || changes[12].Seq != 13 {
+		t.Fatalf("Read %d changes after reopening: %+v", len(changes),
+			changes)
+	}
+
+	// Changes go in whole segments, so some before 10 are kept
+	if err = f.TruncateChanges(10); err != nil {
+		t.Fatalf("TruncateChanges failed: %+v", err)
+	}
+	if _, err = f.Changes(1); !errors.Is(err, ErrTruncated) {
+		t.Errorf("Reading discarded changes did not fail: %+v", err)
+	}
+	changes = readChanges(t, f, 0)
+	if len(changes) == 0 || changes[0].Seq == 1 || changes[0].Seq > 10 ||
+		changes[len(changes)-1].Seq != 13 {
+		t.Errorf("Truncated the wrong changes: %d to %d", changes[0].Seq,
+			changes[len(changes)-1].Seq)
+	}
+	if err = f.SetBytes("next", nil); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	if changes = readChanges(t, f, 14); len(changes) != 1 {
+		t.Errorf("Sequence numbers changed after truncating: %+v", changes)
+	}
+}
+
+// Tests that changes cut short by a crash between recording them and writing
+// the value are followed in the feed by the values the keys were left with
+// once the store is reopened, and that those that were written are not.
+func TestFilestore_ChangesCrash(t *testing.T) {
+	dir := ".ekv_testdir_changes_crash"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.EnableChanges(); err != nil {
+		t.Fatalf("EnableChanges failed: %+v", err)
+	}
+	for _, key := range []string{"lost", "deleted", "written"} {
+		if err = f.SetBytes(key, []byte("first")); err != nil {
+			t.Fatalf("SetBytes failed: %+v", err)
+		}
+	}
+
+	// Crash after recording the changes, with one value written
+	_, err = f.recordChanges(
+		Change{Op: ChangeSet, Key: "lost", Value: []byte("second")},
+		Change{Op: ChangeDelete, Key: "deleted"},
+		Change{Op: ChangeMerge, Key: "merged", Value: counterOperand(1),
+			Operator: "counter"},
+		Change{Op: ChangeSet, Key: "written", Value: []byte("second")})
+	if err != nil {
+		t.Fatalf("recordChanges failed: %+v", err)
+	}
+	contents, err := f.encryptValue("written", []byte("second"),
+		newWriteOptions(nil))
+	if err != nil {
+		t.Fatalf("encryptValue failed: %+v", err)
+	}
+	err = f.writeValue("written", f.getKey("written"),
+		f.getMergeLogKey("written"), f.getHistoryKey("written"), contents,
+		nil)
+	if err != nil {
+		t.Fatalf("writeValue failed: %+v", err)
+	}
+
+	f, err = NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	// The lost value leaves the key with a value, as the change says, and
+	// readers of the feed read the value itself from the store
+	changes := readChanges(t, f, 8)
+	if len(changes) != 2 {
+		t.Fatalf("Expected 2 changes after reopening, got %+v", changes)
+	}
+	if c := changes[0]; c.Op != ChangeSet || c.Key != "deleted" {
+		t.Errorf("Unexpected change for the lost deletion: %+v", c)
+	}
+	if c := changes[1]; c.Op != ChangeDelete || c.Key != "merged" {
+		t.Errorf("Unexpected change for the lost merge: %+v", c)
+	}
+	if value, err := f.GetBytes("written"); err != nil ||
+		string(value) != "second" {
+		t.Errorf("Unexpected written value %q: %+v", value, err)
+	}
+
+	// A store that was closed is not reconciled
+	if err = f.SetBytes("lost", []byte("third")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatalf("Close failed: %+v", err)
+	}
+	if f, err = NewFilestore(dir, "Hello, World!"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if changes = readChanges(t, f, 11); len(changes) != 0 {
+		t.Errorf("Changes recorded after a clean close: %+v", changes)
+	}
+}
+
+// Tests that restoring a snapshot replaces the changes with a reset numbered
+// after every earlier change.
+func TestFilestore_ChangesReset(t *testing.T) {
+	dir := ".ekv_testdir_changes_reset"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.EnableChanges(); err != nil {
+		t.Fatalf("EnableChanges failed: %+v", err)
+	}
+	if err = f.SetBytes("a", []byte("1")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	if err = f.Snapshot("before"); err != nil {
+		t.Fatalf("Snapshot failed: %+v", err)
+	}
+	for _, value := range []string{"2", "3"} {
+		if err = f.SetBytes("a", []byte(value)); err != nil {
+			t.Fatalf("SetBytes failed: %+v", err)
+		}
+	}
+	if err = f.RestoreSnapshot("before"); err != nil {
+		t.Fatalf("RestoreSnapshot failed: %+v", err)
+	}
+
+	changes := readChanges(t, f, 0)
+	if len(changes) != 1 || changes[0].Op != ChangeReset ||
+		changes[0].Seq != 4 {
+		t.Errorf("Unexpected changes after restoring: %+v", changes)
+	}
+	if _, err = f.Changes(2); !errors.Is(err, ErrTruncated) {
+		t.Errorf("Reading changes from before the restore did not fail: "+
+			"%+v", err)
+	}
+}
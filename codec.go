@@ -0,0 +1,233 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// codec.go defines the codecs SetInterface and GetInterface encode objects
+// with. The name of the codec is stored with every value it encodes, so a
+// value is always decoded with the codec that wrote it, whatever the current
+// default. Values without a codec name, written by SetBytes or before codecs
+// were recorded, are decoded as JSON.
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	errEmptyCodec      = "codec name cannot be empty"
+	errBuiltinCodec    = "codec name %q is reserved for a built in codec"
+	errUnknownCodec    = "no codec registered with name %q"
+	errNotProtoMessage = "protobuf codec requires a proto.Message, got %T"
+)
+
+// Codec encodes objects for SetInterface and decodes them for GetInterface.
+type Codec interface {
+	// Name uniquely identifies the codec. It is stored with every value the
+	// codec encodes and must never change.
+	Name() string
+	// Marshal encodes v.
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal decodes data into v, which is typically a pointer.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSONCodec encodes objects with encoding/json. It is the default codec.
+	JSONCodec Codec = jsonCodec{}
+	// CBORCodec encodes objects as CBOR (RFC 8949), which keeps byte slices
+	// and integers intact and is more compact than JSON.
+	CBORCodec Codec = cborCodec{}
+	// GobCodec encodes objects with encoding/gob.
+	GobCodec Codec = gobCodec{}
+	// ProtobufCodec encodes objects that implement proto.Message.
+	ProtobufCodec Codec = protobufCodec{}
+
+	// builtinCodecs are the codecs every store can decode with, by name. No
+	// other codec may be registered under their names.
+	builtinCodecs = map[string]Codec{
+		JSONCodec.Name():     JSONCodec,
+		CBORCodec.Name():     CBORCodec,
+		GobCodec.Name():      GobCodec,
+		ProtobufCodec.Name(): ProtobufCodec,
+	}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type cborCodec struct{}
+
+func (cborCodec) Name() string { return "cbor" }
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+func (cborCodec) Unmarshal(data []byte, v interface{}) error {
+	return cbor.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string { return "protobuf" }
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, errors.Errorf(errNotProtoMessage, v)
+	}
+	return proto.Marshal(m)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return errors.Errorf(errNotProtoMessage, v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+// WithCodec overrides the codec SetInterfaceWith encodes the object with. It
+// has no effect on SetBytesWith.
+func WithCodec(c Codec) WriteOption {
+	return func(o *writeOptions) {
+		o.codec = c
+	}
+}
+
+// codecRegistry holds the default codec of a store and every codec it can
+// decode values with.
+type codecRegistry struct {
+	defaultCodec Codec
+	codecs       map[string]Codec
+	mux          sync.RWMutex
+}
+
+// register adds or replaces the codec under its name. The built in codecs are
+// always available and cannot be replaced, as values they encoded would then
+// be decoded by another codec.
+func (r *codecRegistry) register(c Codec) error {
+	if c == nil || c.Name() == "" {
+		return errors.New(errEmptyCodec)
+	}
+	if builtin, ok := builtinCodecs[c.Name()]; ok {
+		if c != builtin {
+			return errors.Errorf(errBuiltinCodec, c.Name())
+		}
+		return nil
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.codecs == nil {
+		r.codecs = make(map[string]Codec)
+	}
+	r.codecs[c.Name()] = c
+	return nil
+}
+
+// setDefault registers c and makes it the default codec.
+func (r *codecRegistry) setDefault(c Codec) error {
+	if err := r.register(c); err != nil {
+		return err
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.defaultCodec = c
+	return nil
+}
+
+// encoder returns the codec to encode with: the override if set, otherwise
+// the default. An override is registered so that its values can be decoded.
+func (r *codecRegistry) encoder(override Codec) (Codec, error) {
+	if override != nil {
+		return override, r.register(override)
+	}
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	if r.defaultCodec == nil {
+		return JSONCodec, nil
+	}
+	return r.defaultCodec, nil
+}
+
+// decoder returns the codec registered under name. The built in codecs are
+// always available, and an empty name, for values written without one, is
+// JSON.
+func (r *codecRegistry) decoder(name string) (Codec, error) {
+	if name == "" {
+		return JSONCodec, nil
+	} else if c, ok := builtinCodecs[name]; ok {
+		return c, nil
+	}
+
+	r.mux.RLock()
+	c, ok := r.codecs[name]
+	r.mux.RUnlock()
+	if !ok {
+		return nil, errors.Errorf(errUnknownCodec, name)
+	}
+	return c, nil
+}
+
+// encode marshals v with the codec selected by opts and records its name in
+// opts so that it is stored with the value.
+func (r *codecRegistry) encode(v interface{}, opts *writeOptions) (
+	[]byte, error) {
+	c, err := r.encoder(opts.codec)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.Marshal(v)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s codec cannot encode %T", c.Name(), v)
+	}
+	opts.tags.codec = c.Name()
+	return data, nil
+}
+
+// decode unmarshals data into v with the codec registered under name.
+func (r *codecRegistry) decode(name string, data []byte, v interface{}) error {
+	c, err := r.decoder(name)
+	if err != nil {
+		return err
+	}
+	return errors.Wrapf(c.Unmarshal(data, v), "%s codec cannot decode into %T",
+		c.Name(), v)
+}
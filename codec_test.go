@@ -0,0 +1,186 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+
+	"gitlab.com/elixxir/ekv/portableOS"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// codecStore is the subset of the store methods exercised by these tests.
+type codecStore interface {
+	KeyValue
+	SetInterfaceWith(key string, objectToStore interface{},
+		opts ...WriteOption) error
+	SetCodec(c Codec) error
+	RegisterCodec(c Codec) error
+}
+
+// codecObject is an object JSON cannot round trip exactly.
+type codecObject struct {
+	Data  []byte
+	Count uint64
+}
+
+// upperCodec is a custom codec that stores strings in upper case.
+type upperCodec struct{}
+
+func (upperCodec) Name() string { return "upper" }
+
+func (upperCodec) Marshal(v interface{}) ([]byte, error) {
+	return []byte(strings.ToUpper(*v.(*string))), nil
+}
+
+func (upperCodec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*string) = string(data)
+	return nil
+}
+
+// renamedCodec is upperCodec under another name.
+type renamedCodec struct {
+	upperCodec
+	name string
+}
+
+func (c renamedCodec) Name() string { return c.name }
+
+// testCodecs checks that values are decoded with the codec that encoded them
+// regardless of the current default.
+func testCodecs(t *testing.T, s codecStore) {
+	object := &codecObject{Data: []byte{0, 1, 2}, Count: math.MaxUint64}
+
+	for _, c := range []Codec{CBORCodec, GobCodec} {
+		if err := s.SetCodec(c); err != nil {
+			t.Fatalf("SetCodec failed: %+v", err)
+		}
+		if err := s.SetInterface(c.Name(), object); err != nil {
+			t.Fatalf("SetInterface with %s failed: %+v", c.Name(), err)
+		}
+	}
+
+	// Switch back to JSON, which would lose the precision of Count
+	if err := s.SetCodec(JSONCodec); err != nil {
+		t.Fatalf("SetCodec failed: %+v", err)
+	}
+	for _, name := range []string{"cbor", "gob"} {
+		loaded := &codecObject{}
+		if err := s.GetInterface(name, loaded); err != nil {
+			t.Fatalf("GetInterface of %s failed: %+v", name, err)
+		}
+		if !bytes.Equal(loaded.Data, object.Data) ||
+			loaded.Count != object.Count {
+			t.Errorf("%s value did not round trip: %+v", name, loaded)
+		}
+	}
+
+	// Per call override
+	message := wrapperspb.String("Hello, World!")
+	err := s.SetInterfaceWith("protobuf", message, WithCodec(ProtobufCodec))
+	if err != nil {
+		t.Fatalf("SetInterfaceWith failed: %+v", err)
+	}
+	loadedMessage := &wrapperspb.StringValue{}
+	if err = s.GetInterface("protobuf", loadedMessage); err != nil {
+		t.Fatalf("GetInterface failed: %+v", err)
+	}
+	if loadedMessage.GetValue() != message.GetValue() {
+		t.Errorf("Protobuf value did not round trip: %q", loadedMessage.Value)
+	}
+	if err = s.SetInterfaceWith("bad", object, WithCodec(ProtobufCodec)); err == nil {
+		t.Errorf("Protobuf codec encoded a non proto.Message")
+	}
+
+	// Values written with SetBytes are decoded as JSON
+	if err = s.SetBytes("bytes", []byte(`"raw"`)); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	var str string
+	if err = s.GetInterface("bytes", &str); err != nil || str != "raw" {
+		t.Errorf("Failed to decode bytes as JSON: %q, %+v", str, err)
+	}
+
+	// Custom codecs
+	str = "hello"
+	err = s.SetInterfaceWith("custom", &str, WithCodec(upperCodec{}))
+	if err != nil {
+		t.Fatalf("SetInterfaceWith failed: %+v", err)
+	}
+	str = ""
+	if err = s.GetInterface("custom", &str); err != nil || str != "HELLO" {
+		t.Errorf("Custom codec was not used: %q, %+v", str, err)
+	}
+
+	// Built in codecs cannot be replaced, but can be registered again
+	impostor := renamedCodec{name: JSONCodec.Name()}
+	if err = s.RegisterCodec(impostor); err == nil {
+		t.Errorf("Registered a codec under a built in name")
+	}
+	if err = s.SetCodec(impostor); err == nil {
+		t.Errorf("Set a codec under a built in name as the default")
+	}
+	err = s.SetInterfaceWith("impostor", &str, WithCodec(impostor))
+	if err == nil {
+		t.Errorf("Encoded with a codec under a built in name")
+	}
+	if err = s.RegisterCodec(JSONCodec); err != nil {
+		t.Errorf("Failed to register a built in codec: %+v", err)
+	}
+	if err = s.GetInterface("bytes", &str); err != nil || str != "raw" {
+		t.Errorf("JSON value not decoded as JSON: %q, %+v", str, err)
+	}
+}
+
+// Tests that Memstore decodes values with the codec that encoded them.
+func TestMemstore_Codecs(t *testing.T) {
+	testCodecs(t, MakeMemstore())
+}
+
+// Tests that Filestore decodes values with the codec that encoded them, even
+// after reopening, and that unknown custom codecs are reported.
+func TestFilestore_Codecs(t *testing.T) {
+	dir := ".ekv_testdir_codecs"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	testCodecs(t, f)
+
+	f, err = NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	loaded := &codecObject{}
+	if err = f.GetInterface("cbor", loaded); err != nil {
+		t.Fatalf("GetInterface failed after reopening: %+v", err)
+	}
+	if loaded.Count != math.MaxUint64 {
+		t.Errorf("CBOR value did not round trip: %+v", loaded)
+	}
+
+	var str string
+	if err = f.GetInterface("custom", &str); err == nil {
+		t.Errorf("Decoded a value with an unregistered codec")
+	}
+	if err = f.RegisterCodec(upperCodec{}); err != nil {
+		t.Fatalf("RegisterCodec failed: %+v", err)
+	}
+	if err = f.GetInterface("custom", &str); err != nil || str != "HELLO" {
+		t.Errorf("Registered codec was not used: %q, %+v", str, err)
+	}
+}
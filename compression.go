@@ -0,0 +1,135 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// compression.go implements the optional compression of values before they
+// are encrypted. Compressing secret data alongside data an attacker controls
+// can leak the secret through the size of the result, so compression is off
+// by default and can be turned on or off for the whole store, for keys with a
+// given prefix or for a single write.
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Compression algorithms recorded in the envelope of a value.
+const (
+	compressionNone    = 0
+	compressionDeflate = 1
+
+	errCompression = "cannot decompress value: %s"
+)
+
+// compressionPolicy decides which keys are compressed by default. The setting
+// for the longest matching prefix applies, or the store default if none
+// match.
+type compressionPolicy struct {
+	enabled  bool
+	prefixes map[string]bool
+	mux      sync.RWMutex
+}
+
+// setDefault sets whether keys without a matching prefix are compressed.
+func (p *compressionPolicy) setDefault(enabled bool) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.enabled = enabled
+}
+
+// setPrefix sets whether keys starting with prefix are compressed.
+func (p *compressionPolicy) setPrefix(prefix string, enabled bool) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if p.prefixes == nil {
+		p.prefixes = make(map[string]bool)
+	}
+	p.prefixes[prefix] = enabled
+}
+
+// enabledFor returns whether the value of key is compressed by default.
+func (p *compressionPolicy) enabledFor(key string) bool {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	enabled, longest := p.enabled, -1
+	for prefix, prefixEnabled := range p.prefixes {
+		if len(prefix) > longest && strings.HasPrefix(key, prefix) {
+			enabled, longest = prefixEnabled, len(prefix)
+		}
+	}
+	return enabled
+}
+
+// WithCompression overrides whether the value is compressed before it is
+// encrypted, regardless of the compression settings of the store.
+func WithCompression(enabled bool) WriteOption {
+	return func(o *writeOptions) {
+		o.compress = &enabled
+	}
+}
+
+// SetCompression sets whether values are compressed with DEFLATE before they
+// are encrypted. Values that do not get smaller are stored uncompressed.
+// Disabled by default.
+//
+// Compression can reveal information about a value through the size of its
+// file, especially if part of the value is controlled by an attacker. Leave it
+// disabled for such keys with SetCompressionForPrefix or WithCompression.
+func (f *Filestore) SetCompression(enabled bool) {
+	f.compression.setDefault(enabled)
+}
+
+// SetCompressionForPrefix sets whether the values of keys starting with prefix
+// are compressed, overriding SetCompression. When several prefixes match a key
+// the longest applies.
+func (f *Filestore) SetCompressionForPrefix(prefix string, enabled bool) {
+	f.compression.setPrefix(prefix, enabled)
+}
+
+// compress compresses data with DEFLATE and returns the algorithm used along
+// with the result, or data itself if compressing does not make it smaller.
+func compress(data []byte) (byte, []byte) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return compressionNone, data
+	}
+	if _, err = w.Write(data); err != nil || w.Close() != nil {
+		return compressionNone, data
+	}
+	if buf.Len() >= len(data) {
+		return compressionNone, data
+	}
+	return compressionDeflate, buf.Bytes()
+}
+
+// decompress reverses compress for the given algorithm.
+func decompress(algorithm byte, data []byte) ([]byte, error) {
+	switch algorithm {
+	case compressionNone:
+		return data, nil
+	case compressionDeflate:
+		r := flate.NewReader(bytes.NewReader(data))
+		defer r.Close()
+		decompressed, err := io.ReadAll(r)
+		if err != nil {
+			return nil, errors.WithStack(&ErrCorrupt{
+				Reason: fmt.Sprintf(errCompression, err)})
+		}
+		return decompressed, nil
+	default:
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+			errCompression, fmt.Sprintf("unknown algorithm %d", algorithm))})
+	}
+}
@@ -0,0 +1,173 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portableOS"
+)
+
+// Tests that compression follows the store, prefix and per call settings and
+// that compressed and uncompressed values read back the same.
+func TestFilestore_Compression(t *testing.T) {
+	dir := ".ekv_testdir_compression"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	f.SetCompressionForPrefix("secret/", false)
+	f.SetCompressionForPrefix("secret/public/", true)
+
+	value := bytes.Repeat([]byte(`{"message":"Hello, World!"}`), 100)
+	compressed := func(key string) bool {
+		encrypted, err := read(f.getKey(key))
+		if err != nil {
+			t.Fatalf("Failed to read %s: %+v", key, err)
+		}
+		return len(encrypted) < len(value)
+	}
+
+	tests := []struct {
+		key        string
+		enabled    bool
+		opts       []WriteOption
+		compressed bool
+	}{
+		{"key", false, nil, false},
+		{"key", true, nil, true},
+		{"key", true, []WriteOption{WithCompression(false)}, false},
+		{"key", false, []WriteOption{WithCompression(true)}, true},
+		{"secret/key", true, nil, false},
+		{"secret/public/key", true, nil, true},
+		{"secret/key", true, []WriteOption{WithCompression(true)}, true},
+	}
+	for i, test := range tests {
+		f.SetCompression(test.enabled)
+		if err = f.SetBytesWith(test.key, value, test.opts...); err != nil {
+			t.Fatalf("SetBytesWith %d failed: %+v", i, err)
+		}
+		if c := compressed(test.key); c != test.compressed {
+			t.Errorf("Test %d: compressed %t, expected %t", i, c,
+				test.compressed)
+		}
+		data, err := f.GetBytes(test.key)
+		if err != nil {
+			t.Fatalf("GetBytes %d failed: %+v", i, err)
+		}
+		if !bytes.Equal(data, value) {
+			t.Errorf("Test %d: value did not read back", i)
+		}
+	}
+
+	// Transactions follow the policy of the store
+	f.SetCompression(true)
+	err = f.Transaction(func(files map[string]Operable, _ Extender) error {
+		files["transaction"].Set(value)
+		return nil
+	}, "transaction")
+	if err != nil {
+		t.Fatalf("Transaction failed: %+v", err)
+	}
+	if !compressed("transaction") {
+		t.Errorf("Transaction did not compress the value")
+	}
+
+	// Incompressible values are stored as they are
+	if err = f.SetBytes("short", []byte("a")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	encrypted, err := read(f.getKey("short"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := openEnvelope(encrypted, f.key)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if e.compression != compressionNone {
+		t.Errorf("Compressed a value that does not get smaller")
+	}
+}
+
+// Tests that values written before envelopes existed are still readable and
+// that envelopes cannot be read without their associated data.
+func TestFilestore_LegacyValue(t *testing.T) {
+	dir := ".ekv_testdir_legacy_value"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	legacy, err := encrypt([]byte("legacy"), f.key, f.csprng)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = write(f.getKey("key"), legacy, f.csprng); err != nil {
+		t.Fatal(err)
+	}
+	data, err := f.GetBytes("key")
+	if err != nil {
+		t.Fatalf("GetBytes failed: %+v", err)
+	}
+	if !bytes.Equal(data, []byte("legacy")) {
+		t.Errorf("Wrong legacy value: %q", data)
+	}
+
+	sealed, err := sealEnvelope(&envelope{payload: []byte("value")}, f.key,
+		f.csprng)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = decrypt(sealed, f.key); !errors.Is(err, ErrTampered) {
+		t.Errorf("Decrypted an envelope without associated data: %+v", err)
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err = openEnvelope(sealed, f.key); !errors.Is(err, ErrTampered) {
+		t.Errorf("Expected ErrTampered, got %+v", err)
+	}
+}
+
+// Tests that an envelope survives a marshal and unmarshal round trip and that
+// malformed envelopes are rejected.
+func Test_unmarshalEnvelope(t *testing.T) {
+	e := &envelope{compression: compressionDeflate, payload: []byte("data")}
+	decoded, err := unmarshalEnvelope(e.marshal())
+	if err != nil {
+		t.Fatalf("Failed to unmarshal: %+v", err)
+	}
+	if decoded.compression != e.compression ||
+		!bytes.Equal(decoded.payload, e.payload) {
+		t.Errorf("Envelope mismatch: %+v != %+v", decoded, e)
+	}
+
+	for _, data := range [][]byte{
+		nil,
+		{2, 0},
+		{envelopeVersion, 5, envelopeTagCompression},
+		{envelopeVersion, 3, 99, 1, 0},
+	} {
+		if _, err = unmarshalEnvelope(data); err == nil {
+			t.Errorf("Unmarshalled invalid envelope %v", data)
+		}
+	}
+}
@@ -16,47 +16,78 @@ import (
 	"io"
 )
 
+// deriveKey hashes the password into the 256-bit key that is used both for the
+// keyed hashes and to encrypt contents. Stores keep this key instead of the
+// password so that it can be wiped from memory.
+func deriveKey(password string) []byte {
+	pHash := blake2b.Sum256([]byte(password))
+	return pHash[:]
+}
+
 // Used for keyed hashes for, e.g., the "key" in the KV store
-func hashStringWithPassword(data, password string) []byte {
+func hashStringWithKey(data string, key []byte) []byte {
 	dHash := blake2b.Sum256([]byte(data))
-	pHash := blake2b.Sum256([]byte(password))
-	s := append(pHash[:], dHash[:]...)
+	s := make([]byte, 0, len(key)+len(dHash))
+	s = append(append(s, key...), dHash[:]...)
 	h := blake2b.Sum256(s)
 	return h[:]
 }
 
-func initChaCha20Poly1305(password string) cipher.AEAD {
-	pwHash := blake2b.Sum256([]byte(password))
-	chaCipher, err := chacha20poly1305.NewX(pwHash[:])
+func initChaCha20Poly1305(key []byte) (cipher.AEAD, error) {
+	chaCipher, err := chacha20poly1305.NewX(key)
 	if err != nil {
-		panic(fmt.Sprintf("Could not init XChaCha20Poly1305 mode: %s",
-			err.Error()))
+		return nil, errors.Wrap(err, "Could not init XChaCha20Poly1305 mode")
 	}
-	return chaCipher
+	return chaCipher, nil
 }
 
-func encrypt(data []byte, password string, csprng io.Reader) []byte {
-	chaCipher := initChaCha20Poly1305(password)
+func encrypt(data, key []byte, csprng io.Reader) ([]byte, error) {
+	return encryptWithAD(data, nil, key, csprng)
+}
+
+// encryptWithAD encrypts data and authenticates it together with the
+// associated data ad, which must be given again to decrypt it.
+func encryptWithAD(data, ad, key []byte, csprng io.Reader) ([]byte, error) {
+	chaCipher, err := initChaCha20Poly1305(key)
+	if err != nil {
+		return nil, err
+	}
 	nonce := make([]byte, chaCipher.NonceSize())
-	if _, err := io.ReadFull(csprng, nonce); err != nil {
-		panic(fmt.Sprintf("Could not generate nonce: %s", err.Error()))
+	if _, err = io.ReadFull(csprng, nonce); err != nil {
+		return nil, errors.Wrap(err, "Could not generate nonce")
 	}
-	ciphertext := chaCipher.Seal(nonce, nonce, data, nil)
-	return ciphertext
+	ciphertext := chaCipher.Seal(nonce, nonce, data, ad)
+	return ciphertext, nil
 }
 
-func decrypt(data []byte, password string) ([]byte, error) {
-	chaCipher := initChaCha20Poly1305(password)
+func decrypt(data, key []byte) ([]byte, error) {
+	return decryptWithAD(data, nil, key)
+}
+
+// decryptWithAD decrypts data encrypted by encryptWithAD with the same
+// associated data.
+func decryptWithAD(data, ad, key []byte) ([]byte, error) {
+	chaCipher, err := initChaCha20Poly1305(key)
+	if err != nil {
+		return nil, err
+	}
 	nonceLen := chaCipher.NonceSize()
 	if (len(data) - nonceLen) <= 0 {
 		errMsg := fmt.Sprintf("Read %d bytes, too short to decrypt",
 			len(data))
-		return nil, errors.New(errMsg)
+		return nil, errors.WithStack(&ErrCorrupt{Reason: errMsg})
 	}
 	nonce, ciphertext := data[:nonceLen], data[nonceLen:]
-	plaintext, err := chaCipher.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := chaCipher.Open(nil, nonce, ciphertext, ad)
 	if err != nil {
-		return nil, errors.Wrap(err, "Cannot decrypt with password!")
+		return nil, errors.Wrap(ErrTampered, "Cannot decrypt with password!")
 	}
 	return plaintext, nil
 }
+
+// wipe overwrites key material with zeros.
+func wipe(key []byte) {
+	for i := range key {
+		key[i] = 0
+	}
+}
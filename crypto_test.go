@@ -10,14 +10,19 @@ package ekv
 import (
 	"crypto/rand"
 	"testing"
+
+	"github.com/pkg/errors"
 )
 
 // TestCrypto smoke tests the crypto helper functions
 func TestCrypto(t *testing.T) {
 	plaintext := []byte("Hello, World!")
-	password := "test_password"
-	ciphertext := encrypt(plaintext, password, rand.Reader)
-	decrypted, err := decrypt(ciphertext, password)
+	key := deriveKey("test_password")
+	ciphertext, err := encrypt(plaintext, key, rand.Reader)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	decrypted, err := decrypt(ciphertext, key)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
@@ -35,7 +40,7 @@ func TestShortData(t *testing.T) {
 	// Anything under 24 should cause an error.
 	ciphertext := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
 		0, 0, 0, 0, 0, 0, 0, 0}
-	_, err := decrypt(ciphertext, "dummypassword")
+	_, err := decrypt(ciphertext, deriveKey("dummypassword"))
 	if err == nil {
 		t.Errorf("Expected error on short decryption")
 	}
@@ -46,7 +51,7 @@ func TestShortData(t *testing.T) {
 
 	// Empty string shouldn't panic should cause an error.
 	ciphertext = []byte{}
-	_, err = decrypt(ciphertext, "dummypassword")
+	_, err = decrypt(ciphertext, deriveKey("dummypassword"))
 	if err == nil {
 		t.Errorf("Expected error on short decryption")
 	}
@@ -55,3 +60,20 @@ func TestShortData(t *testing.T) {
 		t.Errorf("Unexpected error: %+v", err)
 	}
 }
+
+// failingReader is an io.Reader that always returns an error.
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("no entropy")
+}
+
+// Tests that encrypt returns an error instead of panicking when the csprng
+// fails.
+func TestEncrypt_FailingCSPRNG(t *testing.T) {
+	_, err := encrypt([]byte("Hello, World!"), deriveKey("test_password"),
+		failingReader{})
+	if err == nil {
+		t.Errorf("Expected error from a failing csprng")
+	}
+}
@@ -0,0 +1,241 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// envelope.go wraps values in an envelope before they are encrypted. The
+// envelope records how the value was stored, such as whether it was
+// compressed, so that the way values are stored can change without losing
+// the ability to read older ones.
+//
+// Envelopes are encrypted with envelopeAD as associated data. Values written
+// before envelopes existed were encrypted without associated data, so they
+// fail to decrypt as an envelope and are then read as a bare value.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	envelopeVersion = 1
+
+	// Envelope field tags. Fields are only written when they differ from
+	// their default.
+	envelopeTagCompression = 1
+	envelopeTagCodec       = 2
+	envelopeTagSchema      = 3
+	envelopeTagMetadata    = 4
+	envelopeTagExpiry      = 5
+	envelopeTagKey         = 6
+
+	errEnvelope = "invalid value envelope: %s"
+)
+
+// envelopeAD is the associated data every envelope is encrypted with.
+var envelopeAD = []byte("ekv:envelope:1")
+
+// envelope is a value along with how it is stored.
+type envelope struct {
+	// compression is the algorithm the payload is compressed with.
+	compression byte
+	valueTags
+	meta valueMeta
+	// key is the key the value was written under, so that the keys of a
+	// Filestore can be listed from its files, see keyIndex.go.
+	key     string
+	payload []byte
+}
+
+// valueTags are the fields of an envelope that describe how the value was
+// encoded.
+type valueTags struct {
+	// codec is the name of the codec that encoded the value, if any.
+	codec string
+	// schema is the schema the value was written under, if any.
+	schema schemaTag
+}
+
+// storedValue is a decrypted value along with the fields of its envelope.
+type storedValue struct {
+	data []byte
+	valueTags
+	meta valueMeta
+}
+
+// marshal encodes the envelope as
+// [version][uvarint fields size][fields][payload], where every field is
+// [tag][uvarint size][value].
+func (e *envelope) marshal() []byte {
+	var fields []byte
+	if e.compression != compressionNone {
+		fields = appendEnvelopeField(fields, envelopeTagCompression,
+			[]byte{e.compression})
+	}
+	if e.codec != "" {
+		fields = appendEnvelopeField(fields, envelopeTagCodec, []byte(e.codec))
+	}
+	if e.schema.name != "" {
+		schema := binary.AppendUvarint(nil, uint64(e.schema.version))
+		fields = appendEnvelopeField(fields, envelopeTagSchema,
+			append(schema, e.schema.name...))
+	}
+	if !e.meta.isZero() {
+		fields = appendEnvelopeField(fields, envelopeTagMetadata,
+			e.meta.marshal())
+	}
+	if !e.meta.expires.IsZero() {
+		fields = appendEnvelopeField(fields, envelopeTagExpiry,
+			binary.AppendVarint(nil, e.meta.expires.UnixNano()))
+	}
+	if e.key != "" {
+		fields = appendEnvelopeField(fields, envelopeTagKey, []byte(e.key))
+	}
+
+	buf := make([]byte, 0,
+		1+binary.MaxVarintLen64+len(fields)+len(e.payload))
+	buf = append(buf, envelopeVersion)
+	buf = binary.AppendUvarint(buf, uint64(len(fields)))
+	buf = append(buf, fields...)
+	return append(buf, e.payload...)
+}
+
+// appendEnvelopeField appends the field with the given tag and value to buf.
+func appendEnvelopeField(buf []byte, tag byte, value []byte) []byte {
+	buf = append(buf, tag)
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+// unmarshalEnvelope is the inverse of envelope.marshal.
+func unmarshalEnvelope(data []byte) (*envelope, error) {
+	if len(data) == 0 || data[0] != envelopeVersion {
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+			errEnvelope, "unknown version")})
+	}
+	size, n := binary.Uvarint(data[1:])
+	if n <= 0 || size > uint64(len(data)-1-n) {
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+			errEnvelope, "truncated fields")})
+	}
+	fields := data[1+n : 1+n+int(size)]
+	e := &envelope{payload: data[1+n+int(size):]}
+
+	for len(fields) > 0 {
+		tag := fields[0]
+		size, n = binary.Uvarint(fields[1:])
+		if n <= 0 || size > uint64(len(fields)-1-n) {
+			return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+				errEnvelope, "truncated field")})
+		}
+		value := fields[1+n : 1+n+int(size)]
+		fields = fields[1+n+int(size):]
+
+		switch tag {
+		case envelopeTagCompression:
+			if len(value) != 1 {
+				return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+					errEnvelope, "invalid compression field")})
+			}
+			e.compression = value[0]
+		case envelopeTagCodec:
+			e.codec = string(value)
+		case envelopeTagSchema:
+			version, n := binary.Uvarint(value)
+			if n <= 0 || version > math.MaxUint32 || n == len(value) {
+				return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+					errEnvelope, "invalid schema field")})
+			}
+			e.schema = schemaTag{name: string(value[n:]),
+				version: uint32(version)}
+		case envelopeTagMetadata:
+			meta, err := unmarshalValueMeta(value)
+			if err != nil {
+				return nil, err
+			}
+			meta.expires = e.meta.expires
+			e.meta = meta
+		case envelopeTagExpiry:
+			expires, n := binary.Varint(value)
+			if n <= 0 || n != len(value) {
+				return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+					errEnvelope, "invalid expiry field")})
+			}
+			e.meta.expires = time.Unix(0, expires)
+		case envelopeTagKey:
+			e.key = string(value)
+		default:
+			return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+				errEnvelope, fmt.Sprintf("unknown field %d", tag))})
+		}
+	}
+	return e, nil
+}
+
+// value returns the value held in the envelope, decompressing it if needed.
+func (e *envelope) value() (storedValue, error) {
+	data, err := decompress(e.compression, e.payload)
+	if err != nil {
+		return storedValue{}, err
+	}
+	return storedValue{data: data, valueTags: e.valueTags, meta: e.meta}, nil
+}
+
+// sealEnvelope marshals and encrypts the envelope.
+func sealEnvelope(e *envelope, key []byte, csprng io.Reader) ([]byte, error) {
+	return encryptWithAD(e.marshal(), envelopeAD, key, csprng)
+}
+
+// openEnvelope decrypts and unmarshals an envelope. Values written before
+// envelopes existed are returned in an envelope with default fields.
+func openEnvelope(data, key []byte) (*envelope, error) {
+	plaintext, err := decryptWithAD(data, envelopeAD, key)
+	if err == nil {
+		return unmarshalEnvelope(plaintext)
+	}
+	if !errors.Is(err, ErrTampered) {
+		return nil, err
+	}
+
+	plaintext, legacyErr := decrypt(data, key)
+	if legacyErr != nil {
+		return nil, err
+	}
+	return &envelope{payload: plaintext}, nil
+}
+
+// encryptValue wraps the value data of key in an envelope, compressing it if
+// the options and compression policy of the Filestore call for it, and
+// encrypts it. The metadata of the options is stamped with the current time,
+// in place, so that the caller knows what the value was written with.
+func (f *Filestore) encryptValue(key string, data []byte,
+	opts *writeOptions) ([]byte, error) {
+	if opts == nil {
+		opts = &writeOptions{}
+	}
+	opts.meta = opts.meta.stamp(len(data), f.clock.Now())
+	e := &envelope{payload: data, valueTags: opts.tags, meta: opts.meta,
+		key: key}
+	if opts.compressionFor(key, &f.compression) {
+		e.compression, e.payload = compress(data)
+	}
+	return sealEnvelope(e, f.key, f.csprng)
+}
+
+// decryptValue decrypts and unwraps a value encrypted with encryptValue.
+func (f *Filestore) decryptValue(data []byte) (storedValue, error) {
+	e, err := openEnvelope(data, f.key)
+	if err != nil {
+		return storedValue{}, err
+	}
+	return e.value()
+}
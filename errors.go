@@ -0,0 +1,113 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"errors"
+	"os"
+
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+// Sentinel errors returned by the stores. They are wrapped with additional
+// context, so use errors.Is to test for them.
+var (
+	// ErrNotFound is returned when a key has no value in the store.
+	ErrNotFound = errors.New("object not found")
+
+	// ErrWrongPassword is returned when a store is opened with a password
+	// that does not match the one it was created with.
+	ErrWrongPassword = errors.New("wrong password")
+
+	// ErrTampered is returned when the authentication of an encrypted record
+	// fails, meaning it was modified or was not written by this store.
+	ErrTampered = errors.New("record failed authentication")
+
+	// ErrClosed is returned when operating on a closed store or transaction.
+	ErrClosed = errors.New("store is closed")
+
+	// ErrLocked is returned when operating on a store whose key material has
+	// been wiped by Lock, until it is unlocked.
+	ErrLocked = errors.New("store is locked")
+
+	// ErrReadOnly is returned when modifying a read-only store, such as an
+	// open snapshot.
+	ErrReadOnly = errors.New("store is read-only")
+
+	// ErrNotConfirmed is returned by Export and Import when the caller has
+	// not confirmed that the data is to be handled in plaintext.
+	ErrNotConfirmed = errors.New("plaintext export or import not confirmed")
+
+	// ErrTruncated is returned when reading changes that were discarded from
+	// the change feed.
+	ErrTruncated = errors.New("changes were truncated")
+
+	// ErrChangesDisabled is returned when reading the change feed of a store
+	// that never enabled it with EnableChanges.
+	ErrChangesDisabled = errors.New("change feed is not enabled")
+)
+
+// ErrCorrupt is returned when a record on disk cannot be parsed, such as when
+// its size field is invalid or its checksum does not match. Use errors.As to
+// retrieve it.
+type ErrCorrupt struct {
+	// Path is the file that is corrupt. It is empty if the corruption was
+	// detected after the record was read, such as when decrypting.
+	Path string
+
+	// Reason describes what is wrong with the record.
+	Reason string
+}
+
+// Error returns the reason, prefixed with the path when it is known.
+func (e *ErrCorrupt) Error() string {
+	if e.Path == "" {
+		return e.Reason
+	}
+	return "corrupt record " + e.Path + ": " + e.Reason
+}
+
+// notFoundError marks an error from the file system as ErrNotFound while
+// keeping the original error in the chain.
+type notFoundError struct {
+	err error
+}
+
+// wrapNotFound returns err such that errors.Is matches both ErrNotFound and
+// whatever err already matches, such as os.ErrNotExist.
+func wrapNotFound(err error) error {
+	if err == nil {
+		err = os.ErrNotExist
+	}
+	return &notFoundError{err: err}
+}
+
+// Error returns the message of ErrNotFound followed by the original error.
+func (e *notFoundError) Error() string {
+	return ErrNotFound.Error() + ": " + e.err.Error()
+}
+
+// Is reports whether target is ErrNotFound.
+func (e *notFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// Unwrap returns the original error.
+func (e *notFoundError) Unwrap() error {
+	return e.err
+}
+
+// reportMisuse reports a programming error, such as using an Operable after
+// its transaction closed. It panics if panicOnMisuse is set and otherwise logs
+// the error so that the caller can skip the action.
+func reportMisuse(panicOnMisuse bool, format string, args ...interface{}) {
+	if panicOnMisuse {
+		jww.FATAL.Panicf(format, args...)
+	}
+	jww.ERROR.Printf(format, args...)
+}
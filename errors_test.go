@@ -0,0 +1,118 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portableOS"
+)
+
+// Tests that a missing key is reported as ErrNotFound by both stores.
+func TestErrNotFound(t *testing.T) {
+	dir := ".ekv_testdir_errnotfound"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	for name, kv := range map[string]KeyValue{
+		"Memstore": MakeMemstore(), "Filestore": f} {
+		_, err = kv.GetBytes("missing")
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: expected ErrNotFound, got %+v", name, err)
+		}
+	}
+
+	// The file system error is kept in the chain
+	_, err = f.GetBytes("missing")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected os.ErrNotExist in chain, got %+v", err)
+	}
+}
+
+// Tests that opening a store with the wrong password returns ErrWrongPassword.
+func TestErrWrongPassword(t *testing.T) {
+	dir := ".ekv_testdir_errwrongpassword"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	if _, err := NewFilestore(dir, "Hello, World!"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	_, err := NewFilestore(dir, "badpassword")
+	if !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("Expected ErrWrongPassword, got %+v", err)
+	}
+}
+
+// Tests that a record with a bad checksum returns ErrCorrupt and one with a
+// modified ciphertext returns ErrTampered.
+func TestErrCorrupt_ErrTampered(t *testing.T) {
+	dir := ".ekv_testdir_errcorrupt"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.SetBytes("key", []byte("value")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// Modify the ciphertext but keep the checksum valid
+	path := f.getKey("key")
+	ciphertext, err := read(path)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	ciphertext[len(ciphertext)-1] ^= 0xFF
+	if err = write(path, ciphertext, f.csprng); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	_, err = f.GetBytes("key")
+	if !errors.Is(err, ErrTampered) {
+		t.Errorf("Expected ErrTampered, got %+v", err)
+	}
+
+	// Break the checksum of both copies
+	path1, path2 := getPaths(path)
+	for _, p := range []string{path1, path2} {
+		contents, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		contents[len(contents)-1] ^= 0xFF
+		if err = os.WriteFile(p, contents, 0600); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	_, err = f.GetBytes("key")
+	var corrupt *ErrCorrupt
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("Expected ErrCorrupt, got %+v", err)
+	}
+	if corrupt.Path != path1 && corrupt.Path != path2 {
+		t.Errorf("Unexpected corrupt path: %s", corrupt.Path)
+	}
+}
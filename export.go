@@ -0,0 +1,390 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// export.go implements plaintext export and import, to move data out of a
+// Filestore into another system or to seed one from fixtures. Both are opt-in:
+// they decrypt or take in the values as they are, so the caller must confirm
+// it, and every call logs a warning.
+//
+// Export enumerates the keys of the store by scanning its files, see
+// keyIndex.go. Import writes every entry or none: it reads and checks all of
+// them before writing, and if a write fails, puts back the values it already
+// replaced.
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+// ExportFormat is the encoding of the entries written by Export and read by
+// Import.
+type ExportFormat int
+
+const (
+	// ExportJSONLines encodes every entry as a JSON object on its own line.
+	// Values are base64 encoded.
+	ExportJSONLines ExportFormat = iota + 1
+
+	// ExportCBOR encodes every entry as a CBOR map, one after the other, as
+	// a CBOR sequence (RFC 8742).
+	ExportCBOR
+)
+
+const (
+	errExportFormat    = "unknown export format %d"
+	errExportKey       = "invalid key %q: %s"
+	errImportEntry     = "invalid entry %d"
+	errImportDuplicate = "key %q appears more than once"
+)
+
+// ExportEntry is a key and its value, with the metadata of the value, as
+// written by Export and read by Import.
+type ExportEntry struct {
+	Key   string `json:"key" cbor:"key"`
+	Value []byte `json:"value" cbor:"value"`
+
+	// Codec is the name of the codec that encoded the value, if it was set
+	// with SetInterface, and Schema and SchemaVersion the schema it was
+	// written under, if any.
+	Codec         string `json:"codec,omitempty" cbor:"codec,omitempty"`
+	Schema        string `json:"schema,omitempty" cbor:"schema,omitempty"`
+	SchemaVersion uint32 `json:"schemaVersion,omitempty" cbor:"schemaVersion,omitempty"`
+
+	ContentType string            `json:"contentType,omitempty" cbor:"contentType,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty" cbor:"tags,omitempty"`
+	Created     *time.Time        `json:"created,omitempty" cbor:"created,omitempty"`
+	Expires     *time.Time        `json:"expires,omitempty" cbor:"expires,omitempty"`
+}
+
+// Export writes every key of the store and its value to w in the given
+// format, in the order of the keys. The output is NOT encrypted: anyone who
+// can read it can read every value. confirmPlaintext must be true to
+// acknowledge this, or ErrNotConfirmed is returned.
+//
+// Values are exported as GetBytes returns them, and the keys of namespaces
+// with their namespace prefix. Expired values, records appended with
+// AppendBytes, streams and the history of values are not exported, nor are
+// keys last written before the store had a key index. Keys written while the
+// export runs may or may not be included; export an open snapshot for a
+// consistent copy.
+func (f *Filestore) Export(w io.Writer, format ExportFormat,
+	confirmPlaintext bool) error {
+	if !confirmPlaintext {
+		return errors.WithStack(ErrNotConfirmed)
+	}
+	encode, err := newExportEncoder(w, format)
+	if err != nil {
+		return err
+	}
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	jww.WARN.Printf("Exporting the values of the store in plaintext")
+	return f.exportEntries(encode, nil)
+}
+
+// exportEntries encodes the entries of keys, or of every key if keys is nil,
+// in which case keys without a value are skipped. The caller must be in
+// flight.
+func (f *Filestore) exportEntries(encode func(ExportEntry) error,
+	keys []string) error {
+	selected := keys != nil
+	if !selected {
+		var err error
+		if keys, err = f.indexedKeys(); err != nil {
+			return err
+		}
+	}
+	for _, key := range keys {
+		encryptedKey := f.getKey(key)
+		logKey := f.getMergeLogKey(key)
+		unlock := f.takeLocks(false, encryptedKey, logKey)
+		value, exists, _, err := f.readMerged(key, encryptedKey, logKey)
+		unlock()
+		if err != nil && (Exists(err) || selected) {
+			return errors.WithMessagef(err, "Failed to export %q", key)
+		} else if !exists {
+			continue
+		}
+		if !utf8.ValidString(key) {
+			return errors.Errorf(errExportKey, key, "not valid UTF-8")
+		}
+		if err = encode(newExportEntry(key, value)); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// Import writes the entries read from r in the given format, as written by
+// Export, into the store, replacing the values of keys that already exist.
+// The input is taken in plaintext, so confirmPlaintext must be true to
+// acknowledge this, or ErrNotConfirmed is returned.
+//
+// Either every entry is written or none is. All the entries are read and
+// checked first, so invalid input changes nothing, and if writing an entry
+// fails, the values already replaced are put back. The keys being imported
+// are locked until the import completes. The previous values are kept in the
+// history of their key as for SetBytes, and the versions kept by an import
+// that failed stay there.
+func (f *Filestore) Import(r io.Reader, format ExportFormat,
+	confirmPlaintext bool) error {
+	if !confirmPlaintext {
+		return errors.WithStack(ErrNotConfirmed)
+	}
+	entries, err := readExportEntries(r, format)
+	if err != nil {
+		return err
+	}
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	jww.WARN.Printf("Importing %d values into the store from plaintext",
+		len(entries))
+	return f.importEntries(entries)
+}
+
+// importEntries writes the entries into the store, either all of them or
+// none, as described for Import. The caller must be in flight.
+func (f *Filestore) importEntries(entries []ExportEntry) error {
+	if f.readOnly {
+		return errors.WithStack(ErrReadOnly)
+	}
+
+	// Index every key before writing, so that a failure leaves them listed
+	// rather than missing
+	var err error
+	for _, e := range entries {
+		if err = f.indexCopiedKey(e.Key, e.Expires != nil); err != nil {
+			return err
+		}
+	}
+
+	imports := make([]*importedValue, len(entries))
+	lockKeys := make([]string, 0, 3*len(entries))
+	for i, e := range entries {
+		v := &importedValue{key: e.Key, encryptedKey: f.getKey(e.Key),
+			logKey:     f.getMergeLogKey(e.Key),
+			historyKey: f.getHistoryKey(e.Key)}
+		v.contents, err = f.encryptValue(e.Key, e.Value, e.writeOptions())
+		if err != nil {
+			return err
+		}
+		imports[i] = v
+		lockKeys = append(lockKeys, v.encryptedKey, v.logKey, v.historyKey)
+	}
+	unlock := f.takeTransactionLocks(lockKeys)
+	defer unlock()
+
+	changes := make([]Change, len(entries))
+	for i, e := range entries {
+		changes[i] = Change{Op: ChangeSet, Key: e.Key, Value: e.Value}
+	}
+	if changes, err = f.recordChanges(changes...); err != nil {
+		return err
+	}
+	for i, v := range imports {
+		jww.TRACE.Printf("%s,IMPORT,%s,%s", kvDebugHeader, v.key,
+			v.encryptedKey)
+		if err = f.importValue(v); err != nil {
+			f.rollbackImport(imports[:i+1])
+			return f.commitChanges(changes,
+				errors.WithMessagef(err, "Failed to import %q", v.key))
+		}
+	}
+	return f.commitChanges(changes, nil)
+}
+
+// importedValue is a value being written by Import, along with the files it
+// replaces.
+type importedValue struct {
+	key, encryptedKey, logKey, historyKey string
+
+	// contents is the encrypted value to write.
+	contents []byte
+
+	// value is the encrypted value replaced and log the operands pending
+	// for it, which are nil if there were none, and read is whether they
+	// were read.
+	value []byte
+	log   []mergeOperand
+	read  bool
+}
+
+// importValue writes the imported value v after keeping the files it
+// replaces. The caller must hold the locks of its keys.
+func (f *Filestore) importValue(v *importedValue) error {
+	replaced := f.readReplaced(v.encryptedKey)
+	if replaced.encryptedContents == nil && replaced.err != nil {
+		return replaced.err
+	}
+	v.value = replaced.encryptedContents
+	var err error
+	if v.log, err = f.readMergeLog(v.key, v.logKey); err != nil {
+		return err
+	}
+	v.read = true
+
+	if err = f.archive(v.key, v.encryptedKey, v.historyKey,
+		replaced); err != nil {
+		return err
+	}
+	if err = write(v.encryptedKey, v.contents, f.csprng); err != nil {
+		return errors.WithStack(err)
+	}
+	return f.clearMergeLog(v.key, v.logKey)
+}
+
+// rollbackImport puts back the files replaced by the imported values. Errors
+// are logged, as there is nothing more to be done about them.
+func (f *Filestore) rollbackImport(imports []*importedValue) {
+	restore := func(path string, contents []byte) {
+		var err error
+		if contents != nil {
+			err = write(path, contents, f.csprng)
+		} else {
+			err = deleteFiles(path, f.csprng)
+		}
+		if err != nil {
+			jww.ERROR.Printf("Failed to roll back import of %s: %+v", path,
+				err)
+		}
+	}
+	for _, v := range imports {
+		if v.read {
+			restore(v.encryptedKey, v.value)
+			if err := f.writeMergeLog(v.key, v.logKey, v.log); err != nil {
+				jww.ERROR.Printf("Failed to roll back import of the merge "+
+					"log of %q: %+v", v.key, err)
+			}
+		}
+	}
+}
+
+// newExportEntry returns the entry of key with the stored value.
+func newExportEntry(key string, value storedValue) ExportEntry {
+	e := ExportEntry{
+		Key:           key,
+		Value:         value.data,
+		Codec:         value.codec,
+		Schema:        value.schema.name,
+		SchemaVersion: value.schema.version,
+		ContentType:   value.meta.contentType,
+		Tags:          value.meta.tags,
+	}
+	if e.Value == nil {
+		e.Value = []byte{}
+	}
+	if !value.meta.created.IsZero() {
+		created := value.meta.created
+		e.Created = &created
+	}
+	if !value.meta.expires.IsZero() {
+		expires := value.meta.expires
+		e.Expires = &expires
+	}
+	return e
+}
+
+// writeOptions returns the options to write the value of the entry with.
+func (e *ExportEntry) writeOptions() *writeOptions {
+	o := &writeOptions{
+		tags: valueTags{codec: e.Codec,
+			schema: schemaTag{name: e.Schema, version: e.SchemaVersion}},
+		meta: valueMeta{contentType: e.ContentType, tags: e.Tags},
+	}
+	if e.Created != nil {
+		o.meta.created = *e.Created
+	}
+	if e.Expires != nil {
+		o.meta.expires = *e.Expires
+	}
+	return o
+}
+
+// newExportEncoder returns a function writing entries to w in the format.
+func newExportEncoder(w io.Writer, format ExportFormat) (
+	func(ExportEntry) error, error) {
+	switch format {
+	case ExportJSONLines:
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		return func(e ExportEntry) error { return enc.Encode(e) }, nil
+	case ExportCBOR:
+		enc := cbor.NewEncoder(w)
+		return func(e ExportEntry) error { return enc.Encode(e) }, nil
+	default:
+		return nil, errors.Errorf(errExportFormat, format)
+	}
+}
+
+// readExportEntries reads every entry from r in the format and checks them.
+func readExportEntries(r io.Reader, format ExportFormat) ([]ExportEntry,
+	error) {
+	var decode func(*ExportEntry) error
+	switch format {
+	case ExportJSONLines:
+		dec := json.NewDecoder(r)
+		dec.DisallowUnknownFields()
+		decode = func(e *ExportEntry) error { return dec.Decode(e) }
+	case ExportCBOR:
+		dec := cbor.NewDecoder(r)
+		decode = func(e *ExportEntry) error { return dec.Decode(e) }
+	default:
+		return nil, errors.Errorf(errExportFormat, format)
+	}
+
+	var entries []ExportEntry
+	seen := make(map[string]struct{})
+	for {
+		var e ExportEntry
+		err := decode(&e)
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, errors.WithMessagef(err, errImportEntry,
+				len(entries))
+		}
+		if err = checkImportKey(e.Key); err != nil {
+			return nil, errors.WithMessagef(err, errImportEntry,
+				len(entries))
+		}
+		if _, exists := seen[e.Key]; exists {
+			return nil, errors.WithMessagef(
+				errors.Errorf(errImportDuplicate, e.Key), errImportEntry,
+				len(entries))
+		}
+		seen[e.Key] = struct{}{}
+		entries = append(entries, e)
+	}
+}
+
+// checkImportKey returns an error if key cannot be imported: keys used
+// internally by the store can only be written through it, except for the keys
+// of namespaces.
+func checkImportKey(key string) error {
+	if strings.HasPrefix(key, "\x00") {
+		if _, _, ok := splitNamespaceKey(key); !ok {
+			return errors.Errorf(errExportKey, key, "reserved for the store")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portableOS"
+)
+
+// Tests that the values exported from a Filestore, in either format, are
+// imported with their metadata into a store with another password.
+func TestFilestore_ExportImport(t *testing.T) {
+	srcDir := ".ekv_testdir_export_src"
+	defer func() {
+		if err := portableOS.RemoveAll(srcDir); err != nil {
+			t.Error(err)
+		}
+	}()
+	src, err := NewFilestore(srcDir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = src.SetBytesWith("typed", []byte("<p/>"),
+		WithContentType("text/html"), WithTags(map[string]string{
+			"a": "b"})); err != nil {
+		t.Fatalf("SetBytesWith failed: %+v", err)
+	}
+	if err = src.SetInterface("object", map[string]int{"a": 1}); err != nil {
+		t.Fatalf("SetInterface failed: %+v", err)
+	}
+	if err = src.SetBytesWithTTL("expiring", []byte("soon"),
+		time.Hour); err != nil {
+		t.Fatalf("SetBytesWithTTL failed: %+v", err)
+	}
+	if err = src.SetBytes("deleted", []byte("gone")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	if err = src.Delete("deleted"); err != nil {
+		t.Fatalf("Delete failed: %+v", err)
+	}
+	if err = src.Namespace("ns").SetBytes("inner", []byte("nested")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	err = src.Transaction(func(files map[string]Operable, _ Extender) error {
+		files["transacted"].Set([]byte("value"))
+		return nil
+	}, "transacted")
+	if err != nil {
+		t.Fatalf("Transaction failed: %+v", err)
+	}
+
+	var buf bytes.Buffer
+	if err = src.Export(&buf, ExportJSONLines, false); !errors.Is(err,
+		ErrNotConfirmed) {
+		t.Errorf("Expected ErrNotConfirmed, got %+v", err)
+	}
+	if err = src.Export(&buf, ExportFormat(0), true); err == nil {
+		t.Errorf("Exported in an unknown format")
+	}
+
+	for name, format := range map[string]ExportFormat{
+		"json": ExportJSONLines, "cbor": ExportCBOR} {
+		buf.Reset()
+		if err = src.Export(&buf, format, true); err != nil {
+			t.Fatalf("Export %s failed: %+v", name, err)
+		}
+		if format == ExportJSONLines {
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			if len(lines) != 5 {
+				t.Errorf("Expected 5 lines, got %d:\n%s", len(lines),
+					buf.String())
+			}
+		}
+
+		dir := ".ekv_testdir_export_" + name
+		defer os.RemoveAll(dir)
+		dst, err := NewFilestore(dir, "Goodbye, World!")
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		err = dst.Import(bytes.NewReader(buf.Bytes()), format, false)
+		if !errors.Is(err, ErrNotConfirmed) {
+			t.Errorf("Expected ErrNotConfirmed, got %+v", err)
+		}
+		err = dst.Import(bytes.NewReader(buf.Bytes()), format, true)
+		if err != nil {
+			t.Fatalf("Import %s failed: %+v", name, err)
+		}
+
+		md, err := dst.Stat("typed")
+		if err != nil || md.ContentType != "text/html" ||
+			!reflect.DeepEqual(md.Tags, map[string]string{"a": "b"}) {
+			t.Errorf("Unexpected metadata imported from %s: %+v, %+v", name,
+				md, err)
+		}
+		var object map[string]int
+		if err = dst.GetInterface("object", &object); err != nil ||
+			object["a"] != 1 {
+			t.Errorf("Unexpected object imported from %s: %v, %+v", name,
+				object, err)
+		}
+		if md, err = dst.Stat("expiring"); err != nil || md.Expires.IsZero() {
+			t.Errorf("Expiry not imported from %s: %+v", name, err)
+		}
+		if _, err = dst.GetBytes("deleted"); Exists(err) {
+			t.Errorf("Deleted key imported from %s: %+v", name, err)
+		}
+		if value, err := dst.GetBytes("transacted"); err != nil ||
+			string(value) != "value" {
+			t.Errorf("Unexpected value imported from %s: %q, %+v", name,
+				value, err)
+		}
+		if value, err := dst.Namespace("ns").GetBytes("inner"); err != nil ||
+			string(value) != "nested" {
+			t.Errorf("Unexpected namespace value imported from %s: %q, %+v",
+				name, value, err)
+		}
+		if err = dst.DropNamespace("ns"); err != nil {
+			t.Fatalf("DropNamespace failed: %+v", err)
+		}
+		if _, err = dst.Namespace("ns").GetBytes("inner"); Exists(err) {
+			t.Errorf("Imported namespace key survived the drop: %+v", err)
+		}
+	}
+}
+
+// Tests that an import either writes every entry or none: invalid input and
+// a failure to write an entry leave the store as it was.
+func TestFilestore_ImportAtomic(t *testing.T) {
+	dir := ".ekv_testdir_import_atomic"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.SetBytes("a", []byte("old")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+
+	for name, input := range map[string]string{
+		"malformed": `{"key":"a","value":"bmV3"}` + "\n" + `{"key":`,
+		"duplicate": `{"key":"a","value":"bmV3"}` + "\n" +
+			`{"key":"a","value":"bmV3"}`,
+		"reserved": `{"key":"a","value":"bmV3"}` + "\n" +
+			`{"key":"\u0000ekv:ttl-index","value":"bmV3"}`,
+		"unknown field": `{"key":"a","value":"bmV3","other":1}`,
+	} {
+		err = f.Import(strings.NewReader(input), ExportJSONLines, true)
+		if err == nil {
+			t.Errorf("Imported %s input", name)
+		}
+		if value, err := f.GetBytes("a"); err != nil ||
+			string(value) != "old" {
+			t.Errorf("Store changed importing %s input: %q, %+v", name,
+				value, err)
+		}
+	}
+
+	// A directory in place of the files of a key fails its write
+	path1, path2 := getPaths(f.getKey("blocked"))
+	for _, path := range []string{path1, path2} {
+		if err = portableOS.MkdirAll(path, 0700); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	input := `{"key":"a","value":"bmV3"}` + "\n" +
+		`{"key":"b","value":"bmV3"}` + "\n" +
+		`{"key":"blocked","value":"bmV3"}`
+	err = f.Import(strings.NewReader(input), ExportJSONLines, true)
+	if err == nil {
+		t.Fatalf("Import succeeded despite a failed write")
+	}
+	if value, err := f.GetBytes("a"); err != nil || string(value) != "old" {
+		t.Errorf("Replaced value not rolled back: %q, %+v", value, err)
+	}
+	if _, err = f.GetBytes("b"); Exists(err) {
+		t.Errorf("Added value not rolled back: %+v", err)
+	}
+}
@@ -0,0 +1,474 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// external.go detects changes made to the files of a Filestore by other
+// processes that opened the same directory. On Linux the directory is watched
+// with inotify, see external_linux.go, and elsewhere, or if inotify is not
+// available, the files of the store are polled.
+//
+// Values are stored under hashed names, so changed files are mapped back to
+// keys by the keys listed when detection starts, see keyIndex.go, and a
+// changed file that belongs to no key known yet is decrypted to find the key
+// it holds the value or merge log of. A file changes several times while it
+// is written or deleted, so the changes of a key are only looked at once its
+// files have settled, and files caught part way through are looked at again
+// on their next change. The value of every key last seen or written by this process
+// is remembered as a digest, and a change is only published, to the watchers
+// of the key as an event marked External, when the value differs from it.
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/ekv/portableOS"
+	"golang.org/x/crypto/blake2b"
+)
+
+// DefaultExternalPollInterval is how often the files of a Filestore are
+// polled for external changes when inotify is not available, unless set
+// otherwise.
+const DefaultExternalPollInterval = time.Second
+
+// externalSettleTime is how long the files of a key must go without changing
+// before the change is looked at.
+const externalSettleTime = 20 * time.Millisecond
+
+// WatchExternal starts detecting changes made to the values of the Filestore
+// by other processes, and returns a function that stops it. Every change is
+// published to the watchers of its key, see Watch, as an Event with External
+// set and no sequence number, and drops the cached indexes of the Filestore.
+// Changes made by this process are not reported again, and neither are
+// changes that leave a value as it was.
+//
+// On Linux, the directory of the Filestore is watched with inotify. On other
+// platforms, or if inotify is not available, the files of every key are
+// polled every pollInterval, or DefaultExternalPollInterval if it is 0.
+// Every key of the store is watched, including those other processes add.
+//
+// Detection stops when the Filestore is closed. Starting it again replaces
+// the previous detection.
+func (f *Filestore) WatchExternal(pollInterval time.Duration) (func(), error) {
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	if pollInterval <= 0 {
+		pollInterval = DefaultExternalPollInterval
+	}
+	w := newExternalWatcher(f)
+	if err = w.reload(); err != nil {
+		return nil, err
+	}
+
+	notified, err := w.notify()
+	if err != nil {
+		jww.WARN.Printf("Falling back to polling for external changes: %+v",
+			err)
+	}
+	if !notified {
+		go w.poll(pollInterval)
+	}
+	if old := f.external.Swap(w); old != nil {
+		old.close()
+	}
+	return func() {
+		f.external.CompareAndSwap(w, nil)
+		w.close()
+	}, nil
+}
+
+// observeExternal records the files and values of the changed keys as written
+// by this process, so that they are not reported as external. The values of
+// merges, and of any change without a value, are read again. The caller must
+// hold the locks of the keys.
+func (f *Filestore) observeExternal(changes ...Change) {
+	if w := f.external.Load(); w != nil {
+		for _, c := range changes {
+			w.observe(c)
+		}
+	}
+}
+
+// resetExternal lists the keys again and records the files of every key
+// as they are, after they were replaced by restoring a snapshot or a backup.
+// The caller must have paused the store.
+func (f *Filestore) resetExternal() error {
+	if w := f.external.Load(); w != nil {
+		return w.reload()
+	}
+	return nil
+}
+
+// dropCaches forgets the indexes cached by the Filestore, so that they are
+// read again from its files.
+func (f *Filestore) dropCaches() {
+	f.ttls.mux.Lock()
+	f.ttls.keys, f.ttls.loaded = nil, false
+	f.ttls.mux.Unlock()
+	f.namespaces.mux.Lock()
+	f.namespaces.indexed = nil
+	f.namespaces.mux.Unlock()
+	f.changes.mux.Lock()
+	f.changes.loaded = false
+	f.changes.mux.Unlock()
+}
+
+// fileStamp is the size and modification time of both files at a path, or
+// zero for those that do not exist.
+type fileStamp [2]struct {
+	size     int64
+	modified int64
+}
+
+// stampFiles returns the stamp of the files at path.
+func stampFiles(path string) fileStamp {
+	var s fileStamp
+	path1, path2 := getPaths(path)
+	for i, p := range []string{path1, path2} {
+		if info, err := portableOS.Stat(p); err == nil {
+			s[i].size, s[i].modified = info.Size(), info.ModTime().UnixNano()
+		}
+	}
+	return s
+}
+
+// count returns the number of files that exist.
+func (s fileStamp) count() int {
+	n := 0
+	for _, file := range s {
+		if file.modified != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// settled returns whether the files at path are not part way through being
+// written or deleted, given their stamp and the stamp last seen. Writes never
+// remove a file, so a value whose two files went down to one is being
+// deleted, and the last file modified must hold a complete record.
+func (s fileStamp) settled(path string, last fileStamp) bool {
+	if last.count() == 2 && s.count() == 1 {
+		return false
+	}
+	latest := max(s[0].modified, s[1].modified)
+	path1, path2 := getPaths(path)
+	for i, p := range []string{path1, path2} {
+		if s[i].modified != 0 && s[i].modified == latest && !validRecord(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// keyStamp is the stamp of the files of the value and the merge log of a key.
+type keyStamp struct {
+	value, log fileStamp
+}
+
+// valueDigest is a digest of a value, or of its absence. The zero digest
+// stands for a value that was never seen.
+type valueDigest [blake2b.Size256]byte
+
+// digestValue returns the digest of data, or of a missing value if it does
+// not exist.
+func digestValue(data []byte, exists bool) valueDigest {
+	if !exists {
+		return blake2b.Sum256([]byte{0})
+	}
+	return blake2b.Sum256(append([]byte{1}, data...))
+}
+
+// observedKey is what was last seen of a key.
+type observedKey struct {
+	stamp  keyStamp
+	digest valueDigest
+}
+
+// externalWatcher detects external changes to the files of a Filestore.
+type externalWatcher struct {
+	f *Filestore
+
+	stop    chan struct{}
+	stopped sync.Once
+	// closeNotify, if set, releases the inotify instance.
+	closeNotify func()
+
+	mux sync.Mutex
+	// paths maps the paths of the value and of the merge log of every
+	// known key to the key.
+	paths map[string]string
+	// keys holds what was last seen of every known key.
+	keys map[string]observedKey
+	// unknown holds the stamps of the files last seen to belong to no key.
+	unknown map[string]fileStamp
+	// pending holds the paths changed since they were last looked at, and
+	// all whether every path is to be looked at, once timer fires.
+	pending map[string]struct{}
+	all     bool
+	timer   *time.Timer
+}
+
+// newExternalWatcher returns a watcher of f that has yet to list its keys.
+func newExternalWatcher(f *Filestore) *externalWatcher {
+	return &externalWatcher{f: f, stop: make(chan struct{}),
+		pending: make(map[string]struct{})}
+}
+
+// close stops the watcher. Closing it again does nothing.
+func (w *externalWatcher) close() {
+	w.stopped.Do(func() {
+		close(w.stop)
+		if w.closeNotify != nil {
+			w.closeNotify()
+		}
+		w.mux.Lock()
+		if w.timer != nil {
+			w.timer.Stop()
+		}
+		w.mux.Unlock()
+	})
+}
+
+// reload lists the keys of the store and records the stamps of the files of
+// every key. Their values are yet to be seen. The caller must be in flight and
+// must not hold the locks of any key.
+func (w *externalWatcher) reload() error {
+	keys, err := w.f.indexedKeys()
+	if err != nil {
+		return err
+	}
+	paths := make(map[string]string, 2*len(keys))
+	observed := make(map[string]observedKey, len(keys))
+	for _, key := range keys {
+		path, logKey := w.f.getKey(key), w.f.getMergeLogKey(key)
+		paths[path], paths[logKey] = key, key
+		observed[key] = observedKey{stamp: keyStamp{
+			value: stampFiles(path), log: stampFiles(logKey)}}
+	}
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.paths, w.keys = paths, observed
+	w.unknown = make(map[string]fileStamp)
+	return nil
+}
+
+// observe records the files and value of the key of c as written by this
+// process. The caller must hold the locks of the key.
+func (w *externalWatcher) observe(c Change) {
+	if c.Op == ChangeReset {
+		return
+	}
+	path, logKey := w.f.getKey(c.Key), w.f.getMergeLogKey(c.Key)
+	o := observedKey{stamp: keyStamp{
+		value: stampFiles(path), log: stampFiles(logKey)}}
+	switch c.Op {
+	case ChangeSet:
+		o.digest = digestValue(c.Value, true)
+	case ChangeDelete:
+		o.digest = digestValue(nil, false)
+	default:
+		value, exists, _, err := w.f.readMerged(c.Key, path, logKey)
+		if err == nil || !Exists(err) {
+			o.digest = digestValue(value.data, exists)
+		}
+	}
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.paths[path], w.paths[logKey] = c.Key, c.Key
+	w.keys[c.Key] = o
+}
+
+// changed schedules a look at the file called name, or at every file if name
+// is empty, such as after events were lost. The look waits until no file has
+// changed for externalSettleTime, so that the files of a key have settled.
+func (w *externalWatcher) changed(name string) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if name == "" {
+		w.all = true
+	} else {
+		name = strings.TrimSuffix(strings.TrimSuffix(name, ".1"), ".2")
+		w.pending[w.f.basedir+string(os.PathSeparator)+name] = struct{}{}
+	}
+	if w.timer == nil {
+		w.timer = time.AfterFunc(externalSettleTime, w.settle)
+	} else {
+		w.timer.Reset(externalSettleTime)
+	}
+}
+
+// settle looks at the files changed since it last ran.
+func (w *externalWatcher) settle() {
+	w.mux.Lock()
+	pending, all := w.pending, w.all
+	w.pending, w.all = make(map[string]struct{}), false
+	w.mux.Unlock()
+
+	if all {
+		w.check(nil)
+		return
+	}
+	paths := make([]string, 0, len(pending))
+	for path := range pending {
+		paths = append(paths, path)
+	}
+	w.check(paths)
+}
+
+// check looks for external changes to the files at paths, or to every file
+// if paths is nil, and publishes them.
+func (w *externalWatcher) check(paths []string) {
+	select {
+	case <-w.stop:
+		return
+	default:
+	}
+	done, err := w.f.lifecycle.begin()
+	if err != nil {
+		// A locked store cannot read its files, and a closed one is gone
+		return
+	}
+	defer done()
+
+	w.discover(paths)
+
+	w.mux.Lock()
+	keys := make(map[string]struct{}, len(paths))
+	if paths == nil {
+		for key := range w.keys {
+			keys[key] = struct{}{}
+		}
+	}
+	for _, path := range paths {
+		if key, ok := w.paths[path]; ok {
+			keys[key] = struct{}{}
+		}
+	}
+	w.mux.Unlock()
+
+	for key := range keys {
+		if err = w.keyChanged(key); err != nil {
+			jww.ERROR.Printf("Failed to read external change of %q: %+v",
+				key, err)
+		}
+	}
+}
+
+// discover looks for keys new to this process among the files at paths, or
+// among every file of the store if paths is nil, and starts watching them.
+// Files that belong to no key are only read again once they change. The
+// caller must be in flight.
+func (w *externalWatcher) discover(paths []string) {
+	if paths == nil {
+		var err error
+		if paths, err = w.f.listPaths(); err != nil {
+			jww.ERROR.Printf("Failed to list the files of the store: %+v",
+				err)
+			return
+		}
+	}
+
+	for _, path := range paths {
+		stamp := stampFiles(path)
+		w.mux.Lock()
+		_, known := w.paths[path]
+		if !known && stamp.count() == 0 {
+			delete(w.unknown, path)
+		}
+		skip := known || stamp.count() == 0 || w.unknown[path] == stamp
+		w.mux.Unlock()
+		if skip {
+			continue
+		}
+
+		key, ok := w.f.pathKey(path)
+		w.mux.Lock()
+		if !ok {
+			w.unknown[path] = stamp
+		} else if _, exists := w.keys[key]; !exists {
+			// A new key has no files yet as far as this process knows
+			jww.TRACE.Printf("%s,EXTERNAL_KEY,%s,%s", kvDebugHeader, key,
+				path)
+			valuePath, logKey := w.f.getKey(key), w.f.getMergeLogKey(key)
+			w.paths[valuePath], w.paths[logKey] = key, key
+			w.keys[key] = observedKey{}
+		}
+		w.mux.Unlock()
+	}
+}
+
+// keyChanged publishes the value of key if its files were changed by another
+// process and hold a value different from the last one seen. Files that are
+// part way through a change are left for the next look. The caller must be in
+// flight.
+func (w *externalWatcher) keyChanged(key string) error {
+	path, logKey := w.f.getKey(key), w.f.getMergeLogKey(key)
+	unlock := w.f.takeLocks(false, path, logKey)
+	defer unlock()
+
+	// Changes made by this process are observed before the locks are
+	// released
+	stamp := keyStamp{value: stampFiles(path), log: stampFiles(logKey)}
+	w.mux.Lock()
+	last := w.keys[key]
+	w.mux.Unlock()
+	if stamp == last.stamp || !stamp.value.settled(path, last.stamp.value) ||
+		!stamp.log.settled(logKey, last.stamp.log) {
+		return nil
+	}
+
+	value, exists, _, err := w.f.readMerged(key, path, logKey)
+	if err != nil && Exists(err) {
+		return err
+	}
+	if stampFiles(path) != stamp.value || stampFiles(logKey) != stamp.log {
+		// Changed while being read
+		return nil
+	}
+
+	digest := digestValue(value.data, exists)
+	w.mux.Lock()
+	w.keys[key] = observedKey{stamp: stamp, digest: digest}
+	w.mux.Unlock()
+	if digest == last.digest {
+		return nil
+	}
+
+	jww.TRACE.Printf("%s,EXTERNAL,%s,%s", kvDebugHeader, key, path)
+	w.f.dropCaches()
+	c := Change{Op: ChangeDelete, Key: key, Time: w.f.clock.Now()}
+	if exists {
+		c.Op, c.Value = ChangeSet, value.data
+	}
+	w.f.watchers.publishExternal(c)
+	return nil
+}
+
+// poll looks for changes to the files of every key every interval until the
+// watcher is stopped.
+func (w *externalWatcher) poll(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.check(nil)
+		}
+	}
+}
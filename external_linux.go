@@ -0,0 +1,79 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// This file is compiled for Linux only.
+//go:build linux
+
+package ekv
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+// inotifyMask selects the events of files that were written, deleted, or
+// moved in or out of the directory, as by restoring a snapshot.
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_DELETE |
+	syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM
+
+// notify watches the directory of the Filestore with inotify, and returns
+// whether it does.
+func (w *externalWatcher) notify() (bool, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to initialize inotify")
+	}
+	_, err = syscall.InotifyAddWatch(fd, w.f.basedir, inotifyMask)
+	if err != nil {
+		_ = syscall.Close(fd)
+		return false, errors.Wrapf(err, "failed to watch %s", w.f.basedir)
+	}
+
+	// A non-blocking descriptor wrapped in a file is read through the
+	// runtime poller, so closing the file interrupts a pending read
+	file := os.NewFile(uintptr(fd), "inotify")
+	w.closeNotify = func() { _ = file.Close() }
+	go w.readNotify(file)
+	return true, nil
+}
+
+// readNotify handles the inotify events read from file until it is closed.
+func (w *externalWatcher) readNotify(file *os.File) {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := file.Read(buf)
+		if err != nil {
+			select {
+			case <-w.stop:
+			default:
+				jww.ERROR.Printf("Stopped reading inotify events: %+v", err)
+			}
+			return
+		}
+
+		for i := 0; i+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[i]))
+			start := i + syscall.SizeofInotifyEvent
+			i = start + int(event.Len)
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				// Events were lost, so every file is looked at
+				w.changed("")
+				continue
+			}
+			if i > n || event.Len == 0 {
+				continue
+			}
+			name := bytes.TrimRight(buf[start:i], "\x00")
+			w.changed(string(name))
+		}
+	}
+}
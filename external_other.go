@@ -0,0 +1,17 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// This file is compiled for all platforms except Linux.
+//go:build !linux
+
+package ekv
+
+// notify returns false, as inotify is only available on Linux, so the files
+// of the Filestore are polled instead.
+func (w *externalWatcher) notify() (bool, error) {
+	return false, nil
+}
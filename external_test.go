@@ -0,0 +1,233 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"gitlab.com/elixxir/ekv/portableOS"
+)
+
+// testExternal tests that every change other makes to the directory of local
+// is published once as an external event with its final value, and that the
+// changes of local are not. look makes local look for changes, if it does
+// not on its own.
+func testExternal(t *testing.T, local, other *Filestore, look func()) {
+	events, cancel := local.Watch("k")
+	defer cancel()
+	added, cancelAdded := local.Watch("added")
+	defer cancelAdded()
+	for _, kv := range []*Filestore{local, other} {
+		err := kv.RegisterMergeOperator("counter", CounterMergeOperator)
+		if err != nil {
+			t.Fatalf("RegisterMergeOperator failed: %+v", err)
+		}
+	}
+
+	if err := local.SetBytes("k", []byte("own")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	look()
+	if e := nextEvent(t, events); e.External || string(e.Value) != "own" {
+		t.Errorf("Unexpected event for a local change: %+v", e)
+	}
+
+	if err := other.SetBytes("k", []byte("theirs")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	look()
+	if e := nextEvent(t, events); !e.External || e.Op != ChangeSet ||
+		string(e.Value) != "theirs" {
+		t.Errorf("Unexpected event for an external change: %+v", e)
+	}
+	if data, err := local.GetBytes("k"); err != nil ||
+		string(data) != "theirs" {
+		t.Errorf("Read %q, %+v after an external change", data, err)
+	}
+
+	// New keys are found by decrypting their files, and merges through the
+	// merge log
+	if err := other.SetBytes("added", counterOperand(1)); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	look()
+	if e := nextEvent(t, added); !e.External ||
+		string(e.Value) != string(counterOperand(1)) {
+		t.Errorf("Unexpected event for an external key: %+v", e)
+	}
+	if err := other.Merge("added", "counter", counterOperand(2)); err != nil {
+		t.Fatalf("Merge failed: %+v", err)
+	}
+	look()
+	if e := nextEvent(t, added); !e.External ||
+		string(e.Value) != string(counterOperand(3)) {
+		t.Errorf("Unexpected event for an external merge: %+v", e)
+	}
+	if err := local.Merge("added", "counter", counterOperand(1)); err != nil {
+		t.Fatalf("Merge failed: %+v", err)
+	}
+	look()
+	if e := nextEvent(t, added); e.External || e.Op != ChangeMerge {
+		t.Errorf("Unexpected event for a local merge: %+v", e)
+	}
+
+	if err := other.Delete("k"); err != nil {
+		t.Fatalf("Delete failed: %+v", err)
+	}
+	look()
+	if e := nextEvent(t, events); !e.External || e.Op != ChangeDelete {
+		t.Errorf("Unexpected event for an external deletion: %+v", e)
+	}
+
+	// Writing a value again changes its files but not the value
+	if err := other.SetBytes("added", counterOperand(5)); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	look()
+	if e := nextEvent(t, added); !e.External ||
+		string(e.Value) != string(counterOperand(5)) {
+		t.Errorf("Unexpected event for an external change: %+v", e)
+	}
+	if err := other.SetBytes("added", counterOperand(5)); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	look()
+
+	select {
+	case e := <-events:
+		t.Errorf("Unexpected event after the last change: %+v", e)
+	case e := <-added:
+		t.Errorf("Unexpected event for an unchanged value: %+v", e)
+	case <-time.After(10 * externalSettleTime):
+	}
+}
+
+// openExternal opens two Filestores on the same directory, with a key
+// written before the second is opened.
+func openExternal(t *testing.T, dir string) (*Filestore, *Filestore) {
+	local, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = local.SetBytes("k", []byte("first")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	other, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	return local, other
+}
+
+// Tests detecting external changes with WatchExternal.
+func TestFilestore_WatchExternal(t *testing.T) {
+	dir := ".ekv_testdir_external"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	local, other := openExternal(t, dir)
+	defer other.Close()
+	stop, err := local.WatchExternal(0)
+	if err != nil {
+		t.Fatalf("WatchExternal failed: %+v", err)
+	}
+	if w := local.external.Load(); w.closeNotify == nil {
+		// Polling every second is too slow for the test
+		stop()
+		w = newExternalWatcher(local)
+		if err = w.reload(); err != nil {
+			t.Fatalf("reload failed: %+v", err)
+		}
+		local.external.Store(w)
+		go w.poll(externalSettleTime)
+		stop = w.close
+	}
+	testExternal(t, local, other, func() {})
+
+	stop()
+	if _, err = local.WatchExternal(0); err != nil {
+		t.Fatalf("WatchExternal failed: %+v", err)
+	}
+	if err = local.Close(); err != nil {
+		t.Fatalf("Close failed: %+v", err)
+	}
+	if local.external.Load() != nil {
+		t.Error("Watcher kept after closing the store")
+	}
+}
+
+// Tests looking for external changes in every file, as done by polling.
+func TestFilestore_WatchExternalPoll(t *testing.T) {
+	dir := ".ekv_testdir_external_poll"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	local, other := openExternal(t, dir)
+	defer other.Close()
+	defer local.Close()
+
+	w := newExternalWatcher(local)
+	if err := w.reload(); err != nil {
+		t.Fatalf("reload failed: %+v", err)
+	}
+	local.external.Store(w)
+	testExternal(t, local, other, func() { w.check(nil) })
+}
+
+// Tests that files part way through being written or deleted are left for
+// the next look.
+func TestFileStamp_Settled(t *testing.T) {
+	dir := ".ekv_testdir_external_settled"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	path := f.getKey("key")
+	for _, value := range []string{"1", "2"} {
+		if err = f.SetBytes("key", []byte(value)); err != nil {
+			t.Fatalf("SetBytes failed: %+v", err)
+		}
+	}
+	both := stampFiles(path)
+	if !both.settled(path, fileStamp{}) {
+		t.Error("Written files are not settled")
+	}
+
+	// A file overwritten by a secure delete holds no valid record
+	path1, path2 := getPaths(path)
+	time.Sleep(time.Millisecond)
+	if err = os.WriteFile(path2, []byte("random"), 0600); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if stampFiles(path).settled(path, both) {
+		t.Error("Overwritten file is settled")
+	}
+	if err = portableOS.Remove(path2); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if stampFiles(path).settled(path, both) {
+		t.Error("Half deleted files are settled")
+	}
+	if err = portableOS.Remove(path1); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !stampFiles(path).settled(path, both) {
+		t.Error("Deleted files are not settled")
+	}
+}
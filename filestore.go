@@ -10,10 +10,13 @@ package ekv
 import (
 	"bytes"
 	"crypto/rand"
-	"encoding/json"
+	"fmt"
 	"io"
 	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 	jww "github.com/spf13/jwalterweatherman"
@@ -22,16 +25,48 @@ import (
 
 const (
 	kvDebugHeader = "[KV FILE DEBUG]"
+
+	// ekvFileName is the name of the file used to verify the password and the
+	// read/write capabilities of the directory.
+	ekvFileName = ".ekv"
 )
 
+// ekvContents is the plaintext of the .ekv file.
+var ekvContents = []byte("version:1")
+
 // Filestore implements an ekv by reading and writing to files in a
 // directory.
 type Filestore struct {
 	basedir  string
-	password string
-	sync.RWMutex
+	key      []byte
+	mux      sync.RWMutex
 	keyLocks map[string]*sync.RWMutex
 	csprng   io.Reader
+
+	merges                   mergeRegistry
+	mergeCompactionThreshold int
+
+	appendConsolidationThreshold int
+
+	compression compressionPolicy
+	codecs      codecRegistry
+	schemas     schemaRegistry
+	namespaces  namespaceRegistry
+	ttls        ttlIndex
+	retention   retentionPolicies
+	sync        syncRegistry
+	changes     changeFeed
+	watchers    watchHub
+	external    atomic.Pointer[externalWatcher]
+	clock       clock
+
+	// snapshots serializes taking and restoring snapshots, and readOnly is
+	// set on the Filestore of an open snapshot.
+	snapshots sync.Mutex
+	readOnly  bool
+
+	panicOnMisuse atomic.Bool
+	lifecycle     lifecycle
 }
 
 // NewFilestore returns an initialized filestore object or an error
@@ -52,44 +87,47 @@ func NewFilestoreWithNonceGenerator(basedir, password string,
 		return nil, errors.WithStack(err)
 	}
 
-	// Get the path to the "ekv" file
-	ekvPath := basedir + string(os.PathSeparator) + ".ekv"
-	expectedContents := []byte("version:1")
-
 	// Try to read the .ekv.1/2 file, if it exists then we check
 	// it's contents
-	ekvCiphertext, err := read(ekvPath)
-	if !os.IsNotExist(err) {
-		if err != nil {
-			return nil, errors.WithStack(err)
-		} else if ekvCiphertext != nil {
-			ekvContents, err := decrypt(ekvCiphertext, password)
-			if err != nil {
-				return nil, errors.WithStack(err)
-			}
-
-			if !bytes.Equal(ekvContents, expectedContents) {
-				return nil, errors.Errorf("Bad decryption: "+
-					"%s != %s", ekvContents,
-					expectedContents)
-			}
-		}
+	key := deriveKey(password)
+	ekvPath := getEkvPath(basedir)
+	err = verifyKey(ekvPath, key)
+	if err != nil {
+		return nil, err
 	}
 
 	// Now try to write the .ekv file which also reads and verifies what
 	// we write
-	err = write(ekvPath, encrypt(expectedContents, password, csprng))
+	ekvCiphertext, err := encrypt(ekvContents, key, csprng)
+	if err != nil {
+		return nil, err
+	}
+	err = write(ekvPath, ekvCiphertext, csprng)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
+	fs := newFilestore(basedir, key, csprng)
+	if err = fs.openChanges(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// newFilestore returns a Filestore for the directory at basedir, which has
+// already been checked against key.
+func newFilestore(basedir string, key []byte, csprng io.Reader) *Filestore {
 	fs := &Filestore{
 		basedir:  basedir,
-		password: password,
+		key:      key,
 		keyLocks: make(map[string]*sync.RWMutex),
 		csprng:   csprng,
+
+		mergeCompactionThreshold:     defaultMergeCompactionThreshold,
+		appendConsolidationThreshold: defaultAppendConsolidationThreshold,
 	}
-	return fs, nil
+	fs.panicOnMisuse.Store(true)
+	return fs
 }
 
 // SetNonceGenerator sets the cryptographically secure pseudo-random
@@ -98,13 +136,87 @@ func (f *Filestore) SetNonceGenerator(csprng io.Reader) {
 	f.csprng = csprng
 }
 
-// Close is equivalent to nil'ing out the Filestore object. This function
-// is in place for the future when we add secure memory storage for keys.
-func (f *Filestore) Close() {
-	f.password = ""
+// SetPanicOnMisuse sets whether programming errors, such as using an Operable
+// after its transaction has closed, panic. When disabled, the misuse is logged
+// and the action is skipped instead. Enabled by default.
+func (f *Filestore) SetPanicOnMisuse(panicOnMisuse bool) {
+	f.panicOnMisuse.Store(panicOnMisuse)
+}
+
+// Close closes the Filestore per [KeyValue.Close]. It waits for operations and
+// transactions in flight to complete and then wipes the key material. Every
+// later call returns ErrClosed.
+func (f *Filestore) Close() error {
+	if w := f.external.Swap(nil); w != nil {
+		w.close()
+	}
+	err := f.lifecycle.close()
+	if err != nil {
+		return err
+	}
+	if err = f.closeChanges(); err != nil {
+		jww.WARN.Printf("Failed to mark the store as closed: %+v", err)
+	}
+
+	f.watchers.close()
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	wipe(f.key)
+	f.key = nil
 	f.basedir = ""
 	f.keyLocks = nil
 	f.csprng = nil
+	return nil
+}
+
+// Lock waits for operations and transactions in flight to complete and then
+// wipes the key material while keeping the Filestore open. Until Unlock is
+// called, operations return ErrLocked or, if SetBlockWhenLocked is enabled,
+// block. Locking a locked Filestore does nothing.
+//
+// Lock must not be called from inside a transaction on the same Filestore.
+func (f *Filestore) Lock() error {
+	return f.lifecycle.lock(func() {
+		wipe(f.key)
+		f.key = nil
+	})
+}
+
+// Unlock restores the key material of a locked Filestore from the password.
+// Returns ErrWrongPassword if it is not the password the Filestore was opened
+// with. Unlocking an unlocked Filestore does nothing.
+func (f *Filestore) Unlock(password string) error {
+	return f.lifecycle.unlock(func() error {
+		key := deriveKey(password)
+		err := verifyKey(getEkvPath(f.basedir), key)
+		if err != nil {
+			wipe(key)
+			return err
+		}
+		f.key = key
+		return nil
+	})
+}
+
+// IsLocked returns true while the Filestore is locked.
+func (f *Filestore) IsLocked() bool {
+	return f.lifecycle.isLocked()
+}
+
+// SetAutoLock locks the Filestore once no operation has been in flight for the
+// idle duration. A duration of zero disables the automatic lock.
+func (f *Filestore) SetAutoLock(idle time.Duration) {
+	f.lifecycle.setIdleTimeout(idle, func() {
+		if err := f.Lock(); err != nil {
+			jww.WARN.Printf("Failed to lock idle Filestore: %+v", err)
+		}
+	})
+}
+
+// SetBlockWhenLocked sets whether operations on a locked Filestore block until
+// it is unlocked instead of returning ErrLocked. Disabled by default.
+func (f *Filestore) SetBlockWhenLocked(block bool) {
+	f.lifecycle.setBlockWhenLocked(block)
 }
 
 // Set the value for the given key per [KeyValue.Set]
@@ -123,64 +235,361 @@ func (f *Filestore) Get(key string, loadIntoThisObject Unmarshaler) error {
 
 // Delete the value for the given key per [KeyValue.Delete]
 func (f *Filestore) Delete(key string) error {
-	encryptedKey := f.getKey(key)
-	unlock := f.takeWriteLock(encryptedKey)
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	return f.deleteKey(key)
+}
+
+// deleteKey deletes the value, merge log, stream and record log of key. The
+// caller must be in flight.
+func (f *Filestore) deleteKey(key string) error {
+	unlock := f.takeLocks(true, f.keyPaths(key)...)
 	defer unlock()
+	return f.deleteKeyFiles(key)
+}
+
+// keyPaths returns the paths of every file of key: its value, merge log,
+// stream, record log and history, in that order.
+func (f *Filestore) keyPaths(key string) []string {
+	return []string{f.getKey(key), f.getMergeLogKey(key), f.getStreamKey(key),
+		f.getAppendKey(key), f.getHistoryKey(key)}
+}
+
+// deleteKeyFiles is deleteKey without taking locks. The caller must be in
+// flight and hold the write locks of every path returned by keyPaths.
+func (f *Filestore) deleteKeyFiles(key string) error {
+	changes, err := f.recordChanges(Change{Op: ChangeDelete, Key: key})
+	if err != nil {
+		return err
+	}
+	return f.commitChanges(changes, f.removeKeyFiles(key))
+}
+
+// removeKeyFiles deletes the files of key for deleteKeyFiles and for deletes
+// in transactions. The caller must hold the write locks of every path
+// returned by keyPaths.
+func (f *Filestore) removeKeyFiles(key string) error {
+	paths := f.keyPaths(key)
+	encryptedKey, logKey, streamKey, appendKey, historyKey :=
+		paths[0], paths[1], paths[2], paths[3], paths[4]
 	jww.TRACE.Printf("%s,DELETE,%s,%s", kvDebugHeader, key, encryptedKey)
-	return deleteFiles(encryptedKey, f.csprng)
+	err := deleteFiles(encryptedKey, f.csprng)
+	if err != nil {
+		return err
+	}
+	err = f.clearMergeLog(key, logKey)
+	if err != nil {
+		return err
+	}
+	err = f.deleteStream(key, streamKey)
+	if err != nil {
+		return err
+	}
+	err = f.deleteHistory(key, historyKey)
+	if err != nil {
+		return err
+	}
+	return f.deleteRecords(key, appendKey)
 }
 
-// SetInterface uses json to encode and set data per [KeyValue.SetInterface]
+// SetInterface encodes and sets data per [KeyValue.SetInterface], using the
+// default codec of the Filestore, JSON unless changed with SetCodec.
 func (f *Filestore) SetInterface(key string, objectToStore interface{}) error {
-	data, err := json.Marshal(objectToStore)
+	return f.SetInterfaceWith(key, objectToStore)
+}
+
+// SetInterfaceWith is SetInterface with options that override the settings
+// of the Filestore for this write.
+func (f *Filestore) SetInterfaceWith(key string, objectToStore interface{},
+	opts ...WriteOption) error {
+	o := newWriteOptions(opts)
+	data, err := f.codecs.encode(objectToStore, o)
 	if err == nil {
-		err = f.SetBytes(key, data)
+		err = f.schemas.tag(key, o)
+	}
+	if err == nil {
+		err = f.setBytes(key, data, o)
 	}
 	return errors.WithStack(err)
 }
 
-// GetInterface uses json to encode and get data per [KeyValue.GetInterface]
+// SetCodec sets the default codec SetInterface encodes objects with. Values
+// already stored keep being decoded with the codec that encoded them.
+func (f *Filestore) SetCodec(c Codec) error {
+	return f.codecs.setDefault(c)
+}
+
+// RegisterCodec makes a custom codec available to decode values with. Codecs
+// passed to SetCodec or WithCodec are registered automatically, but values
+// encoded by a custom codec in an earlier session need it registered again.
+// The built in codecs are always available, and no other codec may take one
+// of their names.
+func (f *Filestore) RegisterCodec(c Codec) error {
+	return f.codecs.register(c)
+}
+
+// RegisterSchema registers s so that values can be written under it and
+// values of its earlier versions are upgraded when read. Registering a name
+// again replaces the previous schema.
+func (f *Filestore) RegisterSchema(s Schema) error {
+	return f.schemas.register(s)
+}
+
+// GetInterface decodes the value of key into v per [KeyValue.GetInterface],
+// using the codec the value was encoded with. Values of an earlier version of
+// their schema are upgraded first.
 func (f *Filestore) GetInterface(key string, v interface{}) error {
-	data, err := f.GetBytes(key)
+	value, err := f.getValue(key)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	upgraded, writeBack, err := f.schemas.upgrade(key, value, &f.codecs)
+	if err == nil && writeBack && !f.readOnly {
+		upgraded, err = f.upgradeValue(key)
+	}
 	if err == nil {
-		err = json.Unmarshal(data, v)
+		err = f.codecs.decode(upgraded.codec, upgraded.data, v)
 	}
 	return errors.WithStack(err)
 }
 
-// GetBytes implements [KeyValue.GetBytes]
-func (f *Filestore) GetBytes(key string) ([]byte, error) {
+// upgradeValue upgrades the value of key to the current version of its schema
+// and writes it back. The value is read again under the write lock, so it is
+// upgraded from whatever was last written.
+func (f *Filestore) upgradeValue(key string) (storedValue, error) {
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return storedValue{}, err
+	}
+	defer done()
+
 	encryptedKey := f.getKey(key)
-	unlock := f.takeReadLock(encryptedKey)
+	logKey := f.getMergeLogKey(key)
+	unlock := f.takeLocks(true, encryptedKey, logKey)
+	defer unlock()
 
-	encryptedContents, err := read(encryptedKey)
-	unlock()
+	value, _, _, err := f.readMerged(key, encryptedKey, logKey)
+	if err != nil {
+		return storedValue{}, err
+	}
+	upgraded, writeBack, err := f.schemas.upgrade(key, value, &f.codecs)
+	if err != nil || !writeBack {
+		return upgraded, err
+	}
 
-	var decryptedContents []byte
+	encryptedContents, err := f.encryptValue(key, upgraded.data,
+		&writeOptions{tags: upgraded.valueTags, meta: upgraded.meta})
+	if err != nil {
+		return storedValue{}, err
+	}
+	changes, err := f.recordChanges(
+		Change{Op: ChangeSet, Key: key, Value: upgraded.data})
+	if err != nil {
+		return storedValue{}, err
+	}
+	err = write(encryptedKey, encryptedContents, f.csprng)
 	if err == nil {
-		decryptedContents, err = decrypt(encryptedContents, f.password)
+		err = f.clearMergeLog(key, logKey)
 	}
-	return decryptedContents, errors.WithStack(err)
+	if err = f.commitChanges(changes, err); err != nil {
+		return storedValue{}, errors.WithStack(err)
+	}
+	return upgraded, nil
+}
+
+// GetBytes implements [KeyValue.GetBytes]
+func (f *Filestore) GetBytes(key string) ([]byte, error) {
+	value, err := f.getValue(key)
+	return value.data, err
+}
+
+// getValue reads the value of key along with the fields of its envelope.
+func (f *Filestore) getValue(key string) (storedValue, error) {
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return storedValue{}, err
+	}
+	defer done()
+
+	encryptedKey := f.getKey(key)
+	logKey := f.getMergeLogKey(key)
+	unlock := f.takeLocks(false, encryptedKey, logKey)
+	defer unlock()
+
+	value, _, _, err := f.readMerged(key, encryptedKey, logKey)
+	return value, errors.WithStack(err)
 }
 
 // SetBytes implements [KeyValue.SetBytes]
 func (f *Filestore) SetBytes(key string, data []byte) error {
+	return f.SetBytesWith(key, data)
+}
+
+// SetBytesWith is SetBytes with options that override the settings of the
+// Filestore for this write.
+func (f *Filestore) SetBytesWith(key string, data []byte,
+	opts ...WriteOption) error {
+	return f.setBytes(key, data, newWriteOptions(opts))
+}
+
+// setBytes implements SetBytesWith and SetInterfaceWith.
+func (f *Filestore) setBytes(key string, data []byte, opts *writeOptions) error {
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	if err = opts.setExpiry(f.clock.Now()); err != nil {
+		return err
+	}
+	if !opts.meta.expires.IsZero() {
+		if err = f.indexTTL(key); err != nil {
+			return err
+		}
+	}
+
 	encryptedKey := f.getKey(key)
-	encryptedContents := encrypt(data, f.password, f.csprng)
 	jww.TRACE.Printf(
 		"%s,SET,%s,%s,%s", kvDebugHeader, key, encryptedKey, data)
-	unlock := f.takeWriteLock(encryptedKey)
+	logKey := f.getMergeLogKey(key)
+	historyKey := f.getHistoryKey(key)
+	unlock := f.takeLocks(true, encryptedKey, logKey, historyKey)
+	defer unlock()
+
+	replaced := f.readReplaced(encryptedKey)
+	opts.meta.created = replaced.created(f.clock.Now())
+	encryptedContents, err := f.encryptValue(key, data, opts)
+	if err != nil {
+		return err
+	}
+	changes, err := f.recordChanges(
+		Change{Op: ChangeSet, Key: key, Value: data})
+	if err != nil {
+		return err
+	}
+	return f.commitChanges(changes, f.writeValue(key, encryptedKey, logKey,
+		historyKey, encryptedContents, replaced))
+}
+
+// writeValue replaces the value of key, keeping the previous one as a version
+// if history is enabled, and clears its merge log. replaced is the previous
+// value if the caller already read it, or nil. The caller must be in flight
+// and hold the write locks of encryptedKey, logKey and historyKey.
+func (f *Filestore) writeValue(key, encryptedKey, logKey, historyKey string,
+	encryptedContents []byte, replaced *replacedValue) error {
+	if err := f.archive(key, encryptedKey, historyKey, replaced); err != nil {
+		return err
+	}
+	err := write(encryptedKey, encryptedContents, f.csprng)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return f.clearMergeLog(key, logKey)
+}
+
+// RegisterMergeOperator registers op under name so that it can be referenced
+// by Merge. Registering a name again replaces the previous operator.
+func (f *Filestore) RegisterMergeOperator(name string, op MergeOperator) error {
+	return f.merges.register(name, op)
+}
+
+// Merge records operand as a delta against key. The operand is folded into
+// the value by the merge operator registered under name when the key is next
+// read or compacted. Only the operand is encrypted and written, as a new
+// segment of the pending log of the key, so the cost of a merge does not grow
+// with the number of operands pending. Readers of the key wait for the
+// operand to be written, as they fold in the pending log.
+func (f *Filestore) Merge(key, name string, operand []byte) error {
+	if _, err := f.merges.get(name); err != nil {
+		return err
+	}
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	logKey := f.getMergeLogKey(key)
+	jww.TRACE.Printf(
+		"%s,MERGE,%s,%s,%s,%s", kvDebugHeader, key, logKey, name, operand)
+	unlock := f.takeLocks(true, logKey)
+	var pending int
+	changes, err := f.recordChanges(Change{Op: ChangeMerge, Key: key,
+		Value: operand, Operator: name})
+	if err == nil {
+		pending, err = f.appendMergeLog(key, logKey,
+			mergeOperand{name, operand})
+		err = f.commitChanges(changes, err)
+	}
+	unlock()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if pending >= f.mergeCompactionThreshold {
+		return f.compactMerges(key)
+	}
+	return nil
+}
+
+// CompactMerges folds all pending merge operands of key into its stored value
+// and clears the pending log. It does nothing if there are no operands.
+func (f *Filestore) CompactMerges(key string) error {
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	return f.compactMerges(key)
+}
+
+// compactMerges implements CompactMerges for a caller that is already in
+// flight.
+func (f *Filestore) compactMerges(key string) error {
+	encryptedKey := f.getKey(key)
+	logKey := f.getMergeLogKey(key)
+	unlock := f.takeLocks(true, encryptedKey, logKey)
 	defer unlock()
 
-	err := write(encryptedKey, encryptedContents)
+	value, _, merged, err := f.readMerged(key, encryptedKey, logKey)
+	if err != nil {
+		if !Exists(err) {
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+	if merged == 0 {
+		return nil
+	}
+
+	encryptedContents, err := f.encryptValue(key, value.data,
+		&writeOptions{tags: value.valueTags, meta: value.meta})
+	if err != nil {
+		return err
+	}
+	err = write(encryptedKey, encryptedContents, f.csprng)
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	if err = f.clearMergeLog(key, logKey); err != nil {
+		return err
+	}
+	f.observeExternal(Change{Op: ChangeSet, Key: key, Value: value.data})
 	return nil
 }
 
 // Transaction implements [KeyValue.Transaction]
 func (f *Filestore) Transaction(op TransactionOperation, keys ...string) error {
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
 
 	// setup and get the data
 	e := newExtendable(f)
@@ -200,27 +609,166 @@ func (f *Filestore) Transaction(op TransactionOperation, keys ...string) error {
 	}
 
 	// flush operations
-	e.flush()
+	err = e.flush()
+	if err != nil {
+		return err
+	}
 
+	e.commit()
 	return nil
 }
 
 // Internal helper functions
 
+// takeLocks takes the per-key locks of every encrypted key, in the order of
+// the keys. Unlike takeReadLock and takeWriteLock, the store lock is only
+// held while looking up the per-key locks and not while waiting on them.
+func (f *Filestore) takeLocks(write bool, encryptedKeys ...string) (
+	unlock func()) {
+	locks := f.lookupLocks(encryptedKeys)
+	for _, lck := range locks {
+		if write {
+			lck.Lock()
+		} else {
+			lck.RLock()
+		}
+	}
+
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			if write {
+				locks[i].Unlock()
+			} else {
+				locks[i].RUnlock()
+			}
+		}
+	}
+}
+
+// readMerged reads and decrypts the value stored at encryptedKey and folds in
+// any operands pending in the merge log at logKey. An expired value is treated
+// as missing. It returns whether the value exists and the number of operands
+// folded in. The caller must hold the locks of both paths.
+func (f *Filestore) readMerged(key, encryptedKey, logKey string) (
+	value storedValue, exists bool, merged int, err error) {
+	operands, err := f.readMergeLog(key, logKey)
+	if err != nil {
+		return storedValue{}, false, 0, err
+	}
+
+	encryptedContents, err := read(encryptedKey)
+	if err != nil {
+		if Exists(err) || len(operands) == 0 {
+			return storedValue{}, false, 0, err
+		}
+	} else {
+		value, err = f.decryptValue(encryptedContents)
+		if err != nil {
+			return storedValue{}, false, 0, err
+		}
+		exists = true
+		if value.meta.expired(f.clock.Now()) {
+			if len(operands) == 0 {
+				return storedValue{}, false, 0, errors.WithStack(ErrNotFound)
+			}
+			value, exists = storedValue{}, false
+		}
+	}
+
+	if len(operands) == 0 {
+		return value, exists, 0, nil
+	}
+	value.data, exists, err = f.merges.fold(key, value.data, exists, operands)
+	if err != nil {
+		return storedValue{}, false, 0, err
+	}
+	return value, exists, len(operands), nil
+}
+
+// readMergeLog returns the operands pending in the merge log of key, the
+// record log at logKey, or nil if there are none. The caller must hold the
+// lock of logKey.
+func (f *Filestore) readMergeLog(key, logKey string) ([]mergeOperand, error) {
+	m, err := f.readAppendManifest(logKey)
+	if err != nil {
+		if !Exists(err) {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	var operands []mergeOperand
+	for _, s := range m.segments {
+		records, err := f.readSegment(mergeLogKeyPrefix+key, s)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			recorded, err := unmarshalMergeLog(r)
+			if err != nil {
+				return nil, err
+			}
+			operands = append(operands, recorded...)
+		}
+	}
+	return operands, nil
+}
+
+// appendMergeLog appends operand to the merge log of key at logKey and
+// returns the number of operands pending. The caller must hold the lock of
+// logKey.
+func (f *Filestore) appendMergeLog(key, logKey string,
+	operand mergeOperand) (int, error) {
+	record := marshalMergeLog([]mergeOperand{operand})
+	err := f.appendRecords(mergeLogKeyPrefix+key, logKey, [][]byte{record})
+	if err != nil {
+		return 0, err
+	}
+	m, err := f.readAppendManifest(logKey)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	pending := 0
+	for _, s := range m.segments {
+		pending += int(s.records)
+	}
+	return pending, nil
+}
+
+// writeMergeLog replaces the merge log of key at logKey with operands. The
+// caller must hold the lock of logKey.
+func (f *Filestore) writeMergeLog(key, logKey string,
+	operands []mergeOperand) error {
+	err := f.clearMergeLog(key, logKey)
+	if err != nil || len(operands) == 0 {
+		return err
+	}
+	records := make([][]byte, len(operands))
+	for i, o := range operands {
+		records[i] = marshalMergeLog([]mergeOperand{o})
+	}
+	return f.appendRecords(mergeLogKeyPrefix+key, logKey, records)
+}
+
+// clearMergeLog securely deletes the merge log of key at logKey, if there is
+// one. The caller must hold the lock of logKey.
+func (f *Filestore) clearMergeLog(key, logKey string) error {
+	return f.deleteRecords(mergeLogKeyPrefix+key, logKey)
+}
+
 func (f *Filestore) takeWriteLock(encryptedKey string) (unlock func()) {
-	f.RLock()
+	f.mux.RLock()
 	lck, ok := f.keyLocks[encryptedKey]
 	if ok {
 		lck.Lock()
-		f.RUnlock()
+		f.mux.RUnlock()
 		unlock = lck.Unlock
 		return unlock
 	}
-	f.RUnlock()
+	f.mux.RUnlock()
 
 	// Note that 2 threads can get to this line at the same time,
 	// which is why we check again after taking the write lock
-	f.Lock()
+	f.mux.Lock()
 
 	lck, ok = f.keyLocks[encryptedKey]
 	if !ok {
@@ -229,24 +777,24 @@ func (f *Filestore) takeWriteLock(encryptedKey string) (unlock func()) {
 	}
 	lck.Lock()
 	unlock = lck.Unlock
-	f.Unlock()
+	f.mux.Unlock()
 	return unlock
 }
 
 func (f *Filestore) takeReadLock(encryptedKey string) (unlock func()) {
-	f.RLock()
+	f.mux.RLock()
 	lck, ok := f.keyLocks[encryptedKey]
 	if ok {
 		lck.RLock()
-		f.RUnlock()
+		f.mux.RUnlock()
 		unlock = lck.RUnlock
 		return unlock
 	}
-	f.RUnlock()
+	f.mux.RUnlock()
 
 	// Note that 2 threads can get to this line at the same time,
 	// which is why we check again after taking the write lock
-	f.Lock()
+	f.mux.Lock()
 
 	lck, ok = f.keyLocks[encryptedKey]
 	if !ok {
@@ -255,32 +803,39 @@ func (f *Filestore) takeReadLock(encryptedKey string) (unlock func()) {
 	}
 	lck.RLock()
 	unlock = lck.RUnlock
-	f.Unlock()
+	f.mux.Unlock()
 	return unlock
 }
 
+// takeTransactionLocks takes the write locks of every encrypted key of a
+// transaction. Like takeLocks, the store lock is not held while waiting on
+// them, so that a transaction holding its keys can still take other locks,
+// such as those of the index of a namespace when it is extended.
 func (f *Filestore) takeTransactionLocks(encryptedKeys []string) (unlock func()) {
-	locks := make([]*sync.RWMutex, 0, len(encryptedKeys))
-
-	f.Lock()
+	return f.takeLocks(true, encryptedKeys...)
+}
 
-	for _, ecrKey := range encryptedKeys {
+// lookupLocks returns the per-key locks of the encrypted keys, creating those
+// that do not exist yet. The locks are sorted by key, without duplicates, so
+// that every caller takes them in the same order.
+func (f *Filestore) lookupLocks(encryptedKeys []string) []*sync.RWMutex {
+	sorted := append([]string(nil), encryptedKeys...)
+	sort.Strings(sorted)
+	locks := make([]*sync.RWMutex, 0, len(sorted))
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	for i, ecrKey := range sorted {
+		if i > 0 && sorted[i-1] == ecrKey {
+			continue
+		}
 		lck, ok := f.keyLocks[ecrKey]
 		if !ok {
 			lck = &sync.RWMutex{}
 			f.keyLocks[ecrKey] = lck
 		}
-		lck.Lock()
 		locks = append(locks, lck)
 	}
-
-	f.Unlock()
-
-	return func() {
-		for _, lck := range locks {
-			lck.Unlock()
-		}
-	}
+	return locks
 }
 
 type extendable struct {
@@ -288,6 +843,9 @@ type extendable struct {
 	unlock    func()
 	f         *Filestore
 	operables []map[string]Operable
+	// changes holds the changes flushed by the operables, which are recorded
+	// in the change feed as they are flushed, until they are published
+	changes []Change
 }
 
 func newExtendable(f *Filestore) *extendable {
@@ -300,22 +858,28 @@ func newExtendable(f *Filestore) *extendable {
 
 func (e *extendable) Extend(keys []string) (map[string]Operable, error) {
 	if e.closed {
-		jww.FATAL.Panicf("Cannot extend, transaction already closed")
+		return nil, errors.Wrap(ErrClosed,
+			"Cannot extend, transaction already closed")
 	}
 	operables := make(map[string]Operable, len(keys))
-	ecrKeys := make([]string, len(keys))
+	ecrKeys := make([]string, 0, 5*len(keys))
 
-	// make the ecrypted keys
-	for i, key := range keys {
-		ecrkey := e.f.getKey(key)
+	// make the ecrypted keys, locking every file of the keys so that a
+	// delete can remove them all
+	for _, key := range keys {
+		paths := e.f.keyPaths(key)
 		operables[key] = &operable{
-			key:    key,
-			closed: false,
-			ecrKey: ecrkey,
-			op:     readOp,
-			f:      e.f,
+			key:        key,
+			closed:     false,
+			ecrKey:     paths[0],
+			logKey:     paths[1],
+			appendKey:  paths[3],
+			historyKey: paths[4],
+			op:         readOp,
+			f:          e.f,
+			changes:    &e.changes,
 		}
-		ecrKeys[i] = ecrkey
+		ecrKeys = append(ecrKeys, paths...)
 	}
 
 	// get the locks
@@ -324,27 +888,19 @@ func (e *extendable) Extend(keys []string) (map[string]Operable, error) {
 	// read the keys
 	for _, oper := range operables {
 		operInternal := oper.(*operable)
-		encryptedContents, err := read(operInternal.ecrKey)
+		value, hasfile, merged, err := e.f.readMerged(
+			operInternal.key, operInternal.ecrKey, operInternal.logKey)
 		// if an error is received which is not the file is not found, return it
-		hasfile := true
-		if err != nil {
-			if !Exists(err) {
-				hasfile = false
-			} else {
-				return nil, err
-			}
+		if err != nil && Exists(err) {
+			return nil, err
 		}
 
-		var decryptedContents []byte
-		if hasfile {
-			decryptedContents, err = decrypt(encryptedContents, e.f.password)
-			if err != nil {
-				return nil, err
-			}
-		}
 		operInternal.exists = hasfile
 		operInternal.existed = hasfile
-		operInternal.data = decryptedContents
+		operInternal.merged = merged
+		operInternal.data = value.data
+		operInternal.tags = value.valueTags
+		operInternal.meta = value.meta
 	}
 	e.operables = append(e.operables, operables)
 	return operables, nil
@@ -362,21 +918,31 @@ func (e *extendable) addUnlock(u func()) {
 	}
 }
 
-func (e *extendable) flush() {
+func (e *extendable) flush() error {
 	for _, opMap := range e.operables {
-		for _, oper := range opMap {
+		for key, oper := range opMap {
 			if !oper.IsClosed() {
 				if err := oper.Flush(); err != nil {
-					jww.FATAL.Panicf("Failed on a flush of key %s in "+
-						"transaction: %+v", oper.Key(), err)
+					return errors.Wrapf(err, "Failed on a flush of key %s "+
+						"in transaction", key)
 				}
 			}
 		}
 	}
+	return nil
+}
+
+// commit publishes the changes flushed so far, all at once.
+func (e *extendable) commit() {
+	changes := e.changes
+	e.changes = nil
+	e.f.publishChanges(changes)
 }
 
 func (e *extendable) close() {
 	e.closed = true
+	// Values flushed before the transaction failed are still committed
+	e.commit()
 	e.unlock()
 }
 
@@ -384,15 +950,26 @@ type operable struct {
 	key    string
 	closed bool
 
-	ecrKey string
+	ecrKey     string
+	logKey     string
+	appendKey  string
+	historyKey string
 
 	data    []byte
+	tags    valueTags
+	meta    valueMeta
 	exists  bool
 	existed bool
+	merged  int
+
+	// appended holds the records to append to the record log of the key
+	appended [][]byte
 
 	op OperableOps
 
 	f *Filestore
+	// changes collects the changes flushed in the transaction
+	changes *[]Change
 }
 
 func (op *operable) Key() string {
@@ -401,49 +978,150 @@ func (op *operable) Key() string {
 }
 
 func (op *operable) Exists() bool {
-	op.testClosed("Exists()")
+	if op.testClosed("Exists()") {
+		return false
+	}
 	return op.exists
 }
 
 func (op *operable) Delete() {
-	op.testClosed("Delete()")
+	if op.testClosed("Delete()") {
+		return
+	}
 
 	op.data = nil
+	op.meta = valueMeta{}
 	op.exists = false
 	op.op = deleteOp
 }
 
 func (op *operable) Set(data []byte) {
-	op.testClosed("Set()")
+	if op.testClosed("Set()") {
+		return
+	}
 
 	op.data = data
+	op.tags = valueTags{}
+	op.meta = valueMeta{created: op.meta.created}
 	op.exists = true
 	op.op = writeOp
 }
 
 func (op *operable) Get() ([]byte, bool) {
-	op.testClosed("Get()")
+	if op.testClosed("Get()") {
+		return nil, false
+	}
 	return op.data, op.exists
 }
 
+func (op *operable) GetInterface(v interface{}) error {
+	if op.testClosed("GetInterface()") {
+		return errors.Wrapf(ErrClosed, "Cannot get '%s'", op.key)
+	}
+	if !op.exists {
+		return errors.WithStack(ErrNotFound)
+	}
+	value, writeBack, err := op.f.schemas.upgrade(op.key,
+		storedValue{data: op.data, valueTags: op.tags}, &op.f.codecs)
+	if err != nil {
+		return err
+	}
+	if writeBack && op.op == readOp && !op.f.readOnly {
+		op.data, op.tags = value.data, value.valueTags
+		op.op = writeOp
+	}
+	return op.f.codecs.decode(value.codec, value.data, v)
+}
+
+func (op *operable) SetInterface(v interface{}) error {
+	if op.testClosed("SetInterface()") {
+		return errors.Wrapf(ErrClosed, "Cannot set '%s'", op.key)
+	}
+	o := &writeOptions{}
+	data, err := op.f.codecs.encode(v, o)
+	if err == nil {
+		err = op.f.schemas.tag(op.key, o)
+	}
+	if err != nil {
+		return err
+	}
+	op.Set(data)
+	op.tags = o.tags
+	return nil
+}
+
+func (op *operable) Append(data []byte) {
+	if op.testClosed("Append()") {
+		return
+	}
+	op.appended = append(op.appended, data)
+}
+
 func (op *operable) Flush() error {
-	op.testClosed("Flush()")
+	if op.testClosed("Flush()") {
+		return errors.Wrapf(ErrClosed, "Cannot flush '%s'", op.key)
+	}
 	defer func() {
 		op.closed = true
 	}()
+	if op.f.readOnly && (op.op != readOp || len(op.appended) > 0) {
+		return errors.Wrapf(ErrReadOnly, "Cannot flush '%s'", op.key)
+	}
+	err := op.flushValue()
+	if err != nil || len(op.appended) == 0 {
+		return err
+	}
+	return op.f.appendRecords(op.key, op.appendKey, op.appended)
+}
+
+// flushValue writes or deletes the value of the key as set by the operation.
+func (op *operable) flushValue() error {
 	switch op.op {
 	case readOp:
 		return nil
 	case writeOp:
-		encryptedNewContents := encrypt(op.data, op.f.password, op.f.csprng)
-		return write(op.ecrKey, encryptedNewContents)
+		encryptedNewContents, err := op.f.encryptValue(op.key, op.data,
+			&writeOptions{tags: op.tags, meta: op.meta})
+		if err != nil {
+			return err
+		}
+		return op.commit(Change{Op: ChangeSet, Key: op.key, Value: op.data},
+			func() error {
+				err := op.f.archive(op.key, op.ecrKey, op.historyKey,
+					nil)
+				if err != nil {
+					return err
+				}
+				return write(op.ecrKey, encryptedNewContents, op.f.csprng)
+			})
 	case deleteOp:
-		if op.existed {
-			return deleteFiles(op.ecrKey, op.f.csprng)
+		// Like Delete, this removes every file of the key, but the change is
+		// only recorded if there was a value
+		remove := func() error { return op.f.removeKeyFiles(op.key) }
+		if !op.existed {
+			return remove()
 		}
-		return nil
+		return op.commit(Change{Op: ChangeDelete, Key: op.key}, remove)
+	}
+	return nil
+}
 
+// commit records change in the change feed, makes it with apply and then
+// clears the merge log of the key if the value read had operands folded in.
+// The change is published with the other changes of the transaction.
+func (op *operable) commit(change Change, apply func() error) error {
+	changes, err := op.f.recordChanges(change)
+	if err != nil {
+		return err
+	}
+	err = apply()
+	if err == nil && op.merged != 0 {
+		err = op.f.clearMergeLog(op.key, op.logKey)
 	}
+	if err != nil {
+		return op.f.commitChanges(changes, err)
+	}
+	*op.changes = append(*op.changes, changes...)
 	return nil
 }
 
@@ -451,10 +1129,16 @@ func (op *operable) IsClosed() bool {
 	return op.closed
 }
 
-func (op *operable) testClosed(action string) {
+// testClosed reports whether the operable is closed. Using a closed operable
+// is a programming error, so this panics unless the store is configured not
+// to, in which case the error is logged and the caller skips the action.
+func (op *operable) testClosed(action string) bool {
 	if op.closed {
-		jww.FATAL.Panicf("Cannot '%s' on '%s', already closed", action, op.key)
+		reportMisuse(op.f.panicOnMisuse.Load(),
+			"Cannot '%s' on '%s', already closed", action, op.key)
+		return true
 	}
+	return false
 }
 
 type OperableOps uint8
@@ -466,7 +1150,43 @@ const (
 )
 
 func (f *Filestore) getKey(key string) string {
-	encryptedKey := hashStringWithPassword(key, f.password)
+	encryptedKey := hashStringWithKey(key, f.key)
 	encryptedKeyStr := encodeKey(encryptedKey)
 	return f.basedir + string(os.PathSeparator) + encryptedKeyStr
 }
+
+// getMergeLogKey returns the path of the manifest of the pending merge log of
+// key.
+func (f *Filestore) getMergeLogKey(key string) string {
+	return f.getAppendKey(mergeLogKeyPrefix + key)
+}
+
+// getEkvPath returns the path to the .ekv file of the store at basedir.
+func getEkvPath(basedir string) string {
+	return basedir + string(os.PathSeparator) + ekvFileName
+}
+
+// verifyKey checks that key decrypts the .ekv file at ekvPath. Returns
+// ErrWrongPassword if it does not. A missing .ekv file is not an error.
+func verifyKey(ekvPath string, key []byte) error {
+	ekvCiphertext, err := read(ekvPath)
+	if !Exists(err) {
+		return nil
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+
+	contents, err := decrypt(ekvCiphertext, key)
+	if errors.Is(err, ErrTampered) {
+		return errors.WithStack(ErrWrongPassword)
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if !bytes.Equal(contents, ekvContents) {
+		return errors.WithStack(&ErrCorrupt{Path: ekvPath,
+			Reason: fmt.Sprintf("Bad decryption: %s != %s",
+				contents, ekvContents)})
+	}
+	return nil
+}
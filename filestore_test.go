@@ -389,3 +389,138 @@ func TestFilestore_FDCount(t *testing.T) {
 	debug.SetGCPercent(100)
 
 }
+
+// TestFilestore_FailingCSPRNG checks that a failing nonce generator returns an
+// error from SetBytes and Transaction instead of panicking.
+func TestFilestore_FailingCSPRNG(t *testing.T) {
+	defer func() {
+		if err := portableOS.RemoveAll(".ekv_testdir_failingrng"); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	f, err := NewFilestore(".ekv_testdir_failingrng", "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	f.SetNonceGenerator(failingReader{})
+
+	if err = f.SetBytes("key", []byte("value")); err == nil {
+		t.Errorf("SetBytes succeeded with a failing csprng")
+	}
+
+	err = f.Transaction(func(files map[string]Operable, _ Extender) error {
+		files["key"].Set([]byte("value"))
+		return nil
+	}, "key")
+	if err == nil {
+		t.Errorf("Transaction succeeded with a failing csprng")
+	}
+}
+
+// TestFilestore_MisuseNoPanic checks that using an operable after its
+// transaction has closed only panics when configured to.
+func TestFilestore_MisuseNoPanic(t *testing.T) {
+	defer func() {
+		if err := portableOS.RemoveAll(".ekv_testdir_misuse"); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	f, err := NewFilestore(".ekv_testdir_misuse", "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	var leaked Operable
+	var leakedExt Extender
+	err = f.Transaction(func(files map[string]Operable, ext Extender) error {
+		leaked, leakedExt = files["key"], ext
+		return nil
+	}, "key")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if _, err = leakedExt.Extend([]string{"other"}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Extend, got %+v", err)
+	}
+
+	f.SetPanicOnMisuse(false)
+	leaked.Set([]byte("value"))
+	if err = leaked.Flush(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Flush, got %+v", err)
+	}
+	if _, err = f.GetBytes("key"); Exists(err) {
+		t.Errorf("Closed operable wrote to the store: %+v", err)
+	}
+
+	f.SetPanicOnMisuse(true)
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("Misuse did not panic")
+		}
+	}()
+	leaked.Set([]byte("value"))
+}
+
+// testExtendContended checks that a transaction can extend its keys while
+// another transaction waits on the keys it holds. The waiting transaction
+// used to hold the store lock, which extending needs to index the new keys.
+func testExtendContended(t *testing.T, kv KeyValue, extended string) {
+	held := make(chan struct{})
+	results := make(chan error, 2)
+	go func() {
+		results <- kv.Transaction(
+			func(files map[string]Operable, ext Extender) error {
+				close(held)
+				// Give the other transaction time to wait on the key
+				time.Sleep(50 * time.Millisecond)
+				more, err := ext.Extend([]string{extended})
+				if err != nil {
+					return err
+				}
+				more[extended].Set([]byte("extended"))
+				return nil
+			}, "held")
+	}()
+	<-held
+	go func() {
+		results <- kv.Transaction(
+			func(files map[string]Operable, _ Extender) error {
+				files["held"].Set([]byte("waited"))
+				return nil
+			}, "other", "held")
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-results:
+			if err != nil {
+				t.Fatalf("Transaction failed: %+v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Transactions deadlocked")
+		}
+	}
+	if data, err := kv.GetBytes(extended); err != nil ||
+		string(data) != "extended" {
+		t.Errorf("Extended key not written: %q, %+v", data, err)
+	}
+}
+
+// TestFilestore_ExtendContended checks that extending a transaction does not
+// deadlock with transactions waiting on its keys.
+func TestFilestore_ExtendContended(t *testing.T) {
+	defer func() {
+		if err := portableOS.RemoveAll(".ekv_testdir_extend"); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	f, err := NewFilestore(".ekv_testdir_extend", "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	testExtendContended(t, f, "new")
+}
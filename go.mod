@@ -6,13 +6,16 @@ toolchain go1.21.5
 
 require (
 	github.com/Max-Sum/base32768 v0.0.0-20230304063302-18e6ce5945fd
+	github.com/fxamacker/cbor/v2 v2.7.0
 	github.com/pkg/errors v0.9.1
 	github.com/spf13/jwalterweatherman v1.1.0
 	gitlab.com/elixxir/wasm-utils v0.0.3
 	golang.org/x/crypto v0.16.0
+	google.golang.org/protobuf v1.34.2
 )
 
 require (
 	github.com/stretchr/testify v1.8.2 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	golang.org/x/sys v0.15.0 // indirect
 )
@@ -0,0 +1,487 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// history.go implements value history. When a retention policy applies to a
+// key, every value it replaces is kept as a numbered version: its encrypted
+// contents are copied to a file of their own and an encrypted manifest lists
+// the versions of the key. Versions the policy no longer retains are hidden
+// and securely deleted the next time the key is written, or by PurgeHistory.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+const (
+	// historyKeyPrefix is prepended to a key to derive the key of its history
+	// manifest, and historyVersionKeyPrefix to derive its versions.
+	historyKeyPrefix        = "\x00ekv:history:"
+	historyVersionKeyPrefix = "\x00ekv:history-version:"
+
+	historyManifestVersion = 1
+
+	errHistoryManifest = "invalid history manifest: %s"
+	errUnknownVersion  = "key %q has no version %d"
+)
+
+// RetentionPolicy decides which previous values of a key are kept as
+// versions. A version is kept only while it satisfies every limit that is
+// set. The zero policy keeps no history.
+type RetentionPolicy struct {
+	// Versions is the number of most recent versions kept, or 0 for no
+	// limit.
+	Versions int
+	// MaxAge is how long a version is kept after it is replaced, or 0 for no
+	// limit.
+	MaxAge time.Duration
+}
+
+// enabled returns whether the policy keeps history.
+func (p RetentionPolicy) enabled() bool {
+	return p.Versions > 0 || p.MaxAge > 0
+}
+
+// retains returns whether the policy retains the version at index i of n
+// versions, ordered from oldest to newest, replaced at the given time.
+func (p RetentionPolicy) retains(i, n int, replaced, now time.Time) bool {
+	if p.Versions > 0 && i < n-p.Versions {
+		return false
+	}
+	return p.MaxAge <= 0 || now.Sub(replaced) < p.MaxAge
+}
+
+// VersionInfo describes a previous value of a key.
+type VersionInfo struct {
+	// Version numbers the versions of a key in the order they were replaced,
+	// starting at 1.
+	Version uint64
+	// Replaced is when the value was replaced.
+	Replaced time.Time
+	// Modified is when the value was written.
+	Modified time.Time
+	// Size is the size of the value in bytes.
+	Size int64
+}
+
+// retentionPolicies decides the retention policy of each key. The policy of
+// the longest matching prefix applies, or the store default if none match.
+type retentionPolicies struct {
+	defaultPolicy RetentionPolicy
+	prefixes      map[string]RetentionPolicy
+	mux           sync.RWMutex
+}
+
+// policyFor returns the retention policy of key.
+func (r *retentionPolicies) policyFor(key string) RetentionPolicy {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	policy, longest := r.defaultPolicy, -1
+	for prefix, prefixPolicy := range r.prefixes {
+		if len(prefix) > longest && strings.HasPrefix(key, prefix) {
+			policy, longest = prefixPolicy, len(prefix)
+		}
+	}
+	return policy
+}
+
+// historyManifest lists the versions of a key from oldest to newest.
+type historyManifest struct {
+	next     uint64
+	versions []VersionInfo
+}
+
+// marshal encodes the manifest as
+// [version][uvarint next version][uvarint count] followed by
+// [uvarint version][varint replaced][varint modified][uvarint size] for every
+// version. Times are nanoseconds since the Unix epoch.
+func (m *historyManifest) marshal() []byte {
+	buf := []byte{historyManifestVersion}
+	buf = binary.AppendUvarint(buf, m.next)
+	buf = binary.AppendUvarint(buf, uint64(len(m.versions)))
+	for _, v := range m.versions {
+		buf = binary.AppendUvarint(buf, v.Version)
+		buf = binary.AppendVarint(buf, v.Replaced.UnixNano())
+		buf = binary.AppendVarint(buf, v.Modified.UnixNano())
+		buf = binary.AppendUvarint(buf, uint64(v.Size))
+	}
+	return buf
+}
+
+// unmarshalHistoryManifest is the inverse of historyManifest.marshal.
+func unmarshalHistoryManifest(data []byte) (*historyManifest, error) {
+	if len(data) == 0 || data[0] != historyManifestVersion {
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+			errHistoryManifest, "unknown version")})
+	}
+	d := metaDecoder{data: data[1:]}
+	m := &historyManifest{next: d.uvarint()}
+	count := d.uvarint()
+	// Every version takes at least 4 bytes, so a larger count is corrupt
+	if d.err == nil && count > uint64(len(d.data))/4 {
+		d.err = errors.New("version count exceeds size")
+	}
+	for i := uint64(0); i < count && d.err == nil; i++ {
+		m.versions = append(m.versions, VersionInfo{
+			Version:  d.uvarint(),
+			Replaced: time.Unix(0, d.varint()),
+			Modified: time.Unix(0, d.varint()),
+			Size:     int64(d.uvarint()),
+		})
+	}
+	if d.err == nil && len(d.data) != 0 {
+		d.err = errors.New("trailing data")
+	}
+	if d.err != nil {
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+			errHistoryManifest, d.err.Error())})
+	}
+	return m, nil
+}
+
+// SetRetention sets the retention policy of keys without a matching prefix.
+// By default no history is kept.
+func (f *Filestore) SetRetention(policy RetentionPolicy) {
+	f.retention.mux.Lock()
+	defer f.retention.mux.Unlock()
+	f.retention.defaultPolicy = policy
+}
+
+// SetRetentionForPrefix sets the retention policy of keys starting with
+// prefix, overriding SetRetention. When several prefixes match a key the
+// longest applies.
+func (f *Filestore) SetRetentionForPrefix(prefix string,
+	policy RetentionPolicy) {
+	f.retention.mux.Lock()
+	defer f.retention.mux.Unlock()
+	if f.retention.prefixes == nil {
+		f.retention.prefixes = make(map[string]RetentionPolicy)
+	}
+	f.retention.prefixes[prefix] = policy
+}
+
+// ListVersions returns the previous values of key retained by its policy,
+// from oldest to newest. Returns an empty list if there are none.
+func (f *Filestore) ListVersions(key string) ([]VersionInfo, error) {
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	historyKey := f.getHistoryKey(key)
+	unlock := f.takeLocks(false, historyKey)
+	defer unlock()
+	m, err := f.readHistoryManifest(historyKey)
+	if err != nil {
+		return nil, err
+	}
+	return f.retained(key, m), nil
+}
+
+// GetVersion returns the value of version n of key. Returns an error for
+// which Exists is false if the version does not exist or is no longer
+// retained.
+func (f *Filestore) GetVersion(key string, n uint64) ([]byte, error) {
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	historyKey := f.getHistoryKey(key)
+	unlock := f.takeLocks(false, historyKey)
+	defer unlock()
+	value, err := f.readVersion(key, historyKey, n)
+	return value.data, err
+}
+
+// Revert sets the value of key back to version n. The value being replaced is
+// kept as a new version, so a revert can itself be reverted. The codec,
+// schema, content type and tags of the version are restored, but not its
+// expiry.
+func (f *Filestore) Revert(key string, n uint64) error {
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	encryptedKey := f.getKey(key)
+	logKey := f.getMergeLogKey(key)
+	historyKey := f.getHistoryKey(key)
+	unlock := f.takeLocks(true, encryptedKey, logKey, historyKey)
+	defer unlock()
+
+	version, err := f.readVersion(key, historyKey, n)
+	if err != nil {
+		return err
+	}
+	replaced := f.readReplaced(encryptedKey)
+	meta := version.meta
+	meta.created = replaced.created(f.clock.Now())
+	meta.expires = time.Time{}
+	encryptedContents, err := f.encryptValue(key, version.data,
+		&writeOptions{tags: version.valueTags, meta: meta})
+	if err != nil {
+		return err
+	}
+
+	jww.TRACE.Printf("%s,REVERT,%s,%s,%d", kvDebugHeader, key, encryptedKey, n)
+	changes, err := f.recordChanges(Change{Op: ChangeSet, Key: key,
+		Value: version.data})
+	if err != nil {
+		return err
+	}
+	return f.commitChanges(changes, f.writeValue(key, encryptedKey, logKey,
+		historyKey, encryptedContents, replaced))
+}
+
+// archive keeps the value at encryptedKey as a new version of key if its
+// retention policy calls for it, and deletes the versions the policy no
+// longer retains. Missing and expired values are not kept. The value is read
+// only if the policy is enabled, unless the caller already read it with
+// readReplaced and passes it as replaced. The caller must hold the locks of
+// encryptedKey and historyKey.
+func (f *Filestore) archive(key, encryptedKey, historyKey string,
+	replaced *replacedValue) error {
+	policy := f.retention.policyFor(key)
+	if !policy.enabled() {
+		return nil
+	}
+
+	if replaced == nil {
+		replaced = f.readReplaced(encryptedKey)
+	}
+	if replaced.err != nil {
+		return replaced.err
+	} else if replaced.envelope == nil {
+		return nil
+	}
+	now := f.clock.Now()
+	e, encryptedContents := replaced.envelope, replaced.encryptedContents
+	if e.meta.expired(now) {
+		return nil
+	}
+	size := int64(e.meta.size)
+	if e.meta.isZero() {
+		value, err := e.value()
+		if err != nil {
+			return err
+		}
+		size = int64(len(value.data))
+	}
+
+	m, err := f.readHistoryManifest(historyKey)
+	if err != nil {
+		return err
+	}
+	if m.next == 0 {
+		m.next = 1
+	}
+	// The contents are encrypted independently of their path, so they are
+	// kept as they are
+	err = write(f.getVersionKey(key, m.next), encryptedContents, f.csprng)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	m.versions = append(m.versions, VersionInfo{Version: m.next,
+		Replaced: now, Modified: e.meta.modified, Size: size})
+	m.next++
+
+	// The manifest is the commit point. A version written without it is
+	// overwritten by the next one, as it reuses the number.
+	_, err = f.pruneHistory(key, historyKey, m, policy, now, true)
+	return err
+}
+
+// PurgeHistory securely deletes the versions of every key that its retention
+// policy no longer retains, without waiting for the key to be written again,
+// and returns how many were deleted. Versions of keys whose policy keeps no
+// history are left until the key is deleted, as ListVersions still lists
+// them.
+func (f *Filestore) PurgeHistory() (int, error) {
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	if f.readOnly {
+		return 0, errors.WithStack(ErrReadOnly)
+	}
+
+	keys, err := f.indexedKeys()
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, key := range keys {
+		policy := f.retention.policyFor(key)
+		if !policy.enabled() {
+			continue
+		}
+		n, err := f.purgeHistory(key, policy)
+		purged += n
+		if err != nil {
+			return purged, errors.WithMessagef(err, "key %q", key)
+		}
+	}
+	return purged, nil
+}
+
+// purgeHistory deletes the versions of key that policy no longer retains and
+// returns how many were deleted.
+func (f *Filestore) purgeHistory(key string, policy RetentionPolicy) (int,
+	error) {
+	historyKey := f.getHistoryKey(key)
+	unlock := f.takeLocks(true, historyKey)
+	defer unlock()
+	m, err := f.readHistoryManifest(historyKey)
+	if err != nil {
+		return 0, err
+	}
+	return f.pruneHistory(key, historyKey, m, policy, f.clock.Now(), false)
+}
+
+// pruneHistory drops the versions policy no longer retains from m, writes it
+// and then deletes them, returning how many were deleted. The manifest is
+// only written if versions were dropped, unless write is set. The caller
+// must hold the lock of historyKey.
+func (f *Filestore) pruneHistory(key, historyKey string, m *historyManifest,
+	policy RetentionPolicy, now time.Time, write bool) (int, error) {
+	var retained, expired []VersionInfo
+	for i, v := range m.versions {
+		if policy.retains(i, len(m.versions), v.Replaced, now) {
+			retained = append(retained, v)
+		} else {
+			expired = append(expired, v)
+		}
+	}
+	if len(expired) == 0 && !write {
+		return 0, nil
+	}
+	m.versions = retained
+
+	// The manifest goes first so that a failure cannot leave it listing
+	// deleted versions
+	if err := f.writeHistoryManifest(historyKey, m); err != nil {
+		return 0, err
+	}
+	for i, v := range expired {
+		err := deleteFiles(f.getVersionKey(key, v.Version), f.csprng)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(expired), nil
+}
+
+// retained returns the versions in m that the policy of key retains. Versions
+// are also kept when the policy is disabled, until the key is deleted.
+func (f *Filestore) retained(key string, m *historyManifest) []VersionInfo {
+	policy := f.retention.policyFor(key)
+	now := f.clock.Now()
+	versions := make([]VersionInfo, 0, len(m.versions))
+	for i, v := range m.versions {
+		if !policy.enabled() ||
+			policy.retains(i, len(m.versions), v.Replaced, now) {
+			versions = append(versions, v)
+		}
+	}
+	return versions
+}
+
+// readVersion reads and decrypts version n of key. The caller must hold the
+// lock of historyKey.
+func (f *Filestore) readVersion(key, historyKey string, n uint64) (
+	storedValue, error) {
+	m, err := f.readHistoryManifest(historyKey)
+	if err != nil {
+		return storedValue{}, err
+	}
+	for _, v := range f.retained(key, m) {
+		if v.Version != n {
+			continue
+		}
+		encryptedContents, err := read(f.getVersionKey(key, n))
+		if err != nil {
+			return storedValue{}, errors.WithStack(err)
+		}
+		return f.decryptValue(encryptedContents)
+	}
+	return storedValue{}, errors.Wrapf(ErrNotFound, errUnknownVersion, key, n)
+}
+
+// deleteHistory securely deletes every version and the manifest of the
+// history of key. The caller must hold the lock of historyKey.
+func (f *Filestore) deleteHistory(key, historyKey string) error {
+	m, err := f.readHistoryManifest(historyKey)
+	if err != nil || m.next == 0 {
+		return err
+	}
+
+	// The manifest goes first so that a failure cannot leave it listing
+	// deleted versions
+	if err = deleteFiles(historyKey, f.csprng); err != nil {
+		return err
+	}
+	for _, v := range m.versions {
+		err = deleteFiles(f.getVersionKey(key, v.Version), f.csprng)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readHistoryManifest returns the history manifest at historyKey, or an empty
+// one if there is none. The caller must hold its lock.
+func (f *Filestore) readHistoryManifest(historyKey string) (
+	*historyManifest, error) {
+	encrypted, err := read(historyKey)
+	if err != nil {
+		if !Exists(err) {
+			return &historyManifest{}, nil
+		}
+		return nil, err
+	}
+	data, err := decrypt(encrypted, f.key)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalHistoryManifest(data)
+}
+
+// writeHistoryManifest replaces the history manifest at historyKey with m.
+// The caller must hold its lock.
+func (f *Filestore) writeHistoryManifest(historyKey string,
+	m *historyManifest) error {
+	encrypted, err := encrypt(m.marshal(), f.key, f.csprng)
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(write(historyKey, encrypted, f.csprng))
+}
+
+// getHistoryKey returns the path of the history manifest of key.
+func (f *Filestore) getHistoryKey(key string) string {
+	return f.getKey(historyKeyPrefix + key)
+}
+
+// getVersionKey returns the path of version n of key.
+func (f *Filestore) getVersionKey(key string, n uint64) string {
+	return f.getKey(
+		historyVersionKeyPrefix + strconv.FormatUint(n, 10) + ":" + key)
+}
@@ -0,0 +1,257 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"gitlab.com/elixxir/ekv/portableOS"
+)
+
+// newHistoryTestStore returns a Filestore in dir with a test clock.
+func newHistoryTestStore(t *testing.T, dir string) (*Filestore, *testClock) {
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	c := &testClock{now: time.Unix(1700000000, 0)}
+	f.SetClock(c.Now)
+	return f, c
+}
+
+// listVersionNumbers returns the numbers of the versions of key.
+func listVersionNumbers(t *testing.T, f *Filestore, key string) []uint64 {
+	versions, err := f.ListVersions(key)
+	if err != nil {
+		t.Fatalf("ListVersions failed: %+v", err)
+	}
+	numbers := make([]uint64, 0, len(versions))
+	for _, v := range versions {
+		numbers = append(numbers, v.Version)
+	}
+	return numbers
+}
+
+// Tests that a Filestore keeps the versions its retention policy calls for,
+// reads them back and securely deletes those that age out.
+func TestFilestore_History(t *testing.T) {
+	dir := ".ekv_testdir_history"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	f, c := newHistoryTestStore(t, dir)
+
+	// No history is kept by default
+	for i := 0; i < 2; i++ {
+		if err := f.SetBytes("plain", []byte{byte(i)}); err != nil {
+			t.Fatalf("SetBytes failed: %+v", err)
+		}
+	}
+	if versions := listVersionNumbers(t, f, "plain"); len(versions) != 0 {
+		t.Errorf("Versions kept without a retention policy: %v", versions)
+	}
+
+	f.SetRetention(RetentionPolicy{Versions: 2})
+	for i := 0; i < 4; i++ {
+		c.advance(time.Second)
+		err := f.SetBytes("key", []byte("value "+strconv.Itoa(i)))
+		if err != nil {
+			t.Fatalf("SetBytes failed: %+v", err)
+		}
+	}
+	if versions := listVersionNumbers(t, f, "key"); !reflect.DeepEqual(
+		versions, []uint64{2, 3}) {
+		t.Errorf("Unexpected versions: %v", versions)
+	}
+	versions, _ := f.ListVersions("key")
+	if versions[1].Size != 7 ||
+		!versions[1].Modified.Equal(time.Unix(1700000003, 0)) ||
+		!versions[1].Replaced.Equal(time.Unix(1700000004, 0)) {
+		t.Errorf("Unexpected version info: %+v", versions[1])
+	}
+	if value, err := f.GetVersion("key", 2); err != nil ||
+		string(value) != "value 1" {
+		t.Errorf("Unexpected version 2: %q, %+v", value, err)
+	}
+
+	// Versions that age out are securely deleted
+	if _, err := f.GetVersion("key", 1); Exists(err) {
+		t.Errorf("Pruned version still readable: %+v", err)
+	}
+	if _, err := read(f.getVersionKey("key", 1)); Exists(err) {
+		t.Errorf("Pruned version was not deleted: %+v", err)
+	}
+
+	// Reverting keeps the replaced value as a version
+	if err := f.Revert("key", 2); err != nil {
+		t.Fatalf("Revert failed: %+v", err)
+	}
+	if value, err := f.GetBytes("key"); err != nil || string(value) != "value 1" {
+		t.Errorf("Unexpected value after revert: %q, %+v", value, err)
+	}
+	if versions := listVersionNumbers(t, f, "key"); !reflect.DeepEqual(
+		versions, []uint64{3, 4}) {
+		t.Errorf("Unexpected versions after revert: %v", versions)
+	}
+	if err := f.Revert("key", 1); Exists(err) {
+		t.Errorf("Reverted to a pruned version: %+v", err)
+	}
+
+	// Writes in a transaction are kept too
+	err := f.Transaction(func(files map[string]Operable, _ Extender) error {
+		files["key"].Set([]byte("transaction"))
+		return nil
+	}, "key")
+	if err != nil {
+		t.Fatalf("Transaction failed: %+v", err)
+	}
+	if value, err := f.GetVersion("key", 5); err != nil ||
+		string(value) != "value 1" {
+		t.Errorf("Unexpected version 5: %q, %+v", value, err)
+	}
+
+	// Deleting the key deletes its history
+	if err = f.Delete("key"); err != nil {
+		t.Fatalf("Delete failed: %+v", err)
+	}
+	if versions := listVersionNumbers(t, f, "key"); len(versions) != 0 {
+		t.Errorf("Versions kept after delete: %v", versions)
+	}
+	for _, n := range []uint64{4, 5} {
+		if _, err = read(f.getVersionKey("key", n)); Exists(err) {
+			t.Errorf("Version %d was not deleted: %+v", n, err)
+		}
+	}
+	if _, err = read(f.getHistoryKey("key")); Exists(err) {
+		t.Errorf("History manifest was not deleted: %+v", err)
+	}
+}
+
+// Tests that versions older than the maximum age of the policy of the longest
+// matching prefix are no longer retained, even after reopening the store.
+func TestFilestore_HistoryMaxAge(t *testing.T) {
+	dir := ".ekv_testdir_history_age"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	f, c := newHistoryTestStore(t, dir)
+	f.SetRetentionForPrefix("docs/", RetentionPolicy{MaxAge: time.Hour})
+	f.SetRetentionForPrefix("docs/tmp/", RetentionPolicy{})
+
+	for i := 0; i < 3; i++ {
+		for _, key := range []string{"docs/a", "docs/tmp/b", "other"} {
+			if err := f.SetBytes(key, []byte{byte(i)}); err != nil {
+				t.Fatalf("SetBytes failed: %+v", err)
+			}
+		}
+		c.advance(40 * time.Minute)
+	}
+	if versions := listVersionNumbers(t, f, "docs/a"); !reflect.DeepEqual(
+		versions, []uint64{2}) {
+		t.Errorf("Unexpected versions: %v", versions)
+	}
+	for _, key := range []string{"docs/tmp/b", "other"} {
+		if versions := listVersionNumbers(t, f, key); len(versions) != 0 {
+			t.Errorf("Versions of %s kept without a policy: %v", key, versions)
+		}
+	}
+
+	f, _ = newHistoryTestStore(t, dir)
+	f.SetClock(c.Now)
+	f.SetRetention(RetentionPolicy{MaxAge: 2 * time.Hour})
+	if value, err := f.GetVersion("docs/a", 2); err != nil || value[0] != 1 {
+		t.Errorf("Unexpected version after reopening: %v, %+v", value, err)
+	}
+	c.advance(2 * time.Hour)
+	if versions := listVersionNumbers(t, f, "docs/a"); len(versions) != 0 {
+		t.Errorf("Versions older than the maximum age listed: %v", versions)
+	}
+}
+
+// Tests that PurgeHistory securely deletes the versions that aged out of the
+// policy of keys that are no longer written.
+func TestFilestore_PurgeHistory(t *testing.T) {
+	dir := ".ekv_testdir_history_purge"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	f, c := newHistoryTestStore(t, dir)
+	f.SetRetentionForPrefix("docs/", RetentionPolicy{MaxAge: time.Hour})
+
+	for i := 0; i < 3; i++ {
+		if err := f.SetBytes("docs/a", []byte{byte(i)}); err != nil {
+			t.Fatalf("SetBytes failed: %+v", err)
+		}
+		c.advance(40 * time.Minute)
+	}
+	if err := f.SetBytes("other", []byte("value")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+
+	for _, expected := range []struct {
+		purged   int
+		versions []uint64
+	}{{1, []uint64{2}}, {0, []uint64{2}}, {1, []uint64{}}} {
+		purged, err := f.PurgeHistory()
+		if err != nil || purged != expected.purged {
+			t.Errorf("Unexpected purge: %d, %+v", purged, err)
+		}
+		versions := listVersionNumbers(t, f, "docs/a")
+		if !reflect.DeepEqual(versions, expected.versions) {
+			t.Errorf("Unexpected versions: %v", versions)
+		}
+		c.advance(10 * time.Minute)
+	}
+	for _, n := range []uint64{1, 2} {
+		if _, err := read(f.getVersionKey("docs/a", n)); Exists(err) {
+			t.Errorf("Version %d not deleted: %+v", n, err)
+		}
+	}
+	if value, err := f.GetBytes("docs/a"); err != nil || value[0] != 2 {
+		t.Errorf("Unexpected value after purge: %v, %+v", value, err)
+	}
+}
+
+// Tests that historyManifest round trips and that invalid encodings are
+// rejected.
+func Test_unmarshalHistoryManifest(t *testing.T) {
+	m := &historyManifest{next: 7, versions: []VersionInfo{
+		{Version: 5, Replaced: time.Unix(1, 2), Modified: time.Unix(3, 4),
+			Size: 42},
+		{Version: 6, Replaced: time.Unix(5, 6), Modified: time.Unix(0, 0)},
+	}}
+	encoded := m.marshal()
+	decoded, err := unmarshalHistoryManifest(encoded)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal: %+v", err)
+	}
+	if !reflect.DeepEqual(decoded, m) {
+		t.Errorf("Manifest mismatch: %+v != %+v", decoded, m)
+	}
+
+	for _, data := range [][]byte{
+		nil,
+		{2},
+		encoded[:len(encoded)-1],
+		append(append([]byte{}, encoded...), 0),
+		{historyManifestVersion, 1, 0xff, 0xff, 0x03},
+	} {
+		if _, err = unmarshalHistoryManifest(data); err == nil {
+			t.Errorf("Unmarshalled invalid manifest %v", data)
+		}
+	}
+}
@@ -0,0 +1,465 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// incremental.go implements incremental backups. Every backup of a store gets
+// the next number of its change sequence, and the store keeps, among the
+// snapshots, a manifest of the files of its last backups: their size,
+// modification time and hash. An incremental backup compares the size and
+// modification time of the files of the store against the manifest of the
+// backup it follows, and only copies and reads the files that differ. It
+// writes those whose contents changed and the names of those deleted.
+//
+// Every archive ends with a trailer identifying the store, the backup and the
+// backup it follows, with a digest of the files of each, so that a chain of
+// archives can be checked to apply in order and to produce the files of the
+// last backup.
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/ekv/portableOS"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// backupStateDirName is the directory, among the snapshots, holding the
+	// change sequence and the manifests of the last backups.
+	backupStateDirName = "..backups"
+	backupStateName    = "state"
+
+	backupStateVersion    = 1
+	backupManifestVersion = 1
+	backupTokenVersion    = 1
+
+	// backupManifestsKept is the number of manifests of past backups kept,
+	// and so of backups that BackupSince can follow.
+	backupManifestsKept = 8
+
+	backupStoreIDSize = 16
+	backupTokenSize   = 1 + backupStoreIDSize + 8 + blake2b.Size256
+	backupInfoSize    = 1 + backupStoreIDSize + 2*(8+blake2b.Size256)
+
+	errBackupToken    = "invalid backup token: %s"
+	errBackupTokenOld = "backup %d is too old for an incremental backup, " +
+		"take a full backup instead"
+	errBackupChain    = "invalid backup chain: %s"
+	errBackupState    = "invalid backup state: %s"
+	errBackupManifest = "invalid backup manifest: %s"
+)
+
+// BackupToken identifies a backup of a store. It is returned by Backup and
+// BackupSince, and passed to BackupSince to write the changes since that
+// backup.
+type BackupToken string
+
+// BackupSince writes to w an incremental backup holding only the files
+// added, changed or deleted since the backup with the given token, which must
+// be one of the last few backups of this store. Apply it with RestoreChain,
+// after the backups it follows. Returns the token of the new backup.
+func (f *Filestore) BackupSince(token BackupToken, w io.Writer) (BackupToken,
+	error) {
+	if token == "" {
+		return "", errors.Errorf(errBackupToken, "empty token")
+	}
+	return f.backup(w, token)
+}
+
+// stageChain reads the archives of a chain of backups into the directory dir,
+// replacing anything already there, and checks that they form a consistent
+// chain. The caller must be in flight.
+func (f *Filestore) stageChain(dir string, archives []io.Reader) error {
+	err := portableOS.RemoveAll(dir)
+	if err == nil {
+		err = portableOS.MkdirAll(dir, 0700)
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var last *backupInfo
+	for i, r := range archives {
+		info, err := f.stageArchive(r, dir)
+		if err != nil {
+			return errors.WithMessagef(err, "archive %d", i)
+		}
+		if err = checkBackupChain(last, info, i); err != nil {
+			return err
+		}
+		last = info
+	}
+
+	m := &backupManifest{files: make(map[string]backupFile)}
+	infos, err := portableOS.ReadDir(dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		data, err := readFile(dir + string(os.PathSeparator) + info.Name())
+		if err != nil {
+			return err
+		}
+		m.files[info.Name()] = backupFile{hash: blake2b.Sum256(data)}
+	}
+	if m.digest() != last.digest {
+		return errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+			errBackupChain, "restored files do not match the last backup")})
+	}
+	return nil
+}
+
+// checkBackupChain returns an error if the archive number i, with the trailer
+// info, cannot follow the archive with the trailer last.
+func checkBackupChain(last, info *backupInfo, i int) error {
+	var reason string
+	switch {
+	case i == 0 && info.incremental:
+		reason = "first archive is not a full backup"
+	case i == 0:
+		return nil
+	case !info.incremental:
+		reason = fmt.Sprintf("archive %d is not an incremental backup", i)
+	case info.store != last.store:
+		reason = fmt.Sprintf("archive %d is from another store", i)
+	case info.parentSeq != last.seq || info.parentDigest != last.digest:
+		reason = fmt.Sprintf("archive %d does not follow backup %d", i,
+			last.seq)
+	default:
+		return nil
+	}
+	return errors.WithStack(&ErrCorrupt{
+		Reason: fmt.Sprintf(errBackupChain, reason)})
+}
+
+// backupInfo is the trailer of an archive.
+type backupInfo struct {
+	incremental bool
+	store       [backupStoreIDSize]byte
+	seq         uint64
+	digest      [blake2b.Size256]byte
+
+	// The backup an incremental backup follows
+	parentSeq    uint64
+	parentDigest [blake2b.Size256]byte
+}
+
+// marshal returns the fixed size encoding of the trailer.
+func (info *backupInfo) marshal() []byte {
+	buf := make([]byte, 0, backupInfoSize)
+	if info.incremental {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	buf = append(buf, info.store[:]...)
+	buf = binary.BigEndian.AppendUint64(buf, info.seq)
+	buf = append(buf, info.digest[:]...)
+	buf = binary.BigEndian.AppendUint64(buf, info.parentSeq)
+	return append(buf, info.parentDigest[:]...)
+}
+
+// readBackupInfo reads the trailer of an archive from r.
+func readBackupInfo(r io.Reader) (*backupInfo, error) {
+	buf := make([]byte, backupInfoSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, backupReadError(err)
+	}
+	if buf[0] > 1 {
+		return nil, errors.WithStack(&ErrCorrupt{
+			Reason: fmt.Sprintf(errBackup, "invalid trailer")})
+	}
+	info := &backupInfo{incremental: buf[0] == 1}
+	buf = buf[1+copy(info.store[:], buf[1:]):]
+	info.seq, buf = binary.BigEndian.Uint64(buf), buf[8:]
+	buf = buf[copy(info.digest[:], buf):]
+	info.parentSeq, buf = binary.BigEndian.Uint64(buf), buf[8:]
+	copy(info.parentDigest[:], buf)
+	return info, nil
+}
+
+// token returns the token of the backup.
+func (info *backupInfo) token() BackupToken {
+	buf := make([]byte, 0, backupTokenSize)
+	buf = append(buf, backupTokenVersion)
+	buf = append(buf, info.store[:]...)
+	buf = binary.BigEndian.AppendUint64(buf, info.seq)
+	buf = append(buf, info.digest[:]...)
+	return BackupToken(base64.RawURLEncoding.EncodeToString(buf))
+}
+
+// parseBackupToken returns the store, sequence number and digest of the
+// backup identified by token.
+func parseBackupToken(token BackupToken) (store [backupStoreIDSize]byte,
+	seq uint64, digest [blake2b.Size256]byte, err error) {
+	buf, err := base64.RawURLEncoding.DecodeString(string(token))
+	if err != nil || len(buf) != backupTokenSize ||
+		buf[0] != backupTokenVersion {
+		err = errors.Errorf(errBackupToken, "malformed token")
+		return
+	}
+	buf = buf[1+copy(store[:], buf[1:]):]
+	seq = binary.BigEndian.Uint64(buf)
+	copy(digest[:], buf[8:])
+	return
+}
+
+// backupFile describes a file of the store in a backup.
+type backupFile struct {
+	size     int64
+	modified time.Time
+	hash     [blake2b.Size256]byte
+}
+
+// unchanged returns true if the file described by info is known to have the
+// contents of file without reading it: it has the same size and modification
+// time, and was last modified before the copy of the backup, which started
+// at started, so it cannot have been modified again within the resolution of
+// the clock.
+func (file backupFile) unchanged(info portableOS.FileInfo,
+	started time.Time) bool {
+	return file.size == info.Size() && !info.ModTime().IsZero() &&
+		file.modified.Equal(info.ModTime()) &&
+		info.ModTime().Before(started.Add(-snapshotClockSlack))
+}
+
+// backupManifest lists the files of the store in a backup.
+type backupManifest struct {
+	seq     uint64
+	started time.Time
+	files   map[string]backupFile
+}
+
+// file returns the description of the file called name, if the manifest is
+// not nil and has it.
+func (m *backupManifest) file(name string) (backupFile, bool) {
+	if m == nil {
+		return backupFile{}, false
+	}
+	file, exists := m.files[name]
+	return file, exists
+}
+
+// names returns the names of the files of the manifest, sorted, or nothing if
+// the manifest is nil.
+func (m *backupManifest) names() []string {
+	if m == nil {
+		return nil
+	}
+	names := make([]string, 0, len(m.files))
+	for name := range m.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// digest returns the hash of the names and contents of the files.
+func (m *backupManifest) digest() [blake2b.Size256]byte {
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		jww.FATAL.Panicf("Failed to initialize hash: %+v", err)
+	}
+	for _, name := range m.names() {
+		hash := m.files[name].hash
+		h.Write(binary.AppendUvarint(nil, uint64(len(name))))
+		h.Write([]byte(name))
+		h.Write(hash[:])
+	}
+	var digest [blake2b.Size256]byte
+	h.Sum(digest[:0])
+	return digest
+}
+
+// info returns the trailer of the backup of the manifest, following parent
+// unless it is nil.
+func (m *backupManifest) info(store [backupStoreIDSize]byte,
+	parent *backupManifest) *backupInfo {
+	info := &backupInfo{store: store, seq: m.seq, digest: m.digest()}
+	if parent != nil {
+		info.incremental = true
+		info.parentSeq = parent.seq
+		info.parentDigest = parent.digest()
+	}
+	return info
+}
+
+// marshal returns the encoding of the manifest.
+func (m *backupManifest) marshal() []byte {
+	buf := []byte{backupManifestVersion}
+	buf = binary.AppendUvarint(buf, m.seq)
+	buf = binary.AppendVarint(buf, m.started.UnixNano())
+	buf = binary.AppendUvarint(buf, uint64(len(m.files)))
+	for _, name := range m.names() {
+		file := m.files[name]
+		buf = binary.AppendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+		buf = binary.AppendUvarint(buf, uint64(file.size))
+		buf = binary.AppendVarint(buf, file.modified.UnixNano())
+		buf = append(buf, file.hash[:]...)
+	}
+	return buf
+}
+
+// unmarshalBackupManifest is the inverse of backupManifest.marshal.
+func unmarshalBackupManifest(data []byte) (*backupManifest, error) {
+	if len(data) == 0 || data[0] != backupManifestVersion {
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+			errBackupManifest, "unknown version")})
+	}
+	d := metaDecoder{data: data[1:]}
+	m := &backupManifest{seq: d.uvarint(),
+		started: time.Unix(0, d.varint())}
+	count := d.uvarint()
+	// Every file takes at least 36 bytes, so a larger count is corrupt
+	if d.err == nil && count > uint64(len(d.data))/36 {
+		d.err = errors.New("file count exceeds size")
+	}
+	m.files = make(map[string]backupFile, count)
+	for i := uint64(0); i < count && d.err == nil; i++ {
+		name := d.string()
+		file := backupFile{size: int64(d.uvarint()),
+			modified: time.Unix(0, d.varint())}
+		copy(file.hash[:], d.fixed(blake2b.Size256))
+		m.files[name] = file
+	}
+	if d.err == nil && len(d.data) != 0 {
+		d.err = errors.New("trailing data")
+	}
+	if d.err != nil {
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+			errBackupManifest, d.err.Error())})
+	}
+	return m, nil
+}
+
+// backupState is the change sequence of the backups of a store.
+type backupState struct {
+	// store identifies the store, so that its backups are not chained with
+	// those of another store with the same password.
+	store [backupStoreIDSize]byte
+
+	// next is the sequence number of the next backup.
+	next uint64
+}
+
+// readBackupState returns the backup state stored in the directory dir, or a
+// new state if the store was never backed up. The caller must be in flight.
+func (f *Filestore) readBackupState(dir string) (*backupState, error) {
+	data, err := f.readBackupFile(dir, backupStateName)
+	if !Exists(err) {
+		state := &backupState{next: 1}
+		if _, err = io.ReadFull(f.csprng, state.store[:]); err != nil {
+			return nil, errors.Wrap(err, "Could not generate store ID")
+		}
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if len(data) != 1+backupStoreIDSize+8 || data[0] != backupStateVersion {
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+			errBackupState, "unknown version")})
+	}
+	state := &backupState{}
+	copy(state.store[:], data[1:])
+	state.next = binary.BigEndian.Uint64(data[1+backupStoreIDSize:])
+	return state, nil
+}
+
+// readParentManifest returns the manifest of the backup with the given token,
+// which must be a backup of this store recent enough to still have one.
+func (f *Filestore) readParentManifest(dir string, state *backupState,
+	token BackupToken) (*backupManifest, error) {
+	store, seq, digest, err := parseBackupToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if store != state.store || seq >= state.next {
+		return nil, errors.Errorf(errBackupToken,
+			"not a backup of this store")
+	}
+
+	data, err := f.readBackupFile(dir, strconv.FormatUint(seq, 10))
+	if !Exists(err) {
+		return nil, errors.Errorf(errBackupTokenOld, seq)
+	} else if err != nil {
+		return nil, err
+	}
+	m, err := unmarshalBackupManifest(data)
+	if err != nil {
+		return nil, err
+	}
+	if m.seq != seq || m.digest() != digest {
+		return nil, errors.Errorf(errBackupToken,
+			"does not match the backup")
+	}
+	return m, nil
+}
+
+// saveBackupManifest stores the manifest of the backup just written, advances
+// the change sequence past it and deletes the manifests too old to be kept.
+func (f *Filestore) saveBackupManifest(dir string, state *backupState,
+	m *backupManifest) error {
+	if err := portableOS.MkdirAll(dir, 0700); err != nil {
+		return errors.WithStack(err)
+	}
+	err := f.writeBackupFile(dir, strconv.FormatUint(m.seq, 10), m.marshal())
+	if err != nil {
+		return err
+	}
+
+	state.next = m.seq + 1
+	data := append([]byte{backupStateVersion}, state.store[:]...)
+	data = binary.BigEndian.AppendUint64(data, state.next)
+	if err = f.writeBackupFile(dir, backupStateName, data); err != nil {
+		return err
+	}
+
+	if m.seq <= backupManifestsKept {
+		return nil
+	}
+	old := dir + string(os.PathSeparator) +
+		strconv.FormatUint(m.seq-backupManifestsKept, 10)
+	if err = deleteFiles(old, f.csprng); err != nil {
+		jww.WARN.Printf("Failed to delete backup manifest %s: %+v", old, err)
+	}
+	return nil
+}
+
+// writeBackupFile encrypts data and writes it to the file called name in the
+// directory dir. The name is authenticated with it so that files cannot be
+// swapped.
+func (f *Filestore) writeBackupFile(dir, name string, data []byte) error {
+	encrypted, err := encryptWithAD(data, []byte(name), f.key, f.csprng)
+	if err != nil {
+		return err
+	}
+	return write(dir+string(os.PathSeparator)+name, encrypted, f.csprng)
+}
+
+// readBackupFile returns the contents of the file called name in the
+// directory dir written by writeBackupFile.
+func (f *Filestore) readBackupFile(dir, name string) ([]byte, error) {
+	encrypted, err := read(dir + string(os.PathSeparator) + name)
+	if err != nil {
+		return nil, err
+	}
+	return decryptWithAD(encrypted, []byte(name), f.key)
+}
@@ -0,0 +1,272 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portableOS"
+)
+
+// Tests that incremental backups hold only the changes since the backup they
+// follow, and that a chain of them is restored to the last state backed up.
+func TestFilestore_BackupSince(t *testing.T) {
+	srcDir, dstDir := ".ekv_testdir_incremental_src",
+		".ekv_testdir_incremental_dst"
+	defer func() {
+		for _, dir := range []string{srcDir, dstDir} {
+			if err := portableOS.RemoveAll(dir); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	src, err := NewFilestore(srcDir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	large := bytes.Repeat([]byte("0123456789"), 4*backupFrameSize)
+	for key, value := range map[string][]byte{
+		"large": large, "a": []byte("a1"), "b": []byte("b1")} {
+		if err = src.SetBytes(key, value); err != nil {
+			t.Fatalf("SetBytes failed: %+v", err)
+		}
+	}
+	var full bytes.Buffer
+	token, err := src.Backup(&full)
+	if err != nil {
+		t.Fatalf("Backup failed: %+v", err)
+	}
+
+	if err = src.SetBytes("a", []byte("a2")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	if err = src.Delete("b"); err != nil {
+		t.Fatalf("Delete failed: %+v", err)
+	}
+	if err = src.SetBytes("c", []byte("c2")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	var first bytes.Buffer
+	token, err = src.BackupSince(token, &first)
+	if err != nil {
+		t.Fatalf("BackupSince failed: %+v", err)
+	}
+	if first.Len() >= len(large) {
+		t.Errorf("Incremental backup holds unchanged files: %d bytes",
+			first.Len())
+	}
+
+	if err = src.SetBytes("a", []byte("a3")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	var second bytes.Buffer
+	if _, err = src.BackupSince(token, &second); err != nil {
+		t.Fatalf("BackupSince failed: %+v", err)
+	}
+
+	dst, err := NewFilestore(dstDir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	err = dst.RestoreChain(bytes.NewReader(full.Bytes()),
+		bytes.NewReader(first.Bytes()))
+	if err != nil {
+		t.Fatalf("RestoreChain failed: %+v", err)
+	}
+	if value, err := dst.GetBytes("a"); err != nil || string(value) != "a2" {
+		t.Errorf("Unexpected value of a: %q, %+v", value, err)
+	}
+	err = dst.RestoreChain(bytes.NewReader(full.Bytes()),
+		bytes.NewReader(first.Bytes()), bytes.NewReader(second.Bytes()))
+	if err != nil {
+		t.Fatalf("RestoreChain failed: %+v", err)
+	}
+	for key, expected := range map[string][]byte{
+		"large": large, "a": []byte("a3"), "c": []byte("c2")} {
+		if value, err := dst.GetBytes(key); err != nil ||
+			!bytes.Equal(value, expected) {
+			t.Errorf("Unexpected value of %s after restore: %+v", key, err)
+		}
+	}
+	if _, err = dst.GetBytes("b"); Exists(err) {
+		t.Errorf("Deleted key survived the restore: %+v", err)
+	}
+}
+
+// Tests that incremental backups only read the files whose size or
+// modification time differ from those of the backup they follow.
+func TestFilestore_BackupSinceStamps(t *testing.T) {
+	dir := ".ekv_testdir_incremental_stamps"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	large := bytes.Repeat([]byte("0123456789"), 4*backupFrameSize)
+	if err = f.SetBytes("large", large); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+
+	// Date the files back so that their stamps can be trusted
+	past := time.Now().Add(-time.Hour)
+	infos, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		err = os.Chtimes(filepath.Join(dir, info.Name()), past, past)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	token, err := f.Backup(io.Discard)
+	if err != nil {
+		t.Fatalf("Backup failed: %+v", err)
+	}
+
+	// Change the large file without changing its stamp. Were it read, the
+	// change would be backed up.
+	path1, path2 := getPaths(f.getKey("large"))
+	for _, path := range []string{path1, path2} {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		data[len(data)/2] ^= 0xFF
+		if err = os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Chtimes(path, past, past); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = f.SetBytes("small", []byte("small")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+
+	var incremental bytes.Buffer
+	if _, err = f.BackupSince(token, &incremental); err != nil {
+		t.Fatalf("BackupSince failed: %+v", err)
+	}
+	if incremental.Len() >= len(large) {
+		t.Errorf("Incremental backup read a file with an unchanged stamp: "+
+			"%d bytes", incremental.Len())
+	}
+}
+
+// Tests that chains of backups that are out of order, incomplete or from
+// another store are refused and leave the store as it was, and that
+// incremental backups are refused for tokens of other stores or of backups too
+// old to follow.
+func TestFilestore_RestoreChainInvalid(t *testing.T) {
+	dir, otherDir := ".ekv_testdir_chain_invalid", ".ekv_testdir_chain_other"
+	defer func() {
+		for _, dir := range []string{dir, otherDir} {
+			if err := portableOS.RemoveAll(dir); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	other, err := NewFilestore(otherDir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	archives := make([][]byte, 3)
+	tokens := make([]BackupToken, 3)
+	for i := range archives {
+		if err = f.SetBytes("key", []byte{byte(i)}); err != nil {
+			t.Fatalf("SetBytes failed: %+v", err)
+		}
+		var buf bytes.Buffer
+		if i == 0 {
+			tokens[i], err = f.Backup(&buf)
+		} else {
+			tokens[i], err = f.BackupSince(tokens[i-1], &buf)
+		}
+		if err != nil {
+			t.Fatalf("Backup %d failed: %+v", i, err)
+		}
+		archives[i] = buf.Bytes()
+	}
+	var foreign bytes.Buffer
+	foreignToken, err := other.Backup(&foreign)
+	if err != nil {
+		t.Fatalf("Backup failed: %+v", err)
+	}
+	if err = f.SetBytes("key", []byte("current")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+
+	legacy := bytes.Clone(archives[0])
+	legacy[len(backupMagic)] = 1
+	for name, chain := range map[string][][]byte{
+		"legacy":            {legacy},
+		"incremental first": {archives[1], archives[2]},
+		"missing link":      {archives[0], archives[2]},
+		"reordered":         {archives[0], archives[2], archives[1]},
+		"repeated":          {archives[0], archives[1], archives[1]},
+		"two full":          {archives[0], archives[0]},
+		"foreign full":      {foreign.Bytes(), archives[1]},
+	} {
+		readers := make([]io.Reader, len(chain))
+		for i, archive := range chain {
+			readers[i] = bytes.NewReader(archive)
+		}
+		err = f.RestoreChain(readers[0], readers[1:]...)
+		var corrupt *ErrCorrupt
+		if !errors.As(err, &corrupt) {
+			t.Errorf("Unexpected error restoring %s: %+v", name, err)
+		}
+		if value, err := f.GetBytes("key"); err != nil ||
+			string(value) != "current" {
+			t.Errorf("Store changed restoring %s: %+v", name, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	for name, token := range map[string]BackupToken{
+		"empty":     "",
+		"malformed": "token",
+		"foreign":   foreignToken,
+	} {
+		if _, err = f.BackupSince(token, &buf); err == nil {
+			t.Errorf("Incremental backup since %s token", name)
+		}
+	}
+	for i := 1; i < backupManifestsKept; i++ {
+		if _, err = f.Backup(&buf); err != nil {
+			t.Fatalf("Backup failed: %+v", err)
+		}
+	}
+	if _, err = f.BackupSince(tokens[0], &buf); err == nil {
+		t.Errorf("Incremental backup since a pruned backup")
+	}
+	if _, err = f.BackupSince(tokens[2], &buf); err != nil {
+		t.Errorf("BackupSince failed for a kept backup: %+v", err)
+	}
+}
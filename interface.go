@@ -9,7 +9,6 @@ package ekv
 
 import (
 	"os"
-	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -54,6 +53,10 @@ type KeyValue interface {
 	// occur
 	// If the op returns an error, the operation will be aborted.
 	Transaction(op TransactionOperation, keys ...string) error
+	// Close waits for operations and transactions in flight to complete and
+	// then releases the store. Every later call returns ErrClosed. Close must
+	// not be called from inside a transaction on the same store.
+	Close() error
 }
 
 type TransactionOperation func(files map[string]Operable, ext Extender) error
@@ -63,19 +66,40 @@ type Operable interface {
 	// Key returns the key this interface is operating on
 	Key() string
 	// Exists returns if the file currently exists
-	// will panic if the current transaction isn't in scope
+	// will panic if the current transaction isn't in scope, unless the store
+	// is configured not to panic on misuse
 	Exists() bool
 	// Delete deletes the file at the key and destroy it.
-	// will panic if the current transaction isn't in scope
+	// will panic if the current transaction isn't in scope, unless the store
+	// is configured not to panic on misuse
 	Delete()
 	// Set stores raw bytes.
-	// will panic if the current transaction isn't in scope
+	// will panic if the current transaction isn't in scope, unless the store
+	// is configured not to panic on misuse
 	Set(data []byte)
 	// Get loads raw bytes.
-	// will panic if the current transaction isn't in scope
+	// will panic if the current transaction isn't in scope, unless the store
+	// is configured not to panic on misuse
 	Get() ([]byte, bool)
+	// GetInterface decodes the value into v with the codec that encoded it.
+	// Returns ErrNotFound if the value does not exist.
+	// will panic if the current transaction isn't in scope, unless the store
+	// is configured not to panic on misuse
+	GetInterface(v interface{}) error
+	// SetInterface encodes v with the default codec of the store and sets it
+	// as the value.
+	// will panic if the current transaction isn't in scope, unless the store
+	// is configured not to panic on misuse
+	SetInterface(v interface{}) error
+	// Append queues data to be appended as a record to the record log of the
+	// key when the operation is flushed. It neither reads nor rewrites the
+	// records already in the log, and is independent of Set and Delete.
+	// will panic if the current transaction isn't in scope, unless the store
+	// is configured not to panic on misuse
+	Append(data []byte)
 	// Flush executes the operation and returns an error if the operation
-	// failed. It will set the operable to closed as well.
+	// failed, or ErrClosed if it was already flushed. It will set the
+	// operable to closed as well.
 	// if flush is not called, it will be called by the handler
 	Flush() error
 	// IsClosed returns true if the current transaction is in scope
@@ -92,14 +116,13 @@ type Extender interface {
 	IsClosed() bool
 }
 
-// Exists determines if the error message is known to report the key does not
-// exist. Returns true if the error does not specify or it is nil and false
-// otherwise.
+// Exists determines if the error is known to report the key does not exist,
+// i.e. it is or wraps ErrNotFound or os.ErrNotExist. Returns true if the error
+// does not specify or it is nil and false otherwise.
 func Exists(err error) bool {
 	if err == nil {
 		return true
 	}
 
-	return !(errors.Is(err, os.ErrNotExist) ||
-		strings.Contains(err.Error(), objectNotFoundErr))
+	return !(errors.Is(err, ErrNotFound) || errors.Is(err, os.ErrNotExist))
 }
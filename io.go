@@ -18,7 +18,15 @@ package ekv
 // words: 0 < 1 < 2 < 0 and so on forever.
 
 // Because ekv is meant to load/store in-memory objects, reads and writes are
-// done on the entire file and never incrementally.
+// done on the entire file and never incrementally. Values larger than
+// blobChunkSize are split across several chained files, see chain.go.
+
+// Each file holds a single record. The high nibble of the first byte is the
+// record format and the low nibble is the ModMonCntr. Files written before the
+// format was versioned have a high nibble of zero and a 4-byte size:
+//   [cntr][4-byte size][data][blake2b checksum of data]
+// Current files have a 64-bit size and checksum the header as well:
+//   [0x10|cntr][kind][8-byte size][data][blake2b checksum of all before]
 
 // NOTE: We assume calls to this library are synchronized and that the data is
 // not modified by external programs. It's possible to break things if an
@@ -50,7 +58,30 @@ const (
 	errCannotRead           = "Did not read the same data that was written!"
 	errIsDir                = "File path is a directory: %s"
 	errInvalidFile          = "Invalid file"
+	errRecordFormat         = "Unknown record format: %#x"
+	errRecordKind           = "Unknown record kind: %d"
 	modMonCntrSize          = 1
+
+	// Record formats, stored in the high nibble of the first byte of a file.
+	recordFormatLegacy = 0x00
+	recordFormatV2     = 0x10
+	recordFormatMask   = 0xF0
+	modMonCntrMask     = 0x0F
+
+	// Record kinds. An inline record holds the data itself and a chain record
+	// holds the descriptor of data split across several files.
+	recordKindInline = 0
+	recordKindChain  = 1
+
+	// legacyHeaderSize is the size of the counter and 4-byte size of legacy
+	// records and recordHeaderSize is the size of the format and counter,
+	// kind and 8-byte size of current records.
+	legacyHeaderSize = modMonCntrSize + 4
+	recordHeaderSize = modMonCntrSize + 1 + 8
+
+	// deleteBlockSize is the largest amount of random data held in memory
+	// while overwriting a file before deleting it.
+	deleteBlockSize = 64 * 1024
 )
 
 // getPaths returns "path.1" and "path.2"
@@ -99,19 +130,19 @@ func getFileOrder(path1, path2 string) (portableOS.File, portableOS.File, error)
 	if err1 == nil {
 		buf[0] = 3
 		_, err1 = file1.ReadAt(buf, 0)
-		t1 = buf[0]
+		t1 = recordCntr(buf[0])
 	}
 	// Try to open and read file2
 	file2, err2 := portableOS.Open(path2)
 	if err2 == nil {
 		buf[0] = 3
 		_, err2 = file2.ReadAt(buf, 0)
-		t2 = buf[0]
+		t2 = recordCntr(buf[0])
 	}
 
 	// If both files don't exist, return that
 	if os.IsNotExist(err1) && os.IsNotExist(err2) {
-		return nil, nil, err1
+		return nil, nil, wrapNotFound(err1)
 	}
 
 	// Otherwise return composite error
@@ -137,57 +168,162 @@ func getFileOrder(path1, path2 string) (portableOS.File, portableOS.File, error)
 		return file2, file1, nil
 	}
 
-	return nil, nil, errors.Errorf(errModMonCntrInvalidVal, t1, t2)
+	file1.Close()
+	file2.Close()
+	return nil, nil, errors.WithStack(&ErrCorrupt{Path: path1,
+		Reason: fmt.Sprintf(errModMonCntrInvalidVal, t1, t2)})
 }
 
-// readContents of a file, checking the checksum and returning the data.
-// this function assumes the file read header is at the beginning of the content
-// block
-func readContents(f portableOS.File) ([]byte, error) {
-	// Read the contents size
-	sizeBytes := make([]byte, 4)
-	_, _ = f.Seek(1, 0)
-	cnt, err := f.Read(sizeBytes)
+// recordCntr returns the modular monotonic counter stored in the first byte
+// of a file, or 3, an invalid counter, if the byte does not start a record in
+// a known format.
+func recordCntr(b byte) byte {
+	switch b & recordFormatMask {
+	case recordFormatLegacy, recordFormatV2:
+		return b & modMonCntrMask
+	default:
+		return 3
+	}
+}
+
+// record is the validated contents of a single file.
+type record struct {
+	cntr byte
+	kind byte
+	data []byte
+}
+
+// readAtFull reads exactly len(b) bytes from f at off, returning ErrCorrupt
+// if the file is too short.
+func readAtFull(f portableOS.File, b []byte, off int64) error {
+	cnt, err := f.ReadAt(b, off)
+	if cnt == len(b) {
+		return nil
+	}
+	if err != nil && err != io.EOF {
+		return errors.Wrap(err, "error reading file")
+	}
+	return errors.WithStack(&ErrCorrupt{Path: f.Name(),
+		Reason: fmt.Sprintf(errShortRead, f.Name(), cnt, len(b))})
+}
+
+// readContents of a file, checking the checksum and returning the record.
+// The size stored in the header is checked against the size of the file
+// before anything is allocated, so a damaged header cannot cause a large
+// allocation.
+func readContents(f portableOS.File) (*record, error) {
+	fileSize, err := f.Seek(0, io.SeekEnd)
 	if err != nil {
-		return nil, errors.Wrap(err, "error reading size")
+		return nil, errors.Wrap(err, "error reading file size")
 	}
-	if cnt != len(sizeBytes) {
-		return nil, errors.Errorf(errShortRead, f.Name(),
-			cnt, len(sizeBytes))
+
+	first := make([]byte, 1)
+	if err = readAtFull(f, first, 0); err != nil {
+		return nil, err
 	}
-	size := int(binary.LittleEndian.Uint32(sizeBytes))
-	if size <= 0 {
-		errors.Errorf(errInvalidSizeContents, size)
+
+	switch first[0] & recordFormatMask {
+	case recordFormatLegacy:
+		return readLegacyContents(f, first[0], fileSize)
+	case recordFormatV2:
+		return readV2Contents(f, fileSize)
+	default:
+		return nil, errors.WithStack(&ErrCorrupt{Path: f.Name(),
+			Reason: fmt.Sprintf(errRecordFormat, first[0]&recordFormatMask)})
 	}
+}
 
-	// Read the contents
+// readLegacyContents reads a record written before the 64-bit size was
+// introduced: [cntr][4-byte size][data][checksum of data].
+func readLegacyContents(f portableOS.File, cntr byte,
+	fileSize int64) (*record, error) {
+	// Read the contents size
+	sizeBytes := make([]byte, 4)
+	if err := readAtFull(f, sizeBytes, 1); err != nil {
+		return nil, err
+	}
+	size := int64(binary.LittleEndian.Uint32(sizeBytes))
+	if size <= 0 || size > fileSize-legacyHeaderSize-blake2b.Size256 {
+		return nil, errors.WithStack(&ErrCorrupt{Path: f.Name(),
+			Reason: fmt.Sprintf(errInvalidSizeContents, size)})
+	}
+
+	// Read the contents and checksum
 	contents := make([]byte, size)
-	cnt, err = f.Read(contents)
-	if err != nil {
-		return nil, errors.Wrap(err, "error reading contents")
+	if err := readAtFull(f, contents, legacyHeaderSize); err != nil {
+		return nil, err
 	}
-	if cnt != size {
-		return nil, errors.Errorf(errShortRead, f.Name(), cnt, size)
+	checksumInFile := make([]byte, blake2b.Size256)
+	if err := readAtFull(f, checksumInFile, legacyHeaderSize+size); err != nil {
+		return nil, err
+	}
+
+	actualChecksum := blake2b.Sum256(contents)
+	if !bytes.Equal(checksumInFile, actualChecksum[:]) {
+		return nil, errors.WithStack(&ErrCorrupt{Path: f.Name(),
+			Reason: fmt.Sprintf(errChecksum, f.Name(), actualChecksum,
+				checksumInFile)})
 	}
 
-	// Read checksum
+	return &record{cntr: cntr, kind: recordKindInline, data: contents}, nil
+}
+
+// readV2Contents reads a record in the current format:
+// [format|cntr][kind][8-byte size][data][checksum of everything before].
+func readV2Contents(f portableOS.File, fileSize int64) (*record, error) {
+	header := make([]byte, recordHeaderSize)
+	if err := readAtFull(f, header, 0); err != nil {
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint64(header[2:])
+	maxSize := fileSize - recordHeaderSize - blake2b.Size256
+	if size == 0 || maxSize <= 0 || size > uint64(maxSize) {
+		return nil, errors.WithStack(&ErrCorrupt{Path: f.Name(),
+			Reason: fmt.Sprintf(errInvalidSizeContents, size)})
+	}
+
+	contents := make([]byte, size)
+	if err := readAtFull(f, contents, recordHeaderSize); err != nil {
+		return nil, err
+	}
 	checksumInFile := make([]byte, blake2b.Size256)
-	cnt, err = f.Read(checksumInFile)
+	err := readAtFull(f, checksumInFile, recordHeaderSize+int64(size))
 	if err != nil {
-		return nil, errors.Wrap(err, "error reading checksum")
+		return nil, err
 	}
-	if cnt != blake2b.Size256 {
-		return nil, errors.Errorf(errShortRead, f.Name(),
-			cnt, blake2b.Size256)
+
+	h, _ := blake2b.New256(nil)
+	h.Write(header)
+	h.Write(contents)
+	actualChecksum := h.Sum(nil)
+	if !bytes.Equal(checksumInFile, actualChecksum) {
+		return nil, errors.WithStack(&ErrCorrupt{Path: f.Name(),
+			Reason: fmt.Sprintf(errChecksum, f.Name(), actualChecksum,
+				checksumInFile)})
 	}
 
-	actualChecksum := blake2b.Sum256(contents)
-	if !bytes.Equal(checksumInFile, actualChecksum[:]) {
-		return nil, errors.Errorf(errChecksum, f.Name(), actualChecksum,
-			checksumInFile)
+	kind := header[1]
+	if kind != recordKindInline && kind != recordKindChain {
+		return nil, errors.WithStack(&ErrCorrupt{Path: f.Name(),
+			Reason: fmt.Sprintf(errRecordKind, kind)})
 	}
 
-	return contents, nil
+	return &record{
+		cntr: header[0] & modMonCntrMask,
+		kind: kind,
+		data: contents,
+	}, nil
+}
+
+// marshalRecord encodes data as a record in the current format.
+func marshalRecord(cntr, kind byte, data []byte) []byte {
+	contents := make([]byte, 0, recordHeaderSize+len(data)+blake2b.Size256)
+	contents = append(contents, recordFormatV2|cntr, kind)
+	contents = binary.LittleEndian.AppendUint64(contents, uint64(len(data)))
+	contents = append(contents, data...)
+
+	checksum := blake2b.Sum256(contents)
+	return append(contents, checksum[:]...)
 }
 
 // createFile creates the file, flushes the directory then returns an open,
@@ -225,25 +361,33 @@ func deleteFile(path string, csprng io.Reader) error {
 		return err
 	}
 
-	buf := make([]byte, info.Size())
-	if _, err = io.ReadFull(csprng, buf); err != nil {
-		return err
-	}
 	f, err := portableOS.Create(path)
 	if err != nil {
 		return err
 	}
-	_, err = f.Write(buf)
-	if err != nil {
-		return err
+
+	// Overwrite in blocks so that large files do not need to fit in memory
+	buf := make([]byte, min(info.Size(), deleteBlockSize))
+	for remaining := info.Size(); remaining > 0; {
+		block := buf[:min(remaining, int64(len(buf)))]
+		if _, err = io.ReadFull(csprng, block); err != nil {
+			f.Close()
+			return err
+		}
+		if _, err = f.Write(block); err != nil {
+			f.Close()
+			return err
+		}
+		remaining -= int64(len(block))
 	}
-	f.Close()
 	f.Sync()
+	f.Close()
 	err = portableOS.Remove(path)
 	return err
 }
 
-// deleteFiles deletes both files and then flushes the directory
+// deleteFiles deletes both files and any chunks chained from them and then
+// flushes the directory
 func deleteFiles(path string, csprng io.Reader) error {
 	// Create file if is it is a "does not exist error"
 	var fns [2]string
@@ -263,15 +407,45 @@ func deleteFiles(path string, csprng io.Reader) error {
 	d, err := portableOS.Open(dirname)
 	d.Sync()
 	d.Close()
+	if err != nil {
+		return err
+	}
 
-	return err
+	// The chunks are deleted last so that a failure part way through leaves
+	// orphaned chunks, which the next write removes, rather than a chain with
+	// missing links
+	return deleteChunks(path, csprng)
 }
 
-// write to the file and verify the data can be read
-func write(path string, data []byte) error {
+// write to the file and verify the data can be read. Data larger than
+// blobChunkSize is split across chained files, see chain.go. csprng is used
+// to overwrite chunks left unreferenced by the write.
+func write(path string, data []byte, csprng io.Reader) error {
 	if len(data) == 0 {
 		return errors.New(fmt.Sprintf(errInvalidSizeContents, 0))
 	}
+	if len(data) > blobChunkSize {
+		return writeChain(path, data, csprng)
+	}
+
+	err := writeRecord(path, recordKindInline, data, nil)
+	if err != nil {
+		return err
+	}
+
+	// Remove the chunks of a previous chained value, unless the other file
+	// still holds it
+	return deleteChunks(path, csprng)
+}
+
+// writeRecord writes data as a record of the given kind to the older of the
+// two files and verifies it can be read.
+//
+// If keep is not nil, the file whose data hashes to keep is preserved instead
+// of the newest one. This allows a chunk to be replaced while the chain that
+// still references its old contents is committed.
+func writeRecord(path string, kind byte, data []byte,
+	keep *[blake2b.Size256]byte) error {
 	// First, check if either file can be read. Then write to the other one
 	path1, path2 := getPaths(path)
 	newest, oldest, _ := getFileOrder(path1, path2)
@@ -289,20 +463,23 @@ func write(path string, data []byte) error {
 		if filesToRead[i] == nil {
 			continue
 		}
-		buf := make([]byte, 1)
-		buf[0] = 3
-		cnt, _ := filesToRead[i].ReadAt(buf, 0)
-		_, err := readContents(filesToRead[i])
-
-		if cnt == 1 && err == nil {
-			modMonCntr = buf[0]
-			filePathThatWasRead = filesToRead[i].Name()
-			break
+		rec, err := readContents(filesToRead[i])
+		if err != nil {
+			continue
+		}
+		if keep != nil && blake2b.Sum256(rec.data) != *keep {
+			continue
 		}
+		modMonCntr = rec.cntr
+		filePathThatWasRead = filesToRead[i].Name()
+		break
+	}
+	if keep != nil && filePathThatWasRead == "" {
+		// Nothing to preserve, so replace the oldest as usual
+		return writeRecord(path, kind, data, nil)
 	}
 
 	// Set the file to write, based on which file was read, if any
-	var fileToWrite portableOS.File
 	var filePathToWrite string
 	if filePathThatWasRead == "" || filePathThatWasRead == path2 {
 		filePathToWrite = path1
@@ -312,28 +489,7 @@ func write(path string, data []byte) error {
 
 	// Write the counter and contents of the file
 	modMonCntr = (modMonCntr + 1) % 3
-	// modMonCntrSize + 4 bytes to represent data len, len of data,
-	// and 256 bit (32 byte) hash size
-	contents := make([]byte, 1+4+len(data)+32)
-	contents[0] = modMonCntr
-
-	// Copy in the size
-	size := len(data)
-	sizeBytes := make([]byte, 4)
-	binary.LittleEndian.PutUint32(sizeBytes, uint32(size))
-	// Bytes 1:4 are the size
-	copy(contents[1:4], sizeBytes)
-
-	// Bytes 5 -> 5 + len(data) - 1 are the contents
-	contentStart := 5
-	contentEnd := contentStart + size
-	copy(contents[contentStart:contentEnd], data)
-
-	// Checksum at the end
-	checksum := blake2b.Sum256(data)
-	csumStart := contentEnd
-	csumEnd := csumStart + blake2b.Size256
-	copy(contents[csumStart:csumEnd], checksum[:])
+	contents := marshalRecord(modMonCntr, kind, data)
 
 	fileToWrite, err := createFile(filePathToWrite)
 	// Error out if we failed to create
@@ -360,22 +516,48 @@ func write(path string, data []byte) error {
 	if err != nil {
 		return err
 	}
-	contentsToCheck, err := readContents(fileToWrite)
+	recordToCheck, err := readContents(fileToWrite)
 	fileToWrite.Close()
 	if err != nil {
 		return err
 	}
 
-	if !bytes.Equal(data, contentsToCheck) {
+	if recordToCheck.kind != kind || !bytes.Equal(data, recordToCheck.data) {
 		return errors.Errorf(errCannotRead)
 	}
 
 	return nil
 }
 
-// read returns the contents of the newest file for which it
-// can read all elements and validate the internal checksum
+// read returns the contents of the newest file for which it can read all
+// elements and validate the internal checksum, following the chain if the
+// data was split across several files.
 func read(path string) ([]byte, error) {
+	rec, err := readRecord(path)
+	if err != nil {
+		return nil, err
+	}
+	if rec.kind == recordKindChain {
+		return readChain(path, rec.data)
+	}
+	return rec.data, nil
+}
+
+// validRecord returns whether the file at path holds a complete record with
+// a valid checksum.
+func validRecord(path string) bool {
+	f, err := portableOS.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	_, err = readContents(f)
+	return err == nil
+}
+
+// readRecord returns the record of the newest file for which it can read all
+// elements and validate the internal checksum.
+func readRecord(path string) (*record, error) {
 	// Open the newest first, note we only return this error if
 	// both returned file objects are bad (e.g., if neither file exists or
 	// the first byte of both files cannot be read)
@@ -388,22 +570,25 @@ func read(path string) ([]byte, error) {
 		defer oldest.Close()
 	}
 
+	if err != nil {
+		return nil, err
+	}
+
 	// Return the first file we can read the contents and validate a
-	// checksum, or an error
+	// checksum, or the error of the last file tried
+	err = errors.WithStack(&ErrCorrupt{Path: path, Reason: errInvalidFile})
 	filesToRead := []portableOS.File{newest, oldest}
 	for i := 0; i < len(filesToRead); i++ {
 		if filesToRead[i] == nil {
 			continue
 		}
-		contents, err := readContents(filesToRead[i])
-		if err != nil {
+		rec, readErr := readContents(filesToRead[i])
+		if readErr != nil {
+			err = readErr
 			continue
 		}
-		if len(contents) != 0 {
-			return contents, nil
-		}
+		return rec, nil
 	}
 
-	// Read and return the contents
 	return nil, err
 }
@@ -8,8 +8,18 @@
 package ekv
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
 	"fmt"
+	"math"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portableOS"
+	"golang.org/x/crypto/blake2b"
 )
 
 // TestModMonCntr tests all of the expected states for the Modulo Monotonic
@@ -48,7 +58,7 @@ func TestModMonCntr(t *testing.T) {
 func TestZeroWrite(t *testing.T) {
 	key := "test"
 	data := []byte{}
-	err := write(key, data)
+	err := write(key, data, rand.Reader)
 	if err == nil {
 		t.Errorf("Expected error on 0 write")
 	}
@@ -57,3 +67,99 @@ func TestZeroWrite(t *testing.T) {
 		t.Errorf("Unexpected error: %+v", err)
 	}
 }
+
+// Tests that files written in the legacy format, with a 4-byte size, can still
+// be read and are replaced by the current format on the next write.
+func TestRead_Legacy(t *testing.T) {
+	dir := ".ekv_testdir_legacy"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "legacy")
+
+	data := []byte("Hello, World!")
+	legacy := []byte{1}
+	legacy = binary.LittleEndian.AppendUint32(legacy, uint32(len(data)))
+	legacy = append(legacy, data...)
+	checksum := blake2b.Sum256(data)
+	legacy = append(legacy, checksum[:]...)
+	if err := os.WriteFile(path+".1", legacy, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := read(path)
+	if err != nil {
+		t.Fatalf("Failed to read legacy file: %+v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Wrong legacy contents: %q != %q", got, data)
+	}
+
+	// The new write goes to the other file with the next counter
+	if err = write(path, []byte("new"), rand.Reader); err != nil {
+		t.Fatalf("Write failed: %+v", err)
+	}
+	written, err := os.ReadFile(path + ".2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written[0] != recordFormatV2|2 {
+		t.Errorf("Unexpected first byte: %#x", written[0])
+	}
+	if got, err = read(path); err != nil || !bytes.Equal(got, []byte("new")) {
+		t.Errorf("Failed to read new value: %q, %+v", got, err)
+	}
+
+	// A size larger than the file is rejected rather than allocated
+	binary.LittleEndian.PutUint32(legacy[1:], math.MaxUint32)
+	if err = os.WriteFile(path+".1", legacy, 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := portableOS.Open(path + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = readContents(f)
+	var corrupt *ErrCorrupt
+	if !errors.As(err, &corrupt) {
+		t.Errorf("Expected ErrCorrupt for bad size, got %+v", err)
+	}
+}
+
+// Tests that a record whose 64-bit size does not match the file is rejected.
+func TestReadContents_BadSize(t *testing.T) {
+	dir := ".ekv_testdir_badsize"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "badsize")
+
+	for _, size := range []uint64{0, 4, 6, math.MaxUint64} {
+		contents := marshalRecord(0, recordKindInline, []byte("abcde"))
+		binary.LittleEndian.PutUint64(contents[2:], size)
+		if err := os.WriteFile(path, contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+		f, err := portableOS.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = readContents(f)
+		f.Close()
+		var corrupt *ErrCorrupt
+		if !errors.As(err, &corrupt) {
+			t.Errorf("Expected ErrCorrupt for size %d, got %+v", size, err)
+		}
+	}
+}
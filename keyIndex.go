@@ -0,0 +1,169 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// keyIndex.go lists the keys of a Filestore. A Filestore hashes its keys and
+// so cannot list them from the names of its files. Instead, every value is
+// encrypted along with its key, see envelope.go, and so is the manifest of
+// every merge log, so that the keys are found by scanning the files of the
+// store when they are listed, by Export, Sync, PurgeHistory and WatchExternal,
+// and writes never pay for it.
+//
+// Keys written before values held their key were recorded in an encrypted
+// index, kept as a record log, which is still read. Like the index of a
+// namespace, the keys listed may include keys that have since been deleted,
+// such as those whose versions are kept, but never miss one that exists and
+// was written since the index was introduced.
+
+import (
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portableOS"
+)
+
+// keyIndexKey is the key of the record log listing the keys of the store
+// written before values held their key.
+const keyIndexKey = "\x00ekv:key-index"
+
+// indexCopiedKey records a key written with a value copied from elsewhere, by
+// Import or Sync, in the indexes SetBytes would: the index of keys with a time
+// to live if its value expires, and the index of its namespace if it has one.
+// The caller must be in flight.
+func (f *Filestore) indexCopiedKey(key string, expires bool) error {
+	if expires {
+		if err := f.indexTTL(key); err != nil {
+			return err
+		}
+	}
+	if name, nsKey, ok := splitNamespaceKey(key); ok {
+		return f.indexNamespace(name, []string{nsKey}, true)
+	}
+	return nil
+}
+
+// indexedKeys returns the keys of the store, found in its files and in the
+// index of the keys written before values held their key, sorted. The caller
+// must be in flight and must not hold the locks of any key.
+func (f *Filestore) indexedKeys() ([]string, error) {
+	found, err := f.readStoreKeyIndex(f.getAppendKey(keyIndexKey))
+	if err != nil {
+		return nil, err
+	}
+	paths, err := f.listPaths()
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		if key, ok := f.pathKey(path); ok {
+			found[key] = struct{}{}
+		}
+	}
+
+	keys := make([]string, 0, len(found))
+	for key := range found {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// listPaths returns the paths of the files directly in the directory of the
+// store, without the suffix that tells the two files of a path apart.
+func (f *Filestore) listPaths() ([]string, error) {
+	infos, err := portableOS.ReadDir(f.basedir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	paths := make([]string, 0, len(infos)/2)
+	seen := make(map[string]struct{}, len(infos)/2)
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() ||
+			!strings.HasSuffix(name, ".1") && !strings.HasSuffix(name, ".2") {
+			continue
+		}
+		name = name[:len(name)-2]
+		if _, exists := seen[name]; !exists {
+			seen[name] = struct{}{}
+			paths = append(paths,
+				f.basedir+string(os.PathSeparator)+name)
+		}
+	}
+	return paths, nil
+}
+
+// pathKey returns the key whose value, version or merge log is stored at
+// path, if the files there hold one. Files that cannot be read or decrypted,
+// or that hold anything else, are skipped. The caller must be in flight and
+// must not hold the locks of any key.
+func (f *Filestore) pathKey(path string) (string, bool) {
+	unlock := f.takeLocks(false, path)
+	data, err := read(path)
+	unlock()
+	if err != nil {
+		return "", false
+	}
+
+	if plaintext, err := decryptWithAD(data, envelopeAD, f.key); err == nil {
+		e, err := unmarshalEnvelope(plaintext)
+		if err != nil || e.key == "" {
+			return "", false
+		}
+		return e.key, true
+	}
+	plaintext, err := decrypt(data, f.key)
+	if err != nil {
+		return "", false
+	}
+	m, err := unmarshalAppendManifest(plaintext)
+	if err != nil || !strings.HasPrefix(m.key, mergeLogKeyPrefix) ||
+		f.getAppendKey(m.key) != path {
+		return "", false
+	}
+	return strings.TrimPrefix(m.key, mergeLogKeyPrefix), true
+}
+
+// readStoreKeyIndex returns the keys listed in the index of the keys of the
+// store.
+func (f *Filestore) readStoreKeyIndex(appendKey string) (
+	map[string]struct{}, error) {
+	unlock := f.takeLocks(false, appendKey)
+	defer unlock()
+	return f.readKeyIndex(keyIndexKey, appendKey)
+}
+
+// unindexKeys removes keys from the index of the keys of the store by
+// rewriting it. The caller must be in flight and must not hold the locks of
+// any key.
+func (f *Filestore) unindexKeys(keys []string) error {
+	appendKey := f.getAppendKey(keyIndexKey)
+	unlock := f.takeLocks(true, appendKey)
+	defer unlock()
+	indexed, err := f.readKeyIndex(keyIndexKey, appendKey)
+	if err != nil {
+		return err
+	}
+	removed := false
+	for _, key := range keys {
+		if _, exists := indexed[key]; exists {
+			delete(indexed, key)
+			removed = true
+		}
+	}
+	if !removed {
+		return nil
+	}
+	err = f.deleteRecords(keyIndexKey, appendKey)
+	if err == nil && len(indexed) > 0 {
+		err = f.appendRecords(keyIndexKey, appendKey, keysToRecords(indexed))
+	}
+	return err
+}
@@ -0,0 +1,64 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"reflect"
+	"testing"
+
+	"gitlab.com/elixxir/ekv/portableOS"
+)
+
+// Tests that the keys of a Filestore are listed from its files, along with
+// those of the index of keys written before values held their key, and that
+// writes leave the index alone.
+func TestFilestore_indexedKeys(t *testing.T) {
+	dir := ".ekv_testdir_key_index"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	err = f.RegisterMergeOperator("counter", CounterMergeOperator)
+	if err != nil {
+		t.Fatalf("RegisterMergeOperator failed: %+v", err)
+	}
+	for _, key := range []string{"a", "deleted"} {
+		if err = f.SetBytes(key, []byte(key)); err != nil {
+			t.Fatalf("SetBytes failed: %+v", err)
+		}
+	}
+	if err = f.Merge("merged", "counter", counterOperand(1)); err != nil {
+		t.Fatalf("Merge failed: %+v", err)
+	}
+	if err = f.Delete("deleted"); err != nil {
+		t.Fatalf("Delete failed: %+v", err)
+	}
+
+	appendKey := f.getAppendKey(keyIndexKey)
+	if _, err = read(appendKey); Exists(err) {
+		t.Fatalf("Writes recorded their keys in the key index: %+v", err)
+	}
+	err = f.appendRecords(keyIndexKey, appendKey, [][]byte{[]byte("legacy")})
+	if err != nil {
+		t.Fatalf("appendRecords failed: %+v", err)
+	}
+
+	keys, err := f.indexedKeys()
+	if err != nil {
+		t.Fatalf("indexedKeys failed: %+v", err)
+	}
+	if expected := []string{"a", "legacy", "merged"}; !reflect.DeepEqual(
+		keys, expected) {
+		t.Errorf("Listed keys %q, expected %q", keys, expected)
+	}
+}
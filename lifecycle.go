@@ -0,0 +1,292 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// lifecycle tracks the operations in flight on a store so that closing or
+// locking it can wait for them to drain. Every operation started after Close
+// returns ErrClosed, and every operation started while the store is locked
+// returns ErrLocked or blocks until it is unlocked. While the store is paused,
+// operations wait for it to resume.
+type lifecycle struct {
+	closed  bool
+	locked  bool
+	locking bool
+	paused  bool
+
+	// blockWhenLocked makes operations wait for an unlock instead of
+	// returning ErrLocked.
+	blockWhenLocked bool
+
+	inFlight   int
+	lastActive time.Time
+
+	// idleTimeout, when non-zero, locks the store with onIdle once no
+	// operation has been in flight for that long.
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+	onIdle      func()
+
+	mux  sync.Mutex
+	cond *sync.Cond
+}
+
+// init lazily sets up the condition variable. The caller must hold mux.
+func (l *lifecycle) init() {
+	if l.cond == nil {
+		l.cond = sync.NewCond(&l.mux)
+	}
+}
+
+// begin registers an operation as in flight. The returned function must be
+// called when the operation completes. Returns ErrClosed if the store is
+// closed or closing, and ErrLocked if it is locked and not configured to block.
+// Blocks while the store is paused.
+func (l *lifecycle) begin() (done func(), err error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.init()
+
+	for {
+		if l.closed {
+			return nil, errors.WithStack(ErrClosed)
+		}
+		if !l.locked && !l.paused {
+			break
+		}
+		if l.locked && !l.blockWhenLocked {
+			return nil, errors.WithStack(ErrLocked)
+		}
+		l.cond.Wait()
+	}
+
+	l.inFlight++
+	return l.end, nil
+}
+
+// end marks an operation started by begin as complete.
+func (l *lifecycle) end() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.inFlight--
+	l.lastActive = time.Now()
+	if l.inFlight == 0 {
+		l.cond.Broadcast()
+	}
+}
+
+// drain blocks until no operation is in flight. The caller must hold mux.
+func (l *lifecycle) drain() {
+	for l.inFlight > 0 {
+		l.cond.Wait()
+	}
+}
+
+// close marks the store as closed and blocks until every operation in flight
+// has completed. Returns ErrClosed if the store was already closed.
+//
+// close must not be called from inside an operation on the same store, such
+// as a TransactionOperation, as it would wait on itself.
+func (l *lifecycle) close() error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.init()
+	l.waitForResume()
+
+	if l.closed {
+		return errors.WithStack(ErrClosed)
+	}
+	l.closed = true
+	l.stopIdleTimer()
+
+	// Wake operations blocked on a locked store so that they return ErrClosed
+	l.cond.Broadcast()
+	l.drain()
+	return nil
+}
+
+// lock marks the store as locked, waits for every operation in flight to
+// complete and then calls wipe. Locking a locked store does nothing.
+//
+// Like close, lock must not be called from inside an operation on the same
+// store.
+func (l *lifecycle) lock(wipe func()) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.init()
+	l.waitForResume()
+
+	if l.closed {
+		return errors.WithStack(ErrClosed)
+	}
+	if l.locked {
+		return nil
+	}
+	l.locked = true
+	l.locking = true
+	l.stopIdleTimer()
+
+	l.drain()
+	wipe()
+	l.locking = false
+	l.cond.Broadcast()
+	return nil
+}
+
+// pause waits for every operation in flight to complete and holds back new
+// ones until resume is called, so that the files of the store can be handled
+// as a whole. Unlike lock, the key material is kept. Returns ErrClosed if the
+// store is closed and ErrLocked if it is locked and not configured to block.
+// Close and Lock wait for the store to resume.
+//
+// Like close, pause must not be called from inside an operation on the same
+// store.
+func (l *lifecycle) pause() (resume func(), err error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.init()
+
+	for {
+		if l.closed {
+			return nil, errors.WithStack(ErrClosed)
+		}
+		if !l.locked && !l.paused {
+			break
+		}
+		if l.locked && !l.blockWhenLocked {
+			return nil, errors.WithStack(ErrLocked)
+		}
+		l.cond.Wait()
+	}
+	l.paused = true
+	l.drain()
+
+	return func() {
+		l.mux.Lock()
+		defer l.mux.Unlock()
+		l.paused = false
+		l.lastActive = time.Now()
+		l.cond.Broadcast()
+	}, nil
+}
+
+// waitForResume blocks while the store is paused. The caller must hold mux.
+func (l *lifecycle) waitForResume() {
+	for l.paused {
+		l.cond.Wait()
+	}
+}
+
+// unlock calls restore and, if it succeeds, marks the store as unlocked and
+// wakes any operation waiting on it. Unlocking an unlocked store does nothing.
+func (l *lifecycle) unlock(restore func() error) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.init()
+
+	// Wait for a concurrent lock to finish wiping
+	for l.locking {
+		l.cond.Wait()
+	}
+
+	if l.closed {
+		return errors.WithStack(ErrClosed)
+	}
+	if !l.locked {
+		return nil
+	}
+	if err := restore(); err != nil {
+		return err
+	}
+
+	l.locked = false
+	l.lastActive = time.Now()
+	l.startIdleTimer()
+	l.cond.Broadcast()
+	return nil
+}
+
+// isLocked returns true while the store is locked.
+func (l *lifecycle) isLocked() bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.locked
+}
+
+// setBlockWhenLocked sets whether operations on a locked store block until it
+// is unlocked instead of returning ErrLocked.
+func (l *lifecycle) setBlockWhenLocked(block bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.init()
+	l.blockWhenLocked = block
+
+	// Release waiters if blocking was turned off
+	l.cond.Broadcast()
+}
+
+// setIdleTimeout sets the idle duration after which onIdle is called. A
+// timeout of zero disables it.
+func (l *lifecycle) setIdleTimeout(timeout time.Duration, onIdle func()) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.stopIdleTimer()
+	l.idleTimeout = timeout
+	l.onIdle = onIdle
+	l.lastActive = time.Now()
+	if !l.locked && !l.closed {
+		l.startIdleTimer()
+	}
+}
+
+// startIdleTimer schedules an idle check. The caller must hold mux.
+func (l *lifecycle) startIdleTimer() {
+	if l.idleTimeout <= 0 || l.onIdle == nil {
+		return
+	}
+	l.idleTimer = time.AfterFunc(l.idleTimeout, l.checkIdle)
+}
+
+// stopIdleTimer cancels any scheduled idle check. The caller must hold mux.
+func (l *lifecycle) stopIdleTimer() {
+	if l.idleTimer != nil {
+		l.idleTimer.Stop()
+		l.idleTimer = nil
+	}
+}
+
+// checkIdle calls onIdle if the store has been idle for the idle timeout and
+// otherwise reschedules itself for when it could be.
+func (l *lifecycle) checkIdle() {
+	l.mux.Lock()
+	if l.closed || l.locked || l.idleTimeout <= 0 {
+		l.mux.Unlock()
+		return
+	}
+
+	idle := time.Since(l.lastActive)
+	if l.inFlight > 0 || idle < l.idleTimeout {
+		wait := l.idleTimeout - idle
+		if l.inFlight > 0 {
+			wait = l.idleTimeout
+		}
+		l.idleTimer = time.AfterFunc(wait, l.checkIdle)
+		l.mux.Unlock()
+		return
+	}
+	onIdle := l.onIdle
+	l.mux.Unlock()
+
+	onIdle()
+}
@@ -0,0 +1,233 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portableOS"
+)
+
+// testClose checks that Close waits for a transaction in flight and that every
+// later call returns ErrClosed.
+func testClose(t *testing.T, kv KeyValue) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	txDone := make(chan error)
+	go func() {
+		txDone <- kv.Transaction(
+			func(files map[string]Operable, _ Extender) error {
+				close(started)
+				<-release
+				files["key"].Set([]byte("value"))
+				return nil
+			}, "key")
+	}()
+	<-started
+
+	closed := make(chan error)
+	go func() { closed <- kv.Close() }()
+
+	select {
+	case err := <-closed:
+		t.Fatalf("Close returned before the transaction finished: %+v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := kv.SetBytes("other", []byte("value")); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed while closing, got %+v", err)
+	}
+
+	close(release)
+	if err := <-txDone; err != nil {
+		t.Errorf("Transaction in flight failed: %+v", err)
+	}
+	if err := <-closed; err != nil {
+		t.Errorf("Close failed: %+v", err)
+	}
+
+	if _, err := kv.GetBytes("key"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from GetBytes, got %+v", err)
+	}
+	if err := kv.Delete("key"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Delete, got %+v", err)
+	}
+	err := kv.Transaction(func(map[string]Operable, Extender) error {
+		t.Errorf("Transaction ran on a closed store")
+		return nil
+	}, "key")
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Transaction, got %+v", err)
+	}
+	if err = kv.Close(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from second Close, got %+v", err)
+	}
+}
+
+// Tests the Close lifecycle of Memstore.
+func TestMemstore_Close(t *testing.T) {
+	testClose(t, MakeMemstore())
+}
+
+// Tests the Close lifecycle of Filestore and that the transaction that was in
+// flight was committed.
+func TestFilestore_Close(t *testing.T) {
+	dir := ".ekv_testdir_close"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	testClose(t, f)
+
+	f, err = NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	data, err := f.GetBytes("key")
+	if err != nil || string(data) != "value" {
+		t.Errorf("Transaction in flight was not committed: %q, %+v", data, err)
+	}
+}
+
+// Tests that a locked Filestore returns ErrLocked until it is unlocked with
+// the right password.
+func TestFilestore_LockUnlock(t *testing.T) {
+	dir := ".ekv_testdir_lock"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.SetBytes("key", []byte("value")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if err = f.Lock(); err != nil {
+		t.Fatalf("Lock failed: %+v", err)
+	}
+	if !f.IsLocked() {
+		t.Errorf("Filestore is not locked")
+	}
+	if f.key != nil {
+		t.Errorf("Key material was not wiped")
+	}
+	if _, err = f.GetBytes("key"); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected ErrLocked, got %+v", err)
+	}
+
+	if err = f.Unlock("badpassword"); !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("Expected ErrWrongPassword, got %+v", err)
+	}
+	if !f.IsLocked() {
+		t.Errorf("Filestore unlocked with the wrong password")
+	}
+
+	if err = f.Unlock("Hello, World!"); err != nil {
+		t.Fatalf("Unlock failed: %+v", err)
+	}
+	data, err := f.GetBytes("key")
+	if err != nil || string(data) != "value" {
+		t.Errorf("Unexpected value after unlock: %q, %+v", data, err)
+	}
+}
+
+// Tests that operations block on a locked Filestore when configured to, and
+// that the idle timer locks the Filestore.
+func TestFilestore_AutoLockBlocking(t *testing.T) {
+	dir := ".ekv_testdir_autolock"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	f.SetBlockWhenLocked(true)
+	f.SetAutoLock(20 * time.Millisecond)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !f.IsLocked() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Filestore was not locked when idle")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	setDone := make(chan error)
+	go func() { setDone <- f.SetBytes("key", []byte("value")) }()
+
+	select {
+	case err = <-setDone:
+		t.Fatalf("SetBytes did not block on a locked store: %+v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err = f.Unlock("Hello, World!"); err != nil {
+		t.Fatalf("Unlock failed: %+v", err)
+	}
+	if err = <-setDone; err != nil {
+		t.Errorf("Blocked SetBytes failed after unlock: %+v", err)
+	}
+	f.SetAutoLock(0)
+}
+
+// Tests that operations wait while the lifecycle is paused, and that Close
+// waits for it to resume.
+func TestLifecycle_Pause(t *testing.T) {
+	var l lifecycle
+	resume, err := l.pause()
+	if err != nil {
+		t.Fatalf("pause failed: %+v", err)
+	}
+
+	began := make(chan error)
+	go func() {
+		done, err := l.begin()
+		if err == nil {
+			done()
+		}
+		began <- err
+	}()
+	closed := make(chan error)
+	go func() { closed <- l.close() }()
+
+	select {
+	case err = <-began:
+		t.Fatalf("Operation began while paused: %+v", err)
+	case err = <-closed:
+		t.Fatalf("Closed while paused: %+v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	resume()
+	if err = <-closed; err != nil {
+		t.Errorf("close failed: %+v", err)
+	}
+	if err = <-began; err != nil && !errors.Is(err, ErrClosed) {
+		t.Errorf("Unexpected error from begin: %+v", err)
+	}
+	if _, err = l.pause(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from pause, got %+v", err)
+	}
+}
@@ -8,16 +8,14 @@
 package ekv
 
 import (
-	"encoding/json"
-	jww "github.com/spf13/jwalterweatherman"
 	"sync"
+	"sync/atomic"
 
 	"github.com/pkg/errors"
 )
 
 const (
-	objectNotFoundErr = "object not found"
-	setInterfaceErr   = "SetInterface error"
+	setInterfaceErr = "SetInterface error"
 )
 
 // Memstore is an unencrypted memory-based map that implements the KeyValue
@@ -25,11 +23,69 @@ const (
 type Memstore struct {
 	store map[string][]byte
 	mux   sync.RWMutex
+
+	merges                   mergeRegistry
+	pendingMerges            map[string][]mergeOperand
+	mergeCompactionThreshold int
+
+	records map[string][][]byte
+
+	codecs     codecRegistry
+	schemas    schemaRegistry
+	namespaces namespaceRegistry
+	clock      clock
+	// valueTags holds how each value set with SetInterface was encoded
+	valueTags map[string]valueTags
+	// metadata holds the metadata of each value
+	metadata map[string]valueMeta
+	// changes is the change feed
+	changes  memChangeFeed
+	watchers watchHub
+	sync     syncRegistry
+
+	panicOnMisuse atomic.Bool
+	lifecycle     lifecycle
 }
 
 // MakeMemstore returns a new Memstore with a newly initialised a new map.
 func MakeMemstore() *Memstore {
-	return &Memstore{store: make(map[string][]byte)}
+	m := &Memstore{
+		store:                    make(map[string][]byte),
+		pendingMerges:            make(map[string][]mergeOperand),
+		mergeCompactionThreshold: defaultMergeCompactionThreshold,
+		records:                  make(map[string][][]byte),
+		valueTags:                make(map[string]valueTags),
+		metadata:                 make(map[string]valueMeta),
+	}
+	m.panicOnMisuse.Store(true)
+	return m
+}
+
+// SetPanicOnMisuse sets whether programming errors, such as using an Operable
+// after its transaction has closed, panic. When disabled, the misuse is logged
+// and the action is skipped instead. Enabled by default.
+func (m *Memstore) SetPanicOnMisuse(panicOnMisuse bool) {
+	m.panicOnMisuse.Store(panicOnMisuse)
+}
+
+// Close closes the Memstore per [KeyValue.Close]. It waits for operations and
+// transactions in flight to complete and then discards the stored values.
+// Every later call returns ErrClosed.
+func (m *Memstore) Close() error {
+	err := m.lifecycle.close()
+	if err != nil {
+		return err
+	}
+
+	m.watchers.close()
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.store = nil
+	m.pendingMerges = nil
+	m.records = nil
+	m.valueTags = nil
+	m.metadata = nil
+	return nil
 }
 
 // Set stores the value if there's no serialization error per [KeyValue.Set]
@@ -48,58 +104,264 @@ func (m *Memstore) Get(key string, loadIntoThisObject Unmarshaler) error {
 
 // Delete removes the value from the store per [KeyValue.Delete]
 func (m *Memstore) Delete(key string) error {
+	done, err := m.lifecycle.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+
 	m.mux.Lock()
 	defer m.mux.Unlock()
+	m.deleteValue(key)
+	m.recordChanges(Change{Op: ChangeDelete, Key: key})
+	return nil
+}
 
+// deleteValue removes the value of key, its pending merge operands, records,
+// encoding and metadata. The caller must hold the lock.
+func (m *Memstore) deleteValue(key string) {
 	delete(m.store, key)
-	return nil
+	delete(m.pendingMerges, key)
+	delete(m.records, key)
+	delete(m.valueTags, key)
+	delete(m.metadata, key)
 }
 
-// SetInterface sets the value using a JSON encoder per [KeyValue.SetInterface]
+// SetInterface sets the value using the default codec of the Memstore, JSON
+// unless changed with SetCodec, per [KeyValue.SetInterface]
 func (m *Memstore) SetInterface(key string, objectToStore interface{}) error {
-	data, err := json.Marshal(objectToStore)
+	return m.SetInterfaceWith(key, objectToStore)
+}
+
+// SetInterfaceWith is SetInterface with options for this write. Options that
+// only concern how values are stored on disk, such as compression, are
+// ignored.
+func (m *Memstore) SetInterfaceWith(key string, objectToStore interface{},
+	opts ...WriteOption) error {
+	o := newWriteOptions(opts)
+	data, err := m.codecs.encode(objectToStore, o)
+	if err == nil {
+		err = m.schemas.tag(key, o)
+	}
 	if err != nil {
 		return errors.Wrap(err, setInterfaceErr)
 	}
-	return m.SetBytes(key, data)
+	return m.setBytes(key, data, o)
 }
 
-// GetInterface gets the value using a JSON encoder per [KeyValue.GetInterface]
+// GetInterface decodes the value with the codec that encoded it per
+// [KeyValue.GetInterface]. Values of an earlier version of their schema are
+// upgraded first.
 func (m *Memstore) GetInterface(key string, objectToLoad interface{}) error {
-	data, err := m.GetBytes(key)
+	done, err := m.lifecycle.begin()
 	if err != nil {
 		return err
 	}
+	defer done()
 
-	err = json.Unmarshal(data, objectToLoad)
+	m.mux.Lock()
+	data, tags, err := m.getBytes(key)
+	var value storedValue
+	writeBack := false
+	if err == nil {
+		value, writeBack, err = m.schemas.upgrade(key,
+			storedValue{data: data, valueTags: tags}, &m.codecs)
+	}
+	if err == nil && writeBack {
+		m.setValue(key, value.data, value.valueTags, m.metadata[key])
+		m.recordChanges(Change{Op: ChangeSet, Key: key, Value: value.data})
+	}
+	m.mux.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = m.codecs.decode(value.codec, value.data, objectToLoad)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 	return nil
 }
 
+// RegisterSchema registers s so that values can be written under it and
+// values of its earlier versions are upgraded when read. Registering a name
+// again replaces the previous schema.
+func (m *Memstore) RegisterSchema(s Schema) error {
+	return m.schemas.register(s)
+}
+
+// SetCodec sets the default codec SetInterface encodes objects with. Values
+// already stored keep being decoded with the codec that encoded them.
+func (m *Memstore) SetCodec(c Codec) error {
+	return m.codecs.setDefault(c)
+}
+
+// RegisterCodec makes a custom codec available to decode values with. Codecs
+// passed to SetCodec or WithCodec are registered automatically. No codec may
+// take the name of a built in one.
+func (m *Memstore) RegisterCodec(c Codec) error {
+	return m.codecs.register(c)
+}
+
 // SetBytes implements [KeyValue.SetBytes]
 func (m *Memstore) SetBytes(key string, data []byte) error {
+	return m.SetBytesWith(key, data)
+}
+
+// SetBytesWith is SetBytes with options for this write. Options that only
+// concern how values are stored on disk, such as compression, are ignored.
+func (m *Memstore) SetBytesWith(key string, data []byte,
+	opts ...WriteOption) error {
+	return m.setBytes(key, data, newWriteOptions(opts))
+}
+
+// setBytes sets the value of key along with how it was encoded and its
+// metadata.
+func (m *Memstore) setBytes(key string, data []byte, opts *writeOptions) error {
+	done, err := m.lifecycle.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	if err = opts.setExpiry(m.clock.Now()); err != nil {
+		return err
+	}
+
 	m.mux.Lock()
 	defer m.mux.Unlock()
-	m.store[key] = data
+	meta := opts.meta
+	if _, exists, _ := m.readMerged(key); exists {
+		meta.created = m.metadata[key].created
+	}
+	m.setValue(key, data, opts.tags, meta)
+	m.recordChanges(Change{Op: ChangeSet, Key: key, Value: data})
 	return nil
 }
 
+// setValue sets the value of key, discarding any pending merge operands, and
+// records how it was encoded and its metadata, stamped with the current time.
+// The caller must hold the lock.
+func (m *Memstore) setValue(key string, data []byte, tags valueTags,
+	meta valueMeta) {
+	m.store[key] = data
+	delete(m.pendingMerges, key)
+	if tags == (valueTags{}) {
+		delete(m.valueTags, key)
+	} else {
+		m.valueTags[key] = tags
+	}
+	m.metadata[key] = meta.stamp(len(data), m.clock.Now())
+}
+
 // SetBytes implements [KeyValue.GetBytes]
 func (m *Memstore) GetBytes(key string) ([]byte, error) {
+	done, err := m.lifecycle.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
 	m.mux.Lock()
 	defer m.mux.Unlock()
-	data, ok := m.store[key]
+	data, _, err := m.getBytes(key)
+	return data, err
+}
+
+// getBytes returns the value of key and how it was encoded. The caller must
+// hold the lock.
+func (m *Memstore) getBytes(key string) ([]byte, valueTags, error) {
+	data, ok, err := m.readMerged(key)
+	if err != nil {
+		return nil, valueTags{}, err
+	}
 	if !ok {
-		return nil, errors.New(objectNotFoundErr)
+		return nil, valueTags{}, errors.WithStack(ErrNotFound)
 	}
 
-	return data, nil
+	return data, m.valueTags[key], nil
+}
+
+// RegisterMergeOperator registers op under name so that it can be referenced
+// by Merge. Registering a name again replaces the previous operator.
+func (m *Memstore) RegisterMergeOperator(name string, op MergeOperator) error {
+	return m.merges.register(name, op)
+}
+
+// Merge records operand as a delta against key. The operand is folded into
+// the value by the merge operator registered under name when the key is next
+// read or compacted.
+func (m *Memstore) Merge(key, name string, operand []byte) error {
+	if _, err := m.merges.get(name); err != nil {
+		return err
+	}
+	done, err := m.lifecycle.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.pendingMerges[key] = append(m.pendingMerges[key],
+		mergeOperand{name, operand})
+	m.recordChanges(Change{Op: ChangeMerge, Key: key, Value: operand,
+		Operator: name})
+	if len(m.pendingMerges[key]) >= m.mergeCompactionThreshold {
+		return m.compactMerges(key)
+	}
+	return nil
+}
+
+// CompactMerges folds all pending merge operands of key into its stored value.
+func (m *Memstore) CompactMerges(key string) error {
+	done, err := m.lifecycle.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.compactMerges(key)
+}
+
+// compactMerges folds the pending operands of key into the store. The caller
+// must hold the write lock.
+func (m *Memstore) compactMerges(key string) error {
+	if len(m.pendingMerges[key]) == 0 {
+		return nil
+	}
+	data, _, err := m.readMerged(key)
+	if err != nil {
+		return err
+	}
+	m.setValue(key, data, m.valueTags[key], m.metadata[key])
+	return nil
+}
+
+// readMerged returns the value of key with any pending merge operands folded
+// in. An expired value is treated as missing. The caller must hold the lock.
+func (m *Memstore) readMerged(key string) ([]byte, bool, error) {
+	data, ok := m.store[key]
+	if ok && m.metadata[key].expired(m.clock.Now()) {
+		data, ok = nil, false
+	}
+	operands := m.pendingMerges[key]
+	if len(operands) == 0 {
+		return data, ok, nil
+	}
+	return m.merges.fold(key, data, ok, operands)
 }
 
 // Transaction implements [KeyValue.Transaction]
 func (m *Memstore) Transaction(op TransactionOperation, keys ...string) error {
+	done, err := m.lifecycle.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+
 	m.mux.Lock()
 	defer m.mux.Unlock()
 	e := &extendableMem{
@@ -118,7 +380,10 @@ func (m *Memstore) Transaction(op TransactionOperation, keys ...string) error {
 		return err
 	}
 
-	e.flush()
+	err = e.flush()
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -130,7 +395,8 @@ type extendableMem struct {
 
 func (e *extendableMem) Extend(keys []string) (map[string]Operable, error) {
 	if e.closed {
-		jww.FATAL.Panicf("Cannot extend, transaction already closed")
+		return nil, errors.Wrap(ErrClosed,
+			"Cannot extend, transaction already closed")
 	}
 	operables := make(map[string]Operable, len(keys))
 
@@ -147,7 +413,15 @@ func (e *extendableMem) Extend(keys []string) (map[string]Operable, error) {
 	// read the keys
 	for _, oper := range operables {
 		operInternal := oper.(*operableMem)
-		operInternal.data, operInternal.exists = e.mem.store[operInternal.key]
+		data, exists, err := e.mem.readMerged(operInternal.key)
+		if err != nil {
+			return nil, err
+		}
+		operInternal.data, operInternal.exists = data, exists
+		if exists {
+			operInternal.tags = e.mem.valueTags[operInternal.key]
+			operInternal.meta = e.mem.metadata[operInternal.key]
+		}
 	}
 	e.operables = append(e.operables, operables)
 	return operables, nil
@@ -157,17 +431,18 @@ func (e *extendableMem) IsClosed() bool {
 	return e.closed
 }
 
-func (e *extendableMem) flush() {
+func (e *extendableMem) flush() error {
 	for _, opMap := range e.operables {
-		for _, oper := range opMap {
+		for key, oper := range opMap {
 			if !oper.IsClosed() {
 				if err := oper.Flush(); err != nil {
-					jww.FATAL.Panicf("Failed on a flush of key %s in "+
-						"transaction: %+v", oper.Key(), err)
+					return errors.Wrapf(err, "Failed on a flush of key %s "+
+						"in transaction", key)
 				}
 			}
 		}
 	}
+	return nil
 }
 
 func (e *extendableMem) close() {
@@ -179,8 +454,13 @@ type operableMem struct {
 	closed bool
 
 	data   []byte
+	tags   valueTags
+	meta   valueMeta
 	exists bool
 
+	// appended holds the records to append to the record log of the key
+	appended [][]byte
+
 	op OperableOps
 
 	mem *Memstore
@@ -192,44 +472,103 @@ func (op *operableMem) Key() string {
 }
 
 func (op *operableMem) Exists() bool {
-	op.testClosed("Exists()")
+	if op.testClosed("Exists()") {
+		return false
+	}
 	return op.exists
 }
 
 func (op *operableMem) Delete() {
-	op.testClosed("Delete()")
+	if op.testClosed("Delete()") {
+		return
+	}
 
 	op.data = nil
+	op.meta = valueMeta{}
 	op.exists = false
 	op.op = deleteOp
 }
 
 func (op *operableMem) Set(data []byte) {
-	op.testClosed("Set()")
+	if op.testClosed("Set()") {
+		return
+	}
 
 	op.data = data
+	op.tags = valueTags{}
+	op.meta = valueMeta{created: op.meta.created}
 	op.exists = true
 	op.op = writeOp
 }
 
 func (op *operableMem) Get() ([]byte, bool) {
-	op.testClosed("Get()")
+	if op.testClosed("Get()") {
+		return nil, false
+	}
 	return op.data, op.exists
 }
 
+func (op *operableMem) GetInterface(v interface{}) error {
+	if op.testClosed("GetInterface()") {
+		return errors.Wrapf(ErrClosed, "Cannot get '%s'", op.key)
+	}
+	if !op.exists {
+		return errors.WithStack(ErrNotFound)
+	}
+	value, writeBack, err := op.mem.schemas.upgrade(op.key,
+		storedValue{data: op.data, valueTags: op.tags}, &op.mem.codecs)
+	if err != nil {
+		return err
+	}
+	if writeBack && op.op == readOp {
+		op.data, op.tags = value.data, value.valueTags
+		op.op = writeOp
+	}
+	return op.mem.codecs.decode(value.codec, value.data, v)
+}
+
+func (op *operableMem) SetInterface(v interface{}) error {
+	if op.testClosed("SetInterface()") {
+		return errors.Wrapf(ErrClosed, "Cannot set '%s'", op.key)
+	}
+	o := &writeOptions{}
+	data, err := op.mem.codecs.encode(v, o)
+	if err == nil {
+		err = op.mem.schemas.tag(op.key, o)
+	}
+	if err != nil {
+		return err
+	}
+	op.Set(data)
+	op.tags = o.tags
+	return nil
+}
+
+func (op *operableMem) Append(data []byte) {
+	if op.testClosed("Append()") {
+		return
+	}
+	op.appended = append(op.appended, data)
+}
+
 func (op *operableMem) Flush() error {
-	op.testClosed("Flush()")
+	if op.testClosed("Flush()") {
+		return errors.Wrapf(ErrClosed, "Cannot flush '%s'", op.key)
+	}
 	defer func() {
 		op.closed = true
 	}()
 	switch op.op {
-	case readOp:
-		return nil
 	case writeOp:
-		op.mem.store[op.key] = op.data
+		op.mem.setValue(op.key, op.data, op.tags, op.meta)
+		op.mem.recordChanges(
+			Change{Op: ChangeSet, Key: op.key, Value: op.data})
 	case deleteOp:
-		delete(op.mem.store, op.key)
+		op.mem.deleteValue(op.key)
+		op.mem.recordChanges(Change{Op: ChangeDelete, Key: op.key})
 	}
+	// As in a Filestore, records appended after a delete are kept
+	op.mem.appendRecords(op.key, op.appended)
 	return nil
 }
 
@@ -237,8 +576,14 @@ func (op *operableMem) IsClosed() bool {
 	return op.closed
 }
 
-func (op *operableMem) testClosed(action string) {
+// testClosed reports whether the operable is closed. Using a closed operable
+// is a programming error, so this panics unless the store is configured not
+// to, in which case the error is logged and the caller skips the action.
+func (op *operableMem) testClosed(action string) bool {
 	if op.closed {
-		jww.FATAL.Panicf("Cannot '%s' on '%s', already closed", action, op.key)
+		reportMisuse(op.mem.panicOnMisuse.Load(),
+			"Cannot '%s' on '%s', already closed", action, op.key)
+		return true
 	}
+	return false
 }
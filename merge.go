@@ -0,0 +1,205 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// merge.go implements RocksDB-style merge operators. Instead of reading,
+// decrypting, modifying, and re-encrypting a value under an exclusive lock,
+// a caller records a delta (an "operand") against a key. Operands are kept in
+// a separate pending log per key and are folded into the base value lazily
+// when the key is read, or permanently when the key is compacted.
+//
+// In a Filestore, the pending log is a record log, see append.go, so every
+// operand is written as a new segment and the operands already pending are
+// never read or rewritten by a Merge.
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// mergeLogKeyPrefix is prepended to a key to derive the key of the record
+	// log holding its pending operands. The NUL byte keeps it out of the way
+	// of user keys and the derived names are hashed like any other key, so
+	// the log is indistinguishable from a value on disk.
+	mergeLogKeyPrefix = "\x00ekv:merge:"
+
+	// defaultMergeCompactionThreshold is the number of pending operands after
+	// which a Merge call compacts the key.
+	defaultMergeCompactionThreshold = 64
+
+	errUnknownMergeOperator = "no merge operator registered with name %q"
+	errEmptyMergeOperator   = "merge operator name cannot be empty"
+	errNilMergeOperator     = "merge operator %q cannot be nil"
+	errMergeLogCorrupt      = "merge log is corrupt: %s"
+	errMergeFailed          = "merge operator %q failed on key %q"
+)
+
+// MergeOperator folds a series of operands into an existing value. Operators
+// are registered by name on a store and referenced by that name when calling
+// Merge.
+type MergeOperator interface {
+	// FullMerge applies the operands, in the order they were recorded, to the
+	// existing value and returns the new value. If the key has no base value,
+	// existing is nil and exists is false.
+	FullMerge(key string, existing []byte, exists bool,
+		operands [][]byte) ([]byte, error)
+}
+
+// MergeOperatorFunc is an adapter that allows the use of an ordinary function
+// as a MergeOperator.
+type MergeOperatorFunc func(key string, existing []byte, exists bool,
+	operands [][]byte) ([]byte, error)
+
+// FullMerge calls f(key, existing, exists, operands).
+func (f MergeOperatorFunc) FullMerge(key string, existing []byte, exists bool,
+	operands [][]byte) ([]byte, error) {
+	return f(key, existing, exists, operands)
+}
+
+// CounterMergeOperator treats the value and every operand as a little-endian
+// int64 and adds them together. A missing base value counts as zero.
+var CounterMergeOperator MergeOperator = MergeOperatorFunc(
+	func(_ string, existing []byte, exists bool,
+		operands [][]byte) ([]byte, error) {
+		var sum int64
+		if exists {
+			if len(existing) != 8 {
+				return nil, errors.Errorf(
+					"counter value must be 8 bytes, got %d", len(existing))
+			}
+			sum = int64(binary.LittleEndian.Uint64(existing))
+		}
+		for _, operand := range operands {
+			if len(operand) != 8 {
+				return nil, errors.Errorf(
+					"counter operand must be 8 bytes, got %d", len(operand))
+			}
+			sum += int64(binary.LittleEndian.Uint64(operand))
+		}
+		result := make([]byte, 8)
+		binary.LittleEndian.PutUint64(result, uint64(sum))
+		return result, nil
+	})
+
+// mergeOperand is a single delta recorded by Merge.
+type mergeOperand struct {
+	name    string
+	operand []byte
+}
+
+// mergeRegistry holds the named merge operators of a store.
+type mergeRegistry struct {
+	operators map[string]MergeOperator
+	mux       sync.RWMutex
+}
+
+// register adds or replaces the operator with the given name.
+func (r *mergeRegistry) register(name string, op MergeOperator) error {
+	if name == "" {
+		return errors.New(errEmptyMergeOperator)
+	}
+	if op == nil {
+		return errors.Errorf(errNilMergeOperator, name)
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.operators == nil {
+		r.operators = make(map[string]MergeOperator)
+	}
+	r.operators[name] = op
+	return nil
+}
+
+// get returns the operator registered under name.
+func (r *mergeRegistry) get(name string) (MergeOperator, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	op, ok := r.operators[name]
+	if !ok {
+		return nil, errors.Errorf(errUnknownMergeOperator, name)
+	}
+	return op, nil
+}
+
+// fold applies the operands to the base value. Consecutive operands recorded
+// with the same operator are passed to it in a single FullMerge call.
+func (r *mergeRegistry) fold(key string, base []byte, exists bool,
+	operands []mergeOperand) ([]byte, bool, error) {
+	for start := 0; start < len(operands); {
+		name := operands[start].name
+		end := start
+		batch := make([][]byte, 0, len(operands)-start)
+		for end < len(operands) && operands[end].name == name {
+			batch = append(batch, operands[end].operand)
+			end++
+		}
+
+		op, err := r.get(name)
+		if err != nil {
+			return nil, false, err
+		}
+		base, err = op.FullMerge(key, base, exists, batch)
+		if err != nil {
+			return nil, false, errors.Wrapf(err, errMergeFailed, name, key)
+		}
+		exists = true
+		start = end
+	}
+	return base, exists, nil
+}
+
+// marshalMergeLog serializes operands as a series of
+// [2-byte name length][name][4-byte operand length][operand] entries.
+func marshalMergeLog(operands []mergeOperand) []byte {
+	size := 0
+	for _, o := range operands {
+		size += 2 + len(o.name) + 4 + len(o.operand)
+	}
+
+	buf := make([]byte, 0, size)
+	for _, o := range operands {
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(o.name)))
+		buf = append(buf, o.name...)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(o.operand)))
+		buf = append(buf, o.operand...)
+	}
+	return buf
+}
+
+// unmarshalMergeLog is the inverse of marshalMergeLog.
+func unmarshalMergeLog(data []byte) ([]mergeOperand, error) {
+	var operands []mergeOperand
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, errors.Errorf(errMergeLogCorrupt, "short name length")
+		}
+		nameLen := int(binary.LittleEndian.Uint16(data))
+		data = data[2:]
+		if len(data) < nameLen+4 {
+			return nil, errors.Errorf(errMergeLogCorrupt, "short name")
+		}
+		name := string(data[:nameLen])
+		data = data[nameLen:]
+
+		operandLen := int(binary.LittleEndian.Uint32(data))
+		data = data[4:]
+		if len(data) < operandLen {
+			return nil, errors.Errorf(errMergeLogCorrupt, "short operand")
+		}
+		operand := make([]byte, operandLen)
+		copy(operand, data[:operandLen])
+		data = data[operandLen:]
+
+		operands = append(operands, mergeOperand{name, operand})
+	}
+	return operands, nil
+}
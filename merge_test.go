@@ -0,0 +1,292 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"testing"
+
+	"gitlab.com/elixxir/ekv/portableOS"
+)
+
+// counterOperand encodes n as a CounterMergeOperator operand.
+func counterOperand(n int64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(n))
+	return b
+}
+
+// mergeStore is the subset of the store methods exercised by these tests.
+type mergeStore interface {
+	KeyValue
+	RegisterMergeOperator(name string, op MergeOperator) error
+	Merge(key, name string, operand []byte) error
+	CompactMerges(key string) error
+}
+
+// testMergeCounter runs concurrent counter merges against a store and checks
+// that every delta is accounted for, both before and after compaction.
+func testMergeCounter(t *testing.T, s mergeStore) {
+	err := s.RegisterMergeOperator("counter", CounterMergeOperator)
+	if err != nil {
+		t.Fatalf("Failed to register operator: %+v", err)
+	}
+
+	err = s.Merge("key", "unknown", counterOperand(1))
+	if err == nil {
+		t.Errorf("Merge with an unknown operator succeeded")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if err := s.Merge("key", "counter", counterOperand(1)); err != nil {
+					t.Errorf("Merge failed: %+v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, err := s.GetBytes("key")
+	if err != nil {
+		t.Fatalf("GetBytes failed: %+v", err)
+	}
+	if got := int64(binary.LittleEndian.Uint64(data)); got != 50 {
+		t.Errorf("Unexpected counter value: %d != %d", got, 50)
+	}
+
+	if err = s.CompactMerges("key"); err != nil {
+		t.Fatalf("CompactMerges failed: %+v", err)
+	}
+	if err = s.Merge("key", "counter", counterOperand(-8)); err != nil {
+		t.Fatalf("Merge failed: %+v", err)
+	}
+	data, err = s.GetBytes("key")
+	if err != nil {
+		t.Fatalf("GetBytes failed: %+v", err)
+	}
+	if got := int64(binary.LittleEndian.Uint64(data)); got != 42 {
+		t.Errorf("Unexpected counter value: %d != %d", got, 42)
+	}
+
+	// A set overrides the pending operands
+	if err = s.SetBytes("key", counterOperand(7)); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	data, err = s.GetBytes("key")
+	if err != nil {
+		t.Fatalf("GetBytes failed: %+v", err)
+	}
+	if !bytes.Equal(data, counterOperand(7)) {
+		t.Errorf("Set did not discard pending operands: %v", data)
+	}
+
+	// Transactions see the merged value and consume the operands
+	if err = s.Merge("key", "counter", counterOperand(3)); err != nil {
+		t.Fatalf("Merge failed: %+v", err)
+	}
+	err = s.Transaction(func(files map[string]Operable, _ Extender) error {
+		data, exists := files["key"].Get()
+		if !exists || !bytes.Equal(data, counterOperand(10)) {
+			t.Errorf("Transaction did not see merged value: %v", data)
+		}
+		files["key"].Set(counterOperand(100))
+		return nil
+	}, "key")
+	if err != nil {
+		t.Fatalf("Transaction failed: %+v", err)
+	}
+	data, err = s.GetBytes("key")
+	if err != nil {
+		t.Fatalf("GetBytes failed: %+v", err)
+	}
+	if !bytes.Equal(data, counterOperand(100)) {
+		t.Errorf("Transaction did not consume operands: %v", data)
+	}
+
+	// Deleting removes pending operands as well
+	if err = s.Merge("key", "counter", counterOperand(3)); err != nil {
+		t.Fatalf("Merge failed: %+v", err)
+	}
+	if err = s.Delete("key"); err != nil {
+		t.Fatalf("Delete failed: %+v", err)
+	}
+	if _, err = s.GetBytes("key"); Exists(err) {
+		t.Errorf("Key exists after delete: %+v", err)
+	}
+}
+
+// Tests that merges are folded into the value in Memstore.
+func TestMemstore_Merge(t *testing.T) {
+	testMergeCounter(t, MakeMemstore())
+}
+
+// Tests that merges are folded into the value in Filestore and that pending
+// operands survive reopening the store.
+func TestFilestore_Merge(t *testing.T) {
+	dir := ".ekv_testdir_merge"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	testMergeCounter(t, f)
+
+	if err = f.Merge("persisted", "counter", counterOperand(5)); err != nil {
+		t.Fatalf("Merge failed: %+v", err)
+	}
+
+	f, err = NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = f.GetBytes("persisted"); err == nil {
+		t.Errorf("Folded operands without a registered operator")
+	}
+	err = f.RegisterMergeOperator("counter", CounterMergeOperator)
+	if err != nil {
+		t.Fatalf("Failed to register operator: %+v", err)
+	}
+	data, err := f.GetBytes("persisted")
+	if err != nil {
+		t.Fatalf("GetBytes failed: %+v", err)
+	}
+	if !bytes.Equal(data, counterOperand(5)) {
+		t.Errorf("Pending operand lost on reopen: %v", data)
+	}
+}
+
+// Tests that reaching the compaction threshold folds the operands into the
+// base value.
+func TestFilestore_MergeAutoCompaction(t *testing.T) {
+	dir := ".ekv_testdir_merge_compaction"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	f.mergeCompactionThreshold = 3
+	err = f.RegisterMergeOperator("counter", CounterMergeOperator)
+	if err != nil {
+		t.Fatalf("Failed to register operator: %+v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err = f.Merge("key", "counter", counterOperand(2)); err != nil {
+			t.Fatalf("Merge failed: %+v", err)
+		}
+	}
+
+	operands, err := f.readMergeLog("key", f.getMergeLogKey("key"))
+	if err != nil {
+		t.Fatalf("Failed to read merge log: %+v", err)
+	}
+	if len(operands) != 0 {
+		t.Errorf("Operands were not compacted: %d remain", len(operands))
+	}
+	encrypted, err := read(f.getKey("key"))
+	if err != nil {
+		t.Fatalf("Compacted value was not written: %+v", err)
+	}
+	value, err := f.decryptValue(encrypted)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !bytes.Equal(value.data, counterOperand(6)) {
+		t.Errorf("Unexpected compacted value: %v", value.data)
+	}
+}
+
+// Tests that every operand is appended as a new segment of the merge log,
+// leaving the operands already pending as they are.
+func TestFilestore_MergeAppends(t *testing.T) {
+	dir := ".ekv_testdir_merge_appends"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	err = f.RegisterMergeOperator("counter", CounterMergeOperator)
+	if err != nil {
+		t.Fatalf("Failed to register operator: %+v", err)
+	}
+	if err = f.Merge("key", "counter", counterOperand(1)); err != nil {
+		t.Fatalf("Merge failed: %+v", err)
+	}
+	first := f.getSegmentKey(mergeLogKeyPrefix+"key", 0)
+	before, err := read(first)
+	if err != nil {
+		t.Fatalf("First operand not written as a segment: %+v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err = f.Merge("key", "counter", counterOperand(1)); err != nil {
+			t.Fatalf("Merge failed: %+v", err)
+		}
+	}
+	after, err := read(first)
+	if err != nil || !bytes.Equal(before, after) {
+		t.Errorf("First segment rewritten by later merges: %+v", err)
+	}
+	operands, err := f.readMergeLog("key", f.getMergeLogKey("key"))
+	if err != nil || len(operands) != 4 {
+		t.Fatalf("Read %d operands: %+v", len(operands), err)
+	}
+	if data, err := f.GetBytes("key"); err != nil ||
+		!bytes.Equal(data, counterOperand(4)) {
+		t.Errorf("Unexpected merged value %v: %+v", data, err)
+	}
+}
+
+// Tests that a merge log survives a marshal and unmarshal round trip.
+func Test_marshalMergeLog(t *testing.T) {
+	operands := []mergeOperand{
+		{"a", []byte("first")},
+		{"bb", nil},
+		{"a", []byte("third")},
+	}
+	decoded, err := unmarshalMergeLog(marshalMergeLog(operands))
+	if err != nil {
+		t.Fatalf("Failed to unmarshal: %+v", err)
+	}
+	if len(decoded) != len(operands) {
+		t.Fatalf("Wrong operand count: %d != %d", len(decoded), len(operands))
+	}
+	for i := range operands {
+		if decoded[i].name != operands[i].name ||
+			!bytes.Equal(decoded[i].operand, operands[i].operand) {
+			t.Errorf("Operand %d mismatch: %+v != %+v",
+				i, decoded[i], operands[i])
+		}
+	}
+
+	if _, err = unmarshalMergeLog([]byte{5, 0, 'a'}); err == nil {
+		t.Errorf("Unmarshalled a truncated log")
+	}
+}
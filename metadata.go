@@ -0,0 +1,348 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// metadata.go implements the metadata stored with every value: when it was
+// created and last modified, its size and what it holds. In a Filestore, the
+// metadata is part of the encrypted envelope of the value, so it is no more
+// visible on disk than the value itself. The timestamps of the files are
+// neither read nor set.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+// Metadata describes a stored value.
+type Metadata struct {
+	// Created is when the key was first written. It is kept when the value
+	// is overwritten and reset when the key is deleted.
+	Created time.Time
+	// Modified is when the value was last written, or when merge operands
+	// were last compacted into it.
+	Modified time.Time
+	// Size is the size of the value in bytes, before compression and
+	// encryption, with any pending merge operands folded in.
+	Size int64
+	// Codec is the name of the codec that encoded the value if it was set
+	// with SetInterface.
+	Codec string
+	// ContentType is the content type set with WithContentType.
+	ContentType string
+	// Tags are the tags set with WithTags.
+	Tags map[string]string
+	// Expires is when the value expires, or the zero time if it does not.
+	Expires time.Time
+}
+
+// WithContentType records contentType in the metadata of the value. Like
+// tags, it describes the value it is written with and is not kept when the
+// value is overwritten.
+func WithContentType(contentType string) WriteOption {
+	return func(o *writeOptions) {
+		o.meta.contentType = contentType
+	}
+}
+
+// WithTags records tags in the metadata of the value. Like the content type,
+// they describe the value they are written with and are not kept when the
+// value is overwritten.
+func WithTags(tags map[string]string) WriteOption {
+	return func(o *writeOptions) {
+		o.meta.tags = make(map[string]string, len(tags))
+		for k, v := range tags {
+			o.meta.tags[k] = v
+		}
+	}
+}
+
+// valueMeta is the metadata stored in the envelope of a value.
+type valueMeta struct {
+	created     time.Time
+	modified    time.Time
+	size        uint64
+	contentType string
+	tags        map[string]string
+	// expires is when the value expires, if it does. It is stored in its own
+	// envelope field.
+	expires time.Time
+}
+
+// stamp returns the metadata of a value of the given size written now,
+// keeping the creation time if there is one.
+func (m valueMeta) stamp(size int, now time.Time) valueMeta {
+	if m.created.IsZero() {
+		m.created = now
+	}
+	m.modified = now
+	m.size = uint64(size)
+	return m
+}
+
+// isZero returns whether the metadata, other than the expiry, is unset, as
+// for values written before metadata existed.
+func (m valueMeta) isZero() bool {
+	return m.created.IsZero() && m.modified.IsZero() && m.size == 0 &&
+		m.contentType == "" && len(m.tags) == 0
+}
+
+// marshal encodes the metadata as
+// [varint created][varint modified][uvarint size][content type][tag count]
+// [tags], where the content type and every tag key and value are prefixed
+// with their uvarint size and tags are sorted by key. Times are nanoseconds
+// since the Unix epoch.
+func (m valueMeta) marshal() []byte {
+	buf := binary.AppendVarint(nil, m.created.UnixNano())
+	buf = binary.AppendVarint(buf, m.modified.UnixNano())
+	buf = binary.AppendUvarint(buf, m.size)
+	buf = appendMetaString(buf, m.contentType)
+
+	keys := make([]string, 0, len(m.tags))
+	for k := range m.tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf = binary.AppendUvarint(buf, uint64(len(keys)))
+	for _, k := range keys {
+		buf = appendMetaString(buf, k)
+		buf = appendMetaString(buf, m.tags[k])
+	}
+	return buf
+}
+
+// appendMetaString appends s, prefixed with its uvarint size, to buf.
+func appendMetaString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// unmarshalValueMeta is the inverse of valueMeta.marshal.
+func unmarshalValueMeta(data []byte) (valueMeta, error) {
+	d := metaDecoder{data: data}
+	m := valueMeta{
+		created:     time.Unix(0, d.varint()),
+		modified:    time.Unix(0, d.varint()),
+		size:        d.uvarint(),
+		contentType: d.string(),
+	}
+	count := d.uvarint()
+	if d.err == nil && count > uint64(len(d.data)) {
+		d.err = errors.New("too many tags")
+	}
+	if count > 0 && d.err == nil {
+		m.tags = make(map[string]string, count)
+		for i := uint64(0); i < count && d.err == nil; i++ {
+			k := d.string()
+			m.tags[k] = d.string()
+		}
+	}
+	if d.err == nil && len(d.data) != 0 {
+		d.err = errors.New("trailing data")
+	}
+	if d.err != nil {
+		return valueMeta{}, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+			errEnvelope, "invalid metadata field: "+d.err.Error())})
+	}
+	return m, nil
+}
+
+// metaDecoder reads the parts of encoded metadata in turn. After the first
+// error, every read returns a zero value and err holds the error.
+type metaDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *metaDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = errors.New("truncated integer")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *metaDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = errors.New("truncated integer")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *metaDecoder) string() string {
+	size := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if size > uint64(len(d.data)) {
+		d.err = errors.New("truncated string")
+		return ""
+	}
+	s := string(d.data[:size])
+	d.data = d.data[size:]
+	return s
+}
+
+func (d *metaDecoder) fixed(size int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if size > len(d.data) {
+		d.err = errors.New("truncated field")
+		return nil
+	}
+	b := d.data[:size]
+	d.data = d.data[size:]
+	return b
+}
+
+// newMetadata returns the Metadata of a value of the given size.
+func newMetadata(meta valueMeta, tags valueTags, size int) *Metadata {
+	md := &Metadata{
+		Created:     meta.created,
+		Modified:    meta.modified,
+		Size:        int64(size),
+		Codec:       tags.codec,
+		ContentType: meta.contentType,
+		Expires:     meta.expires,
+	}
+	if len(meta.tags) > 0 {
+		md.Tags = make(map[string]string, len(meta.tags))
+		for k, v := range meta.tags {
+			md.Tags[k] = v
+		}
+	}
+	return md
+}
+
+// Stat returns the metadata of the value of key. Returns an error for which
+// Exists is false if it does not exist. Values written before metadata
+// existed have zero times.
+func (f *Filestore) Stat(key string) (*Metadata, error) {
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	encryptedKey := f.getKey(key)
+	logKey := f.getMergeLogKey(key)
+	unlock := f.takeLocks(false, encryptedKey, logKey)
+	defer unlock()
+
+	operands, err := f.readMergeLog(key, logKey)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(operands) > 0 {
+		// The size depends on the operands, so the value must be merged
+		value, _, _, err := f.readMerged(key, encryptedKey, logKey)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return newMetadata(value.meta, value.valueTags, len(value.data)), nil
+	}
+
+	encryptedContents, err := read(encryptedKey)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	e, err := openEnvelope(encryptedContents, f.key)
+	if err != nil {
+		return nil, err
+	}
+	if e.meta.expired(f.clock.Now()) {
+		return nil, errors.WithStack(ErrNotFound)
+	}
+	size := int(e.meta.size)
+	if e.meta.isZero() {
+		// Values without metadata must be decompressed to get their size
+		value, err := e.value()
+		if err != nil {
+			return nil, err
+		}
+		size = len(value.data)
+	}
+	return newMetadata(e.meta, e.valueTags, size), nil
+}
+
+// replacedValue is the value a write replaces. It is read once, before the
+// write, for both the creation time the new value keeps and the version the
+// history keeps of it.
+type replacedValue struct {
+	// encryptedContents is nil if there is no value.
+	encryptedContents []byte
+	envelope          *envelope
+
+	// err is why a value that exists could not be read or opened.
+	err error
+}
+
+// readReplaced reads the value at encryptedKey that a write is about to
+// replace. The caller must hold the lock of encryptedKey.
+func (f *Filestore) readReplaced(encryptedKey string) *replacedValue {
+	r := &replacedValue{}
+	r.encryptedContents, r.err = read(encryptedKey)
+	if r.err != nil {
+		if !Exists(r.err) {
+			r.err = nil
+		}
+		return r
+	}
+	r.envelope, r.err = openEnvelope(r.encryptedContents, f.key)
+	return r
+}
+
+// created returns the creation time of the replaced value, or the zero time
+// if it does not exist, has expired by now or has none. A value that cannot
+// be read is being overwritten, so it is treated as missing rather than
+// failing the write.
+func (r *replacedValue) created(now time.Time) time.Time {
+	if r.err != nil {
+		jww.WARN.Printf("Cannot read the creation time of the value "+
+			"replaced: %+v", r.err)
+		return time.Time{}
+	}
+	if r.envelope == nil || r.envelope.meta.expired(now) {
+		return time.Time{}
+	}
+	return r.envelope.meta.created
+}
+
+// Stat returns the metadata of the value of key. Returns an error for which
+// Exists is false if it does not exist.
+func (m *Memstore) Stat(key string) (*Metadata, error) {
+	done, err := m.lifecycle.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	data, tags, err := m.getBytes(key)
+	if err != nil {
+		return nil, err
+	}
+	return newMetadata(m.metadata[key], tags, len(data)), nil
+}
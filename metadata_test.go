@@ -0,0 +1,291 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"gitlab.com/elixxir/ekv/portableOS"
+)
+
+// metadataStore is the subset of the store methods exercised by these tests.
+type metadataStore interface {
+	codecStore
+	SetBytesWith(key string, data []byte, opts ...WriteOption) error
+	Stat(key string) (*Metadata, error)
+}
+
+// testMetadata checks the metadata reported by Stat as a key is written,
+// overwritten and deleted.
+func testMetadata(t *testing.T, s metadataStore) {
+	if _, err := s.Stat("key"); Exists(err) {
+		t.Errorf("Stat of a missing key did not return not found: %+v", err)
+	}
+
+	before := time.Now()
+	tags := map[string]string{"owner": "alice", "kind": "note"}
+	err := s.SetBytesWith("key", []byte("Hello, World!"),
+		WithContentType("text/plain"), WithTags(tags))
+	if err != nil {
+		t.Fatalf("SetBytesWith failed: %+v", err)
+	}
+	tags["owner"] = "mallory"
+	md, err := s.Stat("key")
+	if err != nil {
+		t.Fatalf("Stat failed: %+v", err)
+	}
+	if md.Created.Before(before) || !md.Modified.Equal(md.Created) {
+		t.Errorf("Unexpected times: %v, %v", md.Created, md.Modified)
+	}
+	if md.Size != 13 || md.Codec != "" || md.ContentType != "text/plain" ||
+		!reflect.DeepEqual(md.Tags,
+			map[string]string{"owner": "alice", "kind": "note"}) {
+		t.Errorf("Unexpected metadata: %+v", md)
+	}
+	created := md.Created
+
+	// Overwriting keeps the creation time but replaces the rest
+	time.Sleep(2 * time.Millisecond)
+	if err = s.SetInterface("key", []int{1, 2, 3}); err != nil {
+		t.Fatalf("SetInterface failed: %+v", err)
+	}
+	md, err = s.Stat("key")
+	if err != nil {
+		t.Fatalf("Stat failed: %+v", err)
+	}
+	if !md.Created.Equal(created) || !md.Modified.After(created) {
+		t.Errorf("Unexpected times after overwrite: %v, %v", md.Created,
+			md.Modified)
+	}
+	if md.Size != 7 || md.Codec != "json" || md.ContentType != "" ||
+		md.Tags != nil {
+		t.Errorf("Unexpected metadata after overwrite: %+v", md)
+	}
+
+	// As does writing in a transaction
+	err = s.Transaction(func(files map[string]Operable, _ Extender) error {
+		files["key"].Set([]byte("transaction"))
+		return nil
+	}, "key")
+	if err != nil {
+		t.Fatalf("Transaction failed: %+v", err)
+	}
+	md, err = s.Stat("key")
+	if err != nil {
+		t.Fatalf("Stat failed: %+v", err)
+	}
+	if !md.Created.Equal(created) || md.Size != 11 || md.Codec != "" {
+		t.Errorf("Unexpected metadata after transaction: %+v", md)
+	}
+
+	// Deleting resets the creation time
+	if err = s.Delete("key"); err != nil {
+		t.Fatalf("Delete failed: %+v", err)
+	}
+	if _, err = s.Stat("key"); Exists(err) {
+		t.Errorf("Stat of a deleted key did not return not found: %+v", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if err = s.SetBytes("key", []byte("again")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	if md, err = s.Stat("key"); err != nil || !md.Created.After(created) {
+		t.Errorf("Creation time not reset by delete: %+v, %+v", md, err)
+	}
+}
+
+// Tests that Memstore reports the metadata of its values.
+func TestMemstore_Stat(t *testing.T) {
+	testMetadata(t, MakeMemstore())
+}
+
+// Tests that Filestore reports the metadata of its values, including
+// compressed values, values with pending merge operands and values written
+// before metadata existed.
+func TestFilestore_Stat(t *testing.T) {
+	dir := ".ekv_testdir_stat"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	testMetadata(t, f)
+
+	// The size is that of the value, not of what is stored
+	data := bytes.Repeat([]byte("compressible "), 1000)
+	err = f.SetBytesWith("compressed", data, WithCompression(true))
+	if err != nil {
+		t.Fatalf("SetBytesWith failed: %+v", err)
+	}
+	if md, err := f.Stat("compressed"); err != nil ||
+		md.Size != int64(len(data)) {
+		t.Errorf("Unexpected size of compressed value: %+v, %+v", md, err)
+	}
+
+	// Pending merge operands are folded in
+	err = f.RegisterMergeOperator("append", MergeOperatorFunc(
+		func(_ string, existing []byte, _ bool, operands [][]byte) (
+			[]byte, error) {
+			return append(existing, bytes.Join(operands, nil)...), nil
+		}))
+	if err != nil {
+		t.Fatalf("RegisterMergeOperator failed: %+v", err)
+	}
+	if err = f.SetBytes("merged", []byte("abc")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	if err = f.Merge("merged", "append", []byte("de")); err != nil {
+		t.Fatalf("Merge failed: %+v", err)
+	}
+	if md, err := f.Stat("merged"); err != nil || md.Size != 5 ||
+		md.Created.IsZero() {
+		t.Errorf("Unexpected metadata of merged value: %+v, %+v", md, err)
+	}
+
+	// Values written before metadata existed have zero times
+	legacy, err := encrypt([]byte("legacy"), f.key, f.csprng)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = write(f.getKey("legacy"), legacy, f.csprng); err != nil {
+		t.Fatal(err)
+	}
+	md, err := f.Stat("legacy")
+	if err != nil {
+		t.Fatalf("Stat failed: %+v", err)
+	}
+	if !md.Created.IsZero() || !md.Modified.IsZero() || md.Size != 6 {
+		t.Errorf("Unexpected metadata of legacy value: %+v", md)
+	}
+	if err = f.SetBytes("legacy", []byte("new")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	if md, err = f.Stat("legacy"); err != nil || md.Created.IsZero() {
+		t.Errorf("Overwritten legacy value has no creation time: %+v, %+v",
+			md, err)
+	}
+}
+
+// Tests that a write reads the value it replaces once, for both its creation
+// time and its version, and keeps no other file beside the value: a missing
+// or expired value gives no creation time, and one that cannot be opened
+// only fails the write if it is to be kept as a version.
+func TestFilestore_readReplaced(t *testing.T) {
+	dir := ".ekv_testdir_read_replaced"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	c := &testClock{now: time.Unix(1700000000, 0)}
+	f.SetClock(c.Now)
+	encryptedKey := f.getKey("key")
+
+	if r := f.readReplaced(encryptedKey); r.err != nil ||
+		r.encryptedContents != nil || !r.created(c.now).IsZero() {
+		t.Errorf("Unexpected missing value: %+v", r)
+	}
+
+	// Both files of the value exist after the second write
+	for _, data := range []string{"first", "second"} {
+		err = f.SetBytesWithTTL("key", []byte(data), time.Hour)
+		if err != nil {
+			t.Fatalf("SetBytesWithTTL failed: %+v", err)
+		}
+	}
+	infos, err := portableOS.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := len(infos)
+	c.advance(time.Minute)
+	if err = f.SetBytesWithTTL("key", []byte("third"), time.Hour); err != nil {
+		t.Fatalf("SetBytesWithTTL failed: %+v", err)
+	}
+	if infos, err = portableOS.ReadDir(dir); err != nil || len(infos) != files {
+		t.Errorf("Overwrite added %d files: %+v", len(infos)-files, err)
+	}
+
+	f.SetRetention(RetentionPolicy{Versions: 1})
+	c.advance(time.Minute)
+	if err = f.SetBytesWithTTL("key", []byte("fourth"), time.Hour); err != nil {
+		t.Fatalf("SetBytesWithTTL failed: %+v", err)
+	}
+	md, err := f.Stat("key")
+	if err != nil || !md.Created.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("Creation time not kept: %+v, %+v", md, err)
+	}
+	if versions, err := f.ListVersions("key"); err != nil ||
+		len(versions) != 1 {
+		t.Errorf("Replaced value not kept: %+v, %+v", versions, err)
+	}
+
+	c.advance(2 * time.Hour)
+	created := f.readReplaced(encryptedKey).created(c.now)
+	if !created.IsZero() {
+		t.Errorf("Expired value has a creation time: %v", created)
+	}
+
+	if err = write(encryptedKey, []byte("garbage"), f.csprng); err != nil {
+		t.Fatal(err)
+	}
+	if r := f.readReplaced(encryptedKey); r.err == nil ||
+		!r.created(c.now).IsZero() {
+		t.Errorf("Unexpected unreadable value: %+v", r)
+	}
+	if err = f.SetBytes("key", []byte("fifth")); err == nil {
+		t.Errorf("Kept a value that cannot be opened as a version")
+	}
+	f.SetRetention(RetentionPolicy{})
+	if err = f.SetBytes("key", []byte("fifth")); err != nil {
+		t.Errorf("SetBytes over a value that cannot be opened failed: %+v",
+			err)
+	}
+}
+
+// Tests that valueMeta round trips and that invalid encodings are rejected.
+func Test_unmarshalValueMeta(t *testing.T) {
+	m := valueMeta{
+		created:     time.Unix(1, 2),
+		modified:    time.Unix(3, 4),
+		size:        42,
+		contentType: "application/json",
+		tags:        map[string]string{"a": "1", "b": ""},
+	}
+	encoded := m.marshal()
+	decoded, err := unmarshalValueMeta(encoded)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal: %+v", err)
+	}
+	if !reflect.DeepEqual(decoded, m) {
+		t.Errorf("Metadata mismatch: %+v != %+v", decoded, m)
+	}
+
+	for _, data := range [][]byte{
+		nil,
+		encoded[:len(encoded)-1],
+		append(append([]byte{}, encoded...), 0),
+		{0, 0, 0, 0, 0xff, 0xff, 0x03},
+	} {
+		if _, err = unmarshalValueMeta(data); err == nil {
+			t.Errorf("Unmarshalled invalid metadata %v", data)
+		}
+	}
+}
@@ -0,0 +1,440 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// namespace.go implements namespaces: views of a store that scope every key
+// to a name, so that subsystems sharing a store cannot collide and all the
+// keys of one can be deleted at once.
+//
+// A Filestore hashes its keys and so cannot list them. Instead, every key
+// written through a namespace is first recorded in an encrypted index of the
+// namespace, kept as a record log, which DropNamespace reads to find the keys
+// to delete. The index may list keys that were never written or have since
+// been deleted, but never misses one that exists.
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// namespaceKeyPrefix is prepended, along with the length of the name,
+	// to the keys of a namespace, and namespaceIndexKeyPrefix to its name to
+	// derive the key of its index.
+	namespaceKeyPrefix      = "\x00ekv:namespace:"
+	namespaceIndexKeyPrefix = "\x00ekv:namespace-index:"
+)
+
+// namespaceRegistry tracks the namespaces of a store.
+type namespaceRegistry struct {
+	// locks holds a lock per namespace. Writes through a view hold it for
+	// reading and DropNamespace holds it for writing, so that no write can
+	// slip past a drop.
+	locks map[string]*sync.RWMutex
+	// indexed holds, per namespace, the keys known to be in its index. It is
+	// only used by Filestore.
+	indexed map[string]map[string]struct{}
+	mux     sync.Mutex
+}
+
+// lock returns the lock of the namespace.
+func (r *namespaceRegistry) lock(name string) *sync.RWMutex {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.locks == nil {
+		r.locks = make(map[string]*sync.RWMutex)
+	}
+	lck, ok := r.locks[name]
+	if !ok {
+		lck = &sync.RWMutex{}
+		r.locks[name] = lck
+	}
+	return lck
+}
+
+// namespacePrefix returns the prefix of the keys of the namespace. The length
+// of the name is included so that no namespace is a prefix of another.
+func namespacePrefix(name string) string {
+	return namespaceKeyPrefix + strconv.Itoa(len(name)) + ":" + name + ":"
+}
+
+// splitNamespaceKey returns the name of the namespace of a key with a
+// namespace prefix and the key within the namespace. ok is false if key has
+// no namespace prefix.
+func splitNamespaceKey(key string) (name, nsKey string, ok bool) {
+	rest, found := strings.CutPrefix(key, namespaceKeyPrefix)
+	if !found {
+		return "", "", false
+	}
+	size, rest, found := strings.Cut(rest, ":")
+	n, err := strconv.Atoi(size)
+	if !found || err != nil || n < 0 || strconv.Itoa(n) != size ||
+		len(rest) < n+1 || rest[n] != ':' {
+		return "", "", false
+	}
+	return rest[:n], rest[n+1:], true
+}
+
+// namespaceIndexer records the keys written to a namespace, for stores that
+// cannot list their keys.
+type namespaceIndexer interface {
+	// indexNamespace records that keys belong to the namespace. inFlight is
+	// whether the caller is already inside an operation on the store.
+	indexNamespace(name string, keys []string, inFlight bool) error
+}
+
+// namespace is a view of the keys of a store within a namespace.
+type namespace struct {
+	kv      KeyValue
+	name    string
+	prefix  string
+	lock    *sync.RWMutex
+	indexer namespaceIndexer
+	closed  atomic.Bool
+}
+
+// newNamespace returns a view of the namespace name of kv.
+func newNamespace(kv KeyValue, r *namespaceRegistry, name string,
+	indexer namespaceIndexer) *namespace {
+	return &namespace{
+		kv:      kv,
+		name:    name,
+		prefix:  namespacePrefix(name),
+		lock:    r.lock(name),
+		indexer: indexer,
+	}
+}
+
+// beginWrite indexes keys and takes the namespace lock for reading. The
+// returned function releases it.
+func (n *namespace) beginWrite(keys ...string) (done func(), err error) {
+	if n.closed.Load() {
+		return nil, errors.WithStack(ErrClosed)
+	}
+	n.lock.RLock()
+	if n.indexer != nil {
+		err = n.indexer.indexNamespace(n.name, keys, false)
+		if err != nil {
+			n.lock.RUnlock()
+			return nil, err
+		}
+	}
+	return n.lock.RUnlock, nil
+}
+
+// Set implements [KeyValue.Set] within the namespace.
+func (n *namespace) Set(key string, objectToStore Marshaler) error {
+	return n.SetBytes(key, objectToStore.Marshal())
+}
+
+// Get implements [KeyValue.Get] within the namespace.
+func (n *namespace) Get(key string, loadIntoThisObject Unmarshaler) error {
+	if n.closed.Load() {
+		return errors.WithStack(ErrClosed)
+	}
+	return n.kv.Get(n.prefix+key, loadIntoThisObject)
+}
+
+// Delete implements [KeyValue.Delete] within the namespace.
+func (n *namespace) Delete(key string) error {
+	if n.closed.Load() {
+		return errors.WithStack(ErrClosed)
+	}
+	return n.kv.Delete(n.prefix + key)
+}
+
+// SetInterface implements [KeyValue.SetInterface] within the namespace.
+func (n *namespace) SetInterface(key string, objectToStore interface{}) error {
+	done, err := n.beginWrite(key)
+	if err != nil {
+		return err
+	}
+	defer done()
+	return n.kv.SetInterface(n.prefix+key, objectToStore)
+}
+
+// GetInterface implements [KeyValue.GetInterface] within the namespace.
+func (n *namespace) GetInterface(key string, v interface{}) error {
+	if n.closed.Load() {
+		return errors.WithStack(ErrClosed)
+	}
+	return n.kv.GetInterface(n.prefix+key, v)
+}
+
+// SetBytes implements [KeyValue.SetBytes] within the namespace.
+func (n *namespace) SetBytes(key string, data []byte) error {
+	done, err := n.beginWrite(key)
+	if err != nil {
+		return err
+	}
+	defer done()
+	return n.kv.SetBytes(n.prefix+key, data)
+}
+
+// GetBytes implements [KeyValue.GetBytes] within the namespace.
+func (n *namespace) GetBytes(key string) ([]byte, error) {
+	if n.closed.Load() {
+		return nil, errors.WithStack(ErrClosed)
+	}
+	return n.kv.GetBytes(n.prefix + key)
+}
+
+// Transaction implements [KeyValue.Transaction] within the namespace. The
+// operables are keyed, and report their keys, without the namespace.
+func (n *namespace) Transaction(op TransactionOperation, keys ...string) error {
+	done, err := n.beginWrite(keys...)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return n.kv.Transaction(func(
+		files map[string]Operable, ext Extender) error {
+		nsExt := &namespaceExtender{Extender: ext, n: n}
+		return op(nsExt.unprefix(files), nsExt)
+	}, n.prefixed(keys)...)
+}
+
+// Close closes the view. Every later call on it returns ErrClosed. The store
+// and other views of the namespace are not affected.
+func (n *namespace) Close() error {
+	if n.closed.Swap(true) {
+		return errors.WithStack(ErrClosed)
+	}
+	return nil
+}
+
+// prefixed returns keys with the namespace prefix.
+func (n *namespace) prefixed(keys []string) []string {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = n.prefix + key
+	}
+	return prefixed
+}
+
+// namespaceExtender extends a transaction within a namespace.
+type namespaceExtender struct {
+	Extender
+	n *namespace
+}
+
+// Extend implements [Extender.Extend] within the namespace.
+func (e *namespaceExtender) Extend(keys []string) (map[string]Operable, error) {
+	// Only the locks of the index are taken, which do not wait on the keys
+	// the transaction holds
+	if e.n.indexer != nil && !e.IsClosed() {
+		err := e.n.indexer.indexNamespace(e.n.name, keys, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	files, err := e.Extender.Extend(e.n.prefixed(keys))
+	if err != nil {
+		return nil, err
+	}
+	return e.unprefix(files), nil
+}
+
+// unprefix wraps the operables of files so that they are keyed by, and
+// report, their keys without the namespace prefix.
+func (e *namespaceExtender) unprefix(
+	files map[string]Operable) map[string]Operable {
+	unprefixed := make(map[string]Operable, len(files))
+	for key, op := range files {
+		key = key[len(e.n.prefix):]
+		unprefixed[key] = &namespaceOperable{Operable: op, key: key}
+	}
+	return unprefixed
+}
+
+// namespaceOperable is an Operable that reports its key without the
+// namespace prefix.
+type namespaceOperable struct {
+	Operable
+	key string
+}
+
+// Key returns the key without the namespace prefix.
+func (op *namespaceOperable) Key() string {
+	op.Operable.Key()
+	return op.key
+}
+
+// Namespace returns a view of the Filestore in which every key is scoped to
+// name. Views of different namespaces, and the Filestore itself, cannot see
+// each other's keys. Closing the view does not close the Filestore.
+//
+// Keys written through the view are recorded in an encrypted index of the
+// namespace so that DropNamespace can find them.
+func (f *Filestore) Namespace(name string) KeyValue {
+	return newNamespace(f, &f.namespaces, name, f)
+}
+
+// DropNamespace securely deletes every key in the namespace name, along with
+// its index. It waits for writes through views of the namespace in flight to
+// complete, and views can keep being used afterwards.
+func (f *Filestore) DropNamespace(name string) error {
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	lck := f.namespaces.lock(name)
+	lck.Lock()
+	defer lck.Unlock()
+
+	indexKey := namespaceIndexKeyPrefix + name
+	appendKey := f.getAppendKey(indexKey)
+	keys, err := f.readNamespaceIndex(indexKey, appendKey)
+	if err != nil {
+		return err
+	}
+
+	prefix := namespacePrefix(name)
+	dropped := make([]string, 0, len(keys))
+	for key := range keys {
+		if err = f.deleteKey(prefix + key); err != nil {
+			return err
+		}
+		dropped = append(dropped, prefix+key)
+	}
+	if err = f.unindexKeys(dropped); err != nil {
+		return err
+	}
+
+	// The index goes last so that a failure leaves it listing the keys left
+	f.namespaces.mux.Lock()
+	delete(f.namespaces.indexed, name)
+	f.namespaces.mux.Unlock()
+	unlock := f.takeLocks(true, appendKey)
+	defer unlock()
+	return f.deleteRecords(indexKey, appendKey)
+}
+
+// indexNamespace implements namespaceIndexer. Keys are appended to the index
+// of the namespace the first time they are seen.
+func (f *Filestore) indexNamespace(name string, keys []string,
+	inFlight bool) error {
+	if !inFlight {
+		done, err := f.lifecycle.begin()
+		if err != nil {
+			return err
+		}
+		defer done()
+	}
+
+	f.namespaces.mux.Lock()
+	defer f.namespaces.mux.Unlock()
+
+	indexKey := namespaceIndexKeyPrefix + name
+	appendKey := f.getAppendKey(indexKey)
+	known, ok := f.namespaces.indexed[name]
+	if !ok {
+		var err error
+		known, err = f.readNamespaceIndex(indexKey, appendKey)
+		if err != nil {
+			return err
+		}
+		if f.namespaces.indexed == nil {
+			f.namespaces.indexed = make(map[string]map[string]struct{})
+		}
+		f.namespaces.indexed[name] = known
+	}
+
+	var added [][]byte
+	for _, key := range keys {
+		if _, exists := known[key]; !exists {
+			known[key] = struct{}{}
+			added = append(added, []byte(key))
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	unlock := f.takeLocks(true, appendKey)
+	defer unlock()
+	err := f.appendRecords(indexKey, appendKey, added)
+	if err != nil {
+		// Forget the index so that it is read again on the next write
+		delete(f.namespaces.indexed, name)
+	}
+	return err
+}
+
+// readNamespaceIndex returns the keys listed in the index of a namespace.
+func (f *Filestore) readNamespaceIndex(indexKey, appendKey string) (
+	map[string]struct{}, error) {
+	unlock := f.takeLocks(false, appendKey)
+	defer unlock()
+
+	return f.readKeyIndex(indexKey, appendKey)
+}
+
+// Namespace returns a view of the Memstore in which every key is scoped to
+// name. Views of different namespaces, and the Memstore itself, cannot see
+// each other's keys. Closing the view does not close the Memstore.
+func (m *Memstore) Namespace(name string) KeyValue {
+	return newNamespace(m, &m.namespaces, name, nil)
+}
+
+// DropNamespace deletes every key in the namespace name. It waits for writes
+// through views of the namespace in flight to complete, and views can keep
+// being used afterwards.
+func (m *Memstore) DropNamespace(name string) error {
+	done, err := m.lifecycle.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	lck := m.namespaces.lock(name)
+	lck.Lock()
+	defer lck.Unlock()
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	prefix := namespacePrefix(name)
+	deleted := deletePrefixed(m.store, prefix)
+	for _, key := range deletePrefixed(m.pendingMerges, prefix) {
+		if _, exists := m.metadata[key]; !exists {
+			deleted = append(deleted, key)
+		}
+	}
+	deletePrefixed(m.records, prefix)
+	deletePrefixed(m.valueTags, prefix)
+	deletePrefixed(m.metadata, prefix)
+
+	sort.Strings(deleted)
+	changes := make([]Change, len(deleted))
+	for i, key := range deleted {
+		changes[i] = Change{Op: ChangeDelete, Key: key}
+	}
+	m.recordChanges(changes...)
+	return nil
+}
+
+// deletePrefixed deletes every key of m starting with prefix and returns
+// them.
+func deletePrefixed[V any](m map[string]V, prefix string) []string {
+	var deleted []string
+	for key := range m {
+		if strings.HasPrefix(key, prefix) {
+			delete(m, key)
+			deleted = append(deleted, key)
+		}
+	}
+	return deleted
+}
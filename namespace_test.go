@@ -0,0 +1,198 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portableOS"
+)
+
+// namespaceStore is the subset of the store methods exercised by these tests.
+type namespaceStore interface {
+	KeyValue
+	Namespace(name string) KeyValue
+	DropNamespace(name string) error
+}
+
+// testNamespaces checks that namespaces are isolated from each other and the
+// store, and that dropping one only deletes its keys.
+func testNamespaces(t *testing.T, s namespaceStore) {
+	a, b, nested := s.Namespace("a"), s.Namespace("b"), s.Namespace("a:b")
+	for kv, value := range map[KeyValue]string{
+		s: "root", a: "a", b: "b", nested: "nested"} {
+		if err := kv.SetBytes("key", []byte(value)); err != nil {
+			t.Fatalf("SetBytes failed: %+v", err)
+		}
+	}
+	for kv, value := range map[KeyValue]string{
+		s: "root", a: "a", b: "b", nested: "nested"} {
+		data, err := kv.GetBytes("key")
+		if err != nil || string(data) != value {
+			t.Errorf("Expected %q, got %q: %+v", value, data, err)
+		}
+	}
+	if _, err := a.GetBytes(":b:key"); Exists(err) {
+		t.Errorf("Namespace can see the keys of another: %+v", err)
+	}
+
+	// Transactions see keys without the namespace, including extended ones
+	err := a.Transaction(func(files map[string]Operable, ext Extender) error {
+		if files["key"].Key() != "key" {
+			t.Errorf("Operable reports key %q", files["key"].Key())
+		}
+		data, _ := files["key"].Get()
+		more, err := ext.Extend([]string{"other"})
+		if err != nil {
+			return err
+		}
+		more["other"].Set(append(data, '2'))
+		return nil
+	}, "key")
+	if err != nil {
+		t.Fatalf("Transaction failed: %+v", err)
+	}
+	if data, err := a.GetBytes("other"); err != nil || string(data) != "a2" {
+		t.Errorf("Extended key not written: %q, %+v", data, err)
+	}
+
+	// Typed access works over namespaces
+	err = NewBucket[int](a, "counts/").Update("c", func(v *int) error {
+		*v++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update failed: %+v", err)
+	}
+
+	if err = s.DropNamespace("a"); err != nil {
+		t.Fatalf("DropNamespace failed: %+v", err)
+	}
+	for _, key := range []string{"key", "other", "counts/c"} {
+		if _, err = a.GetBytes(key); Exists(err) {
+			t.Errorf("%s survived the drop: %+v", key, err)
+		}
+	}
+	for kv, value := range map[KeyValue]string{
+		s: "root", b: "b", nested: "nested"} {
+		data, err := kv.GetBytes("key")
+		if err != nil || string(data) != value {
+			t.Errorf("Dropped another namespace: %q, %+v", data, err)
+		}
+	}
+
+	// A dropped namespace can be written again
+	if err = a.SetBytes("key", []byte("again")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	if err = s.DropNamespace("a"); err != nil {
+		t.Fatalf("DropNamespace failed: %+v", err)
+	}
+	if _, err = a.GetBytes("key"); Exists(err) {
+		t.Errorf("Key survived the second drop: %+v", err)
+	}
+
+	// Closing a view does not close the store
+	if err = b.Close(); err != nil {
+		t.Fatalf("Close failed: %+v", err)
+	}
+	if _, err = b.GetBytes("key"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Closed view did not return ErrClosed: %+v", err)
+	}
+	if data, err := s.Namespace("b").GetBytes("key"); err != nil ||
+		string(data) != "b" {
+		t.Errorf("Closing a view closed the store: %q, %+v", data, err)
+	}
+}
+
+// Tests that Memstore namespaces are isolated and can be dropped.
+func TestMemstore_Namespaces(t *testing.T) {
+	testNamespaces(t, MakeMemstore())
+	testExtendContended(t, MakeMemstore().Namespace("d"), "new")
+}
+
+// Tests that Filestore namespaces are isolated and that dropping one after
+// reopening the store deletes the files of every key written to it.
+func TestFilestore_Namespaces(t *testing.T) {
+	dir := ".ekv_testdir_namespaces"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	testNamespaces(t, f)
+	// Keys added by extending a transaction are recorded in the index of the
+	// namespace, and so dropped with it
+	d := f.Namespace("d")
+	testExtendContended(t, d, "new")
+	if err = f.DropNamespace("d"); err != nil {
+		t.Fatalf("DropNamespace failed: %+v", err)
+	}
+	if _, err = d.GetBytes("new"); Exists(err) {
+		t.Errorf("Extended key survived the drop: %+v", err)
+	}
+
+	// The change feed grows with every write, so it is consolidated into
+	// one segment whenever the files are counted
+	if err = f.ConsolidateRecords(changeLogKey); err != nil {
+		t.Fatalf("ConsolidateRecords failed: %+v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	c := f.Namespace("c")
+	for _, key := range []string{"x", "y", "z", "x"} {
+		if err = c.SetBytes(key, []byte(key)); err != nil {
+			t.Fatalf("SetBytes failed: %+v", err)
+		}
+	}
+
+	f, err = NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.DropNamespace("c"); err != nil {
+		t.Fatalf("DropNamespace failed: %+v", err)
+	}
+	if err = f.ConsolidateRecords(changeLogKey); err != nil {
+		t.Fatalf("ConsolidateRecords failed: %+v", err)
+	}
+	after, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	before, dropped := countKeyFiles(f, entries), countKeyFiles(f, after)
+	if before != dropped {
+		t.Errorf("%d files before writing the namespace, %d after dropping it",
+			before, dropped)
+	}
+}
+
+// countKeyFiles returns the number of entries that hold keys, leaving out the
+// .ekv files and the open marker of f rewritten when the store is opened.
+func countKeyFiles(f *Filestore, entries []os.DirEntry) int {
+	marker := filepath.Base(f.getKey(changeOpenKey))
+	n := 0
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), ekvFileName) &&
+			!strings.HasPrefix(e.Name(), marker) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,51 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import "time"
+
+// WriteOption changes how a single value is written by SetBytesWith and
+// SetInterfaceWith, overriding the settings of the store.
+type WriteOption func(*writeOptions)
+
+// writeOptions holds the options of a single write. A nil *writeOptions is
+// valid and leaves every setting to the store.
+type writeOptions struct {
+	// compress, if set, overrides the compression policy of the store.
+	compress *bool
+	// codec, if set, overrides the default codec of the store.
+	codec Codec
+	// schema, if set, is the name of the schema the value is written under.
+	schema string
+	// tags describe how the value was encoded. They are recorded when it is
+	// encoded and stored with it.
+	tags valueTags
+	// meta is the metadata stored with the value. Its times and size are set
+	// when the value is written.
+	meta valueMeta
+	// ttl, if set, is how long until the value expires.
+	ttl time.Duration
+}
+
+// newWriteOptions applies opts to a new writeOptions.
+func newWriteOptions(opts []WriteOption) *writeOptions {
+	o := &writeOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// compressionFor returns whether the value of key is compressed, given the
+// compression policy of the store.
+func (o *writeOptions) compressionFor(key string, p *compressionPolicy) bool {
+	if o != nil && o.compress != nil {
+		return *o.compress
+	}
+	return p.enabledFor(key)
+}
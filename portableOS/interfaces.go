@@ -15,8 +15,14 @@
 //	"file already exists"
 //	"file does not exist"
 //	"file already closed"
+//
+// Errors returned by Open and Stat for a missing file must satisfy
+// errors.Is(err, os.ErrNotExist), ideally as an *os.PathError, so that callers
+// can map them to their own not found errors.
 package portableOS
 
+import "time"
+
 // File represents an open file descriptor. It contains a subset of the methods
 // on os.File that are used in this repository.
 type File interface {
@@ -75,6 +81,10 @@ type FileInfo interface {
 	// IsDir reports whether m describes a directory.
 	// That is, it tests for the ModeDir bit being set in m.
 	IsDir() bool
+
+	// ModTime returns the modification time, or the zero time if it is not
+	// known.
+	ModTime() time.Time
 }
 
 // A FileMode represents a file's mode and permission bits. The bits have the
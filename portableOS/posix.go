@@ -52,3 +52,27 @@ var MkdirAll = func(path string, perm FileMode) error {
 var Stat = func(name string) (FileInfo, error) {
 	return os.Stat(name)
 }
+
+// ReadDir reads the named directory and returns a FileInfo for every entry,
+// sorted by name. Entries removed while reading are skipped.
+var ReadDir = func(name string) ([]FileInfo, error) {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Rename renames (moves) oldpath to newpath. If newpath already exists and is
+// not a directory, Rename replaces it.
+var Rename = os.Rename
@@ -12,6 +12,7 @@ package portableOS
 import (
 	"bytes"
 	"sync"
+	"time"
 
 	"gitlab.com/elixxir/wasm-utils/storage"
 )
@@ -168,6 +169,7 @@ func (f *jsFile) Write(b []byte) (n int, err error) {
 type jsFileInfo struct {
 	keyName string
 	size    int64
+	dir     bool
 }
 
 // Name returns the base name of the file.
@@ -183,5 +185,11 @@ func (f *jsFileInfo) Size() int64 {
 // IsDir reports whether m describes a directory.
 // That is, it tests for the ModeDir bit being set in m.
 func (f *jsFileInfo) IsDir() bool {
-	return true
+	return f.dir
+}
+
+// ModTime returns the zero time, as localStorage does not record when an item
+// was modified.
+func (f *jsFileInfo) ModTime() time.Time {
+	return time.Time{}
 }
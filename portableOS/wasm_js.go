@@ -10,6 +10,8 @@
 package portableOS
 
 import (
+	"os"
+	"sort"
 	"strings"
 
 	"gitlab.com/elixxir/wasm-utils/storage"
@@ -23,7 +25,7 @@ var localStorage = storage.GetLocalStorage()
 var Open = func(name string) (File, error) {
 	keyValue, err := localStorage.Get(name)
 	if err != nil {
-		return nil, err
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
 	}
 
 	return open(name, string(keyValue), localStorage), nil
@@ -84,11 +86,81 @@ var MkdirAll = func(path string, perm FileMode) error {
 var Stat = func(name string) (FileInfo, error) {
 	keyValue, err := localStorage.Get(name)
 	if err != nil {
-		return nil, err
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
 	}
 
+	// localStorage does not tell directories from files, so every item is
+	// reported as a directory
 	return &jsFileInfo{
 		keyName: name,
 		size:    int64(len(keyValue)),
+		dir:     true,
 	}, nil
 }
+
+// ReadDir returns a FileInfo for every item directly under the named
+// directory, sorted by name. An item is reported as a directory if there are
+// items under it.
+var ReadDir = func(name string) ([]FileInfo, error) {
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	entries := make(map[string]*jsFileInfo)
+	for i := 0; i < localStorage.Length(); i++ {
+		keyName, err := localStorage.Key(i)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(keyName, prefix) {
+			continue
+		}
+		base, rest, nested := strings.Cut(keyName[len(prefix):], "/")
+		entry, exists := entries[base]
+		if !exists {
+			entry = &jsFileInfo{keyName: base}
+			entries[base] = entry
+		}
+		if nested && rest != "" {
+			entry.dir = true
+		} else if keyValue, err := localStorage.Get(keyName); err == nil {
+			entry.size = int64(len(keyValue))
+		}
+	}
+
+	infos := make([]FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		infos = append(infos, entry)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+	return infos, nil
+}
+
+// Rename renames (moves) oldpath, and every item under it, to newpath.
+var Rename = func(oldpath, newpath string) error {
+	var keyNames []string
+	for i := 0; i < localStorage.Length(); i++ {
+		keyName, err := localStorage.Key(i)
+		if err != nil {
+			return err
+		}
+		if keyName == oldpath || strings.HasPrefix(keyName, oldpath+"/") {
+			keyNames = append(keyNames, keyName)
+		}
+	}
+	if len(keyNames) == 0 {
+		return &os.PathError{Op: "rename", Path: oldpath, Err: os.ErrNotExist}
+	}
+
+	for _, keyName := range keyNames {
+		keyValue, err := localStorage.Get(keyName)
+		if err != nil {
+			return err
+		}
+		err = localStorage.Set(newpath+keyName[len(oldpath):], keyValue)
+		if err != nil {
+			return err
+		}
+		localStorage.RemoveItem(keyName)
+	}
+	return nil
+}
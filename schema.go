@@ -0,0 +1,179 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// schema.go implements versioned schemas for the objects stored with
+// SetInterface. A value written under a schema is tagged with the name and
+// current version of the schema. When GetInterface reads a value tagged with
+// an older version, it runs the chain of upgrade functions of the schema
+// over it before decoding it, and can write the upgraded value back.
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	errEmptySchema     = "schema name cannot be empty"
+	errSchemaVersion   = "schema %q must have a version of at least 1"
+	errUnknownSchema   = "no schema registered with name %q"
+	errNewerSchema     = "value has version %d of schema %q, newer than %d"
+	errNoSchemaUpgrade = "schema %q has no upgrade from version %d"
+	errSchemaUpgrade   = "cannot upgrade value from version %d of schema %q"
+)
+
+// SchemaUpgrade converts the encoded value of an object from one version of
+// its schema to the next. It is given the codec the value is encoded with and
+// must return the new value encoded with the same codec. It may run while the
+// key is locked, so it must not access the store.
+type SchemaUpgrade func(data []byte, c Codec) ([]byte, error)
+
+// Schema describes the current shape of a type of stored object and how to
+// upgrade values of its earlier shapes.
+type Schema struct {
+	// Name uniquely identifies the schema. It is stored with every value
+	// written under the schema and must never change.
+	Name string
+	// Version is the current version of the schema, starting at 1. Values
+	// written under the schema are tagged with it.
+	Version uint32
+	// Upgrades maps every earlier version to the function that upgrades its
+	// values to the next version. Version 0 stands for the untagged values of
+	// keys starting with KeyPrefix, such as those written before the schema
+	// was registered.
+	Upgrades map[uint32]SchemaUpgrade
+	// KeyPrefix, if set, applies the schema to every key starting with it, so
+	// SetInterface tags their values without WithSchema. The schema with the
+	// longest matching prefix applies.
+	KeyPrefix string
+	// WriteBack writes upgraded values back to the store, under the same lock
+	// they were read under, so each value is only upgraded once.
+	WriteBack bool
+}
+
+// schemaTag identifies the schema and version a value was written under.
+type schemaTag struct {
+	name    string
+	version uint32
+}
+
+// WithSchema writes the value under the named schema, tagging it with the
+// current version of the schema. The schema must be registered. It has no
+// effect on SetBytesWith.
+func WithSchema(name string) WriteOption {
+	return func(o *writeOptions) {
+		o.schema = name
+	}
+}
+
+// schemaRegistry holds the schemas registered with a store.
+type schemaRegistry struct {
+	schemas map[string]*Schema
+	mux     sync.RWMutex
+}
+
+// register adds or replaces the schema under its name.
+func (r *schemaRegistry) register(s Schema) error {
+	if s.Name == "" {
+		return errors.New(errEmptySchema)
+	} else if s.Version < 1 {
+		return errors.Errorf(errSchemaVersion, s.Name)
+	}
+
+	upgrades := make(map[uint32]SchemaUpgrade, len(s.Upgrades))
+	for v, upgrade := range s.Upgrades {
+		upgrades[v] = upgrade
+	}
+	s.Upgrades = upgrades
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.schemas == nil {
+		r.schemas = make(map[string]*Schema)
+	}
+	r.schemas[s.Name] = &s
+	return nil
+}
+
+// lookup returns the schema registered under name, or, if name is empty, the
+// schema with the longest key prefix matching key. Returns nil if there is
+// none.
+func (r *schemaRegistry) lookup(key, name string) *Schema {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	if name != "" {
+		return r.schemas[name]
+	}
+
+	var match *Schema
+	for _, s := range r.schemas {
+		if s.KeyPrefix != "" && strings.HasPrefix(key, s.KeyPrefix) &&
+			(match == nil || len(s.KeyPrefix) > len(match.KeyPrefix)) {
+			match = s
+		}
+	}
+	return match
+}
+
+// tag records in opts the schema the value of key is written under: the one
+// requested with WithSchema, if any, otherwise the one matching the key.
+func (r *schemaRegistry) tag(key string, opts *writeOptions) error {
+	s := r.lookup(key, opts.schema)
+	if s == nil {
+		if opts.schema != "" {
+			return errors.Errorf(errUnknownSchema, opts.schema)
+		}
+		return nil
+	}
+	opts.tags.schema = schemaTag{name: s.Name, version: s.Version}
+	return nil
+}
+
+// upgrade upgrades the value of key to the current version of its schema.
+// Returns whether the value was upgraded and should be written back. Values
+// whose schema is not registered are returned unchanged.
+func (r *schemaRegistry) upgrade(key string, value storedValue,
+	codecs *codecRegistry) (upgraded storedValue, writeBack bool, err error) {
+	s := r.lookup(key, value.schema.name)
+	if s == nil {
+		return value, false, nil
+	}
+
+	version := value.schema.version
+	if version == s.Version {
+		return value, false, nil
+	} else if version > s.Version {
+		return value, false, errors.Errorf(
+			errNewerSchema, version, s.Name, s.Version)
+	}
+
+	c, err := codecs.decoder(value.codec)
+	if err != nil {
+		return value, false, err
+	}
+	data := value.data
+	for ; version < s.Version; version++ {
+		upgrade, ok := s.Upgrades[version]
+		if !ok {
+			return value, false, errors.Errorf(
+				errNoSchemaUpgrade, s.Name, version)
+		}
+		data, err = upgrade(data, c)
+		if err != nil {
+			return value, false, errors.Wrapf(
+				err, errSchemaUpgrade, version, s.Name)
+		}
+	}
+
+	upgraded = value
+	upgraded.data = data
+	upgraded.schema = schemaTag{name: s.Name, version: s.Version}
+	return upgraded, s.WriteBack, nil
+}
@@ -0,0 +1,231 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"gitlab.com/elixxir/ekv/portableOS"
+)
+
+// schemaStore is the subset of the store methods exercised by these tests.
+type schemaStore interface {
+	codecStore
+	RegisterSchema(s Schema) error
+}
+
+// Successive shapes of the object stored in these tests.
+type (
+	schemaUserV0 struct{ Name string }
+	schemaUserV1 struct{ First, Last string }
+	schemaUserV2 struct {
+		First, Last string
+		Visits      int
+	}
+)
+
+// schemaUpgrades upgrades schemaUserV0 to schemaUserV1 and schemaUserV1 to
+// schemaUserV2.
+var schemaUpgrades = map[uint32]SchemaUpgrade{
+	0: func(data []byte, c Codec) ([]byte, error) {
+		var old schemaUserV0
+		if err := c.Unmarshal(data, &old); err != nil {
+			return nil, err
+		}
+		first, last, _ := strings.Cut(old.Name, " ")
+		return c.Marshal(&schemaUserV1{First: first, Last: last})
+	},
+	1: func(data []byte, c Codec) ([]byte, error) {
+		var old schemaUserV1
+		if err := c.Unmarshal(data, &old); err != nil {
+			return nil, err
+		}
+		return c.Marshal(&schemaUserV2{First: old.First, Last: old.Last,
+			Visits: 1})
+	},
+}
+
+// testSchemas writes values under successive versions of a schema and checks
+// that they are upgraded when read, and written back when configured to.
+func testSchemas(t *testing.T, s schemaStore) {
+	// A value written before the schema existed is version 0
+	if err := s.SetInterface("users/ada", &schemaUserV0{"Ada Lovelace"}); err != nil {
+		t.Fatalf("SetInterface failed: %+v", err)
+	}
+
+	err := s.RegisterSchema(Schema{Name: "user", Version: 1,
+		Upgrades: schemaUpgrades, KeyPrefix: "users/"})
+	if err != nil {
+		t.Fatalf("RegisterSchema failed: %+v", err)
+	}
+	if err = s.SetCodec(CBORCodec); err != nil {
+		t.Fatalf("SetCodec failed: %+v", err)
+	}
+	err = s.SetInterface("users/alan", &schemaUserV1{"Alan", "Turing"})
+	if err != nil {
+		t.Fatalf("SetInterface failed: %+v", err)
+	}
+	err = s.SetInterfaceWith("grace", &schemaUserV1{"Grace", "Hopper"},
+		WithSchema("user"))
+	if err != nil {
+		t.Fatalf("SetInterfaceWith failed: %+v", err)
+	}
+	err = s.SetInterfaceWith("x", &schemaUserV1{}, WithSchema("unknown"))
+	if err == nil {
+		t.Errorf("Wrote a value under an unregistered schema")
+	}
+
+	// Version 2, without write back
+	err = s.RegisterSchema(Schema{Name: "user", Version: 2,
+		Upgrades: schemaUpgrades, KeyPrefix: "users/"})
+	if err != nil {
+		t.Fatalf("RegisterSchema failed: %+v", err)
+	}
+	expected := map[string]schemaUserV2{
+		"users/ada":  {"Ada", "Lovelace", 1},
+		"users/alan": {"Alan", "Turing", 1},
+		"grace":      {"Grace", "Hopper", 1},
+	}
+	stored := make(map[string][]byte)
+	for key, exp := range expected {
+		stored[key], _ = s.GetBytes(key)
+		var u schemaUserV2
+		if err = s.GetInterface(key, &u); err != nil {
+			t.Fatalf("GetInterface of %s failed: %+v", key, err)
+		}
+		if u != exp {
+			t.Errorf("%s was not upgraded: %+v", key, u)
+		}
+		if data, _ := s.GetBytes(key); !bytes.Equal(data, stored[key]) {
+			t.Errorf("%s was written back", key)
+		}
+	}
+
+	// Values written under the current version are not upgraded
+	err = s.SetInterface("users/new", &schemaUserV2{"Edsger", "Dijkstra", 7})
+	if err != nil {
+		t.Fatalf("SetInterface failed: %+v", err)
+	}
+	var u schemaUserV2
+	if err = s.GetInterface("users/new", &u); err != nil || u.Visits != 7 {
+		t.Errorf("Current value was modified: %+v, %+v", u, err)
+	}
+
+	// With write back, in a transaction and outside of one
+	err = s.RegisterSchema(Schema{Name: "user", Version: 2,
+		Upgrades: schemaUpgrades, KeyPrefix: "users/", WriteBack: true})
+	if err != nil {
+		t.Fatalf("RegisterSchema failed: %+v", err)
+	}
+	if err = s.GetInterface("users/ada", &u); err != nil {
+		t.Fatalf("GetInterface failed: %+v", err)
+	}
+	err = s.Transaction(func(files map[string]Operable, _ Extender) error {
+		return files["grace"].GetInterface(&u)
+	}, "grace")
+	if err != nil {
+		t.Fatalf("Transaction failed: %+v", err)
+	}
+	for _, key := range []string{"users/ada", "grace"} {
+		if data, _ := s.GetBytes(key); bytes.Equal(data, stored[key]) {
+			t.Errorf("%s was not written back", key)
+		}
+	}
+
+	// Once written back, the upgrades are no longer needed
+	err = s.RegisterSchema(Schema{Name: "user", Version: 2,
+		KeyPrefix: "users/"})
+	if err != nil {
+		t.Fatalf("RegisterSchema failed: %+v", err)
+	}
+	for _, key := range []string{"users/ada", "grace"} {
+		if err = s.GetInterface(key, &u); err != nil || u != expected[key] {
+			t.Errorf("%s was not written back: %+v, %+v", key, u, err)
+		}
+	}
+	if err = s.GetInterface("users/alan", &u); err == nil {
+		t.Errorf("Upgraded a value without an upgrade function")
+	}
+
+	// Values of a newer version than the registered one are rejected
+	if err = s.RegisterSchema(Schema{Name: "user", Version: 1}); err != nil {
+		t.Fatalf("RegisterSchema failed: %+v", err)
+	}
+	if err = s.GetInterface("grace", &u); err == nil {
+		t.Errorf("Read a value of a newer schema version")
+	}
+
+	if err = s.RegisterSchema(Schema{Name: "", Version: 1}); err == nil {
+		t.Errorf("Registered a schema without a name")
+	}
+	if err = s.RegisterSchema(Schema{Name: "user"}); err == nil {
+		t.Errorf("Registered a schema with version 0")
+	}
+}
+
+// Tests that Memstore upgrades values written under earlier schema versions.
+func TestMemstore_Schemas(t *testing.T) {
+	testSchemas(t, MakeMemstore())
+}
+
+// Tests that Filestore upgrades values written under earlier schema versions
+// and that written back values persist.
+func TestFilestore_Schemas(t *testing.T) {
+	dir := ".ekv_testdir_schemas"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	testSchemas(t, f)
+
+	f, err = NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	err = f.RegisterSchema(Schema{Name: "user", Version: 2,
+		KeyPrefix: "users/"})
+	if err != nil {
+		t.Fatalf("RegisterSchema failed: %+v", err)
+	}
+	var u schemaUserV2
+	if err = f.GetInterface("users/ada", &u); err != nil || u.Visits != 1 {
+		t.Errorf("Written back value was not persisted: %+v, %+v", u, err)
+	}
+}
+
+// Tests that the schema field of an envelope round trips and that invalid
+// ones are rejected.
+func Test_unmarshalEnvelope_Schema(t *testing.T) {
+	e := &envelope{valueTags: valueTags{codec: "cbor",
+		schema: schemaTag{name: "user", version: 300}}, payload: []byte("x")}
+	decoded, err := unmarshalEnvelope(e.marshal())
+	if err != nil {
+		t.Fatalf("Failed to unmarshal: %+v", err)
+	}
+	if decoded.valueTags != e.valueTags {
+		t.Errorf("Tags mismatch: %+v != %+v", decoded.valueTags, e.valueTags)
+	}
+
+	for _, data := range [][]byte{
+		{envelopeVersion, 2, envelopeTagSchema, 0},
+		{envelopeVersion, 3, envelopeTagSchema, 1, 1},
+		{envelopeVersion, 3, envelopeTagSchema, 1, 0x80},
+	} {
+		if _, err = unmarshalEnvelope(data); err == nil {
+			t.Errorf("Unmarshalled invalid schema field %v", data)
+		}
+	}
+}
@@ -0,0 +1,456 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// snapshot.go implements point-in-time snapshots of a Filestore. A snapshot is
+// a copy of the encrypted files of the store in a directory of its own, so it
+// is no more readable than the store and needs no re-encryption.
+//
+// To avoid blocking writers while the whole store is copied, the files are
+// first copied while the store is in use. The store is then paused, which
+// waits for the operations in flight and holds back new ones, and only the
+// files written since the copy started are copied again. The snapshot is
+// therefore consistent as of the pause.
+
+import (
+	"io"
+	"maps"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/ekv/portableOS"
+)
+
+const (
+	// snapshotDirName is the name of the directory in the store that holds
+	// its snapshots, one directory each. Snapshots being taken are copied to
+	// a directory named after the snapshot prefixed with a dot.
+	snapshotDirName = ".ekv-snapshots"
+
+	// snapshotClockSlack is how long before a copy started a file must have
+	// last been modified for the copy to be trusted without copying it
+	// again. It covers file systems that record coarse modification times.
+	snapshotClockSlack = 2 * time.Second
+
+	errSnapshotName   = "invalid snapshot name %q"
+	errSnapshotExists = "snapshot %q already exists"
+)
+
+// Snapshot captures the store as it is now in a read-only snapshot called
+// name, which can be opened with OpenSnapshot or restored over the store with
+// RestoreSnapshot. Names must not be empty, start with a dot or contain a path
+// separator.
+//
+// Most of the store is copied while it stays in use. Operations are only held
+// back while the files written during that copy are copied again.
+func (f *Filestore) Snapshot(name string) error {
+	if err := checkSnapshotName(name); err != nil {
+		return err
+	}
+	f.snapshots.Lock()
+	defer f.snapshots.Unlock()
+
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return err
+	}
+	dir := getSnapshotPath(f.basedir, name)
+	partial := getSnapshotPath(f.basedir, "."+name)
+	done()
+	if _, err = portableOS.Stat(dir); err == nil {
+		return errors.Errorf(errSnapshotExists, name)
+	}
+
+	jww.TRACE.Printf("%s,SNAPSHOT,%s", kvDebugHeader, name)
+	if _, _, err = f.capture(partial, nil); err != nil {
+		return err
+	}
+	return errors.WithStack(portableOS.Rename(partial, dir))
+}
+
+// capture copies the files of the store to the directory dir, replacing
+// anything already there, such that the copy is consistent. Files for which
+// unchanged returns true, if it is not nil, are left out unless they are
+// modified during the copy. Returns every file of the store, as it was when
+// copied or left out, and when the copy started. The caller must hold the
+// snapshots lock and must not be in flight.
+func (f *Filestore) capture(dir string,
+	unchanged func(name string, info portableOS.FileInfo) bool) (
+	map[string]portableOS.FileInfo, time.Time, error) {
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	basedir := f.basedir
+	err = portableOS.RemoveAll(dir)
+	if err == nil {
+		err = portableOS.MkdirAll(dir, 0700)
+	}
+	if err != nil {
+		done()
+		return nil, time.Time{}, errors.WithStack(err)
+	}
+
+	start := time.Now()
+	copied, err := f.syncFiles(basedir, dir, nil, start, unchanged)
+	done()
+	if err != nil {
+		return nil, time.Time{}, f.discardSnapshot(dir, err)
+	}
+
+	// Copy again what was written in the meantime, with the store paused
+	resume, err := f.lifecycle.pause()
+	if err != nil {
+		return nil, time.Time{}, f.discardSnapshot(dir, err)
+	}
+	files, err := f.syncFiles(basedir, dir, copied, start, unchanged)
+	resume()
+	if err != nil {
+		return nil, time.Time{}, f.discardSnapshot(dir, err)
+	}
+	return files, start, nil
+}
+
+// ListSnapshots returns the names of the snapshots of the store, sorted.
+func (f *Filestore) ListSnapshots() ([]string, error) {
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	infos, err := portableOS.ReadDir(
+		f.basedir + string(os.PathSeparator) + snapshotDirName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
+// OpenSnapshot opens the snapshot called name as a read-only KeyValue. It uses
+// the merge operators, codecs, schemas and clock of the Filestore at the time
+// it is opened, but never writes: schema upgrades are not written back and
+// every write returns ErrReadOnly. Returns an error for which Exists is false
+// if there is no such snapshot.
+func (f *Filestore) OpenSnapshot(name string) (KeyValue, error) {
+	if err := checkSnapshotName(name); err != nil {
+		return nil, err
+	}
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	dir, err := f.findSnapshot(name)
+	if err != nil {
+		return nil, err
+	}
+	key := append([]byte{}, f.key...)
+	s := newFilestore(dir, key, f.csprng)
+	s.readOnly = true
+	s.clock.set(f.clock.Now)
+
+	f.merges.mux.RLock()
+	s.merges.operators = maps.Clone(f.merges.operators)
+	f.merges.mux.RUnlock()
+	f.codecs.mux.RLock()
+	s.codecs.defaultCodec = f.codecs.defaultCodec
+	s.codecs.codecs = maps.Clone(f.codecs.codecs)
+	f.codecs.mux.RUnlock()
+	f.schemas.mux.RLock()
+	s.schemas.schemas = maps.Clone(f.schemas.schemas)
+	f.schemas.mux.RUnlock()
+	return &snapshotStore{f: s}, nil
+}
+
+// RestoreSnapshot replaces the contents of the store with those of the
+// snapshot called name. Operations are held back until it completes. The
+// files of the store that are not in the snapshot are securely deleted.
+// Other snapshots are kept. The restore is not atomic: if it is interrupted,
+// it must be run again.
+func (f *Filestore) RestoreSnapshot(name string) error {
+	if err := checkSnapshotName(name); err != nil {
+		return err
+	}
+	f.snapshots.Lock()
+	defer f.snapshots.Unlock()
+
+	resume, err := f.lifecycle.pause()
+	if err != nil {
+		return err
+	}
+	defer resume()
+
+	dir, err := f.findSnapshot(name)
+	if err != nil {
+		return err
+	}
+	jww.TRACE.Printf("%s,RESTORE,%s", kvDebugHeader, name)
+	return f.restoreFrom(dir)
+}
+
+// restoreFrom replaces the files of the store with those of the directory
+// dir. The caller must have paused the store.
+func (f *Filestore) restoreFrom(dir string) error {
+	next, err := f.changeNext()
+	if err != nil {
+		return err
+	}
+	if _, err = f.syncFiles(dir, f.basedir, nil, time.Time{}, nil); err != nil {
+		return err
+	}
+
+	// The cached indexes describe the replaced files
+	f.dropCaches()
+	if err = f.resetChanges(next); err != nil {
+		return err
+	}
+	if err = f.resetExternal(); err != nil {
+		return err
+	}
+	return f.renewSyncReplica()
+}
+
+// DeleteSnapshot securely deletes the snapshot called name. Returns an error
+// for which Exists is false if there is no such snapshot.
+func (f *Filestore) DeleteSnapshot(name string) error {
+	if err := checkSnapshotName(name); err != nil {
+		return err
+	}
+	f.snapshots.Lock()
+	defer f.snapshots.Unlock()
+
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	dir, err := f.findSnapshot(name)
+	if err != nil {
+		return err
+	}
+	jww.TRACE.Printf("%s,DELETE_SNAPSHOT,%s", kvDebugHeader, name)
+	return f.deleteSnapshot(dir)
+}
+
+// findSnapshot returns the directory of the snapshot called name after
+// checking that it was taken of a store with the same password.
+func (f *Filestore) findSnapshot(name string) (string, error) {
+	dir := getSnapshotPath(f.basedir, name)
+	if _, err := portableOS.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return "", errors.Wrapf(wrapNotFound(err), "snapshot %q", name)
+		}
+		return "", errors.WithStack(err)
+	}
+	return dir, verifyKey(getEkvPath(dir), f.key)
+}
+
+// syncFiles makes the files of the directory dst match those of src by
+// copying every file of src and securely deleting the files of dst that are
+// not in src. Subdirectories are ignored.
+//
+// copied lists the files as they were before a previous call with the same
+// directories, which started at since. Those that have not been modified
+// since are not copied again, nor are those for which unchanged, if not nil,
+// returns true. Returns the files of src as they were before they were
+// copied.
+func (f *Filestore) syncFiles(src, dst string,
+	copied map[string]portableOS.FileInfo, since time.Time,
+	unchanged func(name string, info portableOS.FileInfo) bool) (
+	map[string]portableOS.FileInfo, error) {
+	infos, err := portableOS.ReadDir(src)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	files := make(map[string]portableOS.FileInfo, len(infos))
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		name := info.Name()
+		prev, exists := copied[name]
+		if exists && prev.Size() == info.Size() &&
+			!info.ModTime().IsZero() && prev.ModTime().Equal(info.ModTime()) &&
+			info.ModTime().Before(since.Add(-snapshotClockSlack)) {
+			files[name] = info
+			continue
+		}
+		if unchanged != nil && unchanged(name, info) {
+			files[name] = info
+			continue
+		}
+
+		err = copyFile(src+string(os.PathSeparator)+name,
+			dst+string(os.PathSeparator)+name)
+		if os.IsNotExist(errors.Cause(err)) {
+			// Deleted since the directory was read
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		files[name] = info
+	}
+
+	infos, err = portableOS.ReadDir(dst)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, info := range infos {
+		if _, exists := files[info.Name()]; exists || info.IsDir() {
+			continue
+		}
+		err = deleteFile(dst+string(os.PathSeparator)+info.Name(), f.csprng)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	d, err := portableOS.Open(dst)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	d.Sync()
+	d.Close()
+	return files, nil
+}
+
+// discardSnapshot deletes the partial snapshot at dir after err and returns
+// err.
+func (f *Filestore) discardSnapshot(dir string, err error) error {
+	if deleteErr := f.deleteSnapshot(dir); deleteErr != nil {
+		jww.WARN.Printf("Failed to delete partial snapshot %s: %+v", dir,
+			deleteErr)
+	}
+	return err
+}
+
+// deleteSnapshot securely deletes the files of the snapshot at dir and then
+// the directory.
+func (f *Filestore) deleteSnapshot(dir string) error {
+	infos, err := portableOS.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		err = deleteFile(dir+string(os.PathSeparator)+info.Name(), f.csprng)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return errors.WithStack(portableOS.RemoveAll(dir))
+}
+
+// copyFile copies the file at src to dst and flushes it to disk. The contents
+// are streamed, so large files are never held in memory.
+func copyFile(src, dst string) error {
+	in, err := portableOS.Open(src)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer in.Close()
+
+	out, err := portableOS.Create(dst)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return errors.WithStack(err)
+	}
+	out.Sync()
+	return errors.WithStack(out.Close())
+}
+
+// getSnapshotPath returns the directory of the snapshot called name of the
+// store at basedir.
+func getSnapshotPath(basedir, name string) string {
+	return basedir + string(os.PathSeparator) + snapshotDirName +
+		string(os.PathSeparator) + name
+}
+
+// checkSnapshotName returns an error if name cannot name a snapshot.
+func checkSnapshotName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") ||
+		strings.ContainsAny(name, "/\\\x00") ||
+		strings.ContainsRune(name, os.PathSeparator) {
+		return errors.Errorf(errSnapshotName, name)
+	}
+	return nil
+}
+
+// snapshotStore is an open snapshot. It reads through the Filestore of the
+// snapshot directory and refuses every write.
+type snapshotStore struct {
+	f *Filestore
+}
+
+// Set returns ErrReadOnly.
+func (s *snapshotStore) Set(key string, _ Marshaler) error {
+	return errors.Wrapf(ErrReadOnly, "Cannot set '%s'", key)
+}
+
+// Get loads the value of key from the snapshot per [KeyValue.Get].
+func (s *snapshotStore) Get(key string, loadIntoThisObject Unmarshaler) error {
+	return s.f.Get(key, loadIntoThisObject)
+}
+
+// Delete returns ErrReadOnly.
+func (s *snapshotStore) Delete(key string) error {
+	return errors.Wrapf(ErrReadOnly, "Cannot delete '%s'", key)
+}
+
+// SetInterface returns ErrReadOnly.
+func (s *snapshotStore) SetInterface(key string, _ interface{}) error {
+	return errors.Wrapf(ErrReadOnly, "Cannot set '%s'", key)
+}
+
+// GetInterface decodes the value of key in the snapshot per
+// [KeyValue.GetInterface].
+func (s *snapshotStore) GetInterface(key string, v interface{}) error {
+	return s.f.GetInterface(key, v)
+}
+
+// SetBytes returns ErrReadOnly.
+func (s *snapshotStore) SetBytes(key string, _ []byte) error {
+	return errors.Wrapf(ErrReadOnly, "Cannot set '%s'", key)
+}
+
+// GetBytes returns the value of key in the snapshot per [KeyValue.GetBytes].
+func (s *snapshotStore) GetBytes(key string) ([]byte, error) {
+	return s.f.GetBytes(key)
+}
+
+// Transaction runs op on the keys of the snapshot per [KeyValue.Transaction].
+// Returns ErrReadOnly if op changes any of them.
+func (s *snapshotStore) Transaction(op TransactionOperation,
+	keys ...string) error {
+	return s.f.Transaction(op, keys...)
+}
+
+// Close closes the snapshot per [KeyValue.Close].
+func (s *snapshotStore) Close() error {
+	return s.f.Close()
+}
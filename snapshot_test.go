@@ -0,0 +1,246 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portableOS"
+)
+
+// Tests that a snapshot keeps the store as it was when taken, refuses writes
+// and can be restored over the store and deleted.
+func TestFilestore_Snapshot(t *testing.T) {
+	dir := ".ekv_testdir_snapshot"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	for _, key := range []string{"a", "b"} {
+		if err = f.SetBytes(key, []byte(key+"1")); err != nil {
+			t.Fatalf("SetBytes failed: %+v", err)
+		}
+	}
+	if err = f.Snapshot("before"); err != nil {
+		t.Fatalf("Snapshot failed: %+v", err)
+	}
+	if err = f.Snapshot("before"); err == nil {
+		t.Errorf("Took a snapshot with the name of an existing one")
+	}
+	for _, name := range []string{"", ".hidden", "a/b", "..", "a\\b"} {
+		if err = f.Snapshot(name); err == nil {
+			t.Errorf("Took a snapshot with invalid name %q", name)
+		}
+	}
+
+	if err = f.SetBytes("a", []byte("a2")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	if err = f.Delete("b"); err != nil {
+		t.Fatalf("Delete failed: %+v", err)
+	}
+	if err = f.SetBytes("c", []byte("c2")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	if names, err := f.ListSnapshots(); err != nil ||
+		!reflect.DeepEqual(names, []string{"before"}) {
+		t.Errorf("Unexpected snapshots: %v, %+v", names, err)
+	}
+
+	s, err := f.OpenSnapshot("before")
+	if err != nil {
+		t.Fatalf("OpenSnapshot failed: %+v", err)
+	}
+	for key, expected := range map[string]string{"a": "a1", "b": "b1"} {
+		if value, err := s.GetBytes(key); err != nil ||
+			string(value) != expected {
+			t.Errorf("Unexpected value of %s in snapshot: %q, %+v", key,
+				value, err)
+		}
+	}
+	if _, err = s.GetBytes("c"); Exists(err) {
+		t.Errorf("Key written after the snapshot is in it: %+v", err)
+	}
+	if err = s.SetBytes("a", []byte("x")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly from SetBytes, got %+v", err)
+	}
+	if err = s.Delete("a"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly from Delete, got %+v", err)
+	}
+	err = s.Transaction(func(files map[string]Operable, _ Extender) error {
+		files["a"].Set([]byte("x"))
+		return nil
+	}, "a")
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly from Transaction, got %+v", err)
+	}
+	err = s.Transaction(func(files map[string]Operable, _ Extender) error {
+		if value, _ := files["a"].Get(); string(value) != "a1" {
+			t.Errorf("Unexpected value in transaction: %q", value)
+		}
+		return nil
+	}, "a")
+	if err != nil {
+		t.Errorf("Read-only transaction failed: %+v", err)
+	}
+	if err = s.Close(); err != nil {
+		t.Errorf("Close failed: %+v", err)
+	}
+	if value, err := f.GetBytes("a"); err != nil || string(value) != "a2" {
+		t.Errorf("Closing the snapshot affected the store: %q, %+v", value,
+			err)
+	}
+
+	if err = f.RestoreSnapshot("before"); err != nil {
+		t.Fatalf("RestoreSnapshot failed: %+v", err)
+	}
+	for key, expected := range map[string]string{"a": "a1", "b": "b1"} {
+		if value, err := f.GetBytes(key); err != nil ||
+			string(value) != expected {
+			t.Errorf("Unexpected value of %s after restore: %q, %+v", key,
+				value, err)
+		}
+	}
+	if _, err = f.GetBytes("c"); Exists(err) {
+		t.Errorf("Key written after the snapshot survived the restore: %+v",
+			err)
+	}
+
+	if err = f.DeleteSnapshot("before"); err != nil {
+		t.Fatalf("DeleteSnapshot failed: %+v", err)
+	}
+	if names, err := f.ListSnapshots(); err != nil || len(names) != 0 {
+		t.Errorf("Unexpected snapshots after delete: %v, %+v", names, err)
+	}
+	if _, err = f.OpenSnapshot("before"); Exists(err) {
+		t.Errorf("Opened a deleted snapshot: %+v", err)
+	}
+	if err = f.RestoreSnapshot("before"); Exists(err) {
+		t.Errorf("Restored a deleted snapshot: %+v", err)
+	}
+}
+
+// Tests that a snapshot taken while keys are being written is consistent: two
+// keys always written together in a transaction are equal in the snapshot.
+func TestFilestore_SnapshotConsistency(t *testing.T) {
+	dir := ".ekv_testdir_snapshot_consistency"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for i := 0; i < 50; i++ {
+		if err = f.SetBytes("filler"+strconv.Itoa(i), []byte("value")); err != nil {
+			t.Fatalf("SetBytes failed: %+v", err)
+		}
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			value := []byte(strconv.Itoa(i))
+			err := f.Transaction(func(files map[string]Operable,
+				_ Extender) error {
+				files["x"].Set(value)
+				files["y"].Set(value)
+				return nil
+			}, "x", "y")
+			if err != nil {
+				t.Errorf("Transaction failed: %+v", err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		if err = f.Snapshot("snapshot" + strconv.Itoa(i)); err != nil {
+			t.Errorf("Snapshot failed: %+v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	for i := 0; i < 3; i++ {
+		s, err := f.OpenSnapshot("snapshot" + strconv.Itoa(i))
+		if err != nil {
+			t.Fatalf("OpenSnapshot failed: %+v", err)
+		}
+		x, errX := s.GetBytes("x")
+		y, errY := s.GetBytes("y")
+		if Exists(errX) != Exists(errY) || string(x) != string(y) {
+			t.Errorf("Inconsistent snapshot: %q, %q, %v, %v", x, y, errX, errY)
+		}
+		if value, err := s.GetBytes("filler49"); err != nil ||
+			string(value) != "value" {
+			t.Errorf("Unexpected value in snapshot: %q, %+v", value, err)
+		}
+		_ = s.Close()
+	}
+}
+
+// Tests that capture leaves out the files it is told are unchanged, but still
+// lists them.
+func TestFilestore_CaptureUnchanged(t *testing.T) {
+	dir := ".ekv_testdir_capture"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for _, key := range []string{"left", "copied"} {
+		if err = f.SetBytes(key, []byte(key)); err != nil {
+			t.Fatalf("SetBytes failed: %+v", err)
+		}
+	}
+	left, _ := getPaths(filepath.Base(f.getKey("left")))
+
+	copyDir := getSnapshotPath(dir, "capture")
+	f.snapshots.Lock()
+	files, _, err := f.capture(copyDir,
+		func(name string, _ portableOS.FileInfo) bool { return name == left })
+	f.snapshots.Unlock()
+	if err != nil {
+		t.Fatalf("capture failed: %+v", err)
+	}
+	if _, exists := files[left]; !exists {
+		t.Errorf("Unchanged file %s is not listed", left)
+	}
+	copied, _ := getPaths(filepath.Base(f.getKey("copied")))
+	if _, err = portableOS.Stat(filepath.Join(copyDir, left)); Exists(err) {
+		t.Errorf("Unchanged file %s was copied: %+v", left, err)
+	}
+	if _, err = portableOS.Stat(filepath.Join(copyDir, copied)); err != nil {
+		t.Errorf("Changed file %s was not copied: %+v", copied, err)
+	}
+}
@@ -0,0 +1,513 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// stream.go implements streaming reads and writes of large values. The value
+// is split into fixed size chunks which are each sealed independently using
+// the STREAM construction of Hoang, Reyhanitabar, Rogaway and Vizár: the nonce
+// of every chunk is a random per-stream prefix, followed by the chunk counter
+// and a flag marking the final chunk. This authenticates the order of the
+// chunks and detects truncation while allowing any chunk to be decrypted on
+// its own, so streams use constant memory and support random access.
+//
+// The sealed chunks are written to one of two data files. A small encrypted
+// manifest, written with the regular two-file scheme in io.go, records which
+// data file holds the current stream along with its size and nonce prefix.
+// Writing the manifest is the commit point, so a crash while streaming leaves
+// the previous value intact.
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/ekv/portableOS"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// streamKeyPrefix is prepended to a key to derive the key of its stream
+	// manifest, and streamDataKeyPrefix to derive the names of its data files.
+	streamKeyPrefix     = "\x00ekv:stream:"
+	streamDataKeyPrefix = "\x00ekv:stream-data:"
+
+	// streamChunkSize is the plaintext size of every chunk except the last.
+	streamChunkSize = 64 * 1024
+
+	// streamNoncePrefixSize is the size of the random nonce prefix. The rest of
+	// the nonce is a 4-byte chunk counter and a 1-byte final chunk flag.
+	streamNoncePrefixSize = chacha20poly1305.NonceSizeX - 5
+
+	streamManifestVersion = 1
+	streamManifestSize    = 1 + 1 + 4 + 8 + streamNoncePrefixSize
+
+	errStreamManifest  = "invalid stream manifest: %s"
+	errStreamDataSize  = "stream data is %d bytes, expected %d"
+	errStreamTooLarge  = "stream exceeds the maximum number of chunks"
+	errStreamBadSeek   = "invalid seek to offset %d"
+	errStreamBadWhence = "invalid seek whence %d"
+)
+
+// streamManifest describes the stream currently committed for a key.
+type streamManifest struct {
+	// slot is the data file, 1 or 2, holding the stream.
+	slot      byte
+	chunkSize uint32
+	size      uint64
+	prefix    [streamNoncePrefixSize]byte
+}
+
+// marshal encodes the manifest as
+// [version][slot][4-byte chunk size][8-byte size][nonce prefix].
+func (m *streamManifest) marshal() []byte {
+	buf := make([]byte, 0, streamManifestSize)
+	buf = append(buf, streamManifestVersion, m.slot)
+	buf = binary.LittleEndian.AppendUint32(buf, m.chunkSize)
+	buf = binary.LittleEndian.AppendUint64(buf, m.size)
+	return append(buf, m.prefix[:]...)
+}
+
+// unmarshalStreamManifest is the inverse of streamManifest.marshal.
+func unmarshalStreamManifest(data []byte) (*streamManifest, error) {
+	if len(data) != streamManifestSize {
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+			errStreamManifest, "wrong size")})
+	}
+	if data[0] != streamManifestVersion {
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+			errStreamManifest, "unknown version "+strconv.Itoa(int(data[0])))})
+	}
+	m := &streamManifest{
+		slot:      data[1],
+		chunkSize: binary.LittleEndian.Uint32(data[2:6]),
+		size:      binary.LittleEndian.Uint64(data[6:14]),
+	}
+	copy(m.prefix[:], data[14:])
+	if (m.slot != 1 && m.slot != 2) || m.chunkSize == 0 {
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+			errStreamManifest, "invalid slot or chunk size")})
+	}
+	return m, nil
+}
+
+// numChunks returns the number of chunks in the stream. An empty stream still
+// has a single, empty, final chunk.
+func (m *streamManifest) numChunks() uint64 {
+	if m.size == 0 {
+		return 1
+	}
+	return (m.size + uint64(m.chunkSize) - 1) / uint64(m.chunkSize)
+}
+
+// chunkOffset returns the offset of the sealed chunk i in the data file.
+func (m *streamManifest) chunkOffset(i uint64) int64 {
+	return int64(i * (uint64(m.chunkSize) + chacha20poly1305.Overhead))
+}
+
+// chunkLen returns the plaintext length of chunk i.
+func (m *streamManifest) chunkLen(i uint64) int {
+	if i == m.numChunks()-1 {
+		return int(m.size - i*uint64(m.chunkSize))
+	}
+	return int(m.chunkSize)
+}
+
+// dataSize returns the expected size of the data file.
+func (m *streamManifest) dataSize() int64 {
+	last := m.numChunks() - 1
+	return m.chunkOffset(last) +
+		int64(m.chunkLen(last)+chacha20poly1305.Overhead)
+}
+
+// streamNonce returns the nonce of chunk counter of the stream.
+func streamNonce(prefix []byte, counter uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[streamNoncePrefixSize:], uint32(counter))
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// OpenWriter returns a writer that streams a value for key to disk in
+// independently encrypted chunks, using a constant amount of memory. The value
+// replaces the stream of key when the writer is closed; nothing is committed
+// if writing fails. Only one writer and no readers can be open on a key at a
+// time.
+//
+// Streamed values are kept apart from the values set with SetBytes and are
+// only readable with OpenReader. Delete removes both.
+func (f *Filestore) OpenWriter(key string) (io.WriteCloser, error) {
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return nil, err
+	}
+
+	manifestKey := f.getStreamKey(key)
+	unlock := f.takeLocks(true, manifestKey)
+	w, err := f.newStreamWriter(key, manifestKey)
+	if err != nil {
+		unlock()
+		done()
+		return nil, err
+	}
+	w.release = func() {
+		unlock()
+		done()
+	}
+	jww.TRACE.Printf("%s,OPENWRITER,%s,%s", kvDebugHeader, key, manifestKey)
+	return w, nil
+}
+
+// OpenReader returns a reader for the value streamed to key with OpenWriter.
+// Chunks are decrypted and authenticated as they are read, so the reader uses
+// a constant amount of memory and can seek anywhere in the value. Writers on
+// the key are blocked until the reader is closed.
+func (f *Filestore) OpenReader(key string) (io.ReadSeekCloser, error) {
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return nil, err
+	}
+
+	manifestKey := f.getStreamKey(key)
+	unlock := f.takeLocks(false, manifestKey)
+	r, err := f.newStreamReader(key, manifestKey)
+	if err != nil {
+		unlock()
+		done()
+		return nil, errors.WithStack(err)
+	}
+	r.release = func() {
+		unlock()
+		done()
+	}
+	return r, nil
+}
+
+// readStreamManifest returns the manifest of the stream at manifestKey. The
+// caller must hold its lock.
+func (f *Filestore) readStreamManifest(manifestKey string) (
+	*streamManifest, error) {
+	encrypted, err := read(manifestKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := decrypt(encrypted, f.key)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalStreamManifest(data)
+}
+
+// deleteStream securely deletes the manifest and data of the stream of key,
+// if there is one. The caller must hold the lock of manifestKey.
+func (f *Filestore) deleteStream(key, manifestKey string) error {
+	path1, path2 := getPaths(manifestKey)
+	_, err1 := portableOS.Stat(path1)
+	_, err2 := portableOS.Stat(path2)
+	if Exists(err1) || Exists(err2) {
+		if err := deleteFiles(manifestKey, f.csprng); err != nil {
+			return err
+		}
+	}
+	for _, slot := range []byte{1, 2} {
+		err := deleteFile(f.getStreamDataPath(key, slot), f.csprng)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getStreamKey returns the path of the stream manifest of key.
+func (f *Filestore) getStreamKey(key string) string {
+	return f.getKey(streamKeyPrefix + key)
+}
+
+// getStreamDataPath returns the path of data file slot of the stream of key.
+// Like every other path, it is a hash and reveals nothing about the key.
+func (f *Filestore) getStreamDataPath(key string, slot byte) string {
+	path1, _ := getPaths(
+		f.getKey(streamDataKeyPrefix + strconv.Itoa(int(slot)) + key))
+	return path1
+}
+
+// streamWriter implements io.WriteCloser for OpenWriter.
+type streamWriter struct {
+	f           *Filestore
+	manifestKey string
+	manifest    streamManifest
+	oldDataPath string
+	dataPath    string
+	file        portableOS.File
+	aead        cipher.AEAD
+
+	buf     []byte
+	sealed  []byte
+	counter uint64
+
+	err     error
+	closed  bool
+	release func()
+}
+
+// newStreamWriter creates the data file in the slot not used by the current
+// stream of key. The caller must hold the write lock of manifestKey.
+func (f *Filestore) newStreamWriter(key, manifestKey string) (
+	*streamWriter, error) {
+	w := &streamWriter{
+		f:           f,
+		manifestKey: manifestKey,
+		manifest:    streamManifest{slot: 1, chunkSize: streamChunkSize},
+		buf:         make([]byte, 0, streamChunkSize),
+	}
+
+	current, err := f.readStreamManifest(manifestKey)
+	if err == nil {
+		w.oldDataPath = f.getStreamDataPath(key, current.slot)
+		w.manifest.slot = 3 - current.slot
+	} else if Exists(err) {
+		return nil, err
+	}
+	w.dataPath = f.getStreamDataPath(key, w.manifest.slot)
+
+	if _, err = io.ReadFull(f.csprng, w.manifest.prefix[:]); err != nil {
+		return nil, errors.Wrap(err, "Could not generate nonce")
+	}
+	if w.aead, err = initChaCha20Poly1305(f.key); err != nil {
+		return nil, err
+	}
+	if w.file, err = createFile(w.dataPath); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Write buffers p and writes every chunk that fills up. The last chunk is
+// only sealed on Close, once it is known to be last.
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.WithStack(ErrClosed)
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	n := 0
+	for len(p) > 0 {
+		if len(w.buf) == cap(w.buf) {
+			if w.err = w.writeChunk(false); w.err != nil {
+				return n, w.err
+			}
+		}
+		c := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+// writeChunk seals the buffered chunk and appends it to the data file.
+func (w *streamWriter) writeChunk(last bool) error {
+	if w.counter > math.MaxUint32 {
+		return errors.New(errStreamTooLarge)
+	}
+	nonce := streamNonce(w.manifest.prefix[:], w.counter, last)
+	w.sealed = w.aead.Seal(w.sealed[:0], nonce, w.buf, nil)
+	n, err := w.file.Write(w.sealed)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if n != len(w.sealed) {
+		return errors.Errorf(errShortWrite, w.dataPath, n, len(w.sealed))
+	}
+	w.manifest.size += uint64(len(w.buf))
+	w.counter++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close seals the final chunk and commits the stream by writing its
+// manifest. The data of the previous stream is then securely deleted. If any
+// write failed, the new data is deleted instead and the error is returned.
+func (w *streamWriter) Close() error {
+	if w.closed {
+		return errors.WithStack(ErrClosed)
+	}
+	w.closed = true
+	defer w.release()
+
+	err := w.err
+	if err == nil {
+		err = w.writeChunk(true)
+	}
+	if err == nil {
+		err = w.file.Sync()
+	}
+	closeErr := w.file.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	var encrypted []byte
+	if err == nil {
+		encrypted, err = encrypt(w.manifest.marshal(), w.f.key, w.f.csprng)
+	}
+	if err == nil {
+		err = write(w.manifestKey, encrypted, w.f.csprng)
+	}
+	if err != nil {
+		if delErr := deleteFile(w.dataPath, w.f.csprng); delErr != nil {
+			jww.WARN.Printf("Failed to delete aborted stream data %s: %+v",
+				w.dataPath, delErr)
+		}
+		return errors.WithStack(err)
+	}
+
+	if w.oldDataPath != "" {
+		return deleteFile(w.oldDataPath, w.f.csprng)
+	}
+	return nil
+}
+
+// streamReader implements io.ReadSeekCloser for OpenReader.
+type streamReader struct {
+	manifest *streamManifest
+	file     portableOS.File
+	aead     cipher.AEAD
+
+	pos        int64
+	chunk      []byte
+	sealed     []byte
+	chunkIndex uint64
+	chunkValid bool
+
+	closed  bool
+	release func()
+}
+
+// newStreamReader opens the committed stream of key and checks that its data
+// file has the size recorded in the manifest. The caller must hold the read
+// lock of manifestKey.
+func (f *Filestore) newStreamReader(key, manifestKey string) (
+	*streamReader, error) {
+	manifest, err := f.readStreamManifest(manifestKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := initChaCha20Poly1305(f.key)
+	if err != nil {
+		return nil, err
+	}
+
+	dataPath := f.getStreamDataPath(key, manifest.slot)
+	info, err := portableOS.Stat(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() != manifest.dataSize() {
+		return nil, &ErrCorrupt{Path: dataPath, Reason: fmt.Sprintf(
+			errStreamDataSize, info.Size(), manifest.dataSize())}
+	}
+	file, err := portableOS.Open(dataPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamReader{
+		manifest: manifest,
+		file:     file,
+		aead:     aead,
+		chunk:    make([]byte, 0, manifest.chunkSize),
+		sealed:   make([]byte, manifest.chunkSize+chacha20poly1305.Overhead),
+	}, nil
+}
+
+// Read decrypts chunks as needed to fill p.
+func (r *streamReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, errors.WithStack(ErrClosed)
+	}
+	if uint64(r.pos) >= r.manifest.size {
+		return 0, io.EOF
+	}
+
+	index := uint64(r.pos) / uint64(r.manifest.chunkSize)
+	if err := r.loadChunk(index); err != nil {
+		return 0, err
+	}
+	offset := uint64(r.pos) - index*uint64(r.manifest.chunkSize)
+	n := copy(p, r.chunk[offset:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+// loadChunk reads, authenticates and decrypts chunk index.
+func (r *streamReader) loadChunk(index uint64) error {
+	if r.chunkValid && r.chunkIndex == index {
+		return nil
+	}
+	r.chunkValid = false
+
+	sealed := r.sealed[:r.manifest.chunkLen(index)+chacha20poly1305.Overhead]
+	_, err := r.file.ReadAt(sealed, r.manifest.chunkOffset(index))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	last := index == r.manifest.numChunks()-1
+	nonce := streamNonce(r.manifest.prefix[:], index, last)
+	r.chunk, err = r.aead.Open(r.chunk[:0], nonce, sealed, nil)
+	if err != nil {
+		return errors.Wrapf(ErrTampered, "stream chunk %d", index)
+	}
+	r.chunkIndex = index
+	r.chunkValid = true
+	return nil
+}
+
+// Seek sets the offset for the next Read per io.Seeker.
+func (r *streamReader) Seek(offset int64, whence int) (int64, error) {
+	if r.closed {
+		return 0, errors.WithStack(ErrClosed)
+	}
+
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = int64(r.manifest.size) + offset
+	default:
+		return 0, errors.Errorf(errStreamBadWhence, whence)
+	}
+	if pos < 0 {
+		return 0, errors.Errorf(errStreamBadSeek, pos)
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+// Close closes the data file and releases the lock on the key.
+func (r *streamReader) Close() error {
+	if r.closed {
+		return errors.WithStack(ErrClosed)
+	}
+	r.closed = true
+	defer r.release()
+	return r.file.Close()
+}
@@ -0,0 +1,174 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portableOS"
+)
+
+// writeStream writes data to the stream of key in uneven pieces.
+func writeStream(t *testing.T, f *Filestore, key string, data []byte) {
+	w, err := f.OpenWriter(key)
+	if err != nil {
+		t.Fatalf("OpenWriter failed: %+v", err)
+	}
+	for remaining := data; len(remaining) > 0; {
+		n := min(len(remaining), 1000+len(remaining)%7919)
+		if _, err = w.Write(remaining[:n]); err != nil {
+			t.Fatalf("Write failed: %+v", err)
+		}
+		remaining = remaining[n:]
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("Close failed: %+v", err)
+	}
+}
+
+// readStream reads the whole stream of key.
+func readStream(t *testing.T, f *Filestore, key string) []byte {
+	r, err := f.OpenReader(key)
+	if err != nil {
+		t.Fatalf("OpenReader failed: %+v", err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %+v", err)
+	}
+	return data
+}
+
+// Tests that streamed values of several sizes read back correctly, including
+// after seeking and after being replaced.
+func TestFilestore_Stream(t *testing.T) {
+	dir := ".ekv_testdir_stream"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	for _, size := range []int{0, 1, streamChunkSize, 3*streamChunkSize + 17} {
+		data := make([]byte, size)
+		if _, err = rand.Read(data); err != nil {
+			t.Fatal(err)
+		}
+		writeStream(t, f, "key", data)
+		if got := readStream(t, f, "key"); !bytes.Equal(got, data) {
+			t.Errorf("Stream of %d bytes did not read back", size)
+		}
+	}
+
+	// Random access
+	data := make([]byte, 3*streamChunkSize+17)
+	if _, err = rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	writeStream(t, f, "key", data)
+	r, err := f.OpenReader("key")
+	if err != nil {
+		t.Fatalf("OpenReader failed: %+v", err)
+	}
+	for _, offset := range []int64{2*streamChunkSize + 5, 10, int64(len(data) - 3)} {
+		if _, err = r.Seek(offset, io.SeekStart); err != nil {
+			t.Fatalf("Seek failed: %+v", err)
+		}
+		buf := make([]byte, 3)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			t.Fatalf("Read at %d failed: %+v", offset, err)
+		}
+		if !bytes.Equal(buf, data[offset:offset+3]) {
+			t.Errorf("Wrong data at offset %d", offset)
+		}
+	}
+	if _, err = r.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected EOF at end of stream, got %+v", err)
+	}
+	if err = r.Close(); err != nil {
+		t.Fatalf("Close failed: %+v", err)
+	}
+
+	// Only the current data slot is kept
+	slots := 0
+	for _, slot := range []byte{1, 2} {
+		if _, err = os.Stat(f.getStreamDataPath("key", slot)); err == nil {
+			slots++
+		}
+	}
+	if slots != 1 {
+		t.Errorf("Expected 1 data file, found %d", slots)
+	}
+
+	// Delete removes the stream
+	if err = f.Delete("key"); err != nil {
+		t.Fatalf("Delete failed: %+v", err)
+	}
+	if _, err = f.OpenReader("key"); Exists(err) {
+		t.Errorf("Stream exists after delete: %+v", err)
+	}
+}
+
+// Tests that modified or truncated stream data is detected.
+func TestFilestore_StreamTampered(t *testing.T) {
+	dir := ".ekv_testdir_stream_tampered"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	writeStream(t, f, "key", bytes.Repeat([]byte("a"), 2*streamChunkSize))
+
+	manifest, err := f.readStreamManifest(f.getStreamKey("key"))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	dataPath := f.getStreamDataPath("key", manifest.slot)
+	contents, err := os.ReadFile(dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents[len(contents)-1] ^= 1
+	if err = os.WriteFile(dataPath, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := f.OpenReader("key")
+	if err != nil {
+		t.Fatalf("OpenReader failed: %+v", err)
+	}
+	if _, err = io.ReadAll(r); !errors.Is(err, ErrTampered) {
+		t.Errorf("Expected ErrTampered, got %+v", err)
+	}
+	r.Close()
+
+	if err = os.WriteFile(dataPath, contents[:len(contents)-1], 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.OpenReader("key")
+	var corrupt *ErrCorrupt
+	if !errors.As(err, &corrupt) {
+		t.Errorf("Expected ErrCorrupt for truncated data, got %+v", err)
+	}
+}
@@ -0,0 +1,999 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// sync.go implements two-way sync between a Filestore and another store, such
+// as copies of a store on a phone and a desktop.
+//
+// Every store has a random replica ID and keeps, in a sync state, a version
+// vector per key: how many times every replica changed the key, as far as the
+// store knows. A Filestore encrypts its sync state, and a Memstore keeps it
+// in memory. Changes are found when a sync starts, by comparing the values of
+// the keys with the digest of the value recorded in the sync state, so that
+// writes need no extra bookkeeping. A Filestore with the change feed enabled,
+// see changes.go, only compares the keys written since the last sync, and
+// otherwise every key of the store, listed from its files, see keyIndex.go.
+// Several writes between two syncs count as one change.
+//
+// The vectors of each key on both stores are then compared. If one dominates
+// the other, its value, or its deletion, is copied over, between Filestores
+// as a sealed envelope. If neither does, both stores changed the key
+// concurrently, and the SyncResolver of the store decides the outcome, which
+// becomes a new change of the store dominating both.
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// syncStateKey is the key of the sync state of the store.
+	syncStateKey = "\x00ekv:sync-state"
+
+	syncStateVersion = 2
+	syncReplicaSize  = 8
+
+	errSyncPeer       = "cannot sync with %T, only with a Filestore or Memstore"
+	errSyncSelf       = "cannot sync a store with itself"
+	errSyncState      = "invalid sync state: %s"
+	errSyncResolution = "invalid resolution of the conflict on %q: %s"
+)
+
+// errSyncChanged is returned when a key changed after the sync started. The
+// key is left for the next sync.
+var errSyncChanged = errors.New("key changed during sync")
+
+// SyncSide is one of the stores in a sync.
+type SyncSide int
+
+const (
+	// SyncLocal is the store Sync is called on.
+	SyncLocal SyncSide = iota + 1
+	// SyncRemote is the store passed to Sync.
+	SyncRemote
+)
+
+// SyncVersion is the version of a key on one of the stores in a conflict.
+type SyncVersion struct {
+	// Value is the value of the key, or nil if Deleted is set.
+	Value   []byte
+	Deleted bool
+	// Modified is when the value was last written, or when its deletion was
+	// found.
+	Modified time.Time
+	// Replica is the replica ID of the store.
+	Replica string
+}
+
+// SyncConflict is a key changed concurrently on both stores.
+type SyncConflict struct {
+	Key           string
+	Local, Remote SyncVersion
+}
+
+// version returns the version of the side.
+func (c *SyncConflict) version(side SyncSide) SyncVersion {
+	if side == SyncLocal {
+		return c.Local
+	}
+	return c.Remote
+}
+
+// SyncResolution is the outcome of a conflict, applied to both stores.
+type SyncResolution struct {
+	// Keep is the side whose version the key gets, unless Merged is set.
+	Keep SyncSide
+	// Merged, if not nil, is the value the key gets instead, such as a merge
+	// of both versions.
+	Merged []byte
+	// Copies maps other keys to the side whose version of the key they get,
+	// so that a version can be kept under another key. Deleted versions
+	// cannot be copied.
+	Copies map[string]SyncSide
+}
+
+// SyncResolver decides the outcome of a conflict. An error aborts the sync.
+type SyncResolver func(c SyncConflict) (SyncResolution, error)
+
+// LastWriterWins is the SyncResolver that keeps the version modified last,
+// breaking ties by the replica ID so that the outcome is the same on every
+// store. It is the default.
+func LastWriterWins(c SyncConflict) (SyncResolution, error) {
+	if c.Local.Modified.After(c.Remote.Modified) ||
+		(c.Local.Modified.Equal(c.Remote.Modified) &&
+			c.Local.Replica > c.Remote.Replica) {
+		return SyncResolution{Keep: SyncLocal}, nil
+	}
+	return SyncResolution{Keep: SyncRemote}, nil
+}
+
+// KeepBoth is the SyncResolver that keeps the version modified last, like
+// LastWriterWins, and copies the other version, unless it is a deletion, to
+// the key returned by SyncConflictKey.
+func KeepBoth(c SyncConflict) (SyncResolution, error) {
+	res, err := LastWriterWins(c)
+	if err != nil {
+		return res, err
+	}
+	loser := SyncRemote
+	if res.Keep == SyncRemote {
+		loser = SyncLocal
+	}
+	if v := c.version(loser); !v.Deleted {
+		res.Copies = map[string]SyncSide{
+			SyncConflictKey(c.Key, v.Replica): loser}
+	}
+	return res, nil
+}
+
+// SyncConflictKey returns the key KeepBoth copies the version of key from the
+// store with the replica ID to.
+func SyncConflictKey(key, replica string) string {
+	return key + ".conflict-" + replica
+}
+
+// SetSyncResolver sets how Sync resolves the keys changed concurrently on
+// both stores. A nil resolver restores LastWriterWins.
+func (f *Filestore) SetSyncResolver(resolver SyncResolver) {
+	f.sync.mux.Lock()
+	defer f.sync.mux.Unlock()
+	f.sync.resolver = resolver
+}
+
+// SyncReplica returns the replica ID of the store, which identifies it in
+// version vectors and conflicts.
+func (f *Filestore) SyncReplica() (string, error) {
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return "", err
+	}
+	defer done()
+	f.sync.mux.Lock()
+	defer f.sync.mux.Unlock()
+
+	state, err := f.readSyncState()
+	if err != nil {
+		return "", err
+	}
+	if err = f.writeSyncState(state); err != nil {
+		return "", err
+	}
+	return state.replica, nil
+}
+
+// Sync makes the store and other, which must be a Filestore or a Memstore,
+// hold the same keys and values. Keys changed on one store since they were
+// last synced are copied to the other, including deletions, and keys changed
+// on both are resolved by the SyncResolver of this store. Only the keys that
+// differ are copied, as encrypted envelopes between Filestores. The
+// Filestores may have different passwords.
+//
+// Sync works on the keys of the stores, as listed by Export, along with
+// their metadata. Records appended with AppendBytes, streams and the history
+// of values are not synced. Keys written while Sync runs are left for the
+// next sync. Only the values of the keys written since the last sync are
+// read if the change feed is enabled and kept their changes, see
+// EnableChanges and SetChangeRetention.
+func (f *Filestore) Sync(other KeyValue) error {
+	peer, ok := other.(syncStore)
+	if !ok {
+		return errors.Errorf(errSyncPeer, other)
+	} else if peer == syncStore(f) {
+		return errors.New(errSyncSelf)
+	}
+
+	done, err := f.beginSync()
+	if err != nil {
+		return err
+	}
+	defer done()
+	peerDone, err := peer.beginSync()
+	if err != nil {
+		return err
+	}
+	defer peerDone()
+	// Sync states are locked in a fixed order so that two stores syncing
+	// with each other at once cannot deadlock
+	first, second := f.syncSettings(), peer.syncSettings()
+	if first.order() > second.order() {
+		first, second = second, first
+	}
+	first.mux.Lock()
+	defer first.mux.Unlock()
+	second.mux.Lock()
+	defer second.mux.Unlock()
+
+	s := &syncSession{local: f, remote: peer, resolver: f.sync.resolver}
+	if s.resolver == nil {
+		s.resolver = LastWriterWins
+	}
+	if s.localState, err = f.refreshSyncState(); err != nil {
+		return err
+	}
+	if s.remoteState, err = peer.refreshSyncState(); err != nil {
+		return err
+	}
+	jww.TRACE.Printf("%s,SYNC,%s,%s", kvDebugHeader, s.localState.replica,
+		s.remoteState.replica)
+
+	keys := make([]string, 0, len(s.localState.entries))
+	for key := range s.localState.entries {
+		keys = append(keys, key)
+	}
+	for key := range s.remoteState.entries {
+		if _, exists := s.localState.entries[key]; !exists {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var syncErr error
+	for _, key := range keys {
+		if syncErr = s.reconcile(key); syncErr != nil {
+			break
+		}
+	}
+
+	// The states are saved even after an error, as they describe the keys
+	// already synced
+	err = f.writeSyncState(s.localState)
+	if err == nil {
+		err = peer.writeSyncState(s.remoteState)
+	}
+	if syncErr != nil {
+		return syncErr
+	}
+	return err
+}
+
+// syncOrder numbers the stores in the order their sync states are locked.
+var syncOrder atomic.Uint64
+
+// syncRegistry holds the sync settings of a store. Its lock also serializes
+// syncs and guards the sync state.
+type syncRegistry struct {
+	resolver SyncResolver
+	mux      sync.Mutex
+
+	// state is the marshalled sync state of a Memstore.
+	state []byte
+	id    uint64
+	once  sync.Once
+}
+
+// order returns the position of the store in the order sync states are
+// locked in.
+func (r *syncRegistry) order() uint64 {
+	r.once.Do(func() { r.id = syncOrder.Add(1) })
+	return r.id
+}
+
+// syncStore is a store that can take part in a sync.
+type syncStore interface {
+	KeyValue
+
+	// syncSettings returns the sync settings of the store.
+	syncSettings() *syncRegistry
+	// beginSync registers a sync as in flight on the store, as
+	// lifecycle.begin does, and returns ErrReadOnly if it cannot be written.
+	beginSync() (done func(), err error)
+	// refreshSyncState returns the sync state of the store with a new
+	// change of its replica recorded for every key changed since the last
+	// sync. The caller must be in flight and hold the sync lock.
+	refreshSyncState() (*syncState, error)
+	// writeSyncState saves the sync state of the store. The caller must
+	// hold the sync lock.
+	writeSyncState(state *syncState) error
+	// readSyncValue returns the value of key, which must still be the one
+	// described by entry. The caller must be in flight.
+	readSyncValue(key string, entry *syncEntry) (storedValue, error)
+	// applySyncValue writes value to key, or deletes key if value is nil,
+	// if the value of key is still the one described by entry, which is nil
+	// if the key was not known. The caller must be in flight.
+	applySyncValue(key string, value *storedValue, entry *syncEntry) error
+	// syncNow returns the time according to the clock of the store.
+	syncNow() time.Time
+}
+
+// syncSession is a sync in progress between two stores.
+type syncSession struct {
+	local, remote           syncStore
+	localState, remoteState *syncState
+	resolver                SyncResolver
+}
+
+// store returns the store of the side and its sync state.
+func (s *syncSession) store(side SyncSide) (syncStore, *syncState) {
+	if side == SyncLocal {
+		return s.local, s.localState
+	}
+	return s.remote, s.remoteState
+}
+
+// reconcile brings key to the same version on both stores.
+func (s *syncSession) reconcile(key string) error {
+	local, remote := s.localState.entries[key], s.remoteState.entries[key]
+	var err error
+	switch local.vector().compare(remote.vector()) {
+	case vectorEqual:
+		return nil
+	case vectorAfter:
+		err = s.copy(key, key, SyncLocal, local.vector())
+	case vectorBefore:
+		err = s.copy(key, key, SyncRemote, remote.vector())
+	default:
+		err = s.resolve(key, local, remote)
+	}
+	if err == errSyncChanged {
+		jww.INFO.Printf("Key %q changed during sync, leaving it for the "+
+			"next sync", key)
+		return nil
+	}
+	return err
+}
+
+// resolve settles the conflict between the versions of key changed
+// concurrently on both stores.
+func (s *syncSession) resolve(key string, local, remote *syncEntry) error {
+	// The outcome supersedes both versions
+	merged := local.vector().merge(remote.vector())
+	merged[s.localState.replica]++
+
+	if local.deleted == remote.deleted && local.digest == remote.digest {
+		// Both made the same change
+		s.localState.entries[key] = local.withVector(merged)
+		s.remoteState.entries[key] = remote.withVector(merged)
+		return nil
+	}
+
+	c := SyncConflict{Key: key}
+	var err error
+	if c.Local, err = s.readVersion(key, SyncLocal); err != nil {
+		return err
+	}
+	if c.Remote, err = s.readVersion(key, SyncRemote); err != nil {
+		return err
+	}
+	res, err := s.resolver(c)
+	if err != nil {
+		return errors.WithMessagef(err, "Failed to resolve conflict on %q",
+			key)
+	}
+	if res.Keep != SyncLocal && res.Keep != SyncRemote &&
+		res.Merged == nil {
+		return errors.Errorf(errSyncResolution, key, "no side kept")
+	}
+
+	copyKeys := make([]string, 0, len(res.Copies))
+	for copyKey := range res.Copies {
+		copyKeys = append(copyKeys, copyKey)
+	}
+	sort.Strings(copyKeys)
+	for _, copyKey := range copyKeys {
+		side := res.Copies[copyKey]
+		if copyKey == key || c.version(side).Deleted {
+			return errors.Errorf(errSyncResolution, key,
+				fmt.Sprintf("cannot copy to %q", copyKey))
+		}
+		copyVector := s.localState.entries[copyKey].vector().merge(
+			s.remoteState.entries[copyKey].vector())
+		copyVector[s.localState.replica]++
+		err = s.copy(key, copyKey, side, copyVector)
+		if err != nil && err != errSyncChanged {
+			return err
+		}
+	}
+
+	if res.Merged != nil {
+		return s.writeMerged(key, res.Merged, merged)
+	}
+	return s.copy(key, key, res.Keep, merged)
+}
+
+// copy writes the version of key on the side, as vector, to dst on both
+// stores.
+func (s *syncSession) copy(key, dst string, side SyncSide,
+	vector versionVector) error {
+	src, srcState := s.store(side)
+	entry := srcState.entries[key]
+	var value *storedValue
+	if !entry.deleted {
+		v, err := src.readSyncValue(key, entry)
+		if err != nil {
+			return err
+		}
+		value = &v
+	}
+
+	for _, to := range []SyncSide{SyncLocal, SyncRemote} {
+		f, state := s.store(to)
+		current := state.entries[dst]
+		if current == nil || current.deleted != entry.deleted ||
+			current.digest != entry.digest {
+			err := f.applySyncValue(dst, value, current)
+			if err != nil {
+				return err
+			}
+		}
+		state.entries[dst] = entry.withVector(vector)
+	}
+	return nil
+}
+
+// writeMerged writes the merged value of key, as vector, on both stores.
+func (s *syncSession) writeMerged(key string, data []byte,
+	vector versionVector) error {
+	value := &storedValue{data: data,
+		meta: valueMeta{}.stamp(len(data), s.local.syncNow())}
+	for _, to := range []SyncSide{SyncLocal, SyncRemote} {
+		f, state := s.store(to)
+		if err := f.applySyncValue(key, value, state.entries[key]); err != nil {
+			return err
+		}
+		state.entries[key] = &syncEntry{vec: vector,
+			digest: syncDigest(*value), modified: value.meta.modified}
+	}
+	return nil
+}
+
+// readVersion returns the version of key on the side.
+func (s *syncSession) readVersion(key string, side SyncSide) (SyncVersion,
+	error) {
+	f, state := s.store(side)
+	entry := state.entries[key]
+	v := SyncVersion{Deleted: entry.deleted, Modified: entry.modified,
+		Replica: state.replica}
+	if !entry.deleted {
+		value, err := f.readSyncValue(key, entry)
+		if err != nil {
+			return SyncVersion{}, err
+		}
+		v.Value = value.data
+	}
+	return v, nil
+}
+
+// syncSettings implements syncStore.
+func (f *Filestore) syncSettings() *syncRegistry {
+	return &f.sync
+}
+
+// beginSync implements syncStore.
+func (f *Filestore) beginSync() (func(), error) {
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return nil, err
+	}
+	if f.readOnly {
+		done()
+		return nil, errors.WithStack(ErrReadOnly)
+	}
+	return done, nil
+}
+
+// syncNow implements syncStore.
+func (f *Filestore) syncNow() time.Time {
+	return f.clock.Now()
+}
+
+// readSyncValue implements syncStore.
+func (f *Filestore) readSyncValue(key string, entry *syncEntry) (storedValue,
+	error) {
+	encryptedKey := f.getKey(key)
+	logKey := f.getMergeLogKey(key)
+	unlock := f.takeLocks(false, encryptedKey, logKey)
+	defer unlock()
+	value, exists, _, err := f.readMerged(key, encryptedKey, logKey)
+	if err != nil && Exists(err) {
+		return storedValue{}, err
+	}
+	if !entry.matches(value, exists) {
+		return storedValue{}, errSyncChanged
+	}
+	return value, nil
+}
+
+// applySyncValue implements syncStore. The value is deleted, or written, with
+// the locks of every file of the key held since it was compared with entry.
+func (f *Filestore) applySyncValue(key string, value *storedValue,
+	entry *syncEntry) error {
+	if value != nil {
+		err := f.indexCopiedKey(key, !value.meta.expires.IsZero())
+		if err != nil {
+			return err
+		}
+	}
+
+	paths := f.keyPaths(key)
+	encryptedKey, logKey, historyKey := paths[0], paths[1], paths[4]
+	unlock := f.takeLocks(true, paths...)
+	defer unlock()
+	current, exists, _, err := f.readMerged(key, encryptedKey, logKey)
+	if err != nil && Exists(err) {
+		return err
+	}
+	if !entry.matches(current, exists) {
+		return errSyncChanged
+	}
+
+	if value == nil {
+		if !exists {
+			return nil
+		}
+		jww.TRACE.Printf("%s,SYNC_DELETE,%s,%s", kvDebugHeader, key,
+			encryptedKey)
+		return f.deleteKeyFiles(key)
+	}
+	jww.TRACE.Printf("%s,SYNC_SET,%s,%s", kvDebugHeader, key, encryptedKey)
+	e := &envelope{valueTags: value.valueTags, meta: value.meta, key: key,
+		payload: value.data}
+	if f.compression.enabledFor(key) {
+		e.compression, e.payload = compress(value.data)
+	}
+	contents, err := sealEnvelope(e, f.key, f.csprng)
+	if err != nil {
+		return err
+	}
+	changes, err := f.recordChanges(
+		Change{Op: ChangeSet, Key: key, Value: value.data})
+	if err != nil {
+		return err
+	}
+	return f.commitChanges(changes,
+		f.writeValue(key, encryptedKey, logKey, historyKey, contents, nil))
+}
+
+// refreshSyncState implements syncStore. Only the keys written since the last
+// sync, according to the change feed, are read, unless it is not enabled or
+// discarded the changes.
+func (f *Filestore) refreshSyncState() (*syncState, error) {
+	state, err := f.readSyncState()
+	if err != nil {
+		return nil, err
+	}
+	next, keys, err := f.changedKeys(state.changes)
+	if err != nil {
+		return nil, err
+	}
+	if keys == nil {
+		if keys, err = f.indexedKeys(); err != nil {
+			return nil, err
+		}
+		for key := range state.entries {
+			keys = append(keys, key)
+		}
+	}
+	state.changes = next
+
+	now := f.clock.Now()
+	for _, key := range keys {
+		encryptedKey := f.getKey(key)
+		logKey := f.getMergeLogKey(key)
+		unlock := f.takeLocks(false, encryptedKey, logKey)
+		value, exists, _, err := f.readMerged(key, encryptedKey, logKey)
+		unlock()
+		if err != nil && Exists(err) {
+			return nil, err
+		}
+		state.refresh(key, value, exists, now)
+	}
+	return state, nil
+}
+
+// renewSyncReplica gives the store a new replica ID, after its files were
+// replaced by a snapshot or backup, so that the changes it makes from then on
+// cannot be mistaken for those it made after the snapshot was taken. The
+// caller must have paused the store.
+func (f *Filestore) renewSyncReplica() error {
+	f.sync.mux.Lock()
+	defer f.sync.mux.Unlock()
+	if _, err := read(f.getKey(syncStateKey)); !Exists(err) {
+		return nil
+	}
+	state, err := f.readSyncState()
+	if err != nil {
+		return err
+	}
+	if state.replica, err = newSyncReplica(f.csprng); err != nil {
+		return err
+	}
+	return f.writeSyncState(state)
+}
+
+// readSyncState returns the sync state of the store, or a new one with a new
+// replica ID if it was never synced. The caller must hold the sync lock.
+func (f *Filestore) readSyncState() (*syncState, error) {
+	encryptedKey := f.getKey(syncStateKey)
+	unlock := f.takeLocks(false, encryptedKey)
+	encrypted, err := read(encryptedKey)
+	unlock()
+	if !Exists(err) {
+		replica, err := newSyncReplica(f.csprng)
+		if err != nil {
+			return nil, err
+		}
+		return &syncState{replica: replica,
+			entries: make(map[string]*syncEntry)}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	data, err := decrypt(encrypted, f.key)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalSyncState(data)
+}
+
+// writeSyncState implements syncStore.
+func (f *Filestore) writeSyncState(state *syncState) error {
+	encrypted, err := encrypt(state.marshal(), f.key, f.csprng)
+	if err != nil {
+		return err
+	}
+	encryptedKey := f.getKey(syncStateKey)
+	unlock := f.takeLocks(true, encryptedKey)
+	defer unlock()
+	return errors.WithStack(write(encryptedKey, encrypted, f.csprng))
+}
+
+// newSyncReplica returns a new random replica ID.
+func newSyncReplica(csprng io.Reader) (string, error) {
+	id := make([]byte, syncReplicaSize)
+	if _, err := io.ReadFull(csprng, id); err != nil {
+		return "", errors.Wrap(err, "Could not generate replica ID")
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// syncState is the replica ID of a store and what it knows of the versions of
+// its keys.
+type syncState struct {
+	replica string
+	entries map[string]*syncEntry
+
+	// changes is the sequence number of the first change of the change feed
+	// not yet compared with the entries, or 0 if unknown.
+	changes uint64
+}
+
+// refresh records a new change of the replica of the state to key if the
+// value of key, or its absence, is not the one described by its entry.
+func (s *syncState) refresh(key string, value storedValue, exists bool,
+	now time.Time) {
+	entry := s.entries[key]
+	if entry.matches(value, exists) || (entry == nil && !exists) {
+		return
+	}
+	changed := &syncEntry{vec: entry.vector().merge(nil),
+		deleted: !exists, modified: now}
+	if exists {
+		changed.digest = syncDigest(value)
+		if !value.meta.modified.IsZero() {
+			changed.modified = value.meta.modified
+		}
+	}
+	changed.vec[s.replica]++
+	s.entries[key] = changed
+}
+
+// syncEntry is the version of a key on a store as of its last sync.
+type syncEntry struct {
+	vec      versionVector
+	deleted  bool
+	digest   [blake2b.Size256]byte
+	modified time.Time
+}
+
+// vector returns the version vector of the entry, which is empty for a nil
+// entry.
+func (e *syncEntry) vector() versionVector {
+	if e == nil {
+		return nil
+	}
+	return e.vec
+}
+
+// withVector returns a copy of the entry with another vector.
+func (e *syncEntry) withVector(vector versionVector) *syncEntry {
+	c := *e
+	c.vec = vector.merge(nil)
+	return &c
+}
+
+// matches returns whether the entry describes the value, or its absence.
+// A nil entry matches no value.
+func (e *syncEntry) matches(value storedValue, exists bool) bool {
+	if e == nil {
+		return !exists
+	}
+	if !exists {
+		return e.deleted
+	}
+	return !e.deleted && e.digest == syncDigest(value)
+}
+
+// syncDigest returns the hash of the value and of the fields of its envelope
+// that are synced with it, other than the times, which every store stamps.
+func syncDigest(value storedValue) [blake2b.Size256]byte {
+	buf := appendMetaString(nil, value.codec)
+	buf = appendMetaString(buf, value.schema.name)
+	buf = binary.AppendUvarint(buf, uint64(value.schema.version))
+	buf = appendMetaString(buf, value.meta.contentType)
+	tagKeys := make([]string, 0, len(value.meta.tags))
+	for k := range value.meta.tags {
+		tagKeys = append(tagKeys, k)
+	}
+	sort.Strings(tagKeys)
+	buf = binary.AppendUvarint(buf, uint64(len(tagKeys)))
+	for _, k := range tagKeys {
+		buf = appendMetaString(buf, k)
+		buf = appendMetaString(buf, value.meta.tags[k])
+	}
+	if !value.meta.expires.IsZero() {
+		buf = binary.AppendVarint(buf, value.meta.expires.UnixNano())
+	}
+	return blake2b.Sum256(append(buf, value.data...))
+}
+
+// marshal encodes the state as
+// [version][replica][uvarint changes][uvarint count][entries]
+// with every entry, sorted by key, as
+// [key][deleted][digest][varint modified][uvarint count][replica, counter]...
+// where strings are prefixed with their uvarint size.
+func (s *syncState) marshal() []byte {
+	buf := appendMetaString([]byte{syncStateVersion}, s.replica)
+	buf = binary.AppendUvarint(buf, s.changes)
+	keys := make([]string, 0, len(s.entries))
+	for key := range s.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	buf = binary.AppendUvarint(buf, uint64(len(keys)))
+	for _, key := range keys {
+		e := s.entries[key]
+		buf = appendMetaString(buf, key)
+		if e.deleted {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+		buf = append(buf, e.digest[:]...)
+		buf = binary.AppendVarint(buf, e.modified.UnixNano())
+		replicas := make([]string, 0, len(e.vec))
+		for replica := range e.vec {
+			replicas = append(replicas, replica)
+		}
+		sort.Strings(replicas)
+		buf = binary.AppendUvarint(buf, uint64(len(replicas)))
+		for _, replica := range replicas {
+			buf = appendMetaString(buf, replica)
+			buf = binary.AppendUvarint(buf, e.vec[replica])
+		}
+	}
+	return buf
+}
+
+// unmarshalSyncState is the inverse of syncState.marshal.
+func unmarshalSyncState(data []byte) (*syncState, error) {
+	if len(data) == 0 || data[0] != syncStateVersion {
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+			errSyncState, "unknown version")})
+	}
+	d := metaDecoder{data: data[1:]}
+	s := &syncState{replica: d.string(), changes: d.uvarint()}
+	count := d.uvarint()
+	// Every entry takes at least 36 bytes, so a larger count is corrupt
+	if d.err == nil && count > uint64(len(d.data))/36 {
+		d.err = errors.New("entry count exceeds size")
+	}
+	s.entries = make(map[string]*syncEntry, count)
+	for i := uint64(0); i < count && d.err == nil; i++ {
+		key := d.string()
+		e := &syncEntry{vec: make(versionVector)}
+		flags := d.fixed(1)
+		e.deleted = len(flags) == 1 && flags[0] == 1
+		copy(e.digest[:], d.fixed(blake2b.Size256))
+		e.modified = time.Unix(0, d.varint())
+		n := d.uvarint()
+		for j := uint64(0); j < n && d.err == nil; j++ {
+			replica := d.string()
+			e.vec[replica] = d.uvarint()
+		}
+		s.entries[key] = e
+	}
+	if d.err == nil && len(d.data) != 0 {
+		d.err = errors.New("trailing data")
+	}
+	if d.err != nil {
+		return nil, errors.WithStack(&ErrCorrupt{Reason: fmt.Sprintf(
+			errSyncState, d.err.Error())})
+	}
+	return s, nil
+}
+
+// versionVector counts the changes every replica made to a key.
+type versionVector map[string]uint64
+
+// Results of versionVector.compare.
+const (
+	vectorEqual = iota
+	vectorBefore
+	vectorAfter
+	vectorConcurrent
+)
+
+// compare returns whether v is equal to o, precedes it, follows it or is
+// concurrent with it.
+func (v versionVector) compare(o versionVector) int {
+	before, after := false, false
+	for replica, n := range v {
+		if n > o[replica] {
+			after = true
+		}
+	}
+	for replica, n := range o {
+		if n > v[replica] {
+			before = true
+		}
+	}
+	switch {
+	case before && after:
+		return vectorConcurrent
+	case before:
+		return vectorBefore
+	case after:
+		return vectorAfter
+	default:
+		return vectorEqual
+	}
+}
+
+// merge returns a new vector with, for every replica, the larger count of v
+// and o.
+func (v versionVector) merge(o versionVector) versionVector {
+	m := make(versionVector, len(v)+len(o))
+	for replica, n := range v {
+		m[replica] = n
+	}
+	for replica, n := range o {
+		if n > m[replica] {
+			m[replica] = n
+		}
+	}
+	return m
+}
+
+// syncSettings implements syncStore.
+func (m *Memstore) syncSettings() *syncRegistry {
+	return &m.sync
+}
+
+// beginSync implements syncStore.
+func (m *Memstore) beginSync() (func(), error) {
+	return m.lifecycle.begin()
+}
+
+// syncNow implements syncStore.
+func (m *Memstore) syncNow() time.Time {
+	return m.clock.Now()
+}
+
+// refreshSyncState implements syncStore. Every key of the Memstore is
+// compared.
+func (m *Memstore) refreshSyncState() (*syncState, error) {
+	state, err := m.readSyncState()
+	if err != nil {
+		return nil, err
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	keys := make(map[string]struct{}, len(m.store)+len(state.entries))
+	for key := range m.store {
+		keys[key] = struct{}{}
+	}
+	for key := range m.pendingMerges {
+		keys[key] = struct{}{}
+	}
+	for key := range state.entries {
+		keys[key] = struct{}{}
+	}
+	now := m.clock.Now()
+	for key := range keys {
+		value, exists, err := m.syncValue(key)
+		if err != nil {
+			return nil, err
+		}
+		state.refresh(key, value, exists, now)
+	}
+	return state, nil
+}
+
+// readSyncState returns the sync state of the Memstore, or a new one with a
+// new replica ID if it was never synced. The caller must hold the sync lock.
+func (m *Memstore) readSyncState() (*syncState, error) {
+	if m.sync.state != nil {
+		return unmarshalSyncState(m.sync.state)
+	}
+	replica, err := newSyncReplica(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &syncState{replica: replica,
+		entries: make(map[string]*syncEntry)}, nil
+}
+
+// writeSyncState implements syncStore.
+func (m *Memstore) writeSyncState(state *syncState) error {
+	m.sync.state = state.marshal()
+	return nil
+}
+
+// readSyncValue implements syncStore.
+func (m *Memstore) readSyncValue(key string, entry *syncEntry) (storedValue,
+	error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	value, exists, err := m.syncValue(key)
+	if err != nil {
+		return storedValue{}, err
+	}
+	if !entry.matches(value, exists) {
+		return storedValue{}, errSyncChanged
+	}
+	return value, nil
+}
+
+// applySyncValue implements syncStore. The value is written with the metadata
+// it has on the other store.
+func (m *Memstore) applySyncValue(key string, value *storedValue,
+	entry *syncEntry) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	current, exists, err := m.syncValue(key)
+	if err != nil {
+		return err
+	}
+	if !entry.matches(current, exists) {
+		return errSyncChanged
+	}
+
+	if value == nil {
+		if exists {
+			m.deleteValue(key)
+			m.recordChanges(Change{Op: ChangeDelete, Key: key})
+		}
+		return nil
+	}
+	m.setValue(key, value.data, value.valueTags, value.meta)
+	m.metadata[key] = value.meta
+	m.recordChanges(Change{Op: ChangeSet, Key: key, Value: value.data})
+	return nil
+}
+
+// syncValue returns the value of key with how it was encoded and its
+// metadata, and whether it exists. The caller must hold the lock.
+func (m *Memstore) syncValue(key string) (storedValue, bool, error) {
+	data, exists, err := m.readMerged(key)
+	if err != nil || !exists {
+		return storedValue{}, false, err
+	}
+	return storedValue{data: data, valueTags: m.valueTags[key],
+		meta: m.metadata[key]}, true, nil
+}
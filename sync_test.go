@@ -0,0 +1,322 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"gitlab.com/elixxir/ekv/portableOS"
+)
+
+// newSyncPair returns two new Filestores with different passwords and a
+// shared clock the test can advance.
+func newSyncPair(t *testing.T, name string) (*Filestore, *Filestore,
+	func(time.Duration)) {
+	now := time.Unix(1700000000, 0)
+	tick := func(d time.Duration) { now = now.Add(d) }
+	stores := make([]*Filestore, 2)
+	for i, suffix := range []string{"_a", "_b"} {
+		dir := ".ekv_testdir_sync_" + name + suffix
+		t.Cleanup(func() {
+			if err := portableOS.RemoveAll(dir); err != nil {
+				t.Error(err)
+			}
+		})
+		f, err := NewFilestore(dir, "password"+suffix)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		f.clock.set(func() time.Time { return now })
+		stores[i] = f
+	}
+	return stores[0], stores[1], tick
+}
+
+// checkSyncValue fails the test if key does not have the value on f, or
+// exists if value is nil.
+func checkSyncValue(t *testing.T, f *Filestore, key string, value []byte) {
+	t.Helper()
+	data, err := f.GetBytes(key)
+	if value == nil {
+		if Exists(err) {
+			t.Errorf("%q exists on %s: %q, %v", key, f.basedir, data, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Errorf("GetBytes(%q) on %s failed: %+v", key, f.basedir, err)
+	} else if !bytes.Equal(data, value) {
+		t.Errorf("%q on %s is %q, expected %q", key, f.basedir, data, value)
+	}
+}
+
+// Tests that Sync copies new values, updates and deletions, with their
+// metadata, in both directions, and that a second Sync changes nothing.
+func TestFilestore_Sync(t *testing.T) {
+	a, b, tick := newSyncPair(t, "basic")
+	if err := a.SetBytesWith("typed", []byte("<p/>"),
+		WithContentType("text/html")); err != nil {
+		t.Fatalf("SetBytesWith failed: %+v", err)
+	}
+	if err := a.SetBytes("removed", []byte("soon gone")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	if err := b.Namespace("ns").SetBytes("inner", []byte("b")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	if err := a.Sync(b); err != nil {
+		t.Fatalf("Sync failed: %+v", err)
+	}
+	checkSyncValue(t, b, "typed", []byte("<p/>"))
+	checkSyncValue(t, b, "removed", []byte("soon gone"))
+	if data, err := a.Namespace("ns").GetBytes("inner"); err != nil ||
+		string(data) != "b" {
+		t.Errorf("Namespaced value not synced: %q, %+v", data, err)
+	}
+	meta, err := b.Stat("typed")
+	if err != nil {
+		t.Fatalf("Stat failed: %+v", err)
+	} else if meta.ContentType != "text/html" {
+		t.Errorf("Content type not synced: %+v", meta)
+	}
+
+	tick(time.Minute)
+	if err = b.Delete("removed"); err != nil {
+		t.Fatalf("Delete failed: %+v", err)
+	}
+	if err = a.SetBytes("typed", []byte("<br/>")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	if err = b.Sync(a); err != nil {
+		t.Fatalf("Sync failed: %+v", err)
+	}
+	checkSyncValue(t, a, "removed", nil)
+	checkSyncValue(t, b, "typed", []byte("<br/>"))
+
+	// Nothing differs, so nothing is written
+	before, err := read(b.getKey("typed"))
+	if err != nil {
+		t.Fatalf("read failed: %+v", err)
+	}
+	if err = a.Sync(b); err != nil {
+		t.Fatalf("Sync failed: %+v", err)
+	}
+	after, err := read(b.getKey("typed"))
+	if err != nil {
+		t.Fatalf("read failed: %+v", err)
+	} else if !bytes.Equal(after, before) {
+		t.Error("Second sync rewrote a value")
+	}
+}
+
+// Tests that keys changed on both stores are resolved by the resolver of the
+// store Sync is called on.
+func TestFilestore_SyncConflicts(t *testing.T) {
+	a, b, tick := newSyncPair(t, "conflicts")
+	for _, key := range []string{"lww", "both", "merged", "same"} {
+		if err := a.SetBytes(key, []byte("base")); err != nil {
+			t.Fatalf("SetBytes failed: %+v", err)
+		}
+	}
+	if err := a.Sync(b); err != nil {
+		t.Fatalf("Sync failed: %+v", err)
+	}
+	set := func(f *Filestore, key, value string) {
+		if err := f.SetBytes(key, []byte(value)); err != nil {
+			t.Fatalf("SetBytes failed: %+v", err)
+		}
+	}
+	set(b, "lww", "b")
+	set(b, "both", "b")
+	set(b, "merged", "b")
+	set(a, "same", "equal")
+	set(b, "same", "equal")
+	tick(time.Second)
+	set(a, "lww", "a")
+	set(a, "both", "a")
+	set(a, "merged", "a")
+
+	replica, err := b.SyncReplica()
+	if err != nil {
+		t.Fatalf("SyncReplica failed: %+v", err)
+	}
+	var conflicts []string
+	a.SetSyncResolver(func(c SyncConflict) (SyncResolution, error) {
+		conflicts = append(conflicts, c.Key)
+		switch c.Key {
+		case "both":
+			return KeepBoth(c)
+		case "merged":
+			return SyncResolution{Merged: append(append(c.Local.Value,
+				'+'), c.Remote.Value...)}, nil
+		}
+		return LastWriterWins(c)
+	})
+	if err = a.Sync(b); err != nil {
+		t.Fatalf("Sync failed: %+v", err)
+	}
+	if len(conflicts) != 3 {
+		t.Errorf("Resolved %q, expected three conflicts", conflicts)
+	}
+	for _, f := range []*Filestore{a, b} {
+		checkSyncValue(t, f, "lww", []byte("a"))
+		checkSyncValue(t, f, "both", []byte("a"))
+		checkSyncValue(t, f, SyncConflictKey("both", replica), []byte("b"))
+		checkSyncValue(t, f, "merged", []byte("a+b"))
+		checkSyncValue(t, f, "same", []byte("equal"))
+	}
+
+	// The resolved versions supersede both, so later syncs find nothing
+	conflicts = nil
+	set(b, "merged", "later")
+	if err = b.Sync(a); err != nil {
+		t.Fatalf("Sync failed: %+v", err)
+	}
+	if err = a.Sync(b); err != nil {
+		t.Fatalf("Sync failed: %+v", err)
+	}
+	if len(conflicts) != 0 {
+		t.Errorf("Resolved %q after the conflicts were resolved", conflicts)
+	}
+	checkSyncValue(t, a, "merged", []byte("later"))
+}
+
+// Tests that Sync only reads the keys written since the last sync, unless the
+// changes since were discarded from the change feed.
+func TestFilestore_SyncChangedKeys(t *testing.T) {
+	a, b, _ := newSyncPair(t, "changed")
+	for _, f := range []*Filestore{a, b} {
+		if err := f.EnableChanges(); err != nil {
+			t.Fatalf("EnableChanges failed: %+v", err)
+		}
+	}
+	for _, key := range []string{"untouched", "changed"} {
+		if err := a.SetBytes(key, []byte("first")); err != nil {
+			t.Fatalf("SetBytes failed: %+v", err)
+		}
+	}
+	if err := a.Sync(b); err != nil {
+		t.Fatalf("Sync failed: %+v", err)
+	}
+
+	// Reading the untouched key would now fail
+	path1, path2 := getPaths(a.getKey("untouched"))
+	for _, path := range []string{path1, path2} {
+		if err := os.WriteFile(path, []byte("corrupt"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.SetBytes("changed", []byte("second")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	if err := a.Sync(b); err != nil {
+		t.Fatalf("Sync read an unchanged key: %+v", err)
+	}
+	checkSyncValue(t, b, "changed", []byte("second"))
+
+	if err := a.SetBytes("changed", []byte("third")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	if err := a.SetBytes("other", []byte("third")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	if err := a.TruncateChanges(math.MaxUint64); err != nil {
+		t.Fatalf("TruncateChanges failed: %+v", err)
+	}
+	if err := a.Sync(b); err == nil {
+		t.Error("Sync did not read every key after the changes were " +
+			"discarded")
+	}
+}
+
+// Tests that Sync copies values, with their metadata, and deletions to and
+// from a Memstore, and resolves keys changed on both.
+func TestFilestore_SyncMemstore(t *testing.T) {
+	f, _, tick := newSyncPair(t, "memstore")
+	m := MakeMemstore()
+	m.SetClock(f.clock.Now)
+	if err := f.SetBytesWith("typed", []byte("<p/>"),
+		WithContentType("text/html")); err != nil {
+		t.Fatalf("SetBytesWith failed: %+v", err)
+	}
+	for _, key := range []string{"removed", "conflict"} {
+		if err := m.SetBytes(key, []byte("memory")); err != nil {
+			t.Fatalf("SetBytes failed: %+v", err)
+		}
+	}
+	if err := f.Sync(m); err != nil {
+		t.Fatalf("Sync failed: %+v", err)
+	}
+	checkSyncValue(t, f, "removed", []byte("memory"))
+	if meta, err := m.Stat("typed"); err != nil ||
+		meta.ContentType != "text/html" {
+		t.Errorf("Value not synced with its metadata: %+v, %+v", meta, err)
+	}
+
+	tick(time.Minute)
+	if err := m.Delete("removed"); err != nil {
+		t.Fatalf("Delete failed: %+v", err)
+	}
+	if err := f.SetBytes("conflict", []byte("file")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	tick(time.Minute)
+	if err := m.SetBytes("conflict", []byte("later")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	if err := f.Sync(m); err != nil {
+		t.Fatalf("Sync failed: %+v", err)
+	}
+	checkSyncValue(t, f, "removed", nil)
+	checkSyncValue(t, f, "conflict", []byte("later"))
+	if data, err := m.GetBytes("conflict"); err != nil ||
+		string(data) != "later" {
+		t.Errorf("Conflict not resolved on the Memstore: %q, %+v", data, err)
+	}
+}
+
+// Tests that Sync rejects the store itself and stores it cannot sync with.
+func TestFilestore_SyncInvalid(t *testing.T) {
+	a, _, _ := newSyncPair(t, "invalid")
+	if err := a.Sync(a); err == nil {
+		t.Error("Sync with itself succeeded")
+	}
+	if err := a.Sync(struct{ KeyValue }{MakeMemstore()}); err == nil {
+		t.Error("Sync with an unknown store succeeded")
+	}
+}
+
+// Tests that version vectors are compared and merged per replica.
+func TestVersionVector_Compare(t *testing.T) {
+	v := versionVector{"a": 2, "b": 1}
+	tests := []struct {
+		o        versionVector
+		expected int
+	}{
+		{versionVector{"a": 2, "b": 1}, vectorEqual},
+		{versionVector{"a": 2, "b": 2}, vectorBefore},
+		{versionVector{"a": 1}, vectorAfter},
+		{nil, vectorAfter},
+		{versionVector{"a": 1, "b": 2}, vectorConcurrent},
+		{versionVector{"c": 1}, vectorConcurrent},
+	}
+	for i, tt := range tests {
+		if c := v.compare(tt.o); c != tt.expected {
+			t.Errorf("%d: compare(%v) = %d, expected %d", i, tt.o, c,
+				tt.expected)
+		}
+	}
+	m := v.merge(versionVector{"a": 1, "c": 3})
+	if m.compare(versionVector{"a": 2, "b": 1, "c": 3}) != vectorEqual {
+		t.Errorf("Unexpected merge: %v", m)
+	}
+}
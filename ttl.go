@@ -0,0 +1,329 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// ttl.go implements values that expire. The expiry time of a value is stored
+// in its encrypted envelope, and once it passes, the value is treated as if
+// it did not exist. PurgeExpired deletes expired values for good.
+//
+// A Filestore cannot list its hashed keys, so the keys written with a time to
+// live are recorded in an encrypted index, kept as a record log, which
+// PurgeExpired reads and then rewrites with the keys that have yet to expire.
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+const (
+	// ttlIndexKey is the key of the record log listing the keys written with
+	// a time to live.
+	ttlIndexKey = "\x00ekv:ttl-index"
+
+	errInvalidTTL = "time to live must be positive, got %s"
+)
+
+// clock tells the time of a store. It uses time.Now unless replaced, which
+// tests do to control expiry.
+type clock struct {
+	now atomic.Pointer[func() time.Time]
+}
+
+// Now returns the current time.
+func (c *clock) Now() time.Time {
+	if now := c.now.Load(); now != nil {
+		return (*now)()
+	}
+	return time.Now()
+}
+
+// set replaces the function the clock gets the time from. A nil now restores
+// time.Now.
+func (c *clock) set(now func() time.Time) {
+	if now == nil {
+		c.now.Store(nil)
+	} else {
+		c.now.Store(&now)
+	}
+}
+
+// WithTTL makes the value expire once ttl has passed. An expired value is
+// treated as if it did not exist until PurgeExpired deletes it. Like the
+// content type, the expiry applies to the value it is written with and is not
+// kept when the value is overwritten.
+func WithTTL(ttl time.Duration) WriteOption {
+	return func(o *writeOptions) {
+		o.ttl = ttl
+	}
+}
+
+// setExpiry sets the expiry of the value in opts if it has a time to live.
+func (o *writeOptions) setExpiry(now time.Time) error {
+	if o.ttl == 0 {
+		return nil
+	} else if o.ttl < 0 {
+		return errors.Errorf(errInvalidTTL, o.ttl)
+	}
+	o.meta.expires = now.Add(o.ttl)
+	return nil
+}
+
+// expired returns whether a value with the given metadata has expired.
+func (m valueMeta) expired(now time.Time) bool {
+	return !m.expires.IsZero() && !now.Before(m.expires)
+}
+
+// ttlIndex caches the keys known to be in the index of keys written with a
+// time to live.
+type ttlIndex struct {
+	keys   map[string]struct{}
+	loaded bool
+	mux    sync.Mutex
+}
+
+// SetClock replaces the function the Filestore gets the current time from,
+// which decides when values expire and stamps their metadata. A nil now
+// restores time.Now.
+func (f *Filestore) SetClock(now func() time.Time) {
+	f.clock.set(now)
+}
+
+// SetBytesWithTTL sets the value of key to expire once ttl has passed.
+func (f *Filestore) SetBytesWithTTL(key string, data []byte,
+	ttl time.Duration) error {
+	return f.SetBytesWith(key, data, WithTTL(ttl))
+}
+
+// SetInterfaceWithTTL encodes and sets the value of key to expire once ttl
+// has passed.
+func (f *Filestore) SetInterfaceWithTTL(key string, objectToStore interface{},
+	ttl time.Duration) error {
+	return f.SetInterfaceWith(key, objectToStore, WithTTL(ttl))
+}
+
+// PurgeExpired securely deletes every expired value, as Delete would, and
+// returns how many were deleted. Merge operands recorded after a value
+// expired are kept, as they make up a new value, so only the expired value
+// of their key is deleted and the key is not counted.
+func (f *Filestore) PurgeExpired() (int, error) {
+	done, err := f.lifecycle.begin()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	f.ttls.mux.Lock()
+	defer f.ttls.mux.Unlock()
+	appendKey := f.getAppendKey(ttlIndexKey)
+	keys, err := f.readTTLIndex(appendKey)
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	remaining := make(map[string]struct{}, len(keys))
+	for key := range keys {
+		deleted, err := f.purgeKey(key, remaining)
+		if err != nil {
+			return purged, err
+		}
+		if deleted {
+			purged++
+		}
+	}
+
+	// Rewrite the index with the keys that have yet to expire. Writes with a
+	// time to live wait on the index lock, so none are missed.
+	unlock := f.takeLocks(true, appendKey)
+	defer unlock()
+	f.ttls.loaded = false
+	err = f.deleteRecords(ttlIndexKey, appendKey)
+	if err == nil && len(remaining) > 0 {
+		err = f.appendRecords(ttlIndexKey, appendKey, keysToRecords(remaining))
+	}
+	if err != nil {
+		return purged, err
+	}
+	f.ttls.keys, f.ttls.loaded = remaining, true
+	return purged, nil
+}
+
+// purgeKey deletes the value of key if it has expired, and returns whether
+// the key was deleted, which it is not if merge operands make up a new value.
+// Otherwise, if it has an expiry, it is added to remaining, the keys that stay
+// in the index. The locks of every file of the key are held from the check of
+// the expiry until the deletion is recorded and the index updated, so that a
+// value written meanwhile is never deleted.
+func (f *Filestore) purgeKey(key string, remaining map[string]struct{}) (
+	deleted bool, err error) {
+	paths := f.keyPaths(key)
+	encryptedKey, logKey := paths[0], paths[1]
+	unlock := f.takeLocks(true, paths...)
+	defer unlock()
+	encryptedContents, err := read(encryptedKey)
+	if err != nil {
+		if !Exists(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	e, err := openEnvelope(encryptedContents, f.key)
+	if err != nil {
+		return false, err
+	}
+	if !e.meta.expired(f.clock.Now()) {
+		if !e.meta.expires.IsZero() {
+			remaining[key] = struct{}{}
+		}
+		return false, nil
+	}
+
+	operands, err := f.readMergeLog(key, logKey)
+	if err != nil {
+		return false, err
+	}
+	if len(operands) > 0 {
+		// Only the expired base value goes
+		if err = deleteFiles(encryptedKey, f.csprng); err != nil {
+			return false, err
+		}
+		// The value is now that of the operands alone
+		f.observeExternal(Change{Op: ChangeMerge, Key: key})
+		return false, nil
+	}
+
+	jww.TRACE.Printf("%s,EXPIRE,%s,%s", kvDebugHeader, key, encryptedKey)
+	return true, f.deleteKeyFiles(key)
+}
+
+// indexTTL records key in the index of keys written with a time to live, if
+// it is not already there. The caller must be in flight.
+func (f *Filestore) indexTTL(key string) error {
+	f.ttls.mux.Lock()
+	defer f.ttls.mux.Unlock()
+
+	appendKey := f.getAppendKey(ttlIndexKey)
+	if !f.ttls.loaded {
+		keys, err := f.readTTLIndex(appendKey)
+		if err != nil {
+			return err
+		}
+		f.ttls.keys, f.ttls.loaded = keys, true
+	}
+	if _, exists := f.ttls.keys[key]; exists {
+		return nil
+	}
+
+	unlock := f.takeLocks(true, appendKey)
+	defer unlock()
+	err := f.appendRecords(ttlIndexKey, appendKey, [][]byte{[]byte(key)})
+	if err != nil {
+		f.ttls.loaded = false
+		return err
+	}
+	f.ttls.keys[key] = struct{}{}
+	return nil
+}
+
+// readTTLIndex returns the keys listed in the index of keys written with a
+// time to live.
+func (f *Filestore) readTTLIndex(appendKey string) (map[string]struct{}, error) {
+	unlock := f.takeLocks(false, appendKey)
+	defer unlock()
+	return f.readKeyIndex(ttlIndexKey, appendKey)
+}
+
+// readKeyIndex returns the keys recorded in the record log of indexKey, whose
+// manifest is at appendKey. The caller must hold the lock of appendKey.
+func (f *Filestore) readKeyIndex(indexKey, appendKey string) (
+	map[string]struct{}, error) {
+	keys := make(map[string]struct{})
+	m, err := f.readAppendManifest(appendKey)
+	if err != nil {
+		if !Exists(err) {
+			return keys, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	for _, s := range m.segments {
+		records, err := f.readSegment(indexKey, s)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			keys[string(r)] = struct{}{}
+		}
+	}
+	return keys, nil
+}
+
+// keysToRecords returns the keys as records of a key index.
+func keysToRecords(keys map[string]struct{}) [][]byte {
+	records := make([][]byte, 0, len(keys))
+	for key := range keys {
+		records = append(records, []byte(key))
+	}
+	return records
+}
+
+// SetClock replaces the function the Memstore gets the current time from,
+// which decides when values expire and stamps their metadata. A nil now
+// restores time.Now.
+func (m *Memstore) SetClock(now func() time.Time) {
+	m.clock.set(now)
+}
+
+// SetBytesWithTTL sets the value of key to expire once ttl has passed.
+func (m *Memstore) SetBytesWithTTL(key string, data []byte,
+	ttl time.Duration) error {
+	return m.SetBytesWith(key, data, WithTTL(ttl))
+}
+
+// SetInterfaceWithTTL encodes and sets the value of key to expire once ttl
+// has passed.
+func (m *Memstore) SetInterfaceWithTTL(key string, objectToStore interface{},
+	ttl time.Duration) error {
+	return m.SetInterfaceWith(key, objectToStore, WithTTL(ttl))
+}
+
+// PurgeExpired deletes every expired value and returns how many were
+// deleted. Merge operands recorded after a value expired are kept, as they
+// make up a new value, so only the expired value of their key is deleted
+// and the key is not counted.
+func (m *Memstore) PurgeExpired() (int, error) {
+	done, err := m.lifecycle.begin()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	now := m.clock.Now()
+	purged := 0
+	for key, meta := range m.metadata {
+		if !meta.expired(now) {
+			continue
+		}
+		if len(m.pendingMerges[key]) > 0 {
+			// Only the expired base value goes, as in a Filestore
+			delete(m.store, key)
+			delete(m.valueTags, key)
+			delete(m.metadata, key)
+			continue
+		}
+		m.deleteValue(key)
+		m.recordChanges(Change{Op: ChangeDelete, Key: key})
+		purged++
+	}
+	return purged, nil
+}
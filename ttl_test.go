@@ -0,0 +1,274 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/elixxir/ekv/portableOS"
+)
+
+// ttlStore is the subset of the store methods exercised by these tests.
+type ttlStore interface {
+	metadataStore
+	SetBytesWithTTL(key string, data []byte, ttl time.Duration) error
+	SetInterfaceWithTTL(key string, objectToStore interface{},
+		ttl time.Duration) error
+	SetClock(now func() time.Time)
+	PurgeExpired() (int, error)
+}
+
+// testClock is a clock that only moves when told to.
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time { return c.now }
+
+func (c *testClock) advance(d time.Duration) { c.now = c.now.Add(d) }
+
+// testTTL checks that values expire after their time to live and are purged.
+func testTTL(t *testing.T, s ttlStore) *testClock {
+	c := &testClock{now: time.Unix(1700000000, 0)}
+	s.SetClock(c.Now)
+	start := c.now
+
+	if err := s.SetBytesWithTTL("session", []byte("token"), time.Minute); err != nil {
+		t.Fatalf("SetBytesWithTTL failed: %+v", err)
+	}
+	err := s.SetInterfaceWithTTL("prekey", []int{1, 2}, time.Hour)
+	if err != nil {
+		t.Fatalf("SetInterfaceWithTTL failed: %+v", err)
+	}
+	if err = s.SetBytes("forever", []byte("value")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	if err = s.SetBytesWithTTL("bad", []byte("value"), -time.Second); err == nil {
+		t.Errorf("Set a value with a negative time to live")
+	}
+
+	md, err := s.Stat("session")
+	if err != nil {
+		t.Fatalf("Stat failed: %+v", err)
+	}
+	if !md.Expires.Equal(start.Add(time.Minute)) || !md.Created.Equal(start) {
+		t.Errorf("Unexpected metadata: %+v", md)
+	}
+	if md, _ = s.Stat("forever"); !md.Expires.IsZero() {
+		t.Errorf("Value without a time to live expires at %v", md.Expires)
+	}
+
+	// Once expired, the value no longer exists
+	c.advance(time.Minute)
+	if _, err = s.GetBytes("session"); Exists(err) {
+		t.Errorf("GetBytes of an expired value did not return not found: %+v",
+			err)
+	}
+	if _, err = s.Stat("session"); Exists(err) {
+		t.Errorf("Stat of an expired value did not return not found: %+v", err)
+	}
+	err = s.Transaction(func(files map[string]Operable, _ Extender) error {
+		if files["session"].Exists() {
+			t.Errorf("Expired value exists in a transaction")
+		}
+		return nil
+	}, "session")
+	if err != nil {
+		t.Fatalf("Transaction failed: %+v", err)
+	}
+	var prekey []int
+	if err = s.GetInterface("prekey", &prekey); err != nil || len(prekey) != 2 {
+		t.Errorf("Unexpired value not found: %v, %+v", prekey, err)
+	}
+
+	// Overwriting an expired value starts afresh
+	if err = s.SetBytes("session", []byte("renewed")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	md, err = s.Stat("session")
+	if err != nil {
+		t.Fatalf("Stat failed: %+v", err)
+	}
+	if !md.Created.Equal(c.now) || !md.Expires.IsZero() {
+		t.Errorf("Unexpected metadata after overwrite: %+v", md)
+	}
+
+	if err = s.SetBytesWithTTL("token", []byte("token"), time.Minute); err != nil {
+		t.Fatalf("SetBytesWithTTL failed: %+v", err)
+	}
+	c.advance(2 * time.Minute)
+	if n, err := s.PurgeExpired(); err != nil || n != 1 {
+		t.Errorf("Expected 1 purged value, got %d: %+v", n, err)
+	}
+	c.advance(time.Hour)
+	if n, err := s.PurgeExpired(); err != nil || n != 1 {
+		t.Errorf("Expected 1 purged value, got %d: %+v", n, err)
+	}
+	if n, err := s.PurgeExpired(); err != nil || n != 0 {
+		t.Errorf("Expected no purged value, got %d: %+v", n, err)
+	}
+	for _, key := range []string{"session", "forever"} {
+		if _, err = s.GetBytes(key); err != nil {
+			t.Errorf("Purge deleted %s: %+v", key, err)
+		}
+	}
+	return c
+}
+
+// ttlMergeStore is the subset of the store methods exercised by
+// testPurgeExpiredMerge.
+type ttlMergeStore interface {
+	ttlStore
+	changeStore
+}
+
+// testPurgeExpiredMerge checks that purging an expired value with merge
+// operands recorded after it expired only drops the value: the key keeps the
+// value of the operands, so it is neither counted nor recorded as deleted.
+func testPurgeExpiredMerge(t *testing.T, s ttlMergeStore) {
+	c := &testClock{now: time.Unix(1700000000, 0)}
+	s.SetClock(c.Now)
+	err := s.RegisterMergeOperator("counter", CounterMergeOperator)
+	if err != nil {
+		t.Fatalf("RegisterMergeOperator failed: %+v", err)
+	}
+	if err = s.EnableChanges(); err != nil {
+		t.Fatalf("EnableChanges failed: %+v", err)
+	}
+
+	err = s.SetBytesWithTTL("counter", counterOperand(5), time.Minute)
+	if err != nil {
+		t.Fatalf("SetBytesWithTTL failed: %+v", err)
+	}
+	c.advance(2 * time.Minute)
+	if err = s.Merge("counter", "counter", counterOperand(2)); err != nil {
+		t.Fatalf("Merge failed: %+v", err)
+	}
+	changes := readChanges(t, s, 0)
+
+	if n, err := s.PurgeExpired(); err != nil || n != 0 {
+		t.Errorf("Expected no purged value, got %d: %+v", n, err)
+	}
+	data, err := s.GetBytes("counter")
+	if err != nil || !bytes.Equal(data, counterOperand(2)) {
+		t.Errorf("Unexpected value after purge: %v, %+v", data, err)
+	}
+	if after := readChanges(t, s, 0); len(after) != len(changes) {
+		t.Errorf("Purge recorded changes: %+v", after[len(changes):])
+	}
+}
+
+// Tests that Memstore values expire and are purged.
+func TestMemstore_TTL(t *testing.T) {
+	testTTL(t, MakeMemstore())
+}
+
+// Tests that purging keeps the merge operands of an expired Memstore value.
+func TestMemstore_PurgeExpiredMerge(t *testing.T) {
+	testPurgeExpiredMerge(t, MakeMemstore())
+}
+
+// Tests that purging keeps the merge operands of an expired Filestore value.
+func TestFilestore_PurgeExpiredMerge(t *testing.T) {
+	dir := ".ekv_testdir_purge_expired_merge"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	testPurgeExpiredMerge(t, f)
+}
+
+// Tests that Filestore values expire and that purging deletes their files,
+// including those of keys written before the store was reopened.
+func TestFilestore_TTL(t *testing.T) {
+	dir := ".ekv_testdir_ttl"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	c := testTTL(t, f)
+	if _, err = read(f.getKey("token")); Exists(err) {
+		t.Errorf("Purged value was not deleted: %+v", err)
+	}
+
+	if err = f.SetBytesWithTTL("late", []byte("value"), time.Minute); err != nil {
+		t.Fatalf("SetBytesWithTTL failed: %+v", err)
+	}
+	f, err = NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	c.advance(time.Minute)
+	f.SetClock(c.Now)
+	if n, err := f.PurgeExpired(); err != nil || n != 1 {
+		t.Errorf("Expected 1 purged value after reopening, got %d: %+v", n,
+			err)
+	}
+	if _, err = read(f.getKey("late")); Exists(err) {
+		t.Errorf("Purged value was not deleted: %+v", err)
+	}
+}
+
+// Tests that purging never deletes a value written while the expired value it
+// replaces is being purged.
+func TestFilestore_PurgeExpiredConcurrentWrite(t *testing.T) {
+	dir := ".ekv_testdir_ttl_race"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	c := &testClock{now: time.Unix(1700000000, 0)}
+	f.SetClock(c.Now)
+	err = f.SetBytesWithTTL("key", []byte("expired"), time.Minute)
+	if err != nil {
+		t.Fatalf("SetBytesWithTTL failed: %+v", err)
+	}
+	c.advance(time.Minute)
+
+	// The value is written as soon as the purge checks its expiry, and waits
+	// on the locks of the key
+	var once sync.Once
+	written := make(chan error, 1)
+	f.SetClock(func() time.Time {
+		once.Do(func() {
+			go func() { written <- f.SetBytes("key", []byte("fresh")) }()
+			time.Sleep(50 * time.Millisecond)
+		})
+		return c.now
+	})
+	if n, err := f.PurgeExpired(); err != nil || n != 1 {
+		t.Fatalf("Expected 1 purged value, got %d: %+v", n, err)
+	}
+	if err = <-written; err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	if data, err := f.GetBytes("key"); err != nil || string(data) != "fresh" {
+		t.Errorf("Write lost to the purge: %q, %+v", data, err)
+	}
+}
@@ -0,0 +1,349 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// watch.go implements watching keys for changes within the process. Every
+// committed change is published to the watchers of its key, with its value,
+// whether or not the change feed, see changes.go, is enabled.
+//
+// Publishing never blocks the writer, as it holds the locks of the changed
+// keys. Every watcher has a bounded queue that events are added to, and a
+// goroutine that sends them on its channel. When the queue is full, the
+// overflow policy of the watcher decides which event is dropped, and the
+// next event delivered counts the events missed.
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultWatchBuffer is the number of events a watcher queues by default.
+const DefaultWatchBuffer = 64
+
+// Event is a change delivered to a watcher.
+type Event struct {
+	Change
+	// Missed is the number of events for the watcher dropped before this
+	// one because it fell behind. The value of its keys may have to be read
+	// again.
+	Missed uint64
+	// External is set for changes made by another process, detected by
+	// Filestore.WatchExternal. They have no sequence number.
+	External bool
+}
+
+// WatchOverflow is what a watcher does with a new event when its queue is
+// full.
+type WatchOverflow int
+
+const (
+	// WatchDropOldest drops the oldest queued event to make room for the new
+	// one. It is the default.
+	WatchDropOldest WatchOverflow = iota
+	// WatchDropNewest drops the new event.
+	WatchDropNewest
+	// WatchCoalesce replaces the queued event of the same key, if there is
+	// one, with the new event, and otherwise drops the oldest queued event.
+	// Only the latest change of every key is kept.
+	WatchCoalesce
+)
+
+// WatchOption changes how a watcher queues events.
+type WatchOption func(*watchOptions)
+
+// watchOptions holds the options of a watcher.
+type watchOptions struct {
+	buffer   int
+	overflow WatchOverflow
+}
+
+// WithWatchBuffer sets how many events a watcher queues while it is not
+// reading them. It is DefaultWatchBuffer by default and at least 1.
+func WithWatchBuffer(n int) WatchOption {
+	return func(o *watchOptions) {
+		o.buffer = max(n, 1)
+	}
+}
+
+// WithWatchOverflow sets what a watcher does with a new event when its queue
+// is full.
+func WithWatchOverflow(overflow WatchOverflow) WatchOption {
+	return func(o *watchOptions) {
+		o.overflow = overflow
+	}
+}
+
+// Watch returns a channel that receives an event after every change
+// committed to key, including those of transactions, and a function that
+// stops watching and closes the channel. Events for restores are delivered
+// to every watcher. Events are queued while they are not read, as set by
+// the options.
+//
+// The watcher is stopped and the channel closed when the Filestore is closed.
+func (f *Filestore) Watch(key string, opts ...WatchOption) (
+	<-chan Event, func()) {
+	return f.watchers.watch(key, false, opts)
+}
+
+// WatchPrefix is Watch for every key starting with prefix.
+func (f *Filestore) WatchPrefix(prefix string, opts ...WatchOption) (
+	<-chan Event, func()) {
+	return f.watchers.watch(prefix, true, opts)
+}
+
+// WaitFor blocks until key has a value and returns it, or returns the error
+// of ctx once it is done.
+func (f *Filestore) WaitFor(ctx context.Context, key string) ([]byte, error) {
+	return waitFor(ctx, f, &f.watchers, key)
+}
+
+// Watch returns a channel that receives an event after every change
+// committed to key, including those of transactions, and a function that
+// stops watching and closes the channel. Events are queued while they are
+// not read, as set by the options.
+//
+// The watcher is stopped and the channel closed when the Memstore is closed.
+func (m *Memstore) Watch(key string, opts ...WatchOption) (
+	<-chan Event, func()) {
+	return m.watchers.watch(key, false, opts)
+}
+
+// WatchPrefix is Watch for every key starting with prefix.
+func (m *Memstore) WatchPrefix(prefix string, opts ...WatchOption) (
+	<-chan Event, func()) {
+	return m.watchers.watch(prefix, true, opts)
+}
+
+// WaitFor blocks until key has a value and returns it, or returns the error
+// of ctx once it is done.
+func (m *Memstore) WaitFor(ctx context.Context, key string) ([]byte, error) {
+	return waitFor(ctx, m, &m.watchers, key)
+}
+
+// waitFor implements WaitFor for both stores.
+func waitFor(ctx context.Context, kv KeyValue, watchers *watchHub,
+	key string) ([]byte, error) {
+	// Watching starts first so that a value set after the read is not
+	// missed
+	events, cancel := watchers.watch(key, false, nil)
+	defer cancel()
+	for {
+		data, err := kv.GetBytes(key)
+		if err == nil || Exists(err) {
+			return data, err
+		}
+		// Only a change can give the key a value. Deletions are skipped.
+		for wait := true; wait; {
+			select {
+			case <-ctx.Done():
+				return nil, errors.WithStack(ctx.Err())
+			case e, ok := <-events:
+				if !ok {
+					return nil, errors.WithStack(ErrClosed)
+				}
+				wait = e.Op == ChangeDelete && e.Missed == 0
+			}
+		}
+	}
+}
+
+// watchHub holds the watchers of a store.
+type watchHub struct {
+	mux      sync.Mutex
+	watchers map[*watcher]struct{}
+	closed   bool
+}
+
+// watch adds a watcher of key, or of every key starting with it if prefix is
+// set.
+func (h *watchHub) watch(key string, prefix bool, opts []WatchOption) (
+	<-chan Event, func()) {
+	o := watchOptions{buffer: DefaultWatchBuffer}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	w := &watcher{key: key, prefix: prefix, opts: o,
+		events: make(chan Event), done: make(chan struct{})}
+	w.cond = sync.NewCond(&w.mux)
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.closed {
+		close(w.events)
+		return w.events, func() {}
+	}
+	if h.watchers == nil {
+		h.watchers = make(map[*watcher]struct{})
+	}
+	h.watchers[w] = struct{}{}
+	go w.run()
+	return w.events, func() {
+		h.mux.Lock()
+		delete(h.watchers, w)
+		h.mux.Unlock()
+		w.stop()
+	}
+}
+
+// publish queues an event for every change for the watchers of its key. It
+// never blocks.
+func (h *watchHub) publish(changes []Change) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if len(h.watchers) == 0 {
+		return
+	}
+	for _, c := range changes {
+		// The value may be reused by the writer
+		if c.Value != nil {
+			c.Value = append([]byte(nil), c.Value...)
+		}
+		for w := range h.watchers {
+			if w.matches(c) {
+				w.queue(Event{Change: c})
+			}
+		}
+	}
+}
+
+// publishExternal queues an event for a change made by another process for
+// the watchers of its key. It never blocks.
+func (h *watchHub) publishExternal(c Change) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	for w := range h.watchers {
+		if w.matches(c) {
+			w.queue(Event{Change: c, External: true})
+		}
+	}
+}
+
+// close stops every watcher and closes their channels. Watchers added later
+// get a closed channel.
+func (h *watchHub) close() {
+	h.mux.Lock()
+	watchers := h.watchers
+	h.watchers, h.closed = nil, true
+	h.mux.Unlock()
+	for w := range watchers {
+		w.stop()
+	}
+}
+
+// watcher queues the events of a key, or of the keys starting with a prefix,
+// and sends them on its channel.
+type watcher struct {
+	key    string
+	prefix bool
+	opts   watchOptions
+
+	events chan Event
+	done   chan struct{}
+
+	mux     sync.Mutex
+	cond    *sync.Cond
+	pending []Event
+	missed  uint64
+	stopped bool
+}
+
+// matches returns whether the change is for the watcher.
+func (w *watcher) matches(c Change) bool {
+	switch {
+	case c.Op == ChangeReset:
+		return true
+	case w.prefix:
+		return strings.HasPrefix(c.Key, w.key)
+	default:
+		return c.Key == w.key
+	}
+}
+
+// queue adds the event to the queue, applying the overflow policy if it is
+// full.
+func (w *watcher) queue(e Event) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.stopped {
+		return
+	}
+	if len(w.pending) >= w.opts.buffer {
+		switch w.opts.overflow {
+		case WatchDropNewest:
+			w.missed += e.Missed + 1
+			return
+		case WatchCoalesce:
+			drop := 0
+			for i, queued := range w.pending {
+				if queued.Key == e.Key && queued.Op != ChangeReset {
+					drop = i
+					break
+				}
+			}
+			w.drop(drop)
+		default:
+			w.drop(0)
+		}
+	}
+	e.Missed, w.missed = e.Missed+w.missed, 0
+	w.pending = append(w.pending, e)
+	w.cond.Signal()
+}
+
+// drop removes the queued event i and counts it as missed by the event after
+// it. The caller must hold the lock.
+func (w *watcher) drop(i int) {
+	missed := w.pending[i].Missed + 1
+	w.pending = append(w.pending[:i], w.pending[i+1:]...)
+	if i < len(w.pending) {
+		w.pending[i].Missed += missed
+	} else {
+		w.missed += missed
+	}
+}
+
+// run sends the queued events on the channel until the watcher is stopped,
+// and then closes it.
+func (w *watcher) run() {
+	defer close(w.events)
+	for {
+		w.mux.Lock()
+		for len(w.pending) == 0 && !w.stopped {
+			w.cond.Wait()
+		}
+		if w.stopped {
+			w.mux.Unlock()
+			return
+		}
+		e := w.pending[0]
+		w.pending = w.pending[1:]
+		w.mux.Unlock()
+
+		select {
+		case w.events <- e:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// stop stops the watcher, which closes its channel. Stopping it again does
+// nothing.
+func (w *watcher) stop() {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.stopped {
+		return
+	}
+	w.stopped, w.pending = true, nil
+	close(w.done)
+	w.cond.Signal()
+}
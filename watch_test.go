@@ -0,0 +1,198 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portableOS"
+)
+
+// watchStore is implemented by both stores.
+type watchStore interface {
+	KeyValue
+	Watch(key string, opts ...WatchOption) (<-chan Event, func())
+	WatchPrefix(prefix string, opts ...WatchOption) (<-chan Event, func())
+	WaitFor(ctx context.Context, key string) ([]byte, error)
+}
+
+// nextEvent returns the next event on the channel, failing the test if there
+// is none within a second.
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case e, ok := <-events:
+		if !ok {
+			t.Fatal("Channel closed")
+		}
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("No event received")
+	}
+	return Event{}
+}
+
+// testWatch tests that watchers receive the events of their keys, including
+// those of transactions, until they are cancelled.
+func testWatch(t *testing.T, kv watchStore) {
+	events, cancel := kv.Watch("a")
+	prefixed, cancelPrefix := kv.WatchPrefix("p/")
+	defer cancelPrefix()
+
+	if err := kv.SetBytes("a", []byte("1")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	if err := kv.SetBytes("b", []byte("ignored")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	err := kv.Transaction(func(files map[string]Operable, _ Extender) error {
+		files["a"].Delete()
+		files["p/1"].Set([]byte("2"))
+		return nil
+	}, "a", "p/1")
+	if err != nil {
+		t.Fatalf("Transaction failed: %+v", err)
+	}
+
+	if e := nextEvent(t, events); e.Op != ChangeSet || e.Key != "a" ||
+		string(e.Value) != "1" {
+		t.Errorf("Unexpected first event: %+v", e)
+	}
+	if e := nextEvent(t, events); e.Op != ChangeDelete || e.Key != "a" {
+		t.Errorf("Unexpected second event: %+v", e)
+	}
+	if e := nextEvent(t, prefixed); e.Op != ChangeSet || e.Key != "p/1" ||
+		string(e.Value) != "2" {
+		t.Errorf("Unexpected prefix event: %+v", e)
+	}
+
+	cancel()
+	if err = kv.SetBytes("a", []byte("3")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	for e := range events {
+		t.Errorf("Received %+v after cancelling", e)
+	}
+	cancel()
+}
+
+// testWatchOverflow tests that watchers that fall behind drop events as set
+// by their overflow policy and count them.
+func testWatchOverflow(t *testing.T, kv watchStore) {
+	newest, cancelNewest := kv.Watch("k", WithWatchBuffer(2),
+		WithWatchOverflow(WatchDropNewest))
+	defer cancelNewest()
+	coalesced, cancelCoalesced := kv.WatchPrefix("", WithWatchBuffer(2),
+		WithWatchOverflow(WatchCoalesce))
+	defer cancelCoalesced()
+
+	// The first event is taken by the goroutine of each watcher, which
+	// waits to send it, so two more fill the queue and one overflows
+	for i := 0; i < 4; i++ {
+		if err := kv.SetBytes("k", []byte(strconv.Itoa(i))); err != nil {
+			t.Fatalf("SetBytes failed: %+v", err)
+		}
+		if i == 0 {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	if err := kv.SetBytes("other", []byte("x")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+
+	var values []string
+	var missed uint64
+	for i := 0; i < 3; i++ {
+		e := nextEvent(t, newest)
+		values = append(values, string(e.Value))
+		missed += e.Missed
+	}
+	if values[2] != "2" || missed != 0 {
+		t.Errorf("Kept %q, missed %d, expected to drop only the newest",
+			values, missed)
+	}
+
+	values, missed = nil, 0
+	for i := 0; i < 3; i++ {
+		e := nextEvent(t, coalesced)
+		values = append(values, e.Key+"="+string(e.Value))
+		missed += e.Missed
+	}
+	if values[1] != "k=3" || values[2] != "other=x" || missed != 2 {
+		t.Errorf("Coalesced into %q, missing %d", values, missed)
+	}
+
+	// The dropped event is counted by the next one delivered
+	if err := kv.SetBytes("k", []byte("4")); err != nil {
+		t.Fatalf("SetBytes failed: %+v", err)
+	}
+	if e := nextEvent(t, newest); e.Missed != 1 {
+		t.Errorf("Event after the overflow missed %d, expected 1", e.Missed)
+	}
+}
+
+// testWaitFor tests that WaitFor returns values set later and gives up once
+// its context is done.
+func testWaitFor(t *testing.T, kv watchStore) {
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		if err := kv.SetBytes("later", []byte("here")); err != nil {
+			t.Errorf("SetBytes failed: %+v", err)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if data, err := kv.WaitFor(ctx, "later"); err != nil ||
+		string(data) != "here" {
+		t.Errorf("WaitFor returned %q, %+v", data, err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(),
+		10*time.Millisecond)
+	defer cancel()
+	if _, err := kv.WaitFor(ctx, "never"); !errors.Is(err,
+		context.DeadlineExceeded) {
+		t.Errorf("WaitFor did not time out: %+v", err)
+	}
+}
+
+// Tests watching a Memstore.
+func TestMemstore_Watch(t *testing.T) {
+	testWatch(t, MakeMemstore())
+	testWatchOverflow(t, MakeMemstore())
+	testWaitFor(t, MakeMemstore())
+}
+
+// Tests watching a Filestore, and that closing it closes the channels.
+func TestFilestore_Watch(t *testing.T) {
+	dir := ".ekv_testdir_watch"
+	defer func() {
+		if err := portableOS.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	f, err := NewFilestore(dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	testWatch(t, f)
+	testWatchOverflow(t, f)
+	testWaitFor(t, f)
+
+	events, _ := f.Watch("a")
+	if err = f.Close(); err != nil {
+		t.Fatalf("Close failed: %+v", err)
+	}
+	if _, ok := <-events; ok {
+		t.Error("Channel open after closing the store")
+	}
+}